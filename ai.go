@@ -1,16 +1,12 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math"
-	"net/http"
-	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -18,20 +14,21 @@ import (
 )
 
 type PerplexityRequest struct {
-	Model                  string    `json:"model"`
-	Messages               []Message `json:"messages"`
-	MaxTokens              int       `json:"max_tokens,omitempty"`
-	Temperature            float64   `json:"temperature"`
-	TopP                   float64   `json:"top_p"`
-	ReturnCitations        bool      `json:"return_citations"`
-	SearchDomainFilter     []string  `json:"search_domain_filter"`
-	ReturnImages           bool      `json:"return_images"`
-	ReturnRelatedQuestions bool      `json:"return_related_questions"`
-	SearchRecencyFilter    string    `json:"search_recency_filter"`
-	TopK                   int       `json:"top_k"`
-	Stream                 bool      `json:"stream"`
-	PresencePenalty        float64   `json:"presence_penalty"`
-	FrequencyPenalty       float64   `json:"frequency_penalty"`
+	Model                  string          `json:"model"`
+	Messages               []Message       `json:"messages"`
+	MaxTokens              int             `json:"max_tokens,omitempty"`
+	Temperature            float64         `json:"temperature"`
+	TopP                   float64         `json:"top_p"`
+	ReturnCitations        bool            `json:"return_citations"`
+	SearchDomainFilter     []string        `json:"search_domain_filter"`
+	ReturnImages           bool            `json:"return_images"`
+	ReturnRelatedQuestions bool            `json:"return_related_questions"`
+	SearchRecencyFilter    string          `json:"search_recency_filter"`
+	TopK                   int             `json:"top_k"`
+	Stream                 bool            `json:"stream"`
+	PresencePenalty        float64         `json:"presence_penalty"`
+	FrequencyPenalty       float64         `json:"frequency_penalty"`
+	ResponseFormat         *ResponseFormat `json:"response_format,omitempty"`
 }
 
 type Error struct {
@@ -60,12 +57,16 @@ type SuccessResponse struct {
 	Created int64    `json:"created"`
 	Choices []Choice `json:"choices"`
 	Usage   Usage    `json:"usage"`
+	// perplexity only, sent when ReturnCitations / ReturnRelatedQuestions are set
+	Citations        []string `json:"citations"`
+	RelatedQuestions []string `json:"related_questions"`
 }
 
 type Choice struct {
 	Index        int     `json:"index"`
 	FinishReason string  `json:"finish_reason"`
 	Message      Message `json:"message"`
+	Delta        Message `json:"delta"`
 }
 
 type Usage struct {
@@ -75,9 +76,12 @@ type Usage struct {
 }
 
 type PerplexitySuccessResponse struct {
-	Choices []Choice
-	config  PromptConfig
-	prompt  string
+	Choices          []Choice
+	Model            string
+	Usage            Usage
+	Citations        []string
+	RelatedQuestions []string
+	config           PromptConfig
 }
 
 type PerplexityResult struct {
@@ -151,137 +155,124 @@ func getStartSystemPrompt(theme Theme, chatType ChatType) string {
 	}
 }
 
-func buildPromptConfig(home Home, chatType ChatType, theme Theme) PromptConfig {
-	replacements := getReplacements(home, chatType.AddressType, chatType)
-	startSystemPrompt := getStartSystemPrompt(theme, chatType)
+func applyReplacements(prompt string, replacements map[string]string) string {
+	for key, value := range replacements {
+		prompt = strings.Replace(prompt, key, value, -1)
+	}
+	return prompt
+}
+
+// buildPromptConfig renders the system and user prompts for a chat, see PromptData for the template variables
+func buildPromptConfig(data PromptData) (PromptConfig, error) {
+	chatType := data.ChatType
+	replacements := getReplacements(data.Home, chatType.AddressType, chatType)
+	startSystemPrompt := getStartSystemPrompt(data.Theme, chatType)
+	provider, model := resolveLLMSettings(data.Theme, chatType)
+
+	var responseFormat *ResponseFormat
+	if chatType.OutputMode == OutputModeJSON {
+		startSystemPrompt += structuredOutputInstructions
+		responseFormat = structuredResponseFormat()
+	}
+
+	systemContent, err := renderPrompt("system prompt", startSystemPrompt, replacements, data)
+	if err != nil {
+		return PromptConfig{}, err
+	}
+
+	userContent, err := renderPrompt("prompt", chatType.Prompt, replacements, data)
+	if err != nil {
+		return PromptConfig{}, err
+	}
 
 	return PromptConfig{
-		Token:             os.Getenv("PERPLEXITY_API_TOKEN"),
+		Provider:          provider,
+		Model:             model,
 		StartSystemPrompt: startSystemPrompt,
 		UserPrompt:        chatType.Prompt,
 		Replacements:      replacements,
-		Messages:          []Message{},
-	}
-
+		ResponseFormat:    responseFormat,
+		Messages: []Message{
+			{
+				Role:    "system",
+				Content: systemContent,
+			},
+			{
+				Role:    "user",
+				Content: userContent,
+			},
+		},
+	}, nil
 }
 
 type PromptConfig struct {
-	Token             string
+	Provider          string
+	Model             string
 	DryRun            bool
 	StartSystemPrompt string
 	UserPrompt        string
 	Replacements      map[string]string
 	Messages          []Message
+	ResponseFormat    *ResponseFormat
 }
 
-func callPerplexityAPI(config PromptConfig) (PerplexityResult, error) {
-	url := "https://api.perplexity.ai/chat/completions"
-
-	if config.Token == "" {
-		return PerplexityResult{ErrorMessage: "API token not set"}, errors.New("API token not set")
-	}
-
-	runSettings := RunSettings{
-		MaxTokens: 512,
-	}
-
-	// Construct the Perplexity API request body
-	/*
-		llama-3.1-sonar-small-128k-online (8B parameters)
-		llama-3.1-sonar-large-128k-online (70B parameters)
-		llama-3.1-sonar-huge-128k-online (405B parameters)
-	*/
-	reqBody := PerplexityRequest{
-		Model:                  "llama-3.1-sonar-large-128k-online",
-		Messages:               config.Messages,
-		MaxTokens:              runSettings.MaxTokens,
-		Temperature:            0.2,
-		TopP:                   0.9,
-		ReturnCitations:        true,
-		SearchDomainFilter:     []string{}, // []string{"perplexity.ai"},
-		ReturnImages:           false,
-		ReturnRelatedQuestions: true,
-		TopK:                   0,
-		Stream:                 false,
-		PresencePenalty:        0,
-		FrequencyPenalty:       1,
-	}
-
-	// Convert the struct to JSON
-	reqBodyBytes, err := json.Marshal(reqBody)
+// buildContinuePromptConfig replays a saved Chat as messages and adds the follow up question.
+// The first user turn is the Chat's stored prompt, older chats without one fall back to the chat type prompt.
+func buildContinuePromptConfig(data PromptData, c Chat, question string) (PromptConfig, error) {
+	config, err := buildPromptConfig(data)
 	if err != nil {
-		return PerplexityResult{ErrorMessage: "Failed to marshal request body", config: config}, err
+		return config, err
 	}
-
-	// Create a new POST request
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBodyBytes))
-	if err != nil {
-		return PerplexityResult{ErrorMessage: "Failed to create request", config: config}, err
+	if len(c.Prompt) > 0 {
+		config.Messages[1].Content = c.Prompt
 	}
 
-	// Set headers for the API call
-	req.Header.Set("Authorization", "Bearer "+config.Token)
-	req.Header.Set("Content-Type", "application/json")
-
-	if config.DryRun {
-		return PerplexityResult{
-			config:         config,
-			SuccessResults: PerplexitySuccessResponse{},
-		}, nil
+	results := append([]ChatResult{}, c.Results...)
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+	for _, res := range results {
+		config.Messages = append(config.Messages, Message{
+			Role:    res.Role,
+			Content: res.Result,
+		})
 	}
 
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return PerplexityResult{ErrorMessage: "Failed to call API", config: config}, err
-	}
-	defer resp.Body.Close()
+	config.UserPrompt = question
+	config.Messages = append(config.Messages, Message{
+		Role:    "user",
+		Content: question,
+	})
+	return config, nil
+}
 
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return PerplexityResult{ErrorMessage: "Failed to read response body", config: config}, err
+// buildResponseSources turns the citations and related questions on a response into rows linked
+// to either a chat answer (chatID, chatResultID) or a fractal search message (fractalSearchID, messageIndex)
+func buildResponseSources(response PerplexityResult, chatID uint, chatResultID uint, fractalSearchID uint, messageIndex int) ([]Citation, []RelatedQuestion) {
+	citations := make([]Citation, 0, len(response.SuccessResults.Citations))
+	for i, url := range response.SuccessResults.Citations {
+		citations = append(citations, Citation{
+			ChatID:          chatID,
+			ChatResultID:    chatResultID,
+			FractalSearchID: fractalSearchID,
+			MessageIndex:    messageIndex,
+			Number:          i + 1,
+			URL:             url,
+		})
 	}
 
-	// Check for HTTP errors
-	if resp.StatusCode != http.StatusOK {
-		// Try to unmarshal into ErrorResponse
-		var errResp ErrorResponse
-		if err := json.Unmarshal(body, &errResp); err != nil {
-			return PerplexityResult{ErrorMessage: "Failed to unmarshal error response", config: config}, err
-		}
-
-		log.Printf("\n\n====Response: %+v\n\n", errResp)
-
-		if len(errResp.Detail) == 0 {
-			msg := fmt.Sprintf("API error %d - %v", resp.StatusCode, errResp)
-			return PerplexityResult{ErrorMessage: msg, config: config}, fmt.Errorf(msg)
+	questions := make([]RelatedQuestion, 0, len(response.SuccessResults.RelatedQuestions))
+	for _, question := range response.SuccessResults.RelatedQuestions {
+		if len(strings.TrimSpace(question)) == 0 {
+			continue
 		}
-
-		// Extract error details and return them
-		return PerplexityResult{ErrorMessage: errResp.Detail[0].Msg, config: config}, fmt.Errorf("API error: %s", errResp.Detail[0].Msg)
-	}
-
-	// Try to unmarshal into SuccessResponse
-	var successResp SuccessResponse
-	if err := json.Unmarshal(body, &successResp); err != nil {
-		return PerplexityResult{ErrorMessage: "Failed to unmarshal success response", config: config}, err
-	}
-
-	// log.Printf("\n\n====Response: %+v\n\n", body)
-
-	// Return the content of the assistant's message
-	if len(successResp.Choices) > 0 {
-		return PerplexityResult{
-			SuccessResults: PerplexitySuccessResponse{
-				Choices: successResp.Choices,
-				config:  config,
-			},
-		}, nil
+		questions = append(questions, RelatedQuestion{
+			ChatID:          chatID,
+			ChatResultID:    chatResultID,
+			FractalSearchID: fractalSearchID,
+			MessageIndex:    messageIndex,
+			Question:        strings.TrimSpace(question),
+		})
 	}
-
-	return PerplexityResult{ErrorMessage: "No choices returned in the response"}, fmt.Errorf("no choices returned")
+	return citations, questions
 }
 
 func buildChat(response PerplexityResult, home Home, chatType ChatType) Chat {
@@ -299,13 +290,13 @@ func buildChat(response PerplexityResult, home Home, chatType ChatType) Chat {
 	rating := extractRating(msg.Content)
 
 	return Chat{
-		HomeID:        home.ID,
-		ChatTypeTitle: chatType.Name,
-		ChatType:      uint(chatType.ID),
-		ThemeID:       uint(chatType.ThemeID),
-		Results:       chatResults,
-		Rating:        rating,
-		Prompt:        response.SuccessResults.prompt,
+		HomeID:            home.ID,
+		ChatTypeTitle:     chatType.Name,
+		ChatType:          uint(chatType.ID),
+		ThemeID:           uint(chatType.ThemeID),
+		Results:           chatResults,
+		Rating:            rating,
+		ChatTypeVersionID: chatType.VersionID,
 	}
 }
 
@@ -380,11 +371,16 @@ func parseFractalSearchResult(response PerplexityResult, fs FractalSearch) ([]Fr
 	return results, nil
 }
 
-func progressFractalGeoSearch(db *gorm.DB, fs FractalSearch, existingMessages []Message, theme Theme, request FractalSearchRequest) (FractalSearch, PromptConfig, error) {
+func progressFractalGeoSearch(db *gorm.DB, envConfig EnvConfig, fs FractalSearch, existingMessages []Message, theme Theme, request FractalSearchRequest) (FractalSearch, PromptConfig, error) {
 
 	log.Printf("progressFractalGeoSearch %d messages", len(existingMessages))
 	promptConfig := buildGeoPromptConfig(fs, existingMessages, theme, request.dryRun)
-	response, err := callPerplexityAPI(promptConfig)
+	if !request.dryRun {
+		if err := checkLLMBudget(db, envConfig); err != nil {
+			return fs, promptConfig, err
+		}
+	}
+	response, err := callLLM(envConfig, promptConfig)
 	if err != nil {
 		return fs, promptConfig, err
 	}
@@ -397,6 +393,11 @@ func progressFractalGeoSearch(db *gorm.DB, fs FractalSearch, existingMessages []
 
 	mewMsg := response.SuccessResults.Choices[len(response.SuccessResults.Choices)-1].Message
 
+	var messageIndex int64
+	if err := db.Model(&Message{}).Where("fractal_search_id = ?", fs.ID).Count(&messageIndex).Error; err != nil {
+		return fs, promptConfig, err
+	}
+
 	newMsg, err := CreateMessage(db, Message{
 		Role:            mewMsg.Role,
 		Content:         mewMsg.Content,
@@ -405,6 +406,19 @@ func progressFractalGeoSearch(db *gorm.DB, fs FractalSearch, existingMessages []
 
 	log.Printf("Saved msg with length %d", len(newMsg.Content))
 
+	citations, questions := buildResponseSources(response, 0, 0, fs.ID, int(messageIndex))
+	if err := CreateResponseSources(db, citations, questions); err != nil {
+		return fs, promptConfig, err
+	}
+
+	if _, err := recordLLMUsage(db, envConfig, response, promptConfig, LLMUsage{
+		ThemeID:         fs.ThemeID,
+		FractalSearchID: fs.ID,
+		MessageIndex:    int(messageIndex),
+	}); err != nil {
+		return fs, promptConfig, err
+	}
+
 	searchResult, err := parseFractalSearchResult(response, fs)
 	if err != nil {
 		return fs, promptConfig, err
@@ -572,12 +586,14 @@ func buildGeoPromptConfig(fs FractalSearch, messages []Message, theme Theme, dry
 	for _, msg := range promptMessages {
 		log.Printf("%+v", msg)
 	}
+	provider, model := resolveLLMSettings(theme, ChatType{})
 	promptConfig := PromptConfig{
+		Provider:          provider,
+		Model:             model,
 		StartSystemPrompt: "",
 		UserPrompt:        fs.Query,
 		Replacements:      replacements,
 		Messages:          promptMessages,
-		Token:             os.Getenv("PERPLEXITY_API_TOKEN"),
 		DryRun:            dryRun,
 	}
 
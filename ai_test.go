@@ -359,3 +359,69 @@ func TestParseFractalSearchResult(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildContinuePromptConfig(t *testing.T) {
+	t.Parallel()
+
+	home := Home{ID: 1, CleanAddress: "7 Middleton Road", CleanSuburb: "Riccarton"}
+	chatType := ChatType{ID: 2, Name: "Flooding", Prompt: "Does {address} flood?", ThemeID: 1}
+	theme := Theme{ID: 1, StartSystemPrompt: "You research {topic}."}
+
+	tests := []struct {
+		name      string
+		chat      Chat
+		wantFirst string
+	}{
+		{
+			name: "Stored prompt is replayed",
+			chat: Chat{
+				Prompt: "Does 7 Middleton Road flood? (as asked)",
+				Results: []ChatResult{
+					{ID: 3, Role: "assistant", Result: "Second answer"},
+					{ID: 2, Role: "user", Result: "What about 2021?"},
+					{ID: 1, Role: "assistant", Result: "First answer"},
+				},
+			},
+			wantFirst: "Does 7 Middleton Road flood? (as asked)",
+		},
+		{
+			name: "Older chats fall back to the chat type prompt",
+			chat: Chat{
+				Results: []ChatResult{
+					{ID: 3, Role: "assistant", Result: "Second answer"},
+					{ID: 2, Role: "user", Result: "What about 2021?"},
+					{ID: 1, Role: "assistant", Result: "First answer"},
+				},
+			},
+			wantFirst: "Does 7 Middleton Road flood?",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			config, err := buildContinuePromptConfig(newPromptData(home, chatType, theme), tt.chat, "What about 2022?")
+			if err != nil {
+				t.Fatalf("buildContinuePromptConfig() error = %v", err)
+			}
+
+			want := []Message{
+				{Role: "system", Content: "You research Flooding."},
+				{Role: "user", Content: tt.wantFirst},
+				{Role: "assistant", Content: "First answer"},
+				{Role: "user", Content: "What about 2021?"},
+				{Role: "assistant", Content: "Second answer"},
+				{Role: "user", Content: "What about 2022?"},
+			}
+			if len(config.Messages) != len(want) {
+				t.Fatalf("buildContinuePromptConfig() = %d messages, want %d", len(config.Messages), len(want))
+			}
+			for i, msg := range want {
+				if config.Messages[i].Role != msg.Role || config.Messages[i].Content != msg.Content {
+					t.Errorf("message %d = %+v, want %+v", i, config.Messages[i], msg)
+				}
+			}
+		})
+	}
+}
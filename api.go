@@ -0,0 +1,697 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	apiPrefix = "/api/v1"
+
+	// overlay images are sent base64 encoded in the JSON body
+	apiMaxBodyBytes = 32 << 20
+)
+
+// apiProtectedFields can't be set from a request body, the workspace comes from the login,
+// deleting goes through DELETE and chat type versions are saved by UpdateChatType
+var apiProtectedFields = []string{"ID", "WorkspaceID", "DeletedAt", "VersionID"}
+
+// apiInvalid is a problem with the request the client has to fix, it is sent as a 400
+type apiInvalid string
+
+func (e apiInvalid) Error() string {
+	return string(e)
+}
+
+// APIError is the body of every error response
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// APILoginRequest logs in for a bearer token
+type APILoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// APILoginResponse has the token to send as `Authorization: Bearer <token>`
+type APILoginResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	User      User      `json:"user"`
+}
+
+// APIChatRequest queues research of a home, one chat per chat type, every chat type in the theme when ChatTypeIDs is empty
+type APIChatRequest struct {
+	HomeID      uint   `json:"home_id"`
+	ThemeID     uint   `json:"theme_id"` // 0 for the workspace's first theme
+	ChatTypeIDs []uint `json:"chat_type_ids"`
+}
+
+// APIChatBatch is the queued jobs, each saves a chat once it has run
+type APIChatBatch struct {
+	BatchID string `json:"batch_id"`
+	Jobs    []Job  `json:"jobs"`
+}
+
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiPrefix+"/")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, APIError{Error: msg})
+}
+
+// apiErrorStatus is the status code for an error from a lookup or save
+func apiErrorStatus(err error) int {
+	var invalid apiInvalid
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest
+	case strings.Contains(err.Error(), "UNIQUE constraint failed"):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeAPIErr(w http.ResponseWriter, err error) {
+	writeAPIError(w, apiErrorStatus(err), err.Error())
+}
+
+// decodeAPIBody decodes the JSON body into v, unknown fields are an error so typos aren't silently ignored
+func decodeAPIBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return apiInvalid(fmt.Sprintf("Invalid JSON body - %s", err))
+	}
+	return nil
+}
+
+func apiID(r *http.Request) (uint, error) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		return 0, apiInvalid("Invalid id")
+	}
+	return uint(id), nil
+}
+
+// apiQueryUint is the query parameter as a number, 0 when it isn't set
+func apiQueryUint(r *http.Request, name string) (uint, error) {
+	value := r.URL.Query().Get(name)
+	if len(value) == 0 {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, apiInvalid(fmt.Sprintf("Invalid %s %q", name, value))
+	}
+	return uint(n), nil
+}
+
+// copyProtectedFields copies apiProtectedFields from src to dst, both pointers to the same struct type
+func copyProtectedFields(dst interface{}, src interface{}) {
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src).Elem()
+	for _, name := range apiProtectedFields {
+		if field := d.FieldByName(name); field.IsValid() && field.CanSet() {
+			field.Set(s.FieldByName(name))
+		}
+	}
+}
+
+func recordID(v interface{}) uint64 {
+	field := reflect.Indirect(reflect.ValueOf(v)).FieldByName("ID")
+	if !field.IsValid() {
+		return 0
+	}
+	return field.Uint()
+}
+
+// apiResource is the JSON CRUD for one model. A nil func means that method isn't allowed.
+// Updates decode the body onto the saved record, so fields left out keep their value.
+type apiResource[T any] struct {
+	name       string             // singular, for errors and the OpenAPI document
+	path       string             // under /api/v1, e.g. /homes
+	listParams []openAPIParameter // query parameters list understands
+	list       func(db *gorm.DB, r *http.Request) ([]T, error)
+	get        func(db *gorm.DB, id uint) (*T, error)
+	detail     func(db *gorm.DB, id uint) (interface{}, error) // what GET of one record sends, get when nil
+	detailOf   interface{}                                     // an example of what detail returns, for the OpenAPI document
+	validate   func(r *http.Request, db *gorm.DB, item *T) error
+	create     func(db *gorm.DB, item T) (*T, error)
+	update     func(db *gorm.DB, item T) (*T, error)
+	remove     func(db *gorm.DB, id uint) error
+	present    func(item T) T // trims what is sent back, e.g. base64 image data
+}
+
+// newAPIResource saves and loads T with gorm, hooks can then be replaced or set to nil
+func newAPIResource[T any](name string, path string) apiResource[T] {
+	return apiResource[T]{
+		name: name,
+		path: path,
+		list: func(db *gorm.DB, r *http.Request) ([]T, error) {
+			items := make([]T, 0)
+			err := db.Order("id").Find(&items).Error
+			return items, err
+		},
+		get: func(db *gorm.DB, id uint) (*T, error) {
+			var item T
+			if err := db.First(&item, id).Error; err != nil {
+				return nil, err
+			}
+			return &item, nil
+		},
+		create: func(db *gorm.DB, item T) (*T, error) {
+			if err := db.Create(&item).Error; err != nil {
+				return nil, err
+			}
+			return &item, nil
+		},
+		update: func(db *gorm.DB, item T) (*T, error) {
+			if err := db.Save(&item).Error; err != nil {
+				return nil, err
+			}
+			return &item, nil
+		},
+		remove: func(db *gorm.DB, id uint) error {
+			var item T
+			if err := db.First(&item, id).Error; err != nil {
+				return err
+			}
+			return db.Delete(&item).Error
+		},
+	}
+}
+
+func (res apiResource[T]) presented(item T) T {
+	if res.present == nil {
+		return item
+	}
+	return res.present(item)
+}
+
+func (res apiResource[T]) mount(r chi.Router, db *gorm.DB) {
+	if res.list != nil {
+		r.Get(res.path, res.collectionHandler(db))
+	}
+	if res.create != nil {
+		r.Post(res.path, res.collectionHandler(db))
+	}
+	item := res.path + "/{id:[0-9]+}"
+	r.Get(item, res.itemHandler(db))
+	if res.update != nil {
+		r.Put(item, res.itemHandler(db))
+		r.Patch(item, res.itemHandler(db))
+	}
+	if res.remove != nil {
+		r.Delete(item, res.itemHandler(db))
+	}
+}
+
+func (res apiResource[T]) collectionHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		switch r.Method {
+		case http.MethodGet:
+			items, err := res.list(db, r)
+			if err != nil {
+				writeAPIErr(w, err)
+				return
+			}
+			for i := range items {
+				items[i] = res.presented(items[i])
+			}
+			writeJSON(w, http.StatusOK, items)
+		case http.MethodPost:
+			var item T
+			if err := decodeAPIBody(w, r, &item); err != nil {
+				writeAPIErr(w, err)
+				return
+			}
+			copyProtectedFields(&item, new(T))
+			if res.validate != nil {
+				if err := res.validate(r, db, &item); err != nil {
+					writeAPIErr(w, err)
+					return
+				}
+			}
+
+			created, err := res.create(db, item)
+			if err != nil {
+				writeAPIErr(w, err)
+				return
+			}
+			w.Header().Set("Location", fmt.Sprintf("%s%s/%d", apiPrefix, res.path, recordID(created)))
+			writeJSON(w, http.StatusCreated, res.presented(*created))
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s %s is not allowed", r.Method, res.path))
+		}
+	}
+}
+
+func (res apiResource[T]) itemHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		id, err := apiID(r)
+		if err != nil {
+			writeAPIErr(w, err)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			if res.detail != nil {
+				detail, err := res.detail(db, id)
+				if err != nil {
+					writeAPIErr(w, err)
+					return
+				}
+				writeJSON(w, http.StatusOK, detail)
+				return
+			}
+			item, err := res.get(db, id)
+			if err != nil {
+				writeAPIErr(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, res.presented(*item))
+		case http.MethodPut, http.MethodPatch:
+			existing, err := res.get(db, id)
+			if err != nil {
+				writeAPIErr(w, err)
+				return
+			}
+			item := *existing
+			if err := decodeAPIBody(w, r, &item); err != nil {
+				writeAPIErr(w, err)
+				return
+			}
+			copyProtectedFields(&item, existing)
+			if res.validate != nil {
+				if err := res.validate(r, db, &item); err != nil {
+					writeAPIErr(w, err)
+					return
+				}
+			}
+
+			updated, err := res.update(db, item)
+			if err != nil {
+				writeAPIErr(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, res.presented(*updated))
+		case http.MethodDelete:
+			if err := res.remove(db, id); err != nil {
+				writeAPIErr(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s %s/{id} is not allowed", r.Method, res.path))
+		}
+	}
+}
+
+// apiMountable is an apiResource of any model
+type apiMountable interface {
+	mount(r chi.Router, db *gorm.DB)
+	describe(doc *openAPIDocument)
+}
+
+// apiResources are every resource under /api/v1, the OpenAPI document is generated from the same list
+func apiResources(envConfig EnvConfig) []apiMountable {
+	homes := newAPIResource[Home]("home", "/homes")
+	homes.validate = func(r *http.Request, db *gorm.DB, home *Home) error {
+		if home.Lat < -90 || home.Lat > 90 || home.Lng < -180 || home.Lng > 180 {
+			return apiInvalid(fmt.Sprintf("Lat %v and Lng %v must be a point on the map", home.Lat, home.Lng))
+		}
+		return nil
+	}
+	homes.remove = func(db *gorm.DB, id uint) error {
+		_, err := DeleteHome(db, id)
+		return err
+	}
+
+	factors := newAPIResource[Factor]("factor", "/factors")
+	factors.list = func(db *gorm.DB, r *http.Request) ([]Factor, error) {
+		factors := make([]Factor, 0)
+		err := db.Order("display_order, id").Find(&factors).Error
+		return factors, err
+	}
+	factors.validate = func(r *http.Request, db *gorm.DB, factor *Factor) error {
+		if len(strings.TrimSpace(factor.Title)) == 0 {
+			return apiInvalid("title is required")
+		}
+		return nil
+	}
+
+	ratings := newAPIResource[HomeFactorRating]("rating", "/ratings")
+	ratings.listParams = []openAPIParameter{
+		queryParameter("home_id", "integer", "only this home's ratings"),
+		queryParameter("factor_id", "integer", "only this factor's ratings"),
+		queryParameter("rater", "string", "only this rater's ratings"),
+	}
+	ratings.list = func(db *gorm.DB, r *http.Request) ([]HomeFactorRating, error) {
+		query := db.Order("id")
+		for _, column := range []string{"home_id", "factor_id"} {
+			id, err := apiQueryUint(r, column)
+			if err != nil {
+				return nil, err
+			}
+			if id > 0 {
+				query = query.Where(column+" = ?", id)
+			}
+		}
+		if rater := r.URL.Query().Get("rater"); len(rater) > 0 {
+			query = query.Where("rater = ?", rater)
+		}
+		ratings := make([]HomeFactorRating, 0)
+		err := query.Find(&ratings).Error
+		return ratings, err
+	}
+	ratings.validate = func(r *http.Request, db *gorm.DB, rating *HomeFactorRating) error {
+		if rating.Stars < 1 || rating.Stars > 5 {
+			return apiInvalid("stars must be 1 to 5")
+		}
+		if _, err := GetHome(db, rating.HomeID); err != nil {
+			return apiInvalid(fmt.Sprintf("Home %d not found", rating.HomeID))
+		}
+		if err := db.First(&Factor{}, rating.FactorID).Error; err != nil {
+			return apiInvalid(fmt.Sprintf("Factor %d not found", rating.FactorID))
+		}
+		// instead of the rater cookie, ratings default to the logged in user
+		rating.Rater = strings.TrimSpace(rating.Rater)
+		if len(rating.Rater) == 0 {
+			if user := userFromContext(r.Context()); user != nil {
+				rating.Rater = user.Username
+			}
+		}
+		if len(rating.Rater) > maxRaterLength {
+			return apiInvalid(fmt.Sprintf("Rater name must be %d characters or less", maxRaterLength))
+		}
+		return nil
+	}
+	// rating a home and factor again replaces the rater's earlier rating
+	ratings.create = func(db *gorm.DB, rating HomeFactorRating) (*HomeFactorRating, error) {
+		if err := SaveHomeFactorRating(db, rating); err != nil {
+			return nil, err
+		}
+		var saved HomeFactorRating
+		err := db.Where("home_id = ? AND factor_id = ? AND rater = ?", rating.HomeID, rating.FactorID, rating.Rater).First(&saved).Error
+		if err != nil {
+			return nil, err
+		}
+		return &saved, nil
+	}
+
+	shapes := newAPIResource[Shape]("shape", "/shapes")
+	shapes.validate = func(r *http.Request, db *gorm.DB, shape *Shape) error {
+		if _, err := parseShapeRings(shape.ShapeData); err != nil {
+			return apiInvalid(fmt.Sprintf("Invalid shape_data - %s", err))
+		}
+		if len(shape.ShapeType) == 0 || len(shape.ShapeKind) == 0 {
+			return apiInvalid("shape_type and shape_kind are required")
+		}
+		return nil
+	}
+
+	overlays := newAPIResource[ImageOverlay]("overlay", "/overlays")
+	overlays.validate = func(r *http.Request, db *gorm.DB, overlay *ImageOverlay) error {
+		if overlay.Opacity < 0 || overlay.Opacity > 1 {
+			return apiInvalid("opacity must be 0 to 1")
+		}
+		return nil
+	}
+	// the image is saved to IMAGE_DIR and served from /images/{fileName}
+	overlays.create = func(db *gorm.DB, overlay ImageOverlay) (*ImageOverlay, error) {
+		image, err := base64.StdEncoding.DecodeString(overlay.File)
+		if err != nil || len(image) == 0 {
+			return nil, apiInvalid("fileInput must be the base64 encoded image")
+		}
+		overlay.FileName = uuid.New().String()
+		if err := SaveImage(envConfig.ImageDir, image, overlay.FileName); err != nil {
+			return nil, err
+		}
+		return SaveImgOverlay(db, overlay)
+	}
+	overlays.update = func(db *gorm.DB, overlay ImageOverlay) (*ImageOverlay, error) {
+		saved, err := overlays.get(db, overlay.ID)
+		if err != nil {
+			return nil, err
+		}
+		// replacing the image means adding a new overlay
+		overlay.File = saved.File
+		overlay.FileName = saved.FileName
+		return SaveImgOverlay(db, overlay)
+	}
+	overlays.present = func(overlay ImageOverlay) ImageOverlay {
+		overlay.File = ""
+		return overlay
+	}
+
+	themes := newAPIResource[Theme]("theme", "/themes")
+	themes.validate = func(r *http.Request, db *gorm.DB, theme *Theme) error {
+		if len(strings.TrimSpace(theme.Name)) == 0 {
+			return apiInvalid("name is required")
+		}
+		return nil
+	}
+	// chat types, chats and score weights belong to a theme, and the web UI can't delete them either
+	themes.remove = nil
+
+	chatTypes := newAPIResource[ChatType]("chat type", "/chat-types")
+	chatTypes.listParams = []openAPIParameter{queryParameter("theme_id", "integer", "only this theme's chat types")}
+	chatTypes.list = func(db *gorm.DB, r *http.Request) ([]ChatType, error) {
+		themeID, err := apiQueryUint(r, "theme_id")
+		if err != nil {
+			return nil, err
+		}
+		query := db.Order("id")
+		if themeID > 0 {
+			query = query.Where("theme_id = ?", themeID)
+		}
+		chatTypes := make([]ChatType, 0)
+		err = query.Find(&chatTypes).Error
+		return chatTypes, err
+	}
+	chatTypes.validate = func(r *http.Request, db *gorm.DB, chatType *ChatType) error {
+		if len(strings.TrimSpace(chatType.Name)) == 0 {
+			return apiInvalid("name is required")
+		}
+		if chatType.OutputMode != OutputModeText && chatType.OutputMode != OutputModeJSON {
+			return apiInvalid(fmt.Sprintf("Unknown output_mode %q", chatType.OutputMode))
+		}
+		if chatType.ThemeID == 0 {
+			chatType.ThemeID = GetActiveTheme(db, 0).ID
+		} else if err := db.First(&Theme{}, chatType.ThemeID).Error; err != nil {
+			return apiInvalid(fmt.Sprintf("Theme %d not found", chatType.ThemeID))
+		}
+		return nil
+	}
+	chatTypes.create = CreateChatType
+	chatTypes.update = UpdateChatType
+	chatTypes.remove = func(db *gorm.DB, id uint) error {
+		_, err := DeleteChatType(db, id)
+		return err
+	}
+
+	// chats are made by the job queue, POST /chats queues them
+	chats := newAPIResource[Chat]("chat", "/chats")
+	chats.listParams = []openAPIParameter{
+		queryParameter("home_id", "integer", "the home the chats are about, required"),
+		queryParameter("theme_id", "integer", "the theme, the workspace's first theme when not set"),
+		queryParameter("chat_type_id", "integer", "only chats of this chat type"),
+	}
+	chats.list = func(db *gorm.DB, r *http.Request) ([]Chat, error) {
+		ids := make(map[string]uint)
+		for _, name := range []string{"home_id", "theme_id", "chat_type_id"} {
+			id, err := apiQueryUint(r, name)
+			if err != nil {
+				return nil, err
+			}
+			ids[name] = id
+		}
+		if ids["home_id"] == 0 {
+			return nil, apiInvalid("home_id is required")
+		}
+		if ids["theme_id"] == 0 {
+			ids["theme_id"] = GetActiveTheme(db, 0).ID
+		}
+		chats, err := GetChats(db, ids["theme_id"], ids["home_id"], ids["chat_type_id"])
+		if chats == nil {
+			chats = make([]Chat, 0)
+		}
+		return chats, err
+	}
+	chats.get = GetChat
+	chats.create = nil
+	chats.update = nil
+	chats.remove = func(db *gorm.DB, id uint) error {
+		if _, err := GetChat(db, id); err != nil {
+			return err
+		}
+		_, err := DeleteChat(db, id)
+		return err
+	}
+
+	searches := newAPIResource[FractalSearch]("fractal search", "/fractal-searches")
+	searches.listParams = []openAPIParameter{queryParameter("status", "string", "only searches with this status, e.g. pending")}
+	searches.list = func(db *gorm.DB, r *http.Request) ([]FractalSearch, error) {
+		query := db.Order("id")
+		if status := r.URL.Query().Get("status"); len(status) > 0 {
+			query = query.Where("status = ?", status)
+		}
+		searches := make([]FractalSearch, 0)
+		err := query.Find(&searches).Error
+		return searches, err
+	}
+	searches.detail = func(db *gorm.DB, id uint) (interface{}, error) {
+		return GetFractalSearchFull(db, id)
+	}
+	searches.detailOf = FractalSearchFull{}
+	searches.validate = func(r *http.Request, db *gorm.DB, search *FractalSearch) error {
+		if len(strings.TrimSpace(search.Query)) == 0 {
+			return apiInvalid("query is required")
+		}
+		return nil
+	}
+	// new searches are pending until they are run from the map
+	searches.create = func(db *gorm.DB, search FractalSearch) (*FractalSearch, error) {
+		search.Status = "pending"
+		return CreateFractalSearch(db, search)
+	}
+	searches.remove = func(db *gorm.DB, id uint) error {
+		if _, err := GetFractalSearch(db, id); err != nil {
+			return err
+		}
+		_, err := DeleteFractalSearch(db, id)
+		return err
+	}
+
+	return []apiMountable{homes, factors, ratings, shapes, overlays, themes, chatTypes, chats, searches}
+}
+
+// apiRouter is /api/v1, JSON versions of what the htmx fragments do for scripts and apps
+func apiRouter(db *gorm.DB, envConfig EnvConfig) http.Handler {
+	r := chi.NewRouter()
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("%s not found", r.URL.Path))
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s %s is not allowed", r.Method, r.URL.Path))
+	})
+
+	resources := apiResources(envConfig)
+	for _, res := range resources {
+		res.mount(r, db)
+	}
+	r.Post("/chats", apiQueueChatsHandler(db))
+	r.Post("/login", apiLoginHandler(db))
+	r.Post("/logout", apiLogoutHandler(db))
+
+	doc := buildOpenAPI(resources)
+	r.Get("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, doc)
+	})
+	return r
+}
+
+func apiLoginHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var login APILoginRequest
+		if err := decodeAPIBody(w, r, &login); err != nil {
+			writeAPIErr(w, err)
+			return
+		}
+		user, err := Authenticate(db, login.Username, login.Password)
+		if err != nil {
+			writeAPIError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		token, err := CreateSession(db, user.ID)
+		if err != nil {
+			writeAPIErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, APILoginResponse{Token: token, ExpiresAt: time.Now().Add(sessionDuration), User: *user})
+	}
+}
+
+func apiLogoutHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := DeleteSession(db, sessionToken(r)); err != nil {
+			writeAPIErr(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiQueueChatsHandler queues research like the "Research" buttons, the chats appear under GET /chats as the jobs finish
+func apiQueueChatsHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		var req APIChatRequest
+		if err := decodeAPIBody(w, r, &req); err != nil {
+			writeAPIErr(w, err)
+			return
+		}
+
+		home, err := GetHome(db, req.HomeID)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Home %d not found", req.HomeID))
+			return
+		}
+		if len(home.CleanAddress) == 0 {
+			writeAPIError(w, http.StatusBadRequest, "Home address is empty, set clean_address first")
+			return
+		}
+		if req.ThemeID == 0 {
+			req.ThemeID = GetActiveTheme(db, 0).ID
+		}
+
+		query := db.Where("theme_id = ?", req.ThemeID)
+		if len(req.ChatTypeIDs) > 0 {
+			query = query.Where("id IN ?", req.ChatTypeIDs)
+		}
+		var chatTypes []ChatType
+		if err := query.Find(&chatTypes).Error; err != nil {
+			writeAPIErr(w, err)
+			return
+		}
+		if len(chatTypes) == 0 || (len(req.ChatTypeIDs) > 0 && len(chatTypes) != len(req.ChatTypeIDs)) {
+			writeAPIError(w, http.StatusBadRequest, "No chat types to research, or some of chat_type_ids weren't found")
+			return
+		}
+
+		batchID, jobs, err := EnqueueChatJobs(db, *home, req.ThemeID, chatTypes)
+		if err != nil {
+			writeAPIErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, APIChatBatch{BatchID: batchID, Jobs: jobs})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAPI(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:", ImageDir: t.TempDir()}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+	if err := InitAdminUser(db, EnvConfig{AdminUsername: "sam", AdminPassword: "admin password"}); err != nil {
+		t.Fatalf("InitAdminUser() error = %v", err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(loadUser(db))
+	r.Use(requireUserToChange)
+	r.Use(loadWorkspace(db))
+	r.Use(requireWorkspace)
+	r.Mount(apiPrefix, apiRouter(db, config))
+
+	send := func(method string, path string, body string, token string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, apiPrefix+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send("POST", "/login", `{"username":"sam","password":"wrong password"}`, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("login with the wrong password = %d, want 401", rec.Code)
+	}
+	rec := send("POST", "/login", `{"username":"sam","password":"admin password"}`, "")
+	var login APILoginResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &login); err != nil || len(login.Token) == 0 {
+		t.Fatalf("login = %d %s, want a token", rec.Code, rec.Body.String())
+	}
+	token := login.Token
+
+	image := base64.StdEncoding.EncodeToString([]byte("not really a png"))
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		token      string
+		header     []string
+		wantStatus int
+		want       string
+	}{
+		{name: "Needs a login", method: "GET", path: "/homes", wantStatus: 401, want: "bearer token"},
+		{name: "OpenAPI document is public", method: "GET", path: "/openapi.json", wantStatus: 200, want: `"shape_data":{"type":"string"}`},
+		{name: "Empty list", method: "GET", path: "/homes", token: token, wantStatus: 200, want: "[]"},
+		{name: "Create a home", method: "POST", path: "/homes", body: `{"Title":"Villa","Lat":-43.53,"Lng":172.58}`, token: token, wantStatus: 201, want: `"Title":"Villa"`},
+		{name: "Unknown fields are rejected", method: "POST", path: "/homes", body: `{"Tilte":"Villa"}`, token: token, wantStatus: 400, want: "unknown field"},
+		{name: "Point off the map", method: "POST", path: "/homes", body: `{"Lat":100}`, token: token, wantStatus: 400, want: "point on the map"},
+		{name: "Missing home", method: "GET", path: "/homes/99", token: token, wantStatus: 404, want: "record not found"},
+		{name: "Update keeps other fields", method: "PATCH", path: "/homes/1", body: `{"Notes":"sunny","ID":7}`, token: token, wantStatus: 200, want: `"ID":1,"workspace_id":1,"Lat":-43.53,"Lng":172.58,"PointType":"","Title":"Villa"`},
+		{name: "Create a factor", method: "POST", path: "/factors", body: `{"title":"Sun"}`, token: token, wantStatus: 201, want: `"title":"Sun"`},
+		{name: "Rate as the logged in user", method: "POST", path: "/ratings", body: `{"home_id":1,"factor_id":1,"stars":4}`, token: token, wantStatus: 201, want: `"stars":4,"factor_id":1,"home_id":1,"rater":"sam"`},
+		{name: "Rating again replaces it", method: "POST", path: "/ratings", body: `{"home_id":1,"factor_id":1,"stars":2}`, token: token, wantStatus: 201, want: `"ID":1,"workspace_id":1,"stars":2`},
+		{name: "Stars out of range", method: "POST", path: "/ratings", body: `{"home_id":1,"factor_id":1,"stars":9}`, token: token, wantStatus: 400, want: "stars must be 1 to 5"},
+		{name: "Ratings of a home", method: "GET", path: "/ratings?home_id=1", token: token, wantStatus: 200, want: `"rater":"sam"`},
+		{name: "Invalid shape", method: "POST", path: "/shapes", body: `{"shape_data":"nope","shape_type":"area","shape_kind":"noGo"}`, token: token, wantStatus: 400, want: "Invalid shape_data"},
+		{name: "Create a shape", method: "POST", path: "/shapes", body: `{"shape_data":"[[1,1],[1,2],[2,2]]","shape_type":"area","shape_kind":"noGo"}`, token: token, wantStatus: 201, want: `"shape_kind":"noGo"`},
+		{name: "Create an overlay", method: "POST", path: "/overlays", body: `{"name":"Plan","fileInput":"` + image + `","opacity":0.5}`, token: token, wantStatus: 201, want: `"fileInput":""`},
+		{name: "Create a chat type", method: "POST", path: "/chat-types", body: `{"name":"Schools","prompt":"Schools near {{.Home.Road}}"}`, token: token, wantStatus: 201, want: `"output_mode":"","version_id":1`},
+		{name: "Unknown output mode", method: "PATCH", path: "/chat-types/1", body: `{"output_mode":"xml"}`, token: token, wantStatus: 400, want: "Unknown output_mode"},
+		{name: "Research needs an address", method: "POST", path: "/chats", body: `{"home_id":1}`, token: token, wantStatus: 400, want: "address is empty"},
+		{name: "Set the address", method: "PUT", path: "/homes/1", body: `{"CleanAddress":"1 Main Road"}`, token: token, wantStatus: 200, want: "1 Main Road"},
+		{name: "Create a theme", method: "POST", path: "/themes", body: `{"name":"Flats"}`, token: token, wantStatus: 201, want: `"ID":2`},
+		{name: "Create a chat type in it", method: "POST", path: "/chat-types", body: `{"name":"Bus stops","prompt":"Buses?","theme_id":2}`, token: token, wantStatus: 201, want: `"theme_id":2`},
+		{name: "Research only the theme's chat types", method: "POST", path: "/chats", body: `{"home_id":1,"theme_id":1,"chat_type_ids":[1,2]}`, token: token, wantStatus: 400, want: "weren't found"},
+		{name: "Queue research", method: "POST", path: "/chats", body: `{"home_id":1}`, token: token, wantStatus: 202, want: `"status":"queued"`},
+		{name: "Chats need a home", method: "GET", path: "/chats", token: token, wantStatus: 400, want: "home_id is required"},
+		{name: "Chats are made by jobs", method: "PUT", path: "/chats/1", body: `{}`, token: token, wantStatus: 405},
+		{name: "Create a search", method: "POST", path: "/fractal-searches", body: `{"query":"Parks","status":"done"}`, token: token, wantStatus: 201, want: `"status":"pending"`},
+		{name: "Search with its points", method: "GET", path: "/fractal-searches/1", token: token, wantStatus: 200, want: `"Points":[]`},
+		{name: "Themes can't be deleted", method: "DELETE", path: "/themes/1", token: token, wantStatus: 405},
+		{name: "Someone else's workspace", method: "GET", path: "/homes", token: token, header: []string{"X-Workspace-ID", "99"}, wantStatus: 403, want: "member of workspace 99"},
+		{name: "Delete a home", method: "DELETE", path: "/homes/1", token: token, wantStatus: 204},
+		{name: "Deleted home is gone", method: "GET", path: "/homes/1", token: token, wantStatus: 404},
+		{name: "Unknown path", method: "GET", path: "/houses", token: token, wantStatus: 404, want: `"error"`},
+		{name: "Log out", method: "POST", path: "/logout", token: token, wantStatus: 204},
+		{name: "Token no longer works", method: "GET", path: "/homes", token: token, wantStatus: 401},
+	}
+	for _, tt := range tests {
+		rec := send(tt.method, tt.path, tt.body, tt.token, tt.header...)
+		if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: %s %s = %d %s, want %d with %q", tt.name, tt.method, tt.path, rec.Code, rec.Body.String(), tt.wantStatus, tt.want)
+		}
+		if tt.wantStatus == 201 && !strings.HasPrefix(rec.Header().Get("Location"), apiPrefix+tt.path+"/") {
+			t.Errorf("%s: Location = %q", tt.name, rec.Header().Get("Location"))
+		}
+		if tt.wantStatus >= 400 && rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: error Content-Type = %q, want JSON", tt.name, rec.Header().Get("Content-Type"))
+		}
+	}
+
+	var overlay ImageOverlay
+	db.First(&overlay)
+	if saved, err := os.ReadFile(filepath.Join(config.ImageDir, overlay.FileName+".png")); err != nil || string(saved) != "not really a png" {
+		t.Errorf("overlay image = %q, %v, want the decoded upload", saved, err)
+	}
+	var jobs []Job
+	db.Find(&jobs)
+	if len(jobs) != 1 || jobs[0].HomeID != 1 || jobs[0].ChatTypeID != 1 {
+		t.Errorf("jobs = %+v, want the chat type queued for the home", jobs)
+	}
+}
+
+func TestOpenAPISchema(t *testing.T) {
+	t.Parallel()
+
+	doc := buildOpenAPI(apiResources(EnvConfig{}))
+
+	tests := []struct {
+		schema   string
+		property string
+		want     openAPISchema
+	}{
+		{schema: "Home", property: "Lat", want: openAPISchema{Type: "number"}},
+		{schema: "Home", property: "ID", want: openAPISchema{Type: "integer", ReadOnly: true}},
+		{schema: "Home", property: "RemoveRequestAt", want: openAPISchema{Type: "string", Format: "date-time"}},
+		{schema: "Chat", property: "pros", want: openAPISchema{Type: "array", Items: &openAPISchema{Type: "string"}}},
+		{schema: "Chat", property: "Results", want: openAPISchema{Type: "array", Items: &openAPISchema{Ref: "#/components/schemas/ChatResult"}}},
+		{schema: "FractalSearchFull", property: "query", want: openAPISchema{Type: "string"}},
+		{schema: "APILoginResponse", property: "user", want: openAPISchema{Ref: "#/components/schemas/User"}},
+	}
+	for _, tt := range tests {
+		schema, ok := doc.Components.Schemas[tt.schema]
+		if !ok {
+			t.Errorf("schema %s missing", tt.schema)
+			continue
+		}
+		got, _ := json.Marshal(schema.Properties[tt.property])
+		want, _ := json.Marshal(tt.want)
+		if string(got) != string(want) {
+			t.Errorf("%s.%s = %s, want %s", tt.schema, tt.property, got, want)
+		}
+	}
+
+	for _, hidden := range []string{"Ratings", "Chats"} {
+		if _, ok := doc.Components.Schemas["Home"].Properties[hidden]; ok {
+			t.Errorf("Home has %s, json:\"-\" fields should be left out", hidden)
+		}
+	}
+	if _, ok := doc.Components.Schemas["User"].Properties["PasswordHash"]; ok {
+		t.Errorf("User has PasswordHash")
+	}
+	if _, ok := doc.Paths["/themes/{id}"]["delete"]; ok {
+		t.Errorf("themes can't be deleted but the document has DELETE /themes/{id}")
+	}
+	if op := doc.Paths["/chats"]["post"]; op == nil || op.Responses["202"].Content == nil {
+		t.Errorf("POST /chats = %+v, want a 202 with the queued jobs", op)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+
+	auditBeforeKey = "audit:before"
+	auditActionKey = "audit:action"
+	auditSkipKey   = "audit:skip" // set on statements that aren't changes by a user, as restoring a backup
+	auditPageSize  = 200
+)
+
+// auditedKinds are the tables whose changes are logged, and the kind they are logged as
+var auditedKinds = map[string]string{
+	"homes":            "home",
+	"shapes":           "shape",
+	"image_overlays":   "overlay",
+	"fractal_searches": "search",
+	"factors":          "factor",
+}
+
+// registerAuditLog adds callbacks that log every create, update and delete of the audited tables,
+// with the logged in user from the statement's context
+func registerAuditLog(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Update().Before("gorm:update").Register("audit:before_update", auditBefore); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().Before("gorm:delete").Register("audit:before_delete", auditBefore); err != nil {
+		return err
+	}
+	if err := callbacks.Create().After("gorm:create").Register("audit:create", auditAfter(AuditCreate)); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("gorm:update").Register("audit:update", auditAfter(AuditUpdate)); err != nil {
+		return err
+	}
+	return callbacks.Delete().After("gorm:delete").Register("audit:delete", auditAfter(AuditDelete))
+}
+
+func auditKind(db *gorm.DB) (string, bool) {
+	if db.Statement.Schema == nil {
+		return "", false
+	}
+	if _, skip := db.Get(auditSkipKey); skip {
+		return "", false
+	}
+	kind, ok := auditedKinds[db.Statement.Schema.Table]
+	return kind, ok
+}
+
+// auditSession runs queries on the statement's connection, so inside its transaction
+func auditSession(db *gorm.DB) *gorm.DB {
+	return db.Session(&gorm.Session{NewDB: true, Context: db.Statement.Context})
+}
+
+// auditRows loads the rows a statement is about to change, by ID or by its WHERE clause
+func auditRows(db *gorm.DB, ids []uint) (reflect.Value, error) {
+	stmt := db.Statement
+	rows := reflect.New(reflect.SliceOf(stmt.Schema.ModelType))
+	query := auditSession(db)
+	if len(ids) > 0 {
+		// by ID includes rows in the trash, so restores have a before
+		query = query.Unscoped().Where("id IN ?", ids)
+	} else if where, ok := stmt.Clauses["WHERE"]; ok {
+		query = query.Clauses(where.Expression)
+	} else {
+		return rows.Elem(), nil
+	}
+	err := query.Find(rows.Interface()).Error
+	return rows.Elem(), err
+}
+
+func auditRowIDs(db *gorm.DB, rows []reflect.Value) []uint {
+	ids := make([]uint, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, rowUint(db, row, "ID"))
+	}
+	return ids
+}
+
+func auditJSON(row reflect.Value) string {
+	data, err := json.Marshal(withoutImageFile(row.Interface()))
+	if err != nil {
+		log.Printf("failed to encode audit row: %v", err)
+		return ""
+	}
+	return string(data)
+}
+
+func auditBefore(db *gorm.DB) {
+	if _, ok := auditKind(db); !ok {
+		return
+	}
+	rows, err := auditRows(db, auditRowIDs(db, changedRows(db)))
+	if err != nil {
+		log.Printf("failed to load rows before change: %v", err)
+		return
+	}
+
+	before := make(map[uint]reflect.Value)
+	for i := 0; i < rows.Len(); i++ {
+		before[rowUint(db, rows.Index(i), "ID")] = rows.Index(i)
+	}
+	db.InstanceSet(auditBeforeKey, before)
+}
+
+func auditAfter(statementAction string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		kind, ok := auditKind(db)
+		if !ok || db.Error != nil || db.RowsAffected == 0 {
+			return
+		}
+		// a restore is an update of deleted_at and a purge a delete, RestoreTrash and PurgeTrash say which
+		action := statementAction
+		if override, ok := db.Get(auditActionKey); ok {
+			action = override.(string)
+		}
+
+		before := make(map[uint]reflect.Value)
+		if value, ok := db.InstanceGet(auditBeforeKey); ok {
+			before = value.(map[uint]reflect.Value)
+		}
+
+		after := make(map[uint]reflect.Value)
+		switch action {
+		case AuditCreate:
+			for _, row := range changedRows(db) {
+				after[rowUint(db, row, "ID")] = row
+			}
+		case AuditUpdate, AuditRestore:
+			ids := make([]uint, 0, len(before))
+			for id := range before {
+				ids = append(ids, id)
+			}
+			if len(ids) == 0 {
+				return
+			}
+			rows, err := auditRows(db, ids)
+			if err != nil {
+				log.Printf("failed to load rows after change: %v", err)
+				return
+			}
+			for i := 0; i < rows.Len(); i++ {
+				after[rowUint(db, rows.Index(i), "ID")] = rows.Index(i)
+			}
+		}
+
+		user := userFromContext(db.Statement.Context)
+		entries := make([]AuditLog, 0)
+		for _, id := range auditIDs(before, after) {
+			entry := AuditLog{Action: action, Kind: kind, RecordID: id}
+			if row, ok := before[id]; ok {
+				entry.Before = auditJSON(row)
+				entry.WorkspaceID = rowUint(db, row, "WorkspaceID")
+			}
+			if row, ok := after[id]; ok {
+				entry.After = auditJSON(row)
+				entry.WorkspaceID = rowUint(db, row, "WorkspaceID")
+			}
+			if entry.Before == entry.After {
+				continue
+			}
+			if user != nil {
+				entry.UserID, entry.Username = user.ID, user.Username
+			}
+			entries = append(entries, entry)
+		}
+		if len(entries) == 0 {
+			return
+		}
+		if err := auditSession(db).Create(&entries).Error; err != nil {
+			log.Printf("failed to save audit log: %v", err)
+		}
+	}
+}
+
+// auditIDs are the IDs in either map, in order
+func auditIDs(before map[uint]reflect.Value, after map[uint]reflect.Value) []uint {
+	seen := make(map[uint]bool)
+	ids := make([]uint, 0, len(before)+len(after))
+	for _, rows := range []map[uint]reflect.Value{before, after} {
+		for id := range rows {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// auditUsername is who made a change, changes without a logged in user are from the job queue or startup
+func auditUsername(username string) string {
+	if len(username) == 0 {
+		return "system"
+	}
+	return username
+}
+
+// GetAuditLog is the newest changes first, for one record when kind and id are given
+func GetAuditLog(db *gorm.DB, kind string, id uint, limit int) ([]AuditLog, error) {
+	query := db.Order("id desc").Limit(limit)
+	if len(kind) > 0 {
+		query = query.Where("kind = ?", kind)
+	}
+	if id != 0 {
+		query = query.Where("record_id = ?", id)
+	}
+	var entries []AuditLog
+	if err := query.Find(&entries).Error; err != nil {
+		return nil, fmt.Errorf("failed to get audit log: %w", err)
+	}
+	return entries, nil
+}
+
+// auditHandler shows recent changes, ?kind=home&id=3 narrows it to one record
+func auditHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		kind := r.URL.Query().Get("kind")
+		id, _ := strconv.ParseUint(r.URL.Query().Get("id"), 10, 32)
+
+		entries, err := GetAuditLog(db, kind, uint(id), auditPageSize)
+		if err != nil {
+			warning := warning(err.Error())
+			warning.Render(GetContext(r), w)
+			return
+		}
+		auditList := auditList(entries)
+		auditList.Render(GetContext(r), w)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAuditLogAndTrash(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBInit(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	user, err := CreateUser(db, "sam", "member password", RoleMember)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	ctx := context.WithValue(withWorkspace(context.Background(), defaultWorkspaceID), userKey, user)
+	scoped := db.WithContext(ctx)
+
+	home := Home{Title: "Misclicked", Lat: -43.53, Lng: 172.58, Notes: "great kitchen"}
+	if err := scoped.Create(&home).Error; err != nil {
+		t.Fatalf("failed to create home: %v", err)
+	}
+	factor := Factor{Title: "Sun"}
+	if err := scoped.Create(&factor).Error; err != nil {
+		t.Fatalf("failed to create factor: %v", err)
+	}
+	if err := SaveHomeFactorRating(scoped, HomeFactorRating{HomeID: home.ID, FactorID: factor.ID, Stars: 4, Rater: "sam"}); err != nil {
+		t.Fatalf("SaveHomeFactorRating() error = %v", err)
+	}
+	if err := scoped.Model(&home).Update("notes", "great kitchen, small yard").Error; err != nil {
+		t.Fatalf("failed to update home: %v", err)
+	}
+	if err := scoped.Delete(&Home{ID: home.ID}).Error; err != nil {
+		t.Fatalf("failed to delete home: %v", err)
+	}
+
+	if _, err := GetHome(scoped, home.ID); err == nil {
+		t.Errorf("GetHome() of a deleted home error = nil, want it hidden")
+	}
+	trash, err := GetTrash(scoped)
+	if err != nil {
+		t.Fatalf("GetTrash() error = %v", err)
+	}
+	if len(trash) != 1 || trash[0].Kind != "home" || trash[0].Title != "Misclicked" || trash[0].DeletedBy != "sam" {
+		t.Errorf("GetTrash() = %+v, want the home deleted by sam", trash)
+	}
+
+	entries, err := GetAuditLog(scoped, "home", home.ID, auditPageSize)
+	if err != nil {
+		t.Fatalf("GetAuditLog() error = %v", err)
+	}
+	wantActions := []string{AuditDelete, AuditUpdate, AuditCreate}
+	if len(entries) != len(wantActions) {
+		t.Fatalf("GetAuditLog() = %+v, want %v", entries, wantActions)
+	}
+	for i, entry := range entries {
+		if entry.Action != wantActions[i] || entry.Username != "sam" || entry.WorkspaceID != defaultWorkspaceID {
+			t.Errorf("entry %d = %s by %q in %d, want %s by sam in the default workspace", i, entry.Action, entry.Username, entry.WorkspaceID, wantActions[i])
+		}
+	}
+	update := entries[1]
+	if !contains(update.Before, `"Notes":"great kitchen"`) || !contains(update.After, "small yard") {
+		t.Errorf("update before %s after %s, want the notes change", update.Before, update.After)
+	}
+	if len(entries[0].After) > 0 || len(entries[2].Before) > 0 {
+		t.Errorf("delete after = %q, create before = %q, want both empty", entries[0].After, entries[2].Before)
+	}
+
+	tests := []struct {
+		name    string
+		kind    string
+		id      uint
+		wantErr string
+	}{
+		{name: "Unknown kind", kind: "theme", id: 1, wantErr: "Unknown kind"},
+		{name: "Not deleted", kind: "factor", id: factor.ID, wantErr: "not in the trash"},
+		{name: "Missing", kind: "home", id: 99, wantErr: "not in the trash"},
+		{name: "Restore", kind: "home", id: home.ID},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := RestoreTrash(scoped, tt.kind, tt.id)
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Errorf("RestoreTrash() error = %v", err)
+			}
+			if len(tt.wantErr) > 0 && (err == nil || !contains(err.Error(), tt.wantErr)) {
+				t.Errorf("RestoreTrash() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	restored, err := GetHome(scoped, home.ID)
+	if err != nil || restored.Notes != "great kitchen, small yard" {
+		t.Errorf("GetHome() after restore = %+v, %v, want the home with its notes", restored, err)
+	}
+	if ratings := GetHomeRatings(scoped, home.ID, "sam"); len(ratings) != 1 || len(ratings[0].Ratings) != 1 {
+		t.Errorf("GetHomeRatings() after restore = %+v, want the rating kept", ratings)
+	}
+	if entries, _ := GetAuditLog(scoped, "home", home.ID, 1); len(entries) != 1 || entries[0].Action != AuditRestore {
+		t.Errorf("latest audit entry = %+v, want a restore", entries)
+	}
+}
+
+func TestTrashHandler(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBInit(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	scoped := db.WithContext(withWorkspace(context.Background(), defaultWorkspaceID))
+	scoped.Create(&Shape{ShapeTitle: "Flood zone", ShapeType: "area", ShapeKind: ShapeKindNoGo, ShapeData: "[[1,1],[1,2],[2,2]]"})
+	scoped.Create(&Factor{Title: "Sun"})
+	DeleteAll(scoped)
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(withWorkspace(r.Context(), defaultWorkspaceID)))
+		})
+	})
+	r.Get("/trash", trashHandler(db, EnvConfig{}))
+	r.Post("/trash/{kind:[a-z]+}/{id:[0-9]+}/restore", trashHandler(db, EnvConfig{}))
+	r.Post("/trash/{kind:[a-z]+}/{id:[0-9]+}/purge", trashHandler(db, EnvConfig{}))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   string
+	}{
+		{name: "Trash lists delete-all", method: "GET", path: "/trash", want: "Flood zone"},
+		{name: "Restore a shape", method: "POST", path: "/trash/shape/1/restore", want: "Restored shape 1"},
+		{name: "Restore twice", method: "POST", path: "/trash/shape/1/restore", want: "not in the trash"},
+		{name: "Purge a factor", method: "POST", path: "/trash/factor/1/purge", want: "Deleted factor 1 for good"},
+		{name: "Purged can't be restored", method: "POST", path: "/trash/factor/1/restore", want: "not in the trash"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: %s %s body missing %q", tt.name, tt.method, tt.path, tt.want)
+		}
+	}
+
+	if shapes := GetShapes(scoped); len(shapes) != 1 {
+		t.Errorf("GetShapes() after restore = %d shapes, want 1", len(shapes))
+	}
+	if factors := GetFactors(scoped); len(factors) != 0 {
+		t.Errorf("GetFactors() = %d factors, want the factor purged", len(factors))
+	}
+}
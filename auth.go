@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	RoleMember = "member"
+	RoleAdmin  = "admin"
+
+	sessionCookie     = "session"
+	sessionDuration   = 30 * 24 * time.Hour
+	minPasswordLength = 8
+	maxUsernameLength = 40
+
+	userKey contextKey = "User"
+)
+
+var ErrInvalidLogin = errors.New("Wrong username or password")
+
+func validRole(role string) bool {
+	return role == RoleMember || role == RoleAdmin
+}
+
+// CreateUser adds a user with a bcrypt hash of their password
+func CreateUser(db *gorm.DB, username string, password string, role string) (*User, error) {
+	username = strings.TrimSpace(username)
+	if len(username) == 0 || len(username) > maxUsernameLength {
+		return nil, fmt.Errorf("Username must be 1 to %d characters", maxUsernameLength)
+	}
+	if len(password) < minPasswordLength {
+		return nil, fmt.Errorf("Password must be at least %d characters", minPasswordLength)
+	}
+	if !validRole(role) {
+		return nil, fmt.Errorf("Unknown role %q", role)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	user := User{Username: username, PasswordHash: string(hash), Role: role}
+	if err := db.Create(&user).Error; err != nil {
+		return nil, fmt.Errorf("failed to create user %s: %w", username, err)
+	}
+	return &user, nil
+}
+
+func GetUsers(db *gorm.DB) ([]User, error) {
+	var users []User
+	if err := db.Order("username").Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+	return users, nil
+}
+
+// Authenticate checks a username and password, both being wrong look the same to the caller
+func Authenticate(db *gorm.DB, username string, password string) (*User, error) {
+	var user User
+	if err := db.Where("username = ?", strings.TrimSpace(username)).First(&user).Error; err != nil {
+		return nil, ErrInvalidLogin
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidLogin
+	}
+	return &user, nil
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession logs the user in, the returned token goes in the session cookie
+func CreateSession(db *gorm.DB, userID uint) (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to create session token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+
+	// a login is a good time to clear out old sessions
+	db.Where("expires_at < ?", time.Now()).Delete(&Session{})
+
+	session := Session{TokenHash: hashSessionToken(token), UserID: userID, ExpiresAt: time.Now().Add(sessionDuration)}
+	if err := db.Create(&session).Error; err != nil {
+		return "", fmt.Errorf("failed to save session: %w", err)
+	}
+	return token, nil
+}
+
+// GetSessionUser is the user logged in with the token, an error for unknown or expired sessions
+func GetSessionUser(db *gorm.DB, token string) (*User, error) {
+	var session Session
+	err := db.Where("token_hash = ? AND expires_at > ?", hashSessionToken(token), time.Now()).First(&session).Error
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err := db.First(&user, session.UserID).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func DeleteSession(db *gorm.DB, token string) error {
+	return db.Where("token_hash = ?", hashSessionToken(token)).Delete(&Session{}).Error
+}
+
+// InitAdminUser creates the admin from AUTH_ADMIN_USERNAME and AUTH_ADMIN_PASSWORD when they don't exist yet
+func InitAdminUser(db *gorm.DB, config EnvConfig) error {
+	if len(config.AdminUsername) == 0 {
+		var count int64
+		db.Model(&User{}).Count(&count)
+		if count == 0 {
+			log.Printf("AUTH_ADMIN_USERNAME not set and there are no users, nobody can log in to make changes")
+		}
+		return nil
+	}
+
+	var existing User
+	if err := db.Where("username = ?", config.AdminUsername).First(&existing).Error; err == nil {
+		return nil
+	}
+	user, err := CreateUser(db, config.AdminUsername, config.AdminPassword, RoleAdmin)
+	if err != nil {
+		return err
+	}
+	return AddWorkspaceMember(db, defaultWorkspaceID, user.ID)
+}
+
+func userFromContext(ctx context.Context) *User {
+	user, _ := ctx.Value(userKey).(*User)
+	return user
+}
+
+// sessionToken is the session cookie, or for the API an `Authorization: Bearer` token from /api/v1/login
+func sessionToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// loadUser puts the logged in user, if any, in the request context
+func loadUser(db *gorm.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token := sessionToken(r); len(token) > 0 {
+				if user, err := GetSessionUser(db, token); err == nil {
+					r = r.WithContext(context.WithValue(r.Context(), userKey, user))
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// safeMethod is true for requests that only read
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// denyLogin sends the browser to the login page, htmx requests are redirected with HX-Redirect
+// and API requests get a JSON 401
+func denyLogin(w http.ResponseWriter, r *http.Request) {
+	if isAPIRequest(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, "Log in with POST "+apiPrefix+"/login and send the token as a bearer token")
+		return
+	}
+	next := r.URL.RequestURI()
+	if !safeMethod(r.Method) {
+		// after logging in, go back to the page the change was made from
+		next = "/"
+		if referer, err := url.Parse(r.Referer()); err == nil && len(r.Referer()) > 0 {
+			next = referer.RequestURI()
+		}
+	}
+	loginURL := "/login?next=" + url.QueryEscape(next)
+
+	if len(r.Header.Get("HX-Request")) > 0 {
+		w.Header().Set("HX-Redirect", loginURL)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if safeMethod(r.Method) {
+		http.Redirect(w, r, loginURL, http.StatusSeeOther)
+		return
+	}
+	http.Error(w, "Log in to make changes", http.StatusUnauthorized)
+}
+
+// requireUserToChange lets anyone look around, but only logged in users can change anything.
+// Invite links can create an account so they are let through too.
+func requireUserToChange(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if safeMethod(r.Method) || r.URL.Path == "/login" || r.URL.Path == apiPrefix+"/login" || strings.HasPrefix(r.URL.Path, "/invite/") || userFromContext(r.Context()) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		denyLogin(w, r)
+	})
+}
+
+// requireUser is for GET routes that change things or spend money
+func requireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userFromContext(r.Context()) == nil {
+			denyLogin(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := userFromContext(r.Context())
+			if user == nil {
+				denyLogin(w, r)
+				return
+			}
+			if user.Role != role {
+				msg := fmt.Sprintf("Only %s users can do that", role)
+				if isAPIRequest(r) {
+					writeAPIError(w, http.StatusForbidden, msg)
+					return
+				}
+				http.Error(w, msg, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// safeRedirect only allows paths on this site, so ?next= can't send people elsewhere
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func setSessionCookie(w http.ResponseWriter, envConfig EnvConfig, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(envConfig.BaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func loginHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			loginPage := loginPage(safeRedirect(r.URL.Query().Get("next")), "")
+			loginPage.Render(GetContext(r), w)
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				warning := warning("loginHandler - Unable to parse form data")
+				warning.Render(GetContext(r), w)
+				return
+			}
+			next := safeRedirect(r.PostForm.Get("next"))
+
+			user, err := Authenticate(db, r.PostForm.Get("username"), r.PostForm.Get("password"))
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				loginPage := loginPage(next, err.Error())
+				loginPage.Render(GetContext(r), w)
+				return
+			}
+
+			token, err := CreateSession(db, user.ID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				loginPage := loginPage(next, err.Error())
+				loginPage.Render(GetContext(r), w)
+				return
+			}
+			setSessionCookie(w, envConfig, token, int(sessionDuration.Seconds()))
+			http.Redirect(w, r, next, http.StatusSeeOther)
+		default:
+			warning := warning("Method not allowed")
+			warning.Render(GetContext(r), w)
+		}
+	}
+}
+
+func logoutHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			if err := DeleteSession(db, cookie.Value); err != nil {
+				log.Printf("failed to delete session: %v", err)
+			}
+		}
+		setSessionCookie(w, envConfig, "", -1)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+// usersHandler lists users and lets an admin add more, new users join the admin's current workspace
+func usersHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		msg, errMsg := "", ""
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				errMsg = "usersHandler - Unable to parse form data"
+				break
+			}
+			user, err := CreateUser(db, r.PostForm.Get("username"), r.PostForm.Get("password"), r.PostForm.Get("role"))
+			if err != nil {
+				errMsg = err.Error()
+				break
+			}
+			msg = fmt.Sprintf("Added %s", user.Username)
+			if workspace := currentWorkspace(r.Context()); workspace != nil {
+				if err := AddWorkspaceMember(db, workspace.ID, user.ID); err != nil {
+					errMsg = err.Error()
+					break
+				}
+				msg = fmt.Sprintf("Added %s to %s", user.Username, workspace.Name)
+			}
+		default:
+			warning := warning("Method not allowed")
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		users, err := GetUsers(db)
+		if err != nil {
+			errMsg = err.Error()
+		}
+		userList := userList(users, msg, errMsg)
+		userList.Render(GetContext(r), w)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestCreateUserAndAuthenticate(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBInit(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	if _, err := CreateUser(db, "sam", "correct horse", RoleMember); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		role     string
+		wantErr  string
+	}{
+		{name: "Short password", username: "alex", password: "short", role: RoleMember, wantErr: "at least 8"},
+		{name: "Unknown role", username: "alex", password: "long enough", role: "owner", wantErr: "Unknown role"},
+		{name: "Blank username", username: "  ", password: "long enough", role: RoleMember, wantErr: "Username must be"},
+		{name: "Taken username", username: "sam", password: "long enough", role: RoleMember, wantErr: "failed to create user"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CreateUser(db, tt.username, tt.password, tt.role)
+			if err == nil || !contains(err.Error(), tt.wantErr) {
+				t.Errorf("CreateUser() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	var saved User
+	db.Where("username = ?", "sam").First(&saved)
+	if saved.PasswordHash == "correct horse" || len(saved.PasswordHash) == 0 {
+		t.Errorf("CreateUser() saved password hash %q, want a bcrypt hash", saved.PasswordHash)
+	}
+
+	if _, err := Authenticate(db, "sam", "wrong horse"); err != ErrInvalidLogin {
+		t.Errorf("Authenticate() wrong password error = %v, want ErrInvalidLogin", err)
+	}
+	if _, err := Authenticate(db, "nobody", "correct horse"); err != ErrInvalidLogin {
+		t.Errorf("Authenticate() unknown user error = %v, want ErrInvalidLogin", err)
+	}
+	user, err := Authenticate(db, "sam", "correct horse")
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+
+	token, err := CreateSession(db, user.ID)
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+	if sessionUser, err := GetSessionUser(db, token); err != nil || sessionUser.Username != "sam" {
+		t.Errorf("GetSessionUser() = %+v, %v, want sam", sessionUser, err)
+	}
+	if err := DeleteSession(db, token); err != nil {
+		t.Fatalf("DeleteSession() error = %v", err)
+	}
+	if _, err := GetSessionUser(db, token); err == nil {
+		t.Errorf("GetSessionUser() after logout error = nil, want the session gone")
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:", AdminUsername: "admin", AdminPassword: "admin password"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+	if err := InitAdminUser(db, config); err != nil {
+		t.Fatalf("InitAdminUser() error = %v", err)
+	}
+	if _, err := CreateUser(db, "sam", "member password", RoleMember); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(loadUser(db))
+	r.Use(requireUserToChange)
+	r.Get("/login", loginHandler(db, config))
+	r.Post("/login", loginHandler(db, config))
+	r.Get("/factors", factorHandler(db))
+	r.Post("/factors", factorHandler(db))
+	r.With(requireRole(RoleAdmin)).Post("/delete-all", deleteHandler(db))
+
+	login := func(username string, password string) *http.Cookie {
+		form := url.Values{"username": {username}, "password": {password}, "next": {"/factors"}}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Name == sessionCookie {
+				if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/factors" {
+					t.Errorf("POST /login = %d to %q, want a redirect to next", rec.Code, rec.Header().Get("Location"))
+				}
+				return cookie
+			}
+		}
+		return nil
+	}
+
+	if cookie := login("sam", "wrong password"); cookie != nil {
+		t.Fatalf("POST /login with a wrong password set a session cookie")
+	}
+	member := login("sam", "member password")
+	admin := login("admin", "admin password")
+	if member == nil || admin == nil {
+		t.Fatalf("POST /login didn't set session cookies, member %v admin %v", member, admin)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		cookie     *http.Cookie
+		htmx       bool
+		wantStatus int
+		wantHeader string
+	}{
+		{name: "Anyone can look", method: "GET", path: "/factors", wantStatus: http.StatusOK},
+		{name: "Changes need a login", method: "POST", path: "/factors", body: "title=Sun", wantStatus: http.StatusUnauthorized},
+		{name: "htmx changes are sent to the login page", method: "POST", path: "/factors", body: "title=Sun", htmx: true, wantStatus: http.StatusUnauthorized, wantHeader: "/login?next="},
+		{name: "Members can change things", method: "POST", path: "/factors", body: "title=Sun", cookie: member, wantStatus: http.StatusOK},
+		{name: "Members can't delete everything", method: "POST", path: "/delete-all", body: "confirm=delete+everything", cookie: member, wantStatus: http.StatusForbidden},
+		{name: "Admins have to confirm", method: "POST", path: "/delete-all", cookie: admin, wantStatus: http.StatusOK},
+		{name: "Admins can delete everything", method: "POST", path: "/delete-all", body: "confirm=delete+everything", cookie: admin, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			if tt.htmx {
+				req.Header.Set("HX-Request", "true")
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("%s %s status = %d, want %d", tt.method, tt.path, rec.Code, tt.wantStatus)
+			}
+			if len(tt.wantHeader) > 0 && !contains(rec.Header().Get("HX-Redirect"), tt.wantHeader) {
+				t.Errorf("%s %s HX-Redirect = %q, want %q", tt.method, tt.path, rec.Header().Get("HX-Redirect"), tt.wantHeader)
+			}
+		})
+	}
+
+	var factors int64
+	db.Model(&Factor{}).Count(&factors)
+	if factors != 0 {
+		t.Errorf("factors after delete-all = %d, want 0", factors)
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		next string
+		want string
+	}{
+		{next: "/compare?ids=1,2", want: "/compare?ids=1,2"},
+		{next: "", want: "/"},
+		{next: "https://example.com", want: "/"},
+		{next: "//example.com", want: "/"},
+		{next: "/\\example.com", want: "/"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.next, func(t *testing.T) {
+			t.Parallel()
+			if got := safeRedirect(tt.next); got != tt.want {
+				t.Errorf("safeRedirect(%q) = %q, want %q", tt.next, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	backupFormat       = 1
+	backupManifestFile = "manifest.json"
+	backupTablesDir    = "tables/"
+	backupImagesDir    = "images/"
+	maxBackupBytes     = 1 << 30
+	// a zip can decompress to far more than its size, these stop a crafted one filling memory while it's checked
+	maxBackupEntryBytes        = 256 << 20
+	maxBackupUncompressedBytes = 2 << 30
+)
+
+var errBackupDryRun = errors.New("dry run")
+
+// BackupManifest describes a backup archive. Next to it are tables/<table>.json, each an array of rows
+// keyed by column, and images/<file> with the image overlays' files.
+type BackupManifest struct {
+	Format        int            `json:"format"`
+	CreatedAt     time.Time      `json:"created_at"`
+	SchemaVersion int            `json:"schema_version"` // the last migration applied to the database it came from
+	WorkspaceID   uint           `json:"workspace_id"`   // 0 when it has every workspace
+	Tables        map[string]int `json:"tables"`         // rows in each table
+	Images        []string       `json:"images"`
+}
+
+// backupTable is a table in a backup. Refs are its columns holding the ID of a row in another table, they are
+// remapped to the IDs the rows get when they're restored. workspace_id is remapped for every table that has it.
+type backupTable struct {
+	Model  interface{}
+	Refs   map[string]string
+	Match  string // rows with the same value in this column are merged into the existing row instead of added
+	Shared bool   // not in a workspace, only in backups of every workspace
+}
+
+// backupTables are every table but sessions, which are logins to the database they came from. They are restored
+// in this order so a row comes after the rows it points to, other than a chat type's version which is set after.
+var backupTables = []backupTable{
+	{Model: &Workspace{}},
+	{Model: &User{}, Match: "username", Shared: true},
+	{Model: &WorkspaceMember{}, Refs: map[string]string{"user_id": "users"}, Shared: true},
+	{Model: &WorkspaceInvite{}, Refs: map[string]string{"created_by_id": "users"}, Match: "token_hash", Shared: true},
+	{Model: &ShapeType{}, Match: "name"},
+	{Model: &ShapeKind{}, Match: "name"},
+	{Model: &Theme{}},
+	{Model: &Factor{}},
+	{Model: &Home{}},
+	{Model: &ChatType{}, Refs: map[string]string{"theme_id": "themes", "version_id": "chat_type_versions"}},
+	{Model: &ChatTypeVersion{}, Refs: map[string]string{"chat_type_id": "chat_types", "theme_id": "themes"}},
+	{Model: &ScoreWeight{}, Refs: map[string]string{"theme_id": "themes", "factor_id": "factors", "chat_type_id": "chat_types"}},
+	{Model: &HomeFactorRating{}, Refs: map[string]string{"factor_id": "factors", "home_id": "homes"}},
+	{Model: &Shape{}},
+	{Model: &ImageOverlay{}},
+	{Model: &FractalSearch{}, Refs: map[string]string{"theme_id": "themes"}},
+	{Model: &FractalSearchResultGroup{}, Refs: map[string]string{"fractal_search_id": "fractal_searches"}},
+	{Model: &Point{}, Refs: map[string]string{"theme_id": "themes", "fractal_search_id": "fractal_searches", "fractal_search_result_group_id": "fractal_search_result_groups"}},
+	{Model: &Message{}, Refs: map[string]string{"fractal_search_id": "fractal_searches"}},
+	{Model: &Chat{}, Refs: map[string]string{"theme_id": "themes", "home_id": "homes", "chat_type": "chat_types", "chat_type_version_id": "chat_type_versions"}},
+	{Model: &ChatResult{}, Refs: map[string]string{"chat_id": "chats"}},
+	{Model: &Citation{}, Refs: map[string]string{"chat_id": "chats", "chat_result_id": "chat_results", "fractal_search_id": "fractal_searches"}},
+	{Model: &RelatedQuestion{}, Refs: map[string]string{"chat_id": "chats", "chat_result_id": "chat_results", "fractal_search_id": "fractal_searches"}},
+	{Model: &Job{}, Refs: map[string]string{"theme_id": "themes", "home_id": "homes", "chat_type_id": "chat_types", "chat_type_version_id": "chat_type_versions", "chat_id": "chats"}},
+	{Model: &LLMUsage{}, Refs: map[string]string{"theme_id": "themes", "home_id": "homes", "chat_type_id": "chat_types", "chat_id": "chats", "chat_result_id": "chat_results", "fractal_search_id": "fractal_searches"}},
+	// record_id is remapped by kind, see auditRecordTable
+	{Model: &AuditLog{}, Refs: map[string]string{"user_id": "users"}},
+}
+
+// BackupRestore is what a restore added, or would add on a dry run
+type BackupRestore struct {
+	Manifest BackupManifest
+	Tables   []BackupTableCount
+	Images   int
+	Renamed  int // images saved under a new name as a different file had theirs
+	Detached int // IDs of rows that weren't in the backup or weren't restored, they are cleared
+}
+
+// BackupTableCount is how many rows of a table were restored
+type BackupTableCount struct {
+	Name    string
+	Added   int
+	Matched int // merged into an existing row, e.g. a user with the same username
+}
+
+// RestoreOptions says where a backup goes. WorkspaceID merges every workspace in it into that workspace, without
+// its users, members and invites. Otherwise each workspace in it is added as a new one, with its members.
+type RestoreOptions struct {
+	WorkspaceID uint
+	DryRun      bool
+}
+
+// backupArchive is a backup that has been read and checked, with its rows as model structs
+type backupArchive struct {
+	manifest BackupManifest
+	rows     map[string]reflect.Value
+	images   map[string]*zip.File
+	unread   int64 // how much more can be decompressed, out of maxBackupUncompressedBytes
+}
+
+func backupSchema(db *gorm.DB, model interface{}) (*schema.Schema, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return nil, err
+	}
+	return stmt.Schema, nil
+}
+
+func latestMigration() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Backup writes a zip of every row and image, or only those of one workspace when workspaceID isn't 0.
+// Rows in the trash are included.
+func Backup(db *gorm.DB, imageDir string, workspaceID uint, w io.Writer) (*BackupManifest, error) {
+	// unscoped by workspace, the filter is added here so shared tables can be included
+	db = db.WithContext(context.Background())
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{Format: backupFormat, CreatedAt: time.Now().UTC(), WorkspaceID: workspaceID, Tables: make(map[string]int), Images: make([]string, 0)}
+	for version := range applied {
+		if version > manifest.SchemaVersion {
+			manifest.SchemaVersion = version
+		}
+	}
+
+	archive := zip.NewWriter(w)
+	for _, table := range backupTables {
+		if table.Shared && workspaceID != 0 {
+			continue
+		}
+		s, err := backupSchema(db, table.Model)
+		if err != nil {
+			return nil, err
+		}
+		rows := reflect.New(reflect.SliceOf(s.ModelType))
+		query := db.Unscoped()
+		if workspaceID != 0 {
+			if s.Table == "workspaces" {
+				query = query.Where("id = ?", workspaceID)
+			} else if _, ok := s.FieldsByDBName["workspace_id"]; ok {
+				query = query.Where("workspace_id = ?", workspaceID)
+			}
+		}
+		if s.PrioritizedPrimaryField != nil {
+			query = query.Order(s.PrioritizedPrimaryField.DBName)
+		}
+		if err := query.Find(rows.Interface()).Error; err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", s.Table, err)
+		}
+
+		columns := make([]map[string]interface{}, 0, rows.Elem().Len())
+		for i := 0; i < rows.Elem().Len(); i++ {
+			row := rows.Elem().Index(i)
+			values := make(map[string]interface{})
+			for _, field := range s.Fields {
+				if len(field.DBName) > 0 {
+					values[field.DBName] = row.FieldByIndex(field.StructField.Index).Interface()
+				}
+			}
+			columns = append(columns, values)
+		}
+		data, err := json.Marshal(columns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", s.Table, err)
+		}
+		if err := writeBackupFile(archive, backupTablesDir+s.Table+".json", data); err != nil {
+			return nil, err
+		}
+		manifest.Tables[s.Table] = len(columns)
+	}
+
+	images, err := backupImages(db, imageDir, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range images {
+		data, err := os.ReadFile(filepath.Join(imageDir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image %s: %w", name, err)
+		}
+		if err := writeBackupFile(archive, backupImagesDir+name, data); err != nil {
+			return nil, err
+		}
+		manifest.Images = append(manifest.Images, name)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeBackupFile(archive, backupManifestFile, data); err != nil {
+		return nil, err
+	}
+	return manifest, archive.Close()
+}
+
+func writeBackupFile(archive *zip.Writer, name string, data []byte) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to add %s to the backup: %w", name, err)
+	}
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s to the backup: %w", name, err)
+	}
+	return nil
+}
+
+// backupImages are every file in imageDir, or those of the workspace's overlays
+func backupImages(db *gorm.DB, imageDir string, workspaceID uint) ([]string, error) {
+	names := make([]string, 0)
+	if workspaceID == 0 {
+		entries, err := os.ReadDir(imageDir)
+		if errors.Is(err, os.ErrNotExist) {
+			return names, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list images: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				names = append(names, entry.Name())
+			}
+		}
+		return names, nil
+	}
+
+	var overlays []ImageOverlay
+	if err := db.Unscoped().Where("workspace_id = ?", workspaceID).Order("id").Find(&overlays).Error; err != nil {
+		return nil, fmt.Errorf("failed to get image overlays: %w", err)
+	}
+	for _, overlay := range overlays {
+		name := overlay.FileName + ".png"
+		if _, err := os.Stat(filepath.Join(imageDir, name)); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// readBackup checks a backup can be restored here and decodes its rows, before anything is changed
+func readBackup(db *gorm.DB, archive *zip.Reader) (*backupArchive, error) {
+	files := make(map[string]*zip.File)
+	var size uint64
+	for _, file := range archive.File {
+		if file.UncompressedSize64 > maxBackupEntryBytes {
+			return nil, fmt.Errorf("%s in the backup is over %d MB", file.Name, maxBackupEntryBytes>>20)
+		}
+		size += file.UncompressedSize64
+		if size > maxBackupUncompressedBytes {
+			return nil, fmt.Errorf("The backup is over %d MB uncompressed", maxBackupUncompressedBytes>>20)
+		}
+		files[file.Name] = file
+	}
+	manifestFile, ok := files[backupManifestFile]
+	if !ok {
+		return nil, errors.New("Not a backup, it has no manifest.json")
+	}
+	backup := &backupArchive{rows: make(map[string]reflect.Value), images: make(map[string]*zip.File), unread: maxBackupUncompressedBytes}
+	if err := backup.readJSON(manifestFile, &backup.manifest); err != nil {
+		return nil, err
+	}
+	if backup.manifest.Format != backupFormat {
+		return nil, fmt.Errorf("Unknown backup format %d", backup.manifest.Format)
+	}
+	if backup.manifest.SchemaVersion > latestMigration() {
+		return nil, fmt.Errorf("The backup is from a newer version (migration %d), upgrade before restoring it", backup.manifest.SchemaVersion)
+	}
+
+	schemas := make(map[string]*schema.Schema)
+	for _, table := range backupTables {
+		s, err := backupSchema(db, table.Model)
+		if err != nil {
+			return nil, err
+		}
+		schemas[s.Table] = s
+	}
+	for name := range backup.manifest.Tables {
+		if _, ok := schemas[name]; !ok {
+			return nil, fmt.Errorf("Unknown table %s in the backup", name)
+		}
+	}
+	for name, file := range files {
+		switch {
+		case name == backupManifestFile:
+		case strings.HasPrefix(name, backupTablesDir):
+			table := strings.TrimSuffix(strings.TrimPrefix(name, backupTablesDir), ".json")
+			if _, ok := backup.manifest.Tables[table]; !ok {
+				return nil, fmt.Errorf("%s isn't in the backup's manifest", name)
+			}
+		case strings.HasPrefix(name, backupImagesDir):
+			image := strings.TrimPrefix(name, backupImagesDir)
+			if image != path.Base(image) || strings.HasPrefix(image, ".") {
+				return nil, fmt.Errorf("Invalid image name %s in the backup", name)
+			}
+			backup.images[image] = file
+		default:
+			return nil, fmt.Errorf("Unexpected file %s in the backup", name)
+		}
+	}
+	for _, image := range backup.manifest.Images {
+		if _, ok := backup.images[image]; !ok {
+			return nil, fmt.Errorf("The backup is missing image %s", image)
+		}
+	}
+
+	for name, count := range backup.manifest.Tables {
+		s := schemas[name]
+		file, ok := files[backupTablesDir+name+".json"]
+		if !ok {
+			return nil, fmt.Errorf("The backup is missing %s", name)
+		}
+		var columns []map[string]json.RawMessage
+		if err := backup.readJSON(file, &columns); err != nil {
+			return nil, err
+		}
+		if len(columns) != count {
+			return nil, fmt.Errorf("%s has %d rows, the manifest says %d", name, len(columns), count)
+		}
+		rows := reflect.MakeSlice(reflect.SliceOf(s.ModelType), len(columns), len(columns))
+		for i, values := range columns {
+			for column, raw := range values {
+				field, ok := s.FieldsByDBName[column]
+				if !ok {
+					return nil, fmt.Errorf("Unknown column %s.%s in the backup", name, column)
+				}
+				value := reflect.New(field.StructField.Type)
+				if err := json.Unmarshal(raw, value.Interface()); err != nil {
+					return nil, fmt.Errorf("Invalid %s.%s in row %d of the backup: %w", name, column, i+1, err)
+				}
+				rows.Index(i).FieldByIndex(field.StructField.Index).Set(value.Elem())
+			}
+		}
+		backup.rows[name] = rows
+	}
+	return backup, nil
+}
+
+// read decompresses a file in the backup, no more than its sizes say it can be in case the zip lies about them
+func (backup *backupArchive) read(file *zip.File) ([]byte, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s in the backup: %w", file.Name, err)
+	}
+	defer reader.Close()
+	limit := min(int64(maxBackupEntryBytes), backup.unread)
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s in the backup: %w", file.Name, err)
+	}
+	if int64(len(data)) > limit && limit < maxBackupEntryBytes {
+		return nil, fmt.Errorf("The backup is over %d MB uncompressed", maxBackupUncompressedBytes>>20)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s in the backup is over %d MB", file.Name, maxBackupEntryBytes>>20)
+	}
+	backup.unread -= int64(len(data))
+	return data, nil
+}
+
+func (backup *backupArchive) readJSON(file *zip.File, v interface{}) error {
+	data, err := backup.read(file)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Invalid %s in the backup: %w", file.Name, err)
+	}
+	return nil
+}
+
+// auditRecordTable is the table of the row an audit log entry is about
+func auditRecordTable(kind string) string {
+	for table, auditKind := range auditedKinds {
+		if auditKind == kind {
+			return table
+		}
+	}
+	return ""
+}
+
+// Restore adds everything in a backup to the database with new IDs, in one transaction. Users, shape types and
+// kinds and invites that already exist are reused. Images are copied into imageDir, one with the name of a
+// different file already there is saved under a new name.
+func Restore(db *gorm.DB, imageDir string, archive *zip.Reader, options RestoreOptions) (*BackupRestore, error) {
+	db = db.WithContext(context.Background())
+	backup, err := readBackup(db, archive)
+	if err != nil {
+		return nil, err
+	}
+	if backup.manifest.WorkspaceID != 0 && options.WorkspaceID == 0 {
+		return nil, errors.New("The backup is of one workspace, choose the workspace to restore it into")
+	}
+	if options.WorkspaceID != 0 {
+		if err := db.First(&Workspace{}, options.WorkspaceID).Error; err != nil {
+			return nil, fmt.Errorf("Workspace %d not found", options.WorkspaceID)
+		}
+	}
+
+	restore := &BackupRestore{Manifest: backup.manifest}
+	fileNames, written, err := restoreImages(backup, imageDir, options.DryRun, restore)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := restoreRows(tx, backup, options, fileNames, restore); err != nil {
+			return err
+		}
+		if options.DryRun {
+			return errBackupDryRun
+		}
+		return nil
+	})
+	if errors.Is(err, errBackupDryRun) {
+		err = nil
+	}
+	if err != nil {
+		for _, file := range written {
+			os.Remove(file)
+		}
+		return nil, err
+	}
+	return restore, nil
+}
+
+// restoreImages copies the backup's images into imageDir, returning the overlay file names that had to change
+// and the files it wrote
+func restoreImages(backup *backupArchive, imageDir string, dryRun bool, restore *BackupRestore) (map[string]string, []string, error) {
+	fileNames := make(map[string]string)
+	written := make([]string, 0)
+	names := make([]string, 0, len(backup.images))
+	for name := range backup.images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 && !dryRun {
+		if err := os.MkdirAll(imageDir, os.ModePerm); err != nil {
+			return nil, written, fmt.Errorf("unable to create directory: %w", err)
+		}
+	}
+
+	for _, name := range names {
+		file := backup.images[name]
+		data, err := backup.read(file)
+		if err != nil {
+			return nil, written, err
+		}
+
+		ext := filepath.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+		target := name
+		for i := 2; ; i++ {
+			existing, err := os.ReadFile(filepath.Join(imageDir, target))
+			if errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			if err != nil {
+				return nil, written, fmt.Errorf("failed to read image %s: %w", target, err)
+			}
+			if bytes.Equal(existing, data) {
+				break
+			}
+			target = fmt.Sprintf("%s-%d%s", stem, i, ext)
+		}
+		if target != name {
+			fileNames[stem] = strings.TrimSuffix(target, ext)
+			restore.Renamed++
+		}
+		restore.Images++
+
+		path := filepath.Join(imageDir, target)
+		if _, err := os.Stat(path); dryRun || err == nil {
+			continue
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return nil, written, fmt.Errorf("unable to save image: %w", err)
+		}
+		written = append(written, path)
+	}
+	return fileNames, written, nil
+}
+
+// deferredRef is a reference to a row of a table restored later, it is set once that table is restored
+type deferredRef struct {
+	model  interface{}
+	id     uint
+	column string
+	table  string
+	old    uint
+}
+
+func restoreRows(tx *gorm.DB, backup *backupArchive, options RestoreOptions, fileNames map[string]string, restore *BackupRestore) error {
+	ids := make(map[string]map[uint]uint)
+	restored := make(map[string]bool)
+	remap := func(table string, old uint) uint {
+		if old == 0 {
+			return 0
+		}
+		if id, ok := ids[table][old]; ok {
+			return id
+		}
+		restore.Detached++
+		return 0
+	}
+	deferred := make([]deferredRef, 0)
+
+	for _, table := range backupTables {
+		s, err := backupSchema(tx, table.Model)
+		if err != nil {
+			return err
+		}
+		rows, ok := backup.rows[s.Table]
+		if !ok {
+			continue
+		}
+		ids[s.Table] = make(map[uint]uint)
+		count := BackupTableCount{Name: s.Table}
+		merging := options.WorkspaceID != 0 && (table.Shared || s.Table == "workspaces")
+		if merging && s.Table == "workspaces" {
+			// everything from every workspace in the backup goes into the one chosen
+			for i := 0; i < rows.Len(); i++ {
+				ids[s.Table][rowID(s, rows.Index(i))] = options.WorkspaceID
+			}
+			restored[s.Table] = true
+			continue
+		}
+
+		for i := 0; i < rows.Len(); i++ {
+			row := rows.Index(i)
+			old := rowID(s, row)
+			for column, refTable := range table.Refs {
+				field := s.FieldsByDBName[column]
+				value := row.FieldByIndex(field.StructField.Index)
+				if restored[refTable] {
+					value.SetUint(uint64(remap(refTable, uint(value.Uint()))))
+				}
+			}
+			if field, ok := s.FieldsByDBName["workspace_id"]; ok {
+				row.FieldByIndex(field.StructField.Index).SetUint(uint64(remap("workspaces", uint(row.FieldByIndex(field.StructField.Index).Uint()))))
+			}
+			switch s.Table {
+			case "audit_logs":
+				entry := row.Addr().Interface().(*AuditLog)
+				if recordTable := auditRecordTable(entry.Kind); len(recordTable) > 0 {
+					entry.RecordID = remap(recordTable, entry.RecordID)
+				}
+			case "image_overlays":
+				overlay := row.Addr().Interface().(*ImageOverlay)
+				if fileName, ok := fileNames[overlay.FileName]; ok {
+					overlay.FileName = fileName
+				}
+			}
+
+			if len(table.Match) > 0 {
+				field := s.FieldsByDBName[table.Match]
+				existing := reflect.New(s.ModelType)
+				res := tx.Where(clause.Eq{Column: clause.Column{Name: table.Match}, Value: row.FieldByIndex(field.StructField.Index).Interface()}).Limit(1).Find(existing.Interface())
+				if res.Error != nil {
+					return fmt.Errorf("failed to match %s: %w", s.Table, res.Error)
+				}
+				if res.RowsAffected > 0 {
+					ids[s.Table][old] = rowID(s, existing.Elem())
+					count.Matched++
+					continue
+				}
+			}
+			// merging into a workspace only reuses the users that are already here
+			if merging {
+				continue
+			}
+
+			if s.PrioritizedPrimaryField != nil {
+				row.FieldByIndex(s.PrioritizedPrimaryField.StructField.Index).SetUint(0)
+			}
+			if err := tx.Set(auditSkipKey, true).Omit(clause.Associations).Create(row.Addr().Interface()).Error; err != nil {
+				return fmt.Errorf("failed to restore %s: %w", s.Table, err)
+			}
+			if s.PrioritizedPrimaryField != nil {
+				ids[s.Table][old] = rowID(s, row)
+			}
+			count.Added++
+
+			for column, refTable := range table.Refs {
+				if !restored[refTable] {
+					value := row.FieldByIndex(s.FieldsByDBName[column].StructField.Index)
+					deferred = append(deferred, deferredRef{model: table.Model, id: rowID(s, row), column: column, table: refTable, old: uint(value.Uint())})
+				}
+			}
+		}
+		restored[s.Table] = true
+		restore.Tables = append(restore.Tables, count)
+	}
+
+	for _, ref := range deferred {
+		if err := tx.Model(ref.model).Where("id = ?", ref.id).UpdateColumn(ref.column, remap(ref.table, ref.old)).Error; err != nil {
+			return fmt.Errorf("failed to set %s: %w", ref.column, err)
+		}
+	}
+	return nil
+}
+
+func rowID(s *schema.Schema, row reflect.Value) uint {
+	if s.PrioritizedPrimaryField == nil {
+		return 0
+	}
+	return uint(row.FieldByIndex(s.PrioritizedPrimaryField.StructField.Index).Uint())
+}
+
+// backupDownloadHandler is GET /backup.zip of the workspace, or of everything with all=on
+func backupDownloadHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workspaceID, _ := workspaceFromContext(r.Context())
+		name := fmt.Sprintf("honing-inn-workspace-%d", workspaceID)
+		if r.URL.Query().Get("all") == "on" {
+			workspaceID = 0
+			name = "honing-inn"
+		}
+
+		// written to a file first so a failure is shown instead of a truncated download
+		file, err := os.CreateTemp("", "backup-*.zip")
+		if err != nil {
+			warning := warning(fmt.Sprintf("Unable to create the backup - %s", err))
+			warning.Render(GetContext(r), w)
+			return
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+		if _, err := Backup(db, envConfig.ImageDir, workspaceID, file); err != nil {
+			warning := warning(fmt.Sprintf("Unable to create the backup - %s", err))
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.zip"`, name, time.Now().Format("20060102")))
+		http.ServeContent(w, r, "", time.Time{}, file)
+	}
+}
+
+// backupHandler shows the backup page, POST restores an uploaded backup into the workspace
+func backupHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			backupPage := backupPage(nil, true, "", "")
+			backupPage.Render(GetContext(r), w)
+		case http.MethodPost:
+			r.Body = http.MaxBytesReader(w, r.Body, maxBackupBytes)
+			if err := r.ParseMultipartForm(32 << 20); err != nil {
+				warning := warning(fmt.Sprintf("Unable to read the upload - %s", err))
+				warning.Render(GetContext(r), w)
+				return
+			}
+			dryRun := r.FormValue("dryRun") == "on"
+			file, header, err := r.FormFile("file")
+			if err != nil {
+				backupPage := backupPage(nil, dryRun, "", "Choose a backup zip")
+				backupPage.Render(GetContext(r), w)
+				return
+			}
+			defer file.Close()
+			archive, err := zip.NewReader(file, header.Size)
+			if err != nil {
+				backupPage := backupPage(nil, dryRun, "", fmt.Sprintf("Not a zip - %s", err))
+				backupPage.Render(GetContext(r), w)
+				return
+			}
+
+			workspaceID, _ := workspaceFromContext(r.Context())
+			restore, err := Restore(db, envConfig.ImageDir, archive, RestoreOptions{WorkspaceID: workspaceID, DryRun: dryRun})
+			if err != nil {
+				backupPage := backupPage(nil, dryRun, "", err.Error())
+				backupPage.Render(GetContext(r), w)
+				return
+			}
+			msg := ""
+			if !dryRun {
+				msg = fmt.Sprintf("Restored %s", header.Filename)
+			}
+			backupPage := backupPage(restore, dryRun, msg, "")
+			backupPage.Render(GetContext(r), w)
+		default:
+			warning := warning("Method not allowed")
+			warning.Render(GetContext(r), w)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestBackupTables(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBOpen(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	tables := make(map[string]bool)
+	for _, table := range backupTables {
+		s, err := backupSchema(db, table.Model)
+		if err != nil {
+			t.Fatalf("failed to parse %T: %v", table.Model, err)
+		}
+		tables[s.Table] = true
+		for column := range table.Refs {
+			if field, ok := s.FieldsByDBName[column]; !ok || field.FieldType.Kind() != reflect.Uint {
+				t.Errorf("%s.%s isn't an ID column", s.Table, column)
+			}
+		}
+	}
+	for _, model := range schemaModels {
+		s, err := backupSchema(db, model)
+		if err != nil {
+			t.Fatalf("failed to parse %T: %v", model, err)
+		}
+		if !tables[s.Table] && s.Table != "sessions" {
+			t.Errorf("%s isn't backed up", s.Table)
+		}
+	}
+}
+
+func newBackupTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := DBInit(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+	return db
+}
+
+// seedBackupTestDB adds a home with a rating and a chat, a search with a point, an overlay and a shape in the trash
+func seedBackupTestDB(t *testing.T, db *gorm.DB, imageDir string) {
+	t.Helper()
+	scoped := db.WithContext(withWorkspace(context.Background(), defaultWorkspaceID))
+	user, err := CreateUser(db, "sam", "a long password", RoleMember)
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	db.Create(&WorkspaceMember{WorkspaceID: defaultWorkspaceID, UserID: user.ID})
+	factor := Factor{Title: "Garden"}
+	home := Home{Title: "5 Elm Street", Lat: -43.5, Lng: 172.6}
+	chatType := ChatType{Name: "Schools", Prompt: "Which schools?", ThemeID: 1}
+	search := FractalSearch{ThemeID: 1, Query: "cafes"}
+	for _, row := range []interface{}{&factor, &home, &chatType, &search} {
+		if err := scoped.Create(row).Error; err != nil {
+			t.Fatalf("failed to create %T: %v", row, err)
+		}
+	}
+	if err := saveChatTypeVersion(scoped, &chatType); err != nil {
+		t.Fatalf("failed to save chat type version: %v", err)
+	}
+	scoped.Model(&chatType).Update("version_id", chatType.VersionID)
+
+	chat := Chat{ThemeID: 1, HomeID: home.ID, ChatType: chatType.ID, ChatTypeVersionID: chatType.VersionID, Pros: []string{"Close to a school"}}
+	shape := Shape{ShapeTitle: "Flooding", ShapeType: ShapeTypeArea, ShapeKind: ShapeKindNoGo, ShapeData: "[[-43.5,172.6],[-43.6,172.6],[-43.6,172.7]]"}
+	for _, row := range []interface{}{
+		&HomeFactorRating{FactorID: factor.ID, HomeID: home.ID, Stars: 4},
+		&chat,
+		&Point{Title: "Cafe", Lat: -43.5, Lng: 172.6, ThemeID: 1, FractalSearchID: search.ID},
+		&ImageOverlay{Name: "Zoning", FileName: "zoning"},
+		&shape,
+	} {
+		if err := scoped.Create(row).Error; err != nil {
+			t.Fatalf("failed to create %T: %v", row, err)
+		}
+	}
+	scoped.Create(&ChatResult{ChatID: chat.ID, Result: "Two schools", Role: "assistant"})
+	scoped.Delete(&shape)
+	if err := os.WriteFile(filepath.Join(imageDir, "zoning.png"), []byte("zoning image"), 0644); err != nil {
+		t.Fatalf("failed to write image: %v", err)
+	}
+}
+
+func backupZip(t *testing.T, db *gorm.DB, imageDir string, workspaceID uint) *zip.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := Backup(db, imageDir, workspaceID, &buf); err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("failed to read backup: %v", err)
+	}
+	return archive
+}
+
+func TestBackupRestore(t *testing.T) {
+	t.Parallel()
+
+	source := newBackupTestDB(t)
+	sourceImages := t.TempDir()
+	seedBackupTestDB(t, source, sourceImages)
+	archive := backupZip(t, source, sourceImages, 0)
+
+	target := newBackupTestDB(t)
+	targetImages := t.TempDir()
+	// rows already here take the IDs the backup's rows had, and a different image has the overlay's file name
+	scoped := target.WithContext(withWorkspace(context.Background(), defaultWorkspaceID))
+	scoped.Create(&Home{Title: "Already here"})
+	scoped.Create(&Factor{Title: "Already here"})
+	CreateUser(target, "someone", "a long password", RoleAdmin)
+	sam, _ := CreateUser(target, "sam", "another password", RoleAdmin)
+	os.WriteFile(filepath.Join(targetImages, "zoning.png"), []byte("another image"), 0644)
+
+	dryRun, err := Restore(target, targetImages, archive, RestoreOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Restore() dry run error = %v", err)
+	}
+	var workspaces int64
+	target.Model(&Workspace{}).Count(&workspaces)
+	if workspaces != 1 || dryRun.Images != 1 {
+		t.Errorf("dry run left %d workspaces and counted %d images, want it unchanged and 1 image", workspaces, dryRun.Images)
+	}
+
+	restore, err := Restore(target, targetImages, archive, RestoreOptions{})
+	if err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if restore.Renamed != 1 || restore.Detached != 0 {
+		t.Errorf("restore = %+v, want the image renamed and nothing detached", restore)
+	}
+
+	var workspace Workspace
+	target.Order("id desc").First(&workspace)
+	if workspace.ID == defaultWorkspaceID {
+		t.Fatalf("no workspace was added")
+	}
+	restored := target.WithContext(withWorkspace(context.Background(), workspace.ID))
+
+	var home Home
+	var factor Factor
+	var rating HomeFactorRating
+	var chatType ChatType
+	var chat Chat
+	var result ChatResult
+	var search FractalSearch
+	var point Point
+	var overlay ImageOverlay
+	for _, row := range []interface{}{&home, &factor, &rating, &chatType, &chat, &result, &search, &point, &overlay} {
+		if err := restored.First(row).Error; err != nil {
+			t.Fatalf("%T wasn't restored: %v", row, err)
+		}
+	}
+	if home.Title != "5 Elm Street" || rating.HomeID != home.ID || rating.FactorID != factor.ID || rating.Stars != 4 {
+		t.Errorf("rating = %+v, want it on the restored home %d and factor %d", rating, home.ID, factor.ID)
+	}
+	var version ChatTypeVersion
+	restored.First(&version, chatType.VersionID)
+	if version.ChatTypeID != chatType.ID || chat.ChatType != chatType.ID || chat.ChatTypeVersionID != version.ID || chat.HomeID != home.ID {
+		t.Errorf("chat = %+v and version = %+v, want them on the restored chat type %d", chat, version, chatType.ID)
+	}
+	if result.ChatID != chat.ID || !reflect.DeepEqual(chat.Pros, []string{"Close to a school"}) {
+		t.Errorf("result = %+v and pros = %q, want the chat's", result, chat.Pros)
+	}
+	if point.FractalSearchID != search.ID || point.ThemeID != search.ThemeID || search.ThemeID == 1 {
+		t.Errorf("point = %+v and search = %+v, want them on the restored theme", point, search)
+	}
+	if data, err := os.ReadFile(filepath.Join(targetImages, overlay.FileName+".png")); err != nil || string(data) != "zoning image" || overlay.FileName == "zoning" {
+		t.Errorf("overlay file %s = %q, %v, want the backup's image under a new name", overlay.FileName, data, err)
+	}
+	var trashed Shape
+	if err := restored.Unscoped().First(&trashed).Error; err != nil || !trashed.DeletedAt.Valid {
+		t.Errorf("shape = %+v, %v, want it restored into the trash", trashed, err)
+	}
+
+	var users int64
+	target.Model(&User{}).Count(&users)
+	var members []WorkspaceMember
+	target.Where("workspace_id = ?", workspace.ID).Find(&members)
+	if users != 2 || len(members) != 1 || members[0].UserID != sam.ID {
+		t.Errorf("%d users and members %+v, want sam merged into the existing sam %d", users, members, sam.ID)
+	}
+	var audits int64
+	restored.Model(&AuditLog{}).Where("kind = ? AND record_id = ?", "home", home.ID).Count(&audits)
+	if audits != 1 {
+		t.Errorf("%d audit log entries for the home, want its create from the backup only", audits)
+	}
+}
+
+func TestRestoreIntoWorkspace(t *testing.T) {
+	t.Parallel()
+
+	source := newBackupTestDB(t)
+	sourceImages := t.TempDir()
+	seedBackupTestDB(t, source, sourceImages)
+	archive := backupZip(t, source, sourceImages, defaultWorkspaceID)
+
+	target := newBackupTestDB(t)
+	targetImages := t.TempDir()
+	if _, err := Restore(target, targetImages, archive, RestoreOptions{}); err == nil || !strings.Contains(err.Error(), "choose the workspace") {
+		t.Errorf("Restore() of a workspace without one error = %v", err)
+	}
+	restore, err := Restore(target, targetImages, archive, RestoreOptions{WorkspaceID: defaultWorkspaceID})
+	if err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+
+	scoped := target.WithContext(withWorkspace(context.Background(), defaultWorkspaceID))
+	var themes, homes, workspaces, users int64
+	scoped.Model(&Theme{}).Count(&themes)
+	scoped.Model(&Home{}).Count(&homes)
+	target.Model(&Workspace{}).Count(&workspaces)
+	target.Model(&User{}).Count(&users)
+	if themes != 2 || homes != 1 || workspaces != 1 || users != 0 {
+		t.Errorf("%d themes, %d homes, %d workspaces and %d users, want the backup's theme and home added to the workspace", themes, homes, workspaces, users)
+	}
+	if data, err := os.ReadFile(filepath.Join(targetImages, "zoning.png")); err != nil || string(data) != "zoning image" || restore.Renamed != 0 {
+		t.Errorf("image = %q, %v, want it copied as it is", data, err)
+	}
+}
+
+func TestRestoreInvalidBackup(t *testing.T) {
+	t.Parallel()
+
+	db := newBackupTestDB(t)
+	build := func(manifest BackupManifest, files map[string]string) *zip.Reader {
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		if manifest.Format != 0 {
+			data, _ := json.Marshal(manifest)
+			files[backupManifestFile] = string(data)
+		}
+		for name, data := range files {
+			file, _ := archive.Create(name)
+			file.Write([]byte(data))
+		}
+		archive.Close()
+		reader, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		return reader
+	}
+
+	tests := []struct {
+		name     string
+		manifest BackupManifest
+		files    map[string]string
+		wantErr  string
+	}{
+		{name: "No manifest", files: map[string]string{"data.db": ""}, wantErr: "no manifest.json"},
+		{name: "Newer version", manifest: BackupManifest{Format: backupFormat, SchemaVersion: latestMigration() + 1}, files: map[string]string{}, wantErr: "newer version"},
+		{name: "Unknown format", manifest: BackupManifest{Format: 2}, files: map[string]string{}, wantErr: "Unknown backup format 2"},
+		{name: "Unknown table", manifest: BackupManifest{Format: backupFormat, Tables: map[string]int{"sessions": 0}}, files: map[string]string{"tables/sessions.json": "[]"}, wantErr: "Unknown table sessions"},
+		{name: "Missing rows", manifest: BackupManifest{Format: backupFormat, Tables: map[string]int{"homes": 2}}, files: map[string]string{"tables/homes.json": `[{"id":1}]`}, wantErr: "homes has 1 rows, the manifest says 2"},
+		{name: "Unknown column", manifest: BackupManifest{Format: backupFormat, Tables: map[string]int{"homes": 1}}, files: map[string]string{"tables/homes.json": `[{"id":1,"colour":"red"}]`}, wantErr: "Unknown column homes.colour"},
+		{name: "Wrong type", manifest: BackupManifest{Format: backupFormat, Tables: map[string]int{"homes": 1}}, files: map[string]string{"tables/homes.json": `[{"id":"one"}]`}, wantErr: "Invalid homes.id in row 1"},
+		{name: "Missing image", manifest: BackupManifest{Format: backupFormat, Images: []string{"a.png"}}, files: map[string]string{}, wantErr: "missing image a.png"},
+	}
+	for _, tt := range tests {
+		_, err := Restore(db, t.TempDir(), build(tt.manifest, tt.files), RestoreOptions{WorkspaceID: defaultWorkspaceID})
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: Restore() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// a zip bomb, a small file that says it decompresses to more than a table or image can be
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	file, _ := archive.CreateRaw(&zip.FileHeader{Name: "tables/homes.json", Method: zip.Deflate, CompressedSize64: 2, UncompressedSize64: maxBackupEntryBytes + 1})
+	file.Write([]byte{3, 0})
+	archive.Close()
+	bomb, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("failed to read zip bomb: %v", err)
+	}
+	if _, err := Restore(db, t.TempDir(), bomb, RestoreOptions{WorkspaceID: defaultWorkspaceID}); err == nil || !strings.Contains(err.Error(), "tables/homes.json in the backup is over 256 MB") {
+		t.Errorf("zip bomb: Restore() error = %v, want it rejected by size", err)
+	}
+}
+
+func TestBackupCommands(t *testing.T) {
+	t.Parallel()
+
+	db := newBackupTestDB(t)
+	config := EnvConfig{ImageDir: t.TempDir()}
+	seedBackupTestDB(t, db, config.ImageDir)
+	file := filepath.Join(t.TempDir(), "backup.zip")
+
+	var out bytes.Buffer
+	if err := runCommand(db, config, []string{"backup", file}, &out); err != nil {
+		t.Fatalf("backup error = %v", err)
+	}
+	if !strings.Contains(out.String(), "and 1 images to "+file) {
+		t.Errorf("backup output = %q", out.String())
+	}
+	out.Reset()
+	if err := runCommand(db, config, []string{"restore", "-dry-run", "-workspace", "1", file}, &out); err != nil {
+		t.Fatalf("restore error = %v", err)
+	}
+	if !strings.Contains(out.String(), "would restore 1 homes, 0 already here") || !strings.Contains(out.String(), "would restore 1 images, 0 renamed") {
+		t.Errorf("restore output = %q", out.String())
+	}
+	if err := runCommand(db, config, []string{"restore"}, &out); err == nil {
+		t.Errorf("restore without a file should fail")
+	}
+}
+
+func TestRestoreDryRunEvents(t *testing.T) {
+	t.Parallel()
+
+	source := newBackupTestDB(t)
+	sourceImages := t.TempDir()
+	seedBackupTestDB(t, source, sourceImages)
+	archive := backupZip(t, source, sourceImages, 0)
+
+	target := newBackupTestDB(t)
+	hub := NewEventHub()
+	if err := hub.Register(target); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	events, unsubscribe := hub.Subscribe(defaultWorkspaceID)
+	defer unsubscribe()
+
+	// a dry run adds every row before rolling back, open maps mustn't see them
+	if _, err := Restore(target, t.TempDir(), archive, RestoreOptions{WorkspaceID: defaultWorkspaceID, DryRun: true}); err != nil {
+		t.Fatalf("Restore() dry run error = %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("dry run sent %d events, want none", len(events))
+	}
+
+	if _, err := Restore(target, t.TempDir(), archive, RestoreOptions{WorkspaceID: defaultWorkspaceID}); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if len(events) == 0 {
+		t.Errorf("restore sent no events, want the restored rows")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Ratings and chats belong to a home, and ratings and score weights to a factor. Moving either to the trash keeps
+// them for a restore, purging deletes them in the same transaction. models.go declares the foreign keys too, but
+// SQLite only enforces them with PRAGMA foreign_keys, which stays off as search citations have no chat.
+
+// DeleteHome moves a home to the trash, its ratings and chats stay with it for a restore
+func DeleteHome(db *gorm.DB, id uint) (*Home, error) {
+	home := Home{ID: id}
+	res := db.Delete(&home)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &home, nil
+}
+
+// deleteHomeDependents deletes the homes' ratings, chats and jobs, their LLM usage still counts towards the budget
+func deleteHomeDependents(tx *gorm.DB, ids []uint) error {
+	var chatIDs []uint
+	if err := tx.Model(&Chat{}).Where("home_id IN ?", ids).Pluck("id", &chatIDs).Error; err != nil {
+		return fmt.Errorf("failed to get chats: %w", err)
+	}
+	if err := deleteChats(tx, chatIDs); err != nil {
+		return err
+	}
+	if err := tx.Where("home_id IN ?", ids).Delete(&HomeFactorRating{}).Error; err != nil {
+		return fmt.Errorf("failed to delete ratings: %w", err)
+	}
+	if err := tx.Where("home_id IN ?", ids).Delete(&Job{}).Error; err != nil {
+		return fmt.Errorf("failed to delete jobs: %w", err)
+	}
+	if err := tx.Model(&LLMUsage{}).Where("home_id IN ?", ids).Update("home_id", 0).Error; err != nil {
+		return fmt.Errorf("failed to detach usage: %w", err)
+	}
+	return nil
+}
+
+// deleteChats deletes chats with their results, citations and related questions, and detaches their LLM usage
+func deleteChats(tx *gorm.DB, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	for _, model := range []interface{}{&ChatResult{}, &Citation{}, &RelatedQuestion{}} {
+		if err := tx.Where("chat_id IN ?", ids).Delete(model).Error; err != nil {
+			return fmt.Errorf("failed to delete chat results: %w", err)
+		}
+	}
+	err := tx.Model(&LLMUsage{}).Where("chat_id IN ?", ids).Updates(map[string]interface{}{"chat_id": 0, "chat_result_id": 0}).Error
+	if err != nil {
+		return fmt.Errorf("failed to detach usage: %w", err)
+	}
+	if err := tx.Where("id IN ?", ids).Delete(&Chat{}).Error; err != nil {
+		return fmt.Errorf("failed to delete chats: %w", err)
+	}
+	return nil
+}
+
+// deleteFactorDependents deletes the factors' ratings and score weights
+func deleteFactorDependents(tx *gorm.DB, ids []uint) error {
+	if err := tx.Where("factor_id IN ?", ids).Delete(&HomeFactorRating{}).Error; err != nil {
+		return fmt.Errorf("failed to delete ratings: %w", err)
+	}
+	if err := tx.Where("factor_id IN ?", ids).Delete(&ScoreWeight{}).Error; err != nil {
+		return fmt.Errorf("failed to delete score weights: %w", err)
+	}
+	return nil
+}
+
+// deleteSearchDependents deletes the searches' points, messages and result groups, their LLM usage is kept
+func deleteSearchDependents(tx *gorm.DB, ids []uint) error {
+	for _, id := range ids {
+		if err := DeletePoints(tx, id); err != nil {
+			return fmt.Errorf("failed to delete points: %w", err)
+		}
+		if err := DeleteMessages(tx, id); err != nil {
+			return fmt.Errorf("failed to delete messages: %w", err)
+		}
+	}
+	if err := tx.Where("fractal_search_id IN ?", ids).Delete(&FractalSearchResultGroup{}).Error; err != nil {
+		return fmt.Errorf("failed to delete result groups: %w", err)
+	}
+	if err := tx.Model(&LLMUsage{}).Where("fractal_search_id IN ?", ids).Update("fractal_search_id", 0).Error; err != nil {
+		return fmt.Errorf("failed to detach usage: %w", err)
+	}
+	return nil
+}
+
+// OrphanCount is how many rows one orphanRule found
+type OrphanCount struct {
+	Name  string
+	Count int64
+}
+
+// orphanRule finds rows whose parent is gone, they are deleted unless Detach says which columns to clear instead.
+// Parents in the trash still exist, so the subqueries don't skip deleted rows.
+type orphanRule struct {
+	Name   string
+	Model  interface{}
+	Where  string
+	Detach map[string]interface{}
+}
+
+// orphanRules run in order, so children of the chats the earlier rules delete are found too
+var orphanRules = []orphanRule{
+	{Name: "ratings of missing homes", Model: &HomeFactorRating{}, Where: "home_id NOT IN (SELECT id FROM homes)"},
+	{Name: "ratings of missing factors", Model: &HomeFactorRating{}, Where: "factor_id NOT IN (SELECT id FROM factors)"},
+	{Name: "score weights of missing factors", Model: &ScoreWeight{}, Where: "factor_id <> 0 AND factor_id NOT IN (SELECT id FROM factors)"},
+	{Name: "jobs of missing homes", Model: &Job{}, Where: "home_id NOT IN (SELECT id FROM homes) AND status <> 'running'"},
+	{Name: "chats of missing homes", Model: &Chat{}, Where: "home_id NOT IN (SELECT id FROM homes)"},
+	{Name: "chat results of missing chats", Model: &ChatResult{}, Where: "chat_id NOT IN (SELECT id FROM chats)"},
+	{Name: "citations of missing chats", Model: &Citation{}, Where: "chat_id <> 0 AND chat_id NOT IN (SELECT id FROM chats)"},
+	{Name: "related questions of missing chats", Model: &RelatedQuestion{}, Where: "chat_id <> 0 AND chat_id NOT IN (SELECT id FROM chats)"},
+	{Name: "points of missing searches", Model: &Point{}, Where: "fractal_search_id <> 0 AND fractal_search_id NOT IN (SELECT id FROM fractal_searches)"},
+	{Name: "messages of missing searches", Model: &Message{}, Where: "fractal_search_id NOT IN (SELECT id FROM fractal_searches)"},
+	{Name: "result groups of missing searches", Model: &FractalSearchResultGroup{}, Where: "fractal_search_id NOT IN (SELECT id FROM fractal_searches)"},
+	{Name: "citations of missing searches", Model: &Citation{}, Where: "fractal_search_id <> 0 AND fractal_search_id NOT IN (SELECT id FROM fractal_searches)"},
+	{Name: "related questions of missing searches", Model: &RelatedQuestion{}, Where: "fractal_search_id <> 0 AND fractal_search_id NOT IN (SELECT id FROM fractal_searches)"},
+	{Name: "usage of missing chats", Model: &LLMUsage{}, Where: "chat_id <> 0 AND chat_id NOT IN (SELECT id FROM chats)", Detach: map[string]interface{}{"chat_id": 0, "chat_result_id": 0}},
+	{Name: "usage of missing homes", Model: &LLMUsage{}, Where: "home_id <> 0 AND home_id NOT IN (SELECT id FROM homes)", Detach: map[string]interface{}{"home_id": 0}},
+	{Name: "usage of missing searches", Model: &LLMUsage{}, Where: "fractal_search_id <> 0 AND fractal_search_id NOT IN (SELECT id FROM fractal_searches)", Detach: map[string]interface{}{"fractal_search_id": 0}},
+}
+
+// RepairOrphans deletes or detaches every orphaned row in one transaction. dryRun only counts the rows orphaned now,
+// not the ones the earlier rules would orphan.
+func RepairOrphans(db *gorm.DB, dryRun bool) ([]OrphanCount, error) {
+	counts := make([]OrphanCount, 0, len(orphanRules))
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, rule := range orphanRules {
+			count := OrphanCount{Name: rule.Name}
+			var res *gorm.DB
+			switch {
+			case dryRun:
+				res = tx.Model(rule.Model).Where(rule.Where).Count(&count.Count)
+			case rule.Detach != nil:
+				res = tx.Model(rule.Model).Where(rule.Where).Updates(rule.Detach)
+				count.Count = res.RowsAffected
+			default:
+				res = tx.Where(rule.Where).Delete(rule.Model)
+				count.Count = res.RowsAffected
+			}
+			if res.Error != nil {
+				return fmt.Errorf("failed to repair %s: %w", rule.Name, res.Error)
+			}
+			counts = append(counts, count)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestPurgeTrash(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBInit(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+	scoped := db.WithContext(withWorkspace(context.Background(), defaultWorkspaceID))
+
+	homes := []Home{{Title: "Purged", Lat: 1, Lng: 1}, {Title: "Kept", Lat: 2, Lng: 2}}
+	scoped.Create(&homes)
+	factor := Factor{Title: "Sun"}
+	scoped.Create(&factor)
+	for _, home := range homes {
+		scoped.Create(&HomeFactorRating{HomeID: home.ID, FactorID: factor.ID, Stars: 3})
+		chat := Chat{HomeID: home.ID, Results: []ChatResult{{Role: "assistant", Result: "answer"}}}
+		scoped.Create(&chat)
+		scoped.Create(&Citation{ChatID: chat.ID, Number: 1, URL: "https://example.com"})
+		scoped.Create(&LLMUsage{HomeID: home.ID, ChatID: chat.ID, Cost: 0.5})
+		scoped.Create(&Job{HomeID: home.ID, Status: JobComplete})
+	}
+	SaveScoreWeight(scoped, ScoreWeight{ThemeID: themeId, FactorID: factor.ID, Weight: 2})
+
+	if _, err := DeleteHome(scoped, homes[0].ID); err != nil {
+		t.Fatalf("DeleteHome() error = %v", err)
+	}
+	if _, err := DeleteHome(scoped, 99); err == nil {
+		t.Errorf("DeleteHome() of a missing home error = nil")
+	}
+	if _, err := PurgeTrash(scoped, "home", homes[1].ID); err == nil {
+		t.Errorf("PurgeTrash() of a home that isn't in the trash error = nil")
+	}
+	if _, err := PurgeTrash(scoped, "home", homes[0].ID); err != nil {
+		t.Fatalf("PurgeTrash() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		model interface{}
+		where string
+		want  int64
+	}{
+		{name: "Home is gone", model: &Home{}, where: "1 = 1", want: 1},
+		{name: "Its ratings are gone", model: &HomeFactorRating{}, where: "1 = 1", want: 1},
+		{name: "Its chats are gone", model: &Chat{}, where: "1 = 1", want: 1},
+		{name: "Its chat results are gone", model: &ChatResult{}, where: "1 = 1", want: 1},
+		{name: "Its citations are gone", model: &Citation{}, where: "1 = 1", want: 1},
+		{name: "Its jobs are gone", model: &Job{}, where: "1 = 1", want: 1},
+		{name: "Its usage is kept", model: &LLMUsage{}, where: "1 = 1", want: 2},
+		{name: "Its usage is detached", model: &LLMUsage{}, where: "home_id = 0 AND chat_id = 0", want: 1},
+	}
+	for _, tt := range tests {
+		var count int64
+		db.Unscoped().Model(tt.model).Where(tt.where).Count(&count)
+		if count != tt.want {
+			t.Errorf("%s: %d rows, want %d", tt.name, count, tt.want)
+		}
+	}
+
+	if entries, _ := GetAuditLog(scoped, "home", homes[0].ID, 1); len(entries) != 1 || entries[0].Action != AuditPurge {
+		t.Errorf("latest audit entry = %+v, want a purge", entries)
+	}
+
+	DeleteFactor(scoped, factor.ID)
+	if _, err := PurgeTrash(scoped, "factor", factor.ID); err != nil {
+		t.Fatalf("PurgeTrash() factor error = %v", err)
+	}
+	var ratings, weights int64
+	db.Model(&HomeFactorRating{}).Count(&ratings)
+	db.Model(&ScoreWeight{}).Where("factor_id = ?", factor.ID).Count(&weights)
+	if ratings != 0 || weights != 0 {
+		t.Errorf("after purging the factor %d ratings and %d weights are left, want none", ratings, weights)
+	}
+}
+
+func TestRepairOrphans(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBInit(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	home := Home{Title: "In the trash", Lat: 1, Lng: 1}
+	db.Create(&home)
+	db.Delete(&home)
+	factor := Factor{Title: "Sun"}
+	db.Create(&factor)
+	search := FractalSearch{Query: "schools"}
+	db.Create(&search)
+
+	// what was left behind by hard deletes before cascade.go
+	db.Create(&HomeFactorRating{HomeID: home.ID, FactorID: factor.ID, Stars: 4})
+	db.Create(&HomeFactorRating{HomeID: 41, FactorID: factor.ID, Stars: 2})
+	db.Create(&HomeFactorRating{HomeID: home.ID, FactorID: 42, Stars: 2, Rater: "sam"})
+	orphan := Chat{HomeID: 41, Results: []ChatResult{{Role: "user"}, {Role: "assistant"}}}
+	db.Create(&orphan)
+	db.Create(&Citation{ChatID: orphan.ID, Number: 1})
+	db.Create(&Citation{FractalSearchID: search.ID, Number: 1})
+	db.Create(&Point{Title: "Orphan point", FractalSearchID: 43})
+	db.Create(&Point{Title: "Search point", FractalSearchID: search.ID})
+	db.Create(&LLMUsage{HomeID: 41, ChatID: orphan.ID, Cost: 1})
+
+	var out bytes.Buffer
+	if err := runCommand(db, EnvConfig{}, []string{"repair-orphans", "-dry-run"}, &out); err != nil {
+		t.Fatalf("repair-orphans -dry-run error = %v", err)
+	}
+	if !contains(out.String(), "found 1 ratings of missing homes") || !contains(out.String(), "found 1 chats of missing homes") {
+		t.Errorf("repair-orphans -dry-run output = %q", out.String())
+	}
+	var ratings int64
+	db.Model(&HomeFactorRating{}).Count(&ratings)
+	if ratings != 3 {
+		t.Errorf("dry run left %d ratings, want all 3", ratings)
+	}
+
+	counts, err := RepairOrphans(db, false)
+	if err != nil {
+		t.Fatalf("RepairOrphans() error = %v", err)
+	}
+	got := make(map[string]int64)
+	for _, count := range counts {
+		got[count.Name] = count.Count
+	}
+	tests := []struct {
+		name string
+		want int64
+	}{
+		{name: "ratings of missing homes", want: 1},
+		{name: "ratings of missing factors", want: 1},
+		{name: "chats of missing homes", want: 1},
+		{name: "chat results of missing chats", want: 2},
+		{name: "citations of missing chats", want: 1},
+		{name: "citations of missing searches", want: 0},
+		{name: "points of missing searches", want: 1},
+		{name: "usage of missing chats", want: 1},
+		{name: "usage of missing homes", want: 1},
+	}
+	for _, tt := range tests {
+		if got[tt.name] != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, got[tt.name], tt.want)
+		}
+	}
+
+	// the trashed home's rating, the search's citation and point, and the usage are kept
+	var citations, points, usage int64
+	db.Model(&HomeFactorRating{}).Count(&ratings)
+	db.Model(&Citation{}).Count(&citations)
+	db.Model(&Point{}).Count(&points)
+	db.Model(&LLMUsage{}).Count(&usage)
+	if ratings != 1 || citations != 1 || points != 1 || usage != 1 {
+		t.Errorf("kept %d ratings, %d citations, %d points and %d usage, want 1 of each", ratings, citations, points, usage)
+	}
+
+	counts, _ = RepairOrphans(db, false)
+	for _, count := range counts {
+		if count.Count != 0 {
+			t.Errorf("second repair found %d %s, want none", count.Count, count.Name)
+		}
+	}
+
+	if err := runCommand(db, EnvConfig{}, []string{"repair"}, &out); err == nil {
+		t.Errorf("unknown command error = nil")
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
@@ -33,35 +37,190 @@ type OpenAIResponse struct {
 	} `json:"choices"`
 }
 
-func callAndSavePerplexityAPI(db *gorm.DB, home Home, chatType ChatType, theme Theme) (*Chat, error) {
+func callAndSaveChat(db *gorm.DB, envConfig EnvConfig, home Home, chatType ChatType, theme Theme) (*Chat, error) {
 
-	log.Printf("Calling Perplexity API for home %v and chat type %v", home.ID, chatType.ID)
+	log.Printf("Calling LLM for home %v and chat type %v", home.ID, chatType.ID)
 
-	config := buildPromptConfig(home, chatType, theme)
+	data, err := GetPromptData(db, home, chatType, theme)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := buildPromptConfig(data)
+	if err != nil {
+		return nil, err
+	}
 
 	log.Printf("Using Config %s", config.UserPrompt)
 	log.Printf("Using Config %s", config.StartSystemPrompt)
 	log.Printf("Using Config %v", config.Replacements)
-	response, err := callPerplexityAPI(config)
+	if err := checkLLMBudget(db, envConfig); err != nil {
+		return nil, err
+	}
+	response, err := callLLM(envConfig, config)
 	if err != nil {
 		return nil, err
 	}
 
 	if response.ErrorMessage != "" {
-		return nil, fmt.Errorf("Perplexity API returned error: %v", response.ErrorMessage)
+		return nil, fmt.Errorf("%s returned error: %v", config.Provider, response.ErrorMessage)
 	}
 
 	newChat := buildChat(response, home, chatType)
+	newChat.SystemPrompt = config.Messages[0].Content
+	newChat.Prompt = config.Messages[len(config.Messages)-1].Content
+
+	answerContent := newChat.Results[len(newChat.Results)-1].Result
+	if err := rateChatAnswer(&newChat, chatType, answerContent); err != nil {
+		return nil, fmt.Errorf("%s gave an invalid answer: %v", config.Provider, err)
+	}
 
 	if err := db.Create(&newChat).Error; err != nil {
 		return nil, fmt.Errorf("Failed to save chat %v", err)
 	}
 
+	answer := newChat.Results[len(newChat.Results)-1]
+	newChat.Citations, newChat.RelatedQuestions = buildResponseSources(response, newChat.ID, answer.ID, 0, 0)
+	if err := CreateResponseSources(db, newChat.Citations, newChat.RelatedQuestions); err != nil {
+		return nil, fmt.Errorf("Failed to save chat sources %v", err)
+	}
+
+	usage, err := recordLLMUsage(db, envConfig, response, config, LLMUsage{
+		ThemeID:      newChat.ThemeID,
+		HomeID:       home.ID,
+		ChatTypeID:   chatType.ID,
+		ChatID:       newChat.ID,
+		ChatResultID: answer.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	newChat.Usages = []LLMUsage{*usage}
+
 	return &newChat, nil
 }
 
-func chatHandler(db *gorm.DB) http.HandlerFunc {
+// continueChat asks a follow up question on a saved Chat, storing the question and answer as new ChatResults
+func continueChat(db *gorm.DB, envConfig EnvConfig, c Chat, question string) (*Chat, error) {
+	home, err := GetHome(db, c.HomeID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get home %v", err)
+	}
+
+	// follow ups keep using the version of the chat type that started the chat
+	chatType, err := GetChatTypeForChat(db, c)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get chat type %v", err)
+	}
+
+	theme := GetActiveTheme(db, c.ThemeID)
+	data, err := GetPromptData(db, *home, *chatType, theme)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := buildContinuePromptConfig(data, c, question)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkLLMBudget(db, envConfig); err != nil {
+		return nil, err
+	}
+	response, err := callLLM(envConfig, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.ErrorMessage != "" {
+		return nil, fmt.Errorf("%s returned error: %v", config.Provider, response.ErrorMessage)
+	}
+
+	answer := response.SuccessResults.Choices[len(response.SuccessResults.Choices)-1].Message
+
+	previousRating := c.Rating
+	if err := rateChatAnswer(&c, *chatType, answer.Content); err != nil {
+		return nil, fmt.Errorf("%s gave an invalid answer: %v", config.Provider, err)
+	}
+	// a follow up that doesn't give a rating keeps the one from the earlier answer
+	if c.Rating < 0 {
+		c.Rating = previousRating
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		turns := []ChatResult{
+			{ChatID: c.ID, Role: "user", Result: question},
+			{ChatID: c.ID, Role: answer.Role, Result: answer.Content},
+		}
+		if err := tx.Create(&turns).Error; err != nil {
+			return err
+		}
+		citations, questions := buildResponseSources(response, c.ID, turns[1].ID, 0, 0)
+		if err := CreateResponseSources(tx, citations, questions); err != nil {
+			return err
+		}
+		if _, err := recordLLMUsage(tx, envConfig, response, config, LLMUsage{
+			ThemeID:      c.ThemeID,
+			HomeID:       c.HomeID,
+			ChatTypeID:   c.ChatType,
+			ChatID:       c.ID,
+			ChatResultID: turns[1].ID,
+		}); err != nil {
+			return err
+		}
+		return tx.Model(&c).Select("rating", "summary", "pros", "cons", "confidence").Updates(&c).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to save chat %v", err)
+	}
+
+	return GetChat(db, c.ID)
+}
+
+// resultCitations returns the sources for one answer in the chat
+func resultCitations(c Chat, chatResultID uint) []Citation {
+	citations := make([]Citation, 0)
+	for _, citation := range c.Citations {
+		if citation.ChatResultID == chatResultID {
+			citations = append(citations, citation)
+		}
+	}
+	sort.Slice(citations, func(i, j int) bool { return citations[i].Number < citations[j].Number })
+	return citations
+}
+
+// latestRelatedQuestions returns the follow ups suggested with the most recent answer that had any
+func latestRelatedQuestions(c Chat) []RelatedQuestion {
+	var latest uint
+	for _, question := range c.RelatedQuestions {
+		if question.ChatResultID > latest {
+			latest = question.ChatResultID
+		}
+	}
+
+	questions := make([]RelatedQuestion, 0)
+	for _, question := range c.RelatedQuestions {
+		if question.ChatResultID == latest {
+			questions = append(questions, question)
+		}
+	}
+	return questions
+}
+
+// messageCitations returns the sources for one fractal search message
+func messageCitations(citations []Citation, messageIndex int) []Citation {
+	matched := make([]Citation, 0)
+	for _, citation := range citations {
+		if citation.MessageIndex == messageIndex {
+			matched = append(matched, citation)
+		}
+	}
+	return matched
+}
+
+func chatHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case http.MethodGet:
 			// Extract query from request
@@ -120,8 +279,43 @@ func chatHandler(db *gorm.DB) http.HandlerFunc {
 
 			continueChatID := r.FormValue("ChatID")
 			if len(continueChatID) > 0 {
-				warn := warning("continueChatID not yet implemented")
-				warn.Render(GetContext(r), w)
+				chatIDUint, err := strconv.ParseUint(continueChatID, 10, 32)
+				if err != nil {
+					http.Error(w, "Invalid ChatID", http.StatusBadRequest)
+					return
+				}
+
+				question := strings.TrimSpace(r.FormValue("Question"))
+				if len(question) == 0 {
+					warn := warning("Question is required to continue a chat")
+					warn.Render(GetContext(r), w)
+					return
+				}
+
+				existing, err := GetChat(db, uint(chatIDUint))
+				if err != nil {
+					warn := warning("Failed to get chat")
+					warn.Render(GetContext(r), w)
+					return
+				}
+
+				if existing.Status == "pending" || existing.Status == "streaming" {
+					warn := warning("Chat is still being researched, try again once it has finished")
+					warn.Render(GetContext(r), w)
+					return
+				}
+
+				continued, err := continueChat(db, envConfig, *existing, question)
+				if err != nil {
+					warning := warning(fmt.Sprintf("Failed to continue %s: %v", existing.ChatTypeTitle, err))
+					warning.Render(GetContext(r), w)
+					chatRes := chat(*existing)
+					chatRes.Render(GetContext(r), w)
+					return
+				}
+
+				chatRes := chat(*continued)
+				chatRes.Render(GetContext(r), w)
 				return
 			}
 
@@ -178,23 +372,23 @@ func chatHandler(db *gorm.DB) http.HandlerFunc {
 					return
 				}
 
-				theme := GetActiveTheme(db, uint(themeIDUint))
-
-				newChats := make([]Chat, 0)
-				for _, chatType := range chatTypes {
-
-					newChat, err := callAndSavePerplexityAPI(db, *home, chatType, theme)
-					if err != nil {
-						warning := warning(fmt.Sprintf("Failed to call Perplexity API: %v", err))
-						warning.Render(GetContext(r), w)
-						return
-					}
-
-					newChats = append(newChats, *newChat)
+				// each chat type is researched by the job queue, the progress fragment polls until they finish
+				batchID, _, err := EnqueueChatJobs(db, *home, uint(themeIDUint), chatTypes)
+				if err != nil {
+					warning := warning(fmt.Sprintf("Failed to queue research: %v", err))
+					warning.Render(GetContext(r), w)
+					return
+				}
 
+				progress, err := GetJobProgress(db, batchID)
+				if err != nil {
+					warning := warning(fmt.Sprintf("Failed to get job progress: %v", err))
+					warning.Render(GetContext(r), w)
+					return
 				}
-				ratingListView := chatRatingListView(newChats)
-				ratingListView.Render(GetContext(r), w)
+
+				jobProgress := jobProgress(*progress)
+				jobProgress.Render(GetContext(r), w)
 				return
 			}
 
@@ -210,11 +404,32 @@ func chatHandler(db *gorm.DB) http.HandlerFunc {
 				return
 			}
 
+			if r.FormValue("Stream") == "true" {
+				pendingChat := Chat{
+					HomeID:            home.ID,
+					ChatTypeTitle:     chatType.Name,
+					ChatType:          chatType.ID,
+					ChatTypeVersionID: chatType.VersionID,
+					ThemeID:           chatType.ThemeID,
+					Rating:            -1,
+					Status:            "pending",
+				}
+				if err := db.Create(&pendingChat).Error; err != nil {
+					warning := warning(fmt.Sprintf("Failed to save chat %v", err))
+					warning.Render(GetContext(r), w)
+					return
+				}
+
+				chatStream := chatStream(pendingChat)
+				chatStream.Render(GetContext(r), w)
+				return
+			}
+
 			theme := GetActiveTheme(db, uint(themeIDUint))
 
-			newChat, err := callAndSavePerplexityAPI(db, *home, *chatType, theme)
+			newChat, err := callAndSaveChat(db, envConfig, *home, *chatType, theme)
 			if err != nil {
-				warning := warning(fmt.Sprintf("Failed to call Perplexity API: %v", err))
+				warning := warning(fmt.Sprintf("Failed to research %s: %v", chatType.Name, err))
 				warning.Render(GetContext(r), w)
 				return
 			}
@@ -258,3 +473,187 @@ func chatHandler(db *gorm.DB) http.HandlerFunc {
 	}
 }
 
+// writeSSEEvent writes one server sent event, multi line data is split over several data: lines
+func writeSSEEvent(w http.ResponseWriter, event string, data string) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// writeChatStreamDone sends the final rendered chat, which replaces the streaming placeholder
+func writeChatStreamDone(w http.ResponseWriter, r *http.Request, c Chat, msg string) {
+	var buf bytes.Buffer
+	if len(msg) > 0 {
+		warning(msg).Render(GetContext(r), &buf)
+	}
+	chat(c).Render(GetContext(r), &buf)
+	writeSSEEvent(w, "done", buf.String())
+}
+
+// claimPendingChat marks a pending chat as streaming with its prompts, false when it was no longer pending.
+// Only one of several connections to the same chat wins, so the provider is only called once.
+func claimPendingChat(db *gorm.DB, c *Chat) (bool, error) {
+	claim := db.Model(c).Where("status = ?", "pending").Updates(map[string]interface{}{"status": "streaming", "prompt": c.Prompt, "system_prompt": c.SystemPrompt})
+	if claim.Error != nil {
+		return false, claim.Error
+	}
+	return claim.RowsAffected == 1, nil
+}
+
+// chatStreamHandler runs a pending Chat against its provider and streams the answer as it arrives.
+// The assistant ChatResult is saved as it grows so a dropped connection keeps the partial answer.
+func chatStreamHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		chatIdStr := chi.URLParam(r, "chatId")
+		id, err := strconv.Atoi(chatIdStr)
+		if err != nil {
+			http.Error(w, "Invalid chatId", http.StatusBadRequest)
+			return
+		}
+
+		c, err := GetChat(db, uint(id))
+		if err != nil {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		// EventSource reconnects after the stream closes, only pending chats get run
+		if c.Status != "pending" {
+			writeChatStreamDone(w, r, *c, "")
+			return
+		}
+
+		home, err := GetHome(db, c.HomeID)
+		if err != nil {
+			writeChatStreamDone(w, r, *c, fmt.Sprintf("Failed to get home - %v", err))
+			return
+		}
+
+		chatType, err := GetChatTypeForChat(db, *c)
+		if err != nil {
+			writeChatStreamDone(w, r, *c, fmt.Sprintf("Failed to get chat type - %v", err))
+			return
+		}
+
+		theme := GetActiveTheme(db, c.ThemeID)
+		// anything that stops the call before it starts fails the chat, so a reconnect doesn't retry it
+		failChat := func(err error) {
+			db.Model(c).Where("status = ?", "pending").Update("status", "failed")
+			writeChatStreamDone(w, r, *c, fmt.Sprintf("Failed to research %s: %v", chatType.Name, err))
+		}
+
+		data, err := GetPromptData(db, *home, *chatType, theme)
+		if err != nil {
+			failChat(err)
+			return
+		}
+
+		config, err := buildPromptConfig(data)
+		if err != nil {
+			failChat(err)
+			return
+		}
+
+		if err := checkLLMBudget(db, envConfig); err != nil {
+			failChat(err)
+			return
+		}
+
+		c.SystemPrompt = config.Messages[0].Content
+		c.Prompt = config.Messages[len(config.Messages)-1].Content
+		claimed, err := claimPendingChat(db, c)
+		if err != nil {
+			writeChatStreamDone(w, r, *c, fmt.Sprintf("Failed to update chat - %v", err))
+			return
+		}
+		if !claimed {
+			// another connection, e.g. a second tab, got to it first and is running it
+			if latest, err := GetChat(db, c.ID); err == nil {
+				c = latest
+			}
+			writeChatStreamDone(w, r, *c, "")
+			return
+		}
+
+		result := ChatResult{ChatID: c.ID, Role: "assistant"}
+		if err := db.Create(&result).Error; err != nil {
+			writeChatStreamDone(w, r, *c, fmt.Sprintf("Failed to save chat result - %v", err))
+			return
+		}
+
+		var content strings.Builder
+		lastSave := time.Now()
+		response, err := streamLLM(envConfig, config, func(delta string) error {
+			content.WriteString(delta)
+			writeSSEEvent(w, "delta", html.EscapeString(delta))
+
+			if time.Since(lastSave) > time.Second {
+				lastSave = time.Now()
+				if err := db.Model(&result).Update("result", content.String()).Error; err != nil {
+					return err
+				}
+			}
+			// stop calling the provider once the browser has gone away
+			return r.Context().Err()
+		})
+
+		status := "complete"
+		msg := ""
+		if err != nil {
+			log.Printf("chatStreamHandler chat %d failed: %v", c.ID, err)
+			status = "failed"
+			msg = fmt.Sprintf("Failed to research %s: %v", chatType.Name, err)
+		} else {
+			final := response.SuccessResults.Choices[len(response.SuccessResults.Choices)-1].Message
+			content.Reset()
+			content.WriteString(final.Content)
+			result.Role = final.Role
+
+			citations, questions := buildResponseSources(response, c.ID, result.ID, 0, 0)
+			if err := CreateResponseSources(db, citations, questions); err != nil {
+				log.Printf("chatStreamHandler failed to save sources for chat %d: %v", c.ID, err)
+			}
+			if _, err := recordLLMUsage(db, envConfig, response, config, LLMUsage{
+				ThemeID:      c.ThemeID,
+				HomeID:       c.HomeID,
+				ChatTypeID:   c.ChatType,
+				ChatID:       c.ID,
+				ChatResultID: result.ID,
+			}); err != nil {
+				log.Printf("chatStreamHandler failed to save usage for chat %d: %v", c.ID, err)
+			}
+		}
+
+		result.Result = content.String()
+		if err := db.Save(&result).Error; err != nil {
+			log.Printf("chatStreamHandler failed to save result %d: %v", result.ID, err)
+		}
+
+		if err := rateChatAnswer(c, *chatType, result.Result); err != nil && status == "complete" {
+			status = "failed"
+			msg = fmt.Sprintf("%s gave an invalid answer for %s: %v", config.Provider, chatType.Name, err)
+		}
+
+		c.Status = status
+		if err := db.Model(c).Select("status", "rating", "summary", "pros", "cons", "confidence").Updates(c).Error; err != nil {
+			log.Printf("chatStreamHandler failed to finalise chat %d: %v", c.ID, err)
+		}
+
+		c, err = GetChat(db, c.ID)
+		if err != nil {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		writeChatStreamDone(w, r, *c, msg)
+	}
+}
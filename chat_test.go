@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestChatHandler(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewLLMFixtureServer("testdata/llm", LLMFixtureReplay, nil)
+	if err != nil {
+		t.Fatalf("failed to start llm fixture server: %v", err)
+	}
+	t.Cleanup(server.Close)
+
+	config := EnvConfig{
+		DBUrl:              ":memory:",
+		PerplexityAPIURL:   server.URL + "/" + ProviderPerplexity,
+		PerplexityAPIToken: "test-token",
+	}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	db.Model(&Theme{}).Where("id = ?", 1).Update("start_system_prompt", "You are a home research assistant researching {topic}. Finish with a line like Rating: 2")
+
+	home := Home{Lat: -43.53, Lng: 172.58, CleanAddress: "7 Middleton Road, Riccarton", CleanSuburb: "Riccarton"}
+	db.Create(&home)
+
+	recorded := ChatType{Name: "Traffic", Prompt: "How much traffic noise is there around {address} in {suburb}?", ThemeID: 1}
+	db.Create(&recorded)
+
+	unrecorded := ChatType{Name: "Schools", Prompt: "Which schools are zoned for {address}?", ThemeID: 1}
+	db.Create(&unrecorded)
+
+	tests := []struct {
+		name          string
+		chatType      ChatType
+		wantBody      string
+		wantChats     int
+		wantRating    int
+		wantCitations int
+		wantQuestions int
+	}{
+		{
+			name:          "Recorded response is saved as a chat",
+			chatType:      recorded,
+			wantBody:      "https://www.ccc.govt.nz/transport/traffic-counts",
+			wantChats:     1,
+			wantRating:    2,
+			wantCitations: 2,
+			wantQuestions: 2,
+		},
+		{
+			name:      "Missing recording renders a warning",
+			chatType:  unrecorded,
+			wantBody:  "no recorded response for prompt",
+			wantChats: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{
+				"HomeID":     {"1"},
+				"ThemeID":    {"1"},
+				"chatTypeID": {fmt.Sprintf("%d", tt.chatType.ID)},
+			}
+			req := httptest.NewRequest("POST", "/chat", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+
+			chatHandler(db, config)(rec, req)
+
+			if !contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("chatHandler() body = %q, want it to contain %q", rec.Body.String(), tt.wantBody)
+			}
+
+			chats, err := GetChats(db, 1, home.ID, tt.chatType.ID)
+			if err != nil {
+				t.Fatalf("GetChats() error = %v", err)
+			}
+			if len(chats) != tt.wantChats {
+				t.Fatalf("GetChats() got = %d chats, want %d", len(chats), tt.wantChats)
+			}
+			if tt.wantChats > 0 && chats[0].Rating != tt.wantRating {
+				t.Errorf("chat rating = %d, want %d", chats[0].Rating, tt.wantRating)
+			}
+			if tt.wantChats > 0 && (len(chats[0].Citations) != tt.wantCitations || len(chats[0].RelatedQuestions) != tt.wantQuestions) {
+				t.Errorf("chat sources = %d citations %d questions, want %d and %d", len(chats[0].Citations), len(chats[0].RelatedQuestions), tt.wantCitations, tt.wantQuestions)
+			}
+			if tt.wantChats > 0 && chats[0].Citations[0].ChatResultID != chats[0].Results[0].ID {
+				t.Errorf("citation chat result = %d, want %d", chats[0].Citations[0].ChatResultID, chats[0].Results[0].ID)
+			}
+		})
+	}
+}
+
+func TestChatStreamHandler(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewLLMFixtureServer("testdata/llm", LLMFixtureReplay, nil)
+	if err != nil {
+		t.Fatalf("failed to start llm fixture server: %v", err)
+	}
+	t.Cleanup(server.Close)
+
+	config := EnvConfig{
+		DBUrl:              ":memory:",
+		PerplexityAPIURL:   server.URL + "/" + ProviderPerplexity,
+		PerplexityAPIToken: "test-token",
+	}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	db.Model(&Theme{}).Where("id = ?", 1).Update("start_system_prompt", "You are a home research assistant researching {topic}. Finish with a line like Rating: 2")
+
+	home := Home{Lat: -43.53, Lng: 172.58, CleanAddress: "7 Middleton Road, Riccarton", CleanSuburb: "Riccarton"}
+	db.Create(&home)
+
+	chatType := ChatType{Name: "Traffic", Prompt: "How much traffic noise is there around {address} in {suburb}?", ThemeID: 1}
+	db.Create(&chatType)
+
+	r := chi.NewRouter()
+	r.Post("/chat", chatHandler(db, config))
+	r.Get("/chat/{chatId:[0-9]+}/stream", chatStreamHandler(db, config))
+
+	form := url.Values{
+		"HomeID":     {fmt.Sprintf("%d", home.ID)},
+		"ThemeID":    {"1"},
+		"chatTypeID": {fmt.Sprintf("%d", chatType.ID)},
+		"Stream":     {"true"},
+	}
+	req := httptest.NewRequest("POST", "/chat", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	chats, err := GetChats(db, 1, home.ID, chatType.ID)
+	if err != nil || len(chats) != 1 {
+		t.Fatalf("GetChats() = %d chats, err %v, want 1 pending chat", len(chats), err)
+	}
+	if chats[0].Status != "pending" {
+		t.Fatalf("chat status = %q, want pending", chats[0].Status)
+	}
+	streamURL := fmt.Sprintf("/chat/%d/stream", chats[0].ID)
+	if !contains(rec.Body.String(), streamURL) {
+		t.Errorf("POST /chat body = %q, want sse-connect to %s", rec.Body.String(), streamURL)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", streamURL, nil))
+
+	body := rec.Body.String()
+	if !contains(body, "event: delta") || !contains(body, "event: done") {
+		t.Errorf("stream body = %q, want delta and done events", body)
+	}
+
+	streamed, err := GetChat(db, chats[0].ID)
+	if err != nil {
+		t.Fatalf("GetChat() error = %v", err)
+	}
+	if streamed.Status != "complete" || streamed.Rating != 2 {
+		t.Errorf("chat status = %q rating = %d, want complete 2", streamed.Status, streamed.Rating)
+	}
+	if len(streamed.Results) != 1 || !contains(streamed.Results[0].Result, "Blenheim Road") {
+		t.Errorf("chat results = %+v, want the full streamed answer", streamed.Results)
+	}
+	if len(streamed.Citations) != 2 || len(streamed.RelatedQuestions) != 2 {
+		t.Errorf("chat sources = %d citations %d questions, want 2 of each from the stream", len(streamed.Citations), len(streamed.RelatedQuestions))
+	}
+
+	// a reconnecting EventSource gets the finished chat without another call
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", streamURL, nil))
+	if contains(rec.Body.String(), "event: delta") || !contains(rec.Body.String(), "event: done") {
+		t.Errorf("second stream body = %q, want only done", rec.Body.String())
+	}
+
+	// two connections that both saw the chat pending, only the first runs it
+	pending := Chat{ThemeID: 1, HomeID: home.ID, ChatType: chatType.ID, Status: "pending"}
+	db.Create(&pending)
+	for i, want := range []bool{true, false} {
+		claimed, err := claimPendingChat(db, &Chat{ID: pending.ID, Prompt: "Traffic?"})
+		if err != nil || claimed != want {
+			t.Errorf("claimPendingChat() %d = %v, %v, want %v", i, claimed, err, want)
+		}
+	}
+}
+
+func TestChatHandlerContinue(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	home := Home{Lat: -43.53, Lng: 172.58, CleanAddress: "7 Middleton Road, Riccarton", CleanSuburb: "Riccarton"}
+	db.Create(&home)
+
+	chatType := ChatType{Name: "Flooding", Prompt: "Does {address} flood?", ThemeID: 1, LLMProvider: ProviderFake}
+	db.Create(&chatType)
+
+	first, err := callAndSaveChat(db, config, home, chatType, GetActiveTheme(db, 1))
+	if err != nil {
+		t.Fatalf("callAndSaveChat() error = %v", err)
+	}
+	if first.Prompt != "Does 7 Middleton Road, Riccarton flood?" {
+		t.Errorf("callAndSaveChat() prompt = %q, want the rendered chat type prompt", first.Prompt)
+	}
+
+	tests := []struct {
+		name        string
+		chatID      string
+		question    string
+		wantBody    string
+		wantResults int
+	}{
+		{
+			name:        "Missing question renders a warning",
+			chatID:      fmt.Sprintf("%d", first.ID),
+			question:    " ",
+			wantBody:    "Question is required",
+			wantResults: 1,
+		},
+		{
+			name:        "Follow up adds user and assistant turns",
+			chatID:      fmt.Sprintf("%d", first.ID),
+			question:    "What about flooding in 2022?",
+			wantBody:    "What about flooding in 2022?",
+			wantResults: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{
+				"ChatID":   {tt.chatID},
+				"Question": {tt.question},
+			}
+			req := httptest.NewRequest("POST", "/chat", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			chatHandler(db, config).ServeHTTP(rec, req)
+
+			if !contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("POST /chat body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+
+			continued, err := GetChat(db, first.ID)
+			if err != nil {
+				t.Fatalf("GetChat() error = %v", err)
+			}
+			if len(continued.Results) != tt.wantResults {
+				t.Fatalf("GetChat() = %d results, want %d", len(continued.Results), tt.wantResults)
+			}
+
+			last := continued.Results[len(continued.Results)-1]
+			if tt.wantResults > 1 {
+				if continued.Results[1].Role != "user" || continued.Results[1].Result != tt.question || last.Role != "assistant" {
+					t.Errorf("GetChat() results = %+v, want user then assistant turns", continued.Results)
+				}
+				if !contains(last.Result, tt.question) {
+					t.Errorf("follow up answer = %q, want it to answer %q", last.Result, tt.question)
+				}
+			}
+			if continued.Rating != extractRating(last.Result) {
+				t.Errorf("GetChat() rating = %d, want %d from the latest answer", continued.Rating, extractRating(last.Result))
+			}
+		})
+	}
+}
+
+func TestChatCitations(t *testing.T) {
+	t.Parallel()
+
+	var buf strings.Builder
+	citations := []Citation{{Number: 1, URL: "https://example.com/schools"}, {Number: 2, URL: "javascript:alert(1)"}}
+	if err := chatCitations(citations).Render(context.Background(), &buf); err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	if !strings.Contains(buf.String(), `href="https://example.com/schools"`) || strings.Contains(buf.String(), `href="javascript:`) {
+		t.Errorf("citations = %s, want the https link kept and the javascript one sanitized", buf.String())
+	}
+}
+
+func TestChatHandlerResearchAll(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	home := Home{Lat: -43.53, Lng: 172.58, CleanAddress: "7 Middleton Road, Riccarton", CleanSuburb: "Riccarton"}
+	db.Create(&home)
+	other := Theme{Name: "Schools"}
+	db.Create(&other)
+	traffic := ChatType{Name: "Traffic", Prompt: "How much traffic is there around {address}?", ThemeID: 1}
+	db.Create(&traffic)
+	db.Create(&ChatType{Name: "Zoning", Prompt: "Which schools are zoned for {address}?", ThemeID: other.ID})
+
+	form := url.Values{"HomeID": {fmt.Sprint(home.ID)}, "ThemeID": {"1"}, "All": {"true"}}
+	req := httptest.NewRequest("POST", "/chat", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	chatHandler(db, config)(rec, req)
+
+	// only the current theme's chat types are researched, each is a paid call
+	var jobs []Job
+	db.Find(&jobs)
+	if len(jobs) != 1 || jobs[0].ChatTypeID != traffic.ID || jobs[0].ThemeID != 1 {
+		t.Errorf("jobs = %+v, want only %s queued for theme 1", jobs, traffic.Name)
+	}
+}
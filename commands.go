@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// runCommand runs a maintenance command against the database instead of starting the server,
+// e.g. `honing-inn repair-orphans -dry-run` or `honing-inn migrate status`
+func runCommand(db *gorm.DB, envConfig EnvConfig, args []string, out io.Writer) error {
+	switch args[0] {
+	case "backup":
+		return runBackup(db, envConfig, args, out)
+	case "restore":
+		return runRestore(db, envConfig, args, out)
+	case "migrate":
+		return runMigrate(db, args[1:], out)
+	case "repair-orphans":
+		flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+		flags.SetOutput(out)
+		dryRun := flags.Bool("dry-run", false, "count the orphaned rows without changing anything")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		counts, err := RepairOrphans(db, *dryRun)
+		if err != nil {
+			return err
+		}
+		verb := "repaired"
+		if *dryRun {
+			verb = "found"
+		}
+		var total int64
+		for _, count := range counts {
+			if count.Count > 0 {
+				fmt.Fprintf(out, "%s %d %s\n", verb, count.Count, count.Name)
+			}
+			total += count.Count
+		}
+		fmt.Fprintf(out, "%s %d orphaned rows\n", verb, total)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q, the commands are migrate, repair-orphans, backup and restore", args[0])
+	}
+}
+
+// runBackup is `backup [-workspace id] file.zip`, every workspace unless one is given
+func runBackup(db *gorm.DB, envConfig EnvConfig, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	workspaceID := flags.Uint("workspace", 0, "only back up this workspace")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: backup [-workspace id] file.zip")
+	}
+
+	file, err := os.Create(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	manifest, err := Backup(db, envConfig.ImageDir, *workspaceID, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(flags.Arg(0))
+		return err
+	}
+	var rows int
+	for _, count := range manifest.Tables {
+		rows += count
+	}
+	fmt.Fprintf(out, "backed up %d rows from %d tables and %d images to %s\n", rows, len(manifest.Tables), len(manifest.Images), flags.Arg(0))
+	return nil
+}
+
+// runRestore is `restore [-workspace id] [-dry-run] file.zip`, see RestoreOptions
+func runRestore(db *gorm.DB, envConfig EnvConfig, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	workspaceID := flags.Uint("workspace", 0, "merge everything in the backup into this workspace instead of adding its workspaces")
+	dryRun := flags.Bool("dry-run", false, "check the backup and count what it would add without changing anything")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: restore [-workspace id] [-dry-run] file.zip")
+	}
+
+	archive, err := zip.OpenReader(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	restore, err := Restore(db, envConfig.ImageDir, &archive.Reader, RestoreOptions{WorkspaceID: *workspaceID, DryRun: *dryRun})
+	if err != nil {
+		return err
+	}
+	verb := "restored"
+	if *dryRun {
+		verb = "would restore"
+	}
+	for _, count := range restore.Tables {
+		if count.Added > 0 || count.Matched > 0 {
+			fmt.Fprintf(out, "%s %d %s, %d already here\n", verb, count.Added, count.Name, count.Matched)
+		}
+	}
+	fmt.Fprintf(out, "%s %d images, %d renamed\n", verb, restore.Images, restore.Renamed)
+	if restore.Detached > 0 {
+		fmt.Fprintf(out, "cleared %d references to rows that aren't in the backup\n", restore.Detached)
+	}
+	return nil
+}
+
+// runMigrate is `migrate [up [version]]`, `migrate down [steps]` or `migrate status`
+func runMigrate(db *gorm.DB, args []string, out io.Writer) error {
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	number := 0
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid number %q", args[1])
+		}
+		number = n
+	}
+
+	switch action {
+	case "up":
+		applied, err := MigrateUp(db, number)
+		for _, m := range applied {
+			fmt.Fprintf(out, "applied %d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(out, "no pending migrations")
+		}
+		// the seeds need every table, so they wait until it's fully migrated
+		if number != 0 {
+			return nil
+		}
+		return SeedDB(db)
+	case "down":
+		if number == 0 {
+			number = 1
+		}
+		rolledBack, err := MigrateDown(db, number)
+		for _, m := range rolledBack {
+			fmt.Fprintf(out, "rolled back %d %s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		statuses, err := GetMigrationStatus(db)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if !status.AppliedAt.IsZero() {
+				applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if status.Unknown {
+				applied += " by a newer build"
+			}
+			fmt.Fprintf(out, "%d %s: %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate action %q, expected up, down or status", action)
+	}
+}
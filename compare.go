@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	officePointType = "Office"
+
+	// comparing more homes than this doesn't fit on a screen
+	maxCompareHomes = 8
+)
+
+// HomeComparison is a matrix of the homes being compared, one column per home
+type HomeComparison struct {
+	Homes    []Home
+	Sections []ComparisonSection
+}
+
+type ComparisonSection struct {
+	Title string
+	Rows  []ComparisonRow
+}
+
+// ComparisonRow is one thing being compared, Differs is set when the homes don't all have the same value
+type ComparisonRow struct {
+	Label   string
+	Cells   []ComparisonCell
+	Differs bool
+}
+
+// ComparisonCell is one home's value, Best marks the winning homes on rows that differ
+type ComparisonCell struct {
+	Text  string
+	Title string
+	Best  bool
+}
+
+// comparisonValue is a cell before it is formatted, OK is false when the home has no value
+type comparisonValue struct {
+	Value float64
+	OK    bool
+	Title string
+}
+
+// numericRow formats values and marks the best, higherIsBetter picks whether that is the largest or smallest
+func numericRow(label string, values []comparisonValue, format func(float64) string, higherIsBetter bool) ComparisonRow {
+	row := ComparisonRow{Label: label, Cells: make([]ComparisonCell, len(values))}
+
+	best, found := 0.0, false
+	for i, v := range values {
+		row.Cells[i] = ComparisonCell{Text: "-", Title: v.Title}
+		if !v.OK {
+			continue
+		}
+		row.Cells[i].Text = format(v.Value)
+		if !found || (higherIsBetter && v.Value > best) || (!higherIsBetter && v.Value < best) {
+			best, found = v.Value, true
+		}
+	}
+
+	row.Differs = cellsDiffer(row.Cells)
+	if row.Differs {
+		for i, v := range values {
+			row.Cells[i].Best = v.OK && row.Cells[i].Text == format(best)
+		}
+	}
+	return row
+}
+
+func cellsDiffer(cells []ComparisonCell) bool {
+	for _, cell := range cells {
+		if cell.Text != cells[0].Text {
+			return true
+		}
+	}
+	return false
+}
+
+// latestChatRatings is the rating of each home's latest finished chat, by chat type
+func latestChatRatings(db *gorm.DB, themeID uint, homeID uint) (map[uint]Chat, error) {
+	chats, err := GetChats(db, themeID, homeID, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[uint]Chat)
+	for _, c := range chats {
+		if c.Status == "pending" || c.Status == "streaming" || c.Status == "failed" {
+			continue
+		}
+		if existing, ok := latest[c.ChatType]; !ok || c.ID > existing.ID {
+			latest[c.ChatType] = c
+		}
+	}
+	return latest, nil
+}
+
+// GetHomeComparison lines up the homes' scores, factor ratings, latest research ratings,
+// distances to office points and the areas they fall inside
+func GetHomeComparison(db *gorm.DB, themeID uint, homeIDs []uint) (*HomeComparison, error) {
+	cmp := HomeComparison{Homes: make([]Home, 0, len(homeIDs))}
+	for _, id := range homeIDs {
+		home, err := GetHome(db, id)
+		if err != nil {
+			return nil, fmt.Errorf("home %d not found: %w", id, err)
+		}
+		cmp.Homes = append(cmp.Homes, *home)
+	}
+
+	scores, err := GetHomeScores(db, themeID)
+	if err != nil {
+		return nil, err
+	}
+	scoreValues := make([]comparisonValue, len(cmp.Homes))
+	for i, home := range cmp.Homes {
+		score := scores[home.ID]
+		scoreValues[i] = comparisonValue{Value: score.Score, OK: score.Scored, Title: scoreBreakdown(score)}
+	}
+	cmp.Sections = append(cmp.Sections, ComparisonSection{
+		Title: "Score",
+		Rows:  []ComparisonRow{numericRow("Score", scoreValues, func(v float64) string { return fmt.Sprintf("%.0f", v) }, true)},
+	})
+
+	factors := ComparisonSection{Title: "Factors"}
+	ratings := make([][]HomeFactorAndRating, len(cmp.Homes))
+	for i, home := range cmp.Homes {
+		ratings[i] = GetHomeRatings(db, home.ID, "")
+	}
+	for f, factor := range GetFactors(db) {
+		values := make([]comparisonValue, len(cmp.Homes))
+		for i := range cmp.Homes {
+			// GetHomeRatings returns every factor in GetFactors order
+			if f < len(ratings[i]) {
+				average, ok := ratings[i][f].Average()
+				values[i] = comparisonValue{Value: average, OK: ok, Title: raterBreakdown(ratings[i][f])}
+			}
+		}
+		factors.Rows = append(factors.Rows, numericRow(factor.Title, values, func(v float64) string { return fmt.Sprintf("%g/%d", math.Round(v*10)/10, factorStarsMax) }, true))
+	}
+	cmp.Sections = append(cmp.Sections, factors)
+
+	chatTypes, err := GetChatTypes(db, themeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chat types: %w", err)
+	}
+	research := ComparisonSection{Title: "Research"}
+	latest := make([]map[uint]Chat, len(cmp.Homes))
+	for i, home := range cmp.Homes {
+		if latest[i], err = latestChatRatings(db, themeID, home.ID); err != nil {
+			return nil, fmt.Errorf("failed to get chats for home %d: %w", home.ID, err)
+		}
+	}
+	for _, chatType := range chatTypes {
+		values := make([]comparisonValue, len(cmp.Homes))
+		for i := range cmp.Homes {
+			if c, ok := latest[i][chatType.ID]; ok && c.Rating > 0 {
+				values[i] = comparisonValue{Value: float64(c.Rating), OK: true, Title: chatSummary(c)}
+			}
+		}
+		research.Rows = append(research.Rows, numericRow(chatType.Name, values, func(v float64) string { return fmt.Sprintf("%.0f", v) }, true))
+	}
+	cmp.Sections = append(cmp.Sections, research)
+
+	offices := ComparisonSection{Title: "Distance to offices"}
+	for _, office := range GetHomes(db) {
+		if office.PointType != officePointType {
+			continue
+		}
+		values := make([]comparisonValue, len(cmp.Homes))
+		for i, home := range cmp.Homes {
+			meters := haversineMeters(LatLng{Lat: home.Lat, Lng: home.Lng}, LatLng{Lat: office.Lat, Lng: office.Lng})
+			values[i] = comparisonValue{Value: meters, OK: true}
+		}
+		offices.Rows = append(offices.Rows, numericRow(office.Title, values, func(v float64) string { return fmt.Sprintf("%.1f km", v/1000) }, false))
+	}
+	cmp.Sections = append(cmp.Sections, offices)
+
+	// only areas at least one of the homes is inside
+	areas := ComparisonSection{Title: "Areas"}
+	for _, geometry := range GetShapeGeometries(db) {
+		shape := geometry.Shape
+		row := ComparisonRow{Label: fmt.Sprintf("%s: %s", shape.ShapeKind, shape.ShapeTitle), Cells: make([]ComparisonCell, len(cmp.Homes))}
+		insideAny := false
+		for i, home := range cmp.Homes {
+			inside := geometry.Contains(LatLng{Lat: home.Lat, Lng: home.Lng})
+			row.Cells[i].Best = inside == (shape.ShapeKind == ShapeKindGood)
+			if inside {
+				row.Cells[i].Text = "inside"
+				insideAny = true
+			}
+		}
+		if !insideAny {
+			continue
+		}
+		row.Differs = cellsDiffer(row.Cells)
+		for i := range row.Cells {
+			row.Cells[i].Best = row.Differs && row.Cells[i].Best
+		}
+		areas.Rows = append(areas.Rows, row)
+	}
+	cmp.Sections = append(cmp.Sections, areas)
+
+	return &cmp, nil
+}
+
+// compareHomeIDs reads ?ids=1,2,3 and/or repeated ?homeId= values, keeping the order given
+func compareHomeIDs(r *http.Request) ([]uint, error) {
+	values := r.URL.Query()["homeId"]
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); len(id) > 0 {
+			values = append(values, id)
+		}
+	}
+
+	ids := make([]uint, 0, len(values))
+	seen := make(map[uint]bool)
+	for _, value := range values {
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid home id %q", value)
+		}
+		if !seen[uint(id)] {
+			seen[uint(id)] = true
+			ids = append(ids, uint(id))
+		}
+	}
+	return ids, nil
+}
+
+// compareHandler renders the comparison page for /compare?ids=1,2,3
+func compareHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		themeId, err := getThemeIDOrRedirect(w, r)
+		if err != nil {
+			return
+		}
+
+		homeIDs, err := compareHomeIDs(r)
+		if err != nil {
+			warning := warning(err.Error())
+			warning.Render(GetContext(r), w)
+			return
+		}
+		if len(homeIDs) < 2 || len(homeIDs) > maxCompareHomes {
+			warning := warning(fmt.Sprintf("Choose 2 to %d homes to compare", maxCompareHomes))
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		cmp, err := GetHomeComparison(db, themeId, homeIDs)
+		if err != nil {
+			warning := warning(fmt.Sprintf("Failed to compare homes - %v", err))
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		homeComparison := homeComparison(*cmp)
+		homeComparison.Render(GetContext(r), w)
+	}
+}
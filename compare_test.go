@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHomeComparison(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	homes := []Home{
+		{Lat: -43.530, Lng: 172.580, Title: "Riccarton", PointType: "Home"},
+		{Lat: -43.480, Lng: 172.620, Title: "Papanui", PointType: "Home"},
+		{Lat: -43.531, Lng: 172.637, Title: "Work", PointType: officePointType},
+	}
+	db.Create(&homes)
+	riccarton, papanui := homes[0], homes[1]
+
+	sun := Factor{Title: "Sun"}
+	db.Create(&sun)
+	db.Create(&[]HomeFactorRating{
+		{HomeID: riccarton.ID, FactorID: sun.ID, Stars: 4},
+		{HomeID: papanui.ID, FactorID: sun.ID, Stars: 2},
+	})
+
+	flooding := ChatType{Name: "Flooding", ThemeID: 1}
+	db.Create(&flooding)
+	db.Create(&[]Chat{
+		{ThemeID: 1, HomeID: riccarton.ID, ChatType: flooding.ID, Rating: 1, Status: "complete"},
+		{ThemeID: 1, HomeID: riccarton.ID, ChatType: flooding.ID, Rating: 2, Status: "complete"},
+		{ThemeID: 1, HomeID: papanui.ID, ChatType: flooding.ID, Rating: 2, Status: "complete"},
+		{ThemeID: 1, HomeID: papanui.ID, ChatType: flooding.ID, Rating: 3, Status: "failed"},
+	})
+
+	// another theme's research never has a rating for this theme, it isn't a row
+	other := Theme{Name: "Schools"}
+	db.Create(&other)
+	db.Create(&ChatType{Name: "Zoning", ThemeID: other.ID})
+
+	db.Create(&[]Shape{
+		{ShapeTitle: "Flood plain", ShapeKind: "warning", ShapeData: "[[-43.54,172.57],[-43.54,172.59],[-43.52,172.59],[-43.52,172.57]]"},
+		{ShapeTitle: "Far away", ShapeKind: "noGo", ShapeData: "[[-44,170],[-44,170.1],[-43.9,170.1]]"},
+	})
+
+	cmp, err := GetHomeComparison(db, 1, []uint{riccarton.ID, papanui.ID})
+	if err != nil {
+		t.Fatalf("GetHomeComparison() error = %v", err)
+	}
+
+	rows := make(map[string]ComparisonRow)
+	for _, section := range cmp.Sections {
+		for _, row := range section.Rows {
+			rows[section.Title+"/"+row.Label] = row
+		}
+	}
+
+	tests := []struct {
+		name        string
+		row         string
+		wantTexts   []string
+		wantBest    []bool
+		wantDiffers bool
+	}{
+		{
+			name:        "Factor stars, more is better",
+			row:         "Factors/Sun",
+			wantTexts:   []string{"4/5", "2/5"},
+			wantBest:    []bool{true, false},
+			wantDiffers: true,
+		},
+		{
+			name:      "Latest finished research rating",
+			row:       "Research/Flooding",
+			wantTexts: []string{"2", "2"},
+			wantBest:  []bool{false, false},
+		},
+		{
+			name:        "Office distance, closer is better",
+			row:         "Distance to offices/Work",
+			wantTexts:   []string{"4.6 km", "5.8 km"},
+			wantBest:    []bool{true, false},
+			wantDiffers: true,
+		},
+		{
+			name:        "Being outside a warning area is better",
+			row:         "Areas/warning: Flood plain",
+			wantTexts:   []string{"inside", ""},
+			wantBest:    []bool{false, true},
+			wantDiffers: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			row, ok := rows[tt.row]
+			if !ok {
+				t.Fatalf("GetHomeComparison() has no %q row, rows %v", tt.row, rows)
+			}
+			if row.Differs != tt.wantDiffers {
+				t.Errorf("%s Differs = %v, want %v", tt.row, row.Differs, tt.wantDiffers)
+			}
+			for i, cell := range row.Cells {
+				if cell.Text != tt.wantTexts[i] || cell.Best != tt.wantBest[i] {
+					t.Errorf("%s cell %d = %+v, want %q best %v", tt.row, i, cell, tt.wantTexts[i], tt.wantBest[i])
+				}
+			}
+		})
+	}
+
+	if _, ok := rows["Areas/noGo: Far away"]; ok {
+		t.Errorf("GetHomeComparison() lists an area neither home is inside")
+	}
+	if _, ok := rows["Research/Zoning"]; ok {
+		t.Errorf("GetHomeComparison() lists another theme's chat type")
+	}
+}
+
+func TestCompareHandler(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	db.Create(&[]Home{
+		{Lat: -43.53, Lng: 172.58, Title: "Riccarton"},
+		{Lat: -43.50, Lng: 172.60, Title: "Papanui"},
+	})
+
+	tests := []struct {
+		name     string
+		query    string
+		wantBody string
+	}{
+		{name: "Comma separated ids", query: "?ids=1,2", wantBody: "Papanui"},
+		{name: "Repeated homeId", query: "?homeId=2&homeId=1", wantBody: "Riccarton"},
+		{name: "Needs two homes", query: "?ids=1", wantBody: "Choose 2 to"},
+		{name: "Invalid id", query: "?ids=1,x", wantBody: "invalid home id"},
+		{name: "Missing home", query: "?ids=1,9", wantBody: "home 9 not found"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/compare"+tt.query, nil)
+			req.AddCookie(&http.Cookie{Name: "themeId", Value: "1"})
+			rec := httptest.NewRecorder()
+			compareHandler(db).ServeHTTP(rec, req)
+
+			if !contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("GET /compare%s body = %q, want %q", tt.query, rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+
+	// without a theme it only sends the browser to pick one
+	rec := httptest.NewRecorder()
+	compareHandler(db).ServeHTTP(rec, httptest.NewRequest("GET", "/compare?ids=1,2", nil))
+	if rec.Header().Get("HX-Redirect") != "/set-theme" || rec.Body.Len() > 0 {
+		t.Errorf("GET /compare without a theme = %q redirecting to %q, want only the redirect", rec.Body.String(), rec.Header().Get("HX-Redirect"))
+	}
+}
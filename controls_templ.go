@@ -127,6 +127,10 @@ func mapControls(meta PointMeta, activeControlKey string) templ.Component {
 				return templ_7745c5c3_Err
 			}
 		}
+		templ_7745c5c3_Err = userMenu().Render(ctx, templ_7745c5c3_Buffer)
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
 		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("</div><script>\n        document.querySelectorAll('button[data-action-mode-key]').forEach(button => {\n            button.addEventListener('click', function(e) {\n                L.DomEvent.preventDefault(e)\n                const actionMode = this.getAttribute('data-action-mode-key');\n                if (actionMode) {\n                    window.mapActor.setMode(actionMode);\n                }\n            });\n            button.addEventListener('onload', function(e){\n                const btnMode = this.getAttribute('data-action-mode-key');\n                if (btnMode == window.mapActor.mode) {\n                    e.style.background = 'blue'\n                }\n            })\n        });\n\n    </script>")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
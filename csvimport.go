@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+const (
+	CSVFieldAddress = "address"
+	CSVFieldSuburb  = "suburb"
+	CSVFieldURL     = "url"
+	CSVFieldNotes   = "notes"
+	CSVFieldPrice   = "price"
+	CSVFieldLat     = "lat"
+	CSVFieldLng     = "lng"
+
+	CSVRowFromFile  = "from the file"
+	CSVRowGeocoded  = "geocoded"
+	CSVRowUnmatched = "unmatched"
+	CSVRowDuplicate = "already a home"
+
+	// at one lookup a second this keeps an upload to a couple of minutes, the rest can be uploaded again
+	maxCSVGeocodes = 100
+)
+
+// csvFields are the home fields a column can be, in the order they're offered
+var csvFields = []string{CSVFieldAddress, CSVFieldSuburb, CSVFieldURL, CSVFieldNotes, CSVFieldPrice, CSVFieldLat, CSVFieldLng}
+
+// csvFieldHeaders are the headers, lower case with spaces for - and _, each field is picked for without asking
+var csvFieldHeaders = map[string][]string{
+	CSVFieldAddress: {"address", "street address", "full address", "property address", "location", "street"},
+	CSVFieldSuburb:  {"suburb", "city", "town", "locality"},
+	CSVFieldURL:     {"url", "link", "listing url", "listing link", "web"},
+	CSVFieldNotes:   {"notes", "note", "description", "comments"},
+	CSVFieldPrice:   {"price", "asking price", "list price", "listing price"},
+	CSVFieldLat:     {"lat", "latitude"},
+	CSVFieldLng:     {"lng", "lon", "long", "longitude"},
+}
+
+// CSVImport is an uploaded CSV of listings, e.g. a listing site's saved search, with each row's home
+type CSVImport struct {
+	Columns []string
+	Fields  []string // the field each column is, "" when it's ignored
+	Rows    []CSVImportRow
+}
+
+// CSVImportRow is a line of the CSV. Only rows with a position from the file or geocoding are saved.
+type CSVImportRow struct {
+	Line    int
+	Home    Home
+	Query   string // what is geocoded, the address and suburb
+	Status  string
+	Message string // the geocoded place, or why the row won't be saved
+}
+
+// Matched is whether the row has a position to save it at
+func (row CSVImportRow) Matched() bool {
+	return row.Status == CSVRowFromFile || row.Status == CSVRowGeocoded
+}
+
+func csvHeaderField(header string) string {
+	header = strings.ToLower(strings.TrimSpace(strings.NewReplacer("_", " ", "-", " ").Replace(header)))
+	for field, headers := range csvFieldHeaders {
+		for _, h := range headers {
+			if header == h {
+				return field
+			}
+		}
+	}
+	return ""
+}
+
+func validCSVField(field string) bool {
+	for _, f := range csvFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCSVImport reads the rows of a CSV with a header line. fields says what each column is, columns it
+// doesn't cover are picked by their header. Spreadsheets' byte order marks and semicolons are handled.
+func ParseCSVImport(data []byte, fields []string) (*CSVImport, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		return nil, errors.New("The CSV isn't UTF-8, save it as CSV UTF-8")
+	}
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	firstLine, _, _ := strings.Cut(string(data), "\n")
+	if strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		reader.Comma = ';'
+	}
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Not a CSV - %s", err)
+	}
+	if len(records) < 2 {
+		return nil, errors.New("The CSV needs a header line and at least one listing")
+	}
+
+	imported := &CSVImport{Columns: records[0], Fields: make([]string, len(records[0])), Rows: make([]CSVImportRow, 0, len(records)-1)}
+	has := make(map[string]bool)
+	for i, header := range imported.Columns {
+		if i < len(fields) {
+			if len(fields[i]) > 0 && !validCSVField(fields[i]) {
+				return nil, fmt.Errorf("Unknown field %q for column %s", fields[i], header)
+			}
+			imported.Fields[i] = fields[i]
+		} else {
+			imported.Fields[i] = csvHeaderField(header)
+		}
+		has[imported.Fields[i]] = true
+	}
+	if !has[CSVFieldAddress] && !(has[CSVFieldLat] && has[CSVFieldLng]) {
+		return nil, errors.New("Choose the column with the address, or the latitude and longitude columns")
+	}
+
+	for i, record := range records[1:] {
+		values := make(map[string][]string)
+		for column, value := range record {
+			value = strings.TrimSpace(value)
+			if column < len(imported.Fields) && len(imported.Fields[column]) > 0 && len(value) > 0 {
+				values[imported.Fields[column]] = append(values[imported.Fields[column]], value)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		first := func(field string) string {
+			if len(values[field]) == 0 {
+				return ""
+			}
+			return values[field][0]
+		}
+
+		// several columns can make up the address, e.g. street and unit
+		address := strings.Join(values[CSVFieldAddress], ", ")
+		suburb := strings.Join(values[CSVFieldSuburb], ", ")
+		row := CSVImportRow{Line: i + 2, Home: Home{
+			Title:        address,
+			CleanAddress: cleanAddress(address),
+			CleanSuburb:  suburb,
+			Url:          first(CSVFieldURL),
+			Notes:        strings.Join(values[CSVFieldNotes], "\n"),
+			Price:        first(CSVFieldPrice),
+			PointType:    "Home",
+		}}
+		row.Query = address
+		if len(address) > 0 && len(suburb) > 0 {
+			row.Query = address + ", " + suburb
+		} else if len(suburb) > 0 {
+			row.Query = suburb
+		}
+
+		lat, lng := first(CSVFieldLat), first(CSVFieldLng)
+		switch {
+		case len(lat) > 0 || len(lng) > 0:
+			p, err := parseCSVLatLng(lat, lng)
+			if err != nil {
+				row.Status, row.Message = CSVRowUnmatched, err.Error()
+				break
+			}
+			row.Home.Lat, row.Home.Lng = p.Lat, p.Lng
+			row.Status = CSVRowFromFile
+		case len(row.Query) == 0:
+			row.Status, row.Message = CSVRowUnmatched, "no address to look up"
+		}
+		imported.Rows = append(imported.Rows, row)
+	}
+	return imported, nil
+}
+
+func parseCSVLatLng(lat string, lng string) (LatLng, error) {
+	var p LatLng
+	var errLat, errLng error
+	p.Lat, errLat = strconv.ParseFloat(lat, 64)
+	p.Lng, errLng = strconv.ParseFloat(lng, 64)
+	if errLat != nil || errLng != nil {
+		return p, fmt.Errorf("%q, %q isn't a latitude and longitude", lat, lng)
+	}
+	return p, validLatLng(p)
+}
+
+// Geocode looks up the rows without a position, one at a time through the client's rate limiter. known are
+// queries already geocoded for the preview, so saving doesn't look them up again.
+func (imported *CSVImport) Geocode(ctx context.Context, client *osmClient, known map[string]LatLng) {
+	found := make(map[string]GeocodeResult)
+	failed := make(map[string]string)
+	lookups := 0
+	for i := range imported.Rows {
+		row := &imported.Rows[i]
+		if len(row.Status) > 0 {
+			continue
+		}
+		if p, ok := known[row.Query]; ok && validLatLng(p) == nil {
+			row.Home.Lat, row.Home.Lng = p.Lat, p.Lng
+			row.Status = CSVRowGeocoded
+			continue
+		}
+
+		if reason, ok := failed[row.Query]; ok {
+			row.Status, row.Message = CSVRowUnmatched, reason
+			continue
+		}
+		result, ok := found[row.Query]
+		if !ok {
+			if lookups >= maxCSVGeocodes {
+				row.Status, row.Message = CSVRowUnmatched, fmt.Sprintf("only %d addresses are looked up at a time, import these rows again after saving", maxCSVGeocodes)
+				continue
+			}
+			if ctx.Err() != nil {
+				row.Status, row.Message = CSVRowUnmatched, "not looked up, the upload was cancelled"
+				continue
+			}
+			lookups++
+			results, err := client.GeocodeAddressContext(ctx, row.Query)
+			if err != nil {
+				failed[row.Query] = fmt.Sprintf("not found - %s", err)
+				row.Status, row.Message = CSVRowUnmatched, failed[row.Query]
+				continue
+			}
+			result = results[0]
+			found[row.Query] = result
+		}
+		p, err := parseCSVLatLng(result.Lat, result.Lon)
+		if err != nil {
+			row.Status, row.Message = CSVRowUnmatched, err.Error()
+			continue
+		}
+		row.Home.Lat, row.Home.Lng = p.Lat, p.Lng
+		row.Status, row.Message = CSVRowGeocoded, result.DisplayName
+	}
+}
+
+// MarkDuplicates skips rows whose listing URL is already a home, or an earlier row, so a saved search's
+// export can be uploaded again as it grows
+func (imported *CSVImport) MarkDuplicates(db *gorm.DB) error {
+	urls := make([]string, 0)
+	for _, row := range imported.Rows {
+		if len(row.Home.Url) > 0 {
+			urls = append(urls, row.Home.Url)
+		}
+	}
+	seen := make(map[string]bool)
+	if len(urls) > 0 {
+		var existing []string
+		if err := db.Model(&Home{}).Where("url IN ?", urls).Pluck("url", &existing).Error; err != nil {
+			return fmt.Errorf("failed to check for existing homes: %w", err)
+		}
+		for _, url := range existing {
+			seen[url] = true
+		}
+	}
+	for i := range imported.Rows {
+		row := &imported.Rows[i]
+		if len(row.Home.Url) == 0 {
+			continue
+		}
+		if seen[row.Home.Url] {
+			row.Status, row.Message = CSVRowDuplicate, "a home has this URL"
+		}
+		seen[row.Home.Url] = true
+	}
+	return nil
+}
+
+// Counts are the rows that would be saved and the ones that wouldn't
+func (imported *CSVImport) Counts() (int, int) {
+	matched := 0
+	for _, row := range imported.Rows {
+		if row.Matched() {
+			matched++
+		}
+	}
+	return matched, len(imported.Rows) - matched
+}
+
+// mapImport is the matched rows' homes, to save them like a map import
+func (imported *CSVImport) mapImport() *MapImport {
+	homes := newMapImport()
+	for _, row := range imported.Rows {
+		if row.Matched() {
+			homes.addHome(fmt.Sprintf("Line %d", row.Line), LatLng{Lat: row.Home.Lat, Lng: row.Home.Lng}, row.Home)
+		}
+	}
+	return homes
+}
+
+// csvImportForm is what the CSV import page sends. After a preview the file comes back in FileData, with
+// the positions geocoded for it, so the columns can be changed or the homes saved without looking them up again.
+type csvImportForm struct {
+	FileName string
+	FileData string // base64
+	Fields   []string
+	Known    map[string]LatLng
+}
+
+func readCSVImportForm(r *http.Request) (csvImportForm, []byte, error) {
+	form := csvImportForm{Fields: r.Form["field"], Known: make(map[string]LatLng)}
+	queries, positions := r.Form["geocodedQuery"], r.Form["geocodedLatLng"]
+	for i := 0; i < len(queries) && i < len(positions); i++ {
+		lat, lng, _ := strings.Cut(positions[i], ",")
+		if p, err := parseCSVLatLng(lat, lng); err == nil {
+			form.Known[queries[i]] = p
+		}
+	}
+
+	var data []byte
+	file, header, err := r.FormFile("file")
+	switch {
+	case err == nil:
+		defer file.Close()
+		if data, err = io.ReadAll(file); err != nil {
+			return form, nil, fmt.Errorf("Failed to read the file - %s", err)
+		}
+		form.FileName = header.Filename
+		// a different file has different columns
+		form.Fields = nil
+		form.Known = make(map[string]LatLng)
+	case len(r.FormValue("fileData")) > 0:
+		if data, err = base64.StdEncoding.DecodeString(r.FormValue("fileData")); err != nil {
+			return form, nil, fmt.Errorf("Failed to read the previewed file - %s", err)
+		}
+		form.FileName = r.FormValue("fileName")
+	default:
+		return form, nil, errors.New("Choose a CSV file of listings to import")
+	}
+	if len(data) > maxImportBytes {
+		return form, nil, fmt.Errorf("The file is over %d MB", maxImportBytes>>20)
+	}
+	form.FileData = base64.StdEncoding.EncodeToString(data)
+	return form, data, nil
+}
+
+// csvImportHandler shows the upload form. Posting it previews the rows, geocoding the ones without a position,
+// and posting the preview with save=on saves the matched rows as homes.
+func csvImportHandler(db *gorm.DB, client *osmClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		switch r.Method {
+		case http.MethodGet:
+			importPage := csvImportPage(csvImportForm{}, nil, false, "", "")
+			importPage.Render(GetContext(r), w)
+		case http.MethodPost:
+			r.Body = http.MaxBytesReader(w, r.Body, maxImportFormBytes)
+			if err := r.ParseMultipartForm(maxImportFormBytes); err != nil {
+				warning := warning(fmt.Sprintf("Unable to read the upload - %s", err))
+				warning.Render(GetContext(r), w)
+				return
+			}
+			form, data, err := readCSVImportForm(r)
+			if err != nil {
+				importPage := csvImportPage(form, nil, false, "", err.Error())
+				importPage.Render(GetContext(r), w)
+				return
+			}
+
+			imported, err := ParseCSVImport(data, form.Fields)
+			if err != nil {
+				importPage := csvImportPage(form, nil, false, "", err.Error())
+				importPage.Render(GetContext(r), w)
+				return
+			}
+			form.Fields = imported.Fields
+			if err := imported.MarkDuplicates(db); err != nil {
+				importPage := csvImportPage(form, imported, false, "", err.Error())
+				importPage.Render(GetContext(r), w)
+				return
+			}
+			imported.Geocode(r.Context(), client, form.Known)
+			if r.FormValue("save") != "on" {
+				importPage := csvImportPage(form, imported, false, "", "")
+				importPage.Render(GetContext(r), w)
+				return
+			}
+
+			homes := imported.mapImport()
+			if err := ImportMap(db, homes, 0); err != nil {
+				importPage := csvImportPage(form, imported, false, "", err.Error())
+				importPage.Render(GetContext(r), w)
+				return
+			}
+			form.FileData = ""
+			_, unmatched := imported.Counts()
+			msg := fmt.Sprintf("Imported %d homes from %s, %d rows weren't saved", len(homes.Homes), form.FileName, unmatched)
+			importPage := csvImportPage(form, imported, true, msg, "")
+			importPage.Render(GetContext(r), w)
+		default:
+			warning := warning("Method not allowed")
+			warning.Render(GetContext(r), w)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestParseCSVImport(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		data       string
+		fields     []string
+		wantErr    string
+		wantFields []string
+		wantRows   []CSVImportRow
+	}{
+		{name: "Not UTF-8", data: "address\n\xff\xfe", wantErr: "isn't UTF-8"},
+		{name: "Only a header", data: "address,price\n", wantErr: "at least one listing"},
+		{name: "No address", data: "headline,price\nSunny,$1\n", wantErr: "Choose the column with the address"},
+		{name: "Unknown field", data: "a\nb\n", fields: []string{"colour"}, wantErr: `Unknown field "colour"`},
+		{
+			name:       "Listing site export",
+			data:       "\xef\xbb\xbfStreet Address,Suburb,Asking Price,Listing URL,Description,Agent\n12 Office Road,Merivale,\"$650,000\",https://example.com/1,\"Sunny, quiet\",Jo\n\n,,,,,\n",
+			wantFields: []string{CSVFieldAddress, CSVFieldSuburb, CSVFieldPrice, CSVFieldURL, CSVFieldNotes, ""},
+			wantRows: []CSVImportRow{{Line: 2, Query: "12 Office Road, Merivale", Home: Home{
+				Title: "12 Office Road", CleanAddress: "12 Office Road", CleanSuburb: "Merivale", Price: "$650,000",
+				Url: "https://example.com/1", Notes: "Sunny, quiet", PointType: "Home",
+			}}},
+		},
+		{
+			name:       "Semicolons with positions",
+			data:       "name;latitude;longitude\n5 Elm Street;-43.5;172.6\nNowhere;north;172.6\n",
+			fields:     []string{CSVFieldAddress},
+			wantFields: []string{CSVFieldAddress, CSVFieldLat, CSVFieldLng},
+			wantRows: []CSVImportRow{
+				{Line: 2, Query: "5 Elm Street", Status: CSVRowFromFile, Home: Home{Title: "5 Elm Street", CleanAddress: "5 Elm Street", PointType: "Home", Lat: -43.5, Lng: 172.6}},
+				{Line: 3, Query: "Nowhere", Status: CSVRowUnmatched, Message: `"north", "172.6" isn't a latitude and longitude`, Home: Home{Title: "Nowhere", CleanAddress: "Nowhere", PointType: "Home"}},
+			},
+		},
+		{
+			name:       "Address in two columns",
+			data:       "unit,street,price\n2,5 Elm Street,\n",
+			fields:     []string{CSVFieldAddress, CSVFieldAddress, ""},
+			wantFields: []string{CSVFieldAddress, CSVFieldAddress, ""},
+			wantRows:   []CSVImportRow{{Line: 2, Query: "2, 5 Elm Street", Home: Home{Title: "2, 5 Elm Street", CleanAddress: "2, 5 Elm Street", PointType: "Home"}}},
+		},
+	}
+	for _, tt := range tests {
+		imported, err := ParseCSVImport([]byte(tt.data), tt.fields)
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: ParseCSVImport() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ParseCSVImport() error = %v", tt.name, err)
+			continue
+		}
+		if fmt.Sprint(imported.Fields) != fmt.Sprint(tt.wantFields) {
+			t.Errorf("%s: Fields = %q, want %q", tt.name, imported.Fields, tt.wantFields)
+		}
+		if fmt.Sprintf("%+v", imported.Rows) != fmt.Sprintf("%+v", tt.wantRows) {
+			t.Errorf("%s: Rows = %+v, want %+v", tt.name, imported.Rows, tt.wantRows)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	limiter := newRateLimiter(20 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limiter.Wait(context.Background()); err != nil {
+			t.Fatalf("Wait() error = %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("3 waits took %v, want at least 2 intervals", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limiter.Wait(context.Background())
+	if err := limiter.Wait(ctx); err == nil {
+		t.Errorf("Wait() with a cancelled context waiting its turn error = nil")
+	}
+}
+
+func TestCSVImportHandler(t *testing.T) {
+	t.Parallel()
+
+	var lookups atomic.Int32
+	nominatim := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		if r.URL.Query().Get("q") == "12 Office Road, Merivale" {
+			fmt.Fprint(w, `[{"lat":"-43.51","lon":"172.62","display_name":"12 Office Road, Merivale, Christchurch"}]`)
+			return
+		}
+		fmt.Fprint(w, `[]`)
+	}))
+	t.Cleanup(nominatim.Close)
+	client := &osmClient{endpoint: nominatim.URL, limiter: newRateLimiter(0)}
+
+	db := newBackupTestDB(t)
+	scoped := db.WithContext(withWorkspace(context.Background(), defaultWorkspaceID))
+	scoped.Create(&Home{Title: "Seen before", Url: "https://example.com/3"})
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(withWorkspace(r.Context(), defaultWorkspaceID)))
+		})
+	})
+	r.Post("/import/csv", csvImportHandler(db, client))
+
+	post := func(file []byte, fields ...string) string {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		if file != nil {
+			part, _ := form.CreateFormFile("file", "saved search.csv")
+			part.Write(file)
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			form.WriteField(fields[i], fields[i+1])
+		}
+		form.Close()
+		req := httptest.NewRequest("POST", "/import/csv", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	listings := []byte("Address,Suburb,Price,Link,Lat,Lng\n" +
+		"12 Office Road,Merivale,\"$650,000\",https://example.com/1,,\n" +
+		"5 Elm Street,Nowhere,By negotiation,https://example.com/2,,\n" +
+		"7 Oak Lane,Riccarton,,https://example.com/3,,\n" +
+		"9 Pine Street,Riccarton,$500,https://example.com/4,-43.53,172.58\n" +
+		"12 Office Road,Merivale,\"$650,000\",https://example.com/5,,\n")
+	kept := base64.StdEncoding.EncodeToString(listings)
+
+	tests := []struct {
+		name        string
+		file        []byte
+		fields      []string
+		want        []string
+		wantLookups int32
+		wantHomes   int64
+	}{
+		{name: "No file", want: []string{"Choose a CSV file"}, wantHomes: 1},
+		{name: "Preview", file: listings, want: []string{
+			"Would create 3 homes, 2 rows won&#39;t be saved",
+			"12 Office Road, Merivale, Christchurch",
+			"not found - no results found for address: 5 Elm Street, Nowhere",
+			CSVRowDuplicate,
+			`name="geocodedQuery" value="12 Office Road, Merivale"`,
+			`name="geocodedLatLng" value="-43.51,172.62"`,
+			"Save 3 homes",
+		}, wantLookups: 2, wantHomes: 1},
+		{name: "Preview a big kept file", fields: []string{"fileName", "big.csv", "fileData", base64.StdEncoding.EncodeToString([]byte("Address,Lat,Lng,Notes\n9 Pine Street,-43.53,172.58," + strings.Repeat("x", 16<<20) + "\n"))}, want: []string{
+			"Would create 1 homes",
+		}, wantLookups: 2, wantHomes: 1},
+		{name: "Save the kept file", fields: []string{"fileName", "saved search.csv", "fileData", kept,
+			"geocodedQuery", "12 Office Road, Merivale", "geocodedLatLng", "-43.51,172.62", "save", "on"}, want: []string{
+			"Imported 3 homes from saved search.csv, 2 rows weren&#39;t saved",
+		}, wantLookups: 3, wantHomes: 4},
+	}
+	for _, tt := range tests {
+		body := post(tt.file, tt.fields...)
+		for _, want := range tt.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: body missing %s", tt.name, want)
+			}
+		}
+		var homes int64
+		scoped.Model(&Home{}).Count(&homes)
+		// saving only looks up the address that wasn't found in the preview again
+		if lookups.Load() != tt.wantLookups || homes != tt.wantHomes {
+			t.Errorf("%s: %d lookups and %d homes, want %d and %d", tt.name, lookups.Load(), homes, tt.wantLookups, tt.wantHomes)
+		}
+	}
+
+	var home Home
+	scoped.Where("url = ?", "https://example.com/1").First(&home)
+	if home.Lat != -43.51 || home.Lng != 172.62 || home.Price != "$650,000" || home.CleanSuburb != "Merivale" || home.PointType != "Home" {
+		t.Errorf("home = %+v, want the geocoded listing with its price and suburb", home)
+	}
+}
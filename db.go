@@ -1,43 +1,79 @@
 package main
 
 import (
+	"fmt"
 	"log"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-// DBInit initializes the database and creates the tables
-func DBInit(config EnvConfig) (*gorm.DB, error) {
+// DBOpen connects to the database and registers the workspace and audit callbacks, without migrating it
+func DBOpen(config EnvConfig) (*gorm.DB, error) {
 
 	db, err := gorm.Open(sqlite.Open(config.DBUrl), &gorm.Config{})
 	if err != nil {
 		log.Fatal("failed to connect database:", err)
 	}
+	if err := registerWorkspaceScope(db); err != nil {
+		log.Fatal("failed to register workspace scope:", err)
+	}
+	if err := registerAuditLog(db); err != nil {
+		log.Fatal("failed to register audit log:", err)
+	}
+	return db, nil
+}
+
+// DBInit opens the database, applies any pending migrations and seeds it
+func DBInit(config EnvConfig) (*gorm.DB, error) {
+	db, err := DBOpen(config)
+	if err != nil {
+		return nil, err
+	}
 
-	// Migrate the schema
-	err = db.AutoMigrate(&Factor{}, &Home{}, &HomeFactorRating{}, &Shape{}, &ShapeType{}, &ShapeKind{}, &ImageOverlay{}, &ChatType{}, &Chat{}, &ChatResult{}, &Theme{}, &FractalSearch{}, &Point{}, &Message{}, &FractalSearchResultGroup{})
+	applied, err := MigrateUp(db, 0)
 	if err != nil {
 		log.Fatal("failed to migrate database:", err)
 	}
+	for _, m := range applied {
+		log.Printf("applied migration %d (%s)", m.Version, m.Name)
+	}
 
-	InitShapeTypes(db)
-	InitShapeKinds(db)
-	InitTheme(db)
+	if err := SeedDB(db); err != nil {
+		log.Fatal("failed to seed database:", err)
+	}
 	return db, nil
 }
 
-func InitShapeTypes(db *gorm.DB) error {
-	// delete all existing shapes
-	err := db.Exec("DELETE FROM shape_types")
-	if err.Error != nil {
-		log.Fatal("failed to delete shape types:", err.Error)
+// SeedDB adds the data every database needs, it only adds what is missing so it runs on every start
+func SeedDB(db *gorm.DB) error {
+	if err := InitShapeTypes(db); err != nil {
+		return err
 	}
+	if err := InitShapeKinds(db); err != nil {
+		return err
+	}
+	if err := InitTheme(db); err != nil {
+		return err
+	}
+	if err := InitChatTypeVersions(db); err != nil {
+		return err
+	}
+	if err := InitWorkspaces(db); err != nil {
+		return fmt.Errorf("failed to initialize workspaces: %w", err)
+	}
+	return nil
+}
 
+// InitShapeTypes adds any missing shape types, ones no longer listed are left for the shapes that use them
+func InitShapeTypes(db *gorm.DB) error {
 	shapes := []ShapeType{
 		{
 			ID:   1,
-			Name: "area",
+			Name: ShapeTypeArea,
+		}, {
+			ID:   2,
+			Name: ShapeTypeRoute,
 		},
 	}
 	for _, shape := range shapes {
@@ -49,12 +85,8 @@ func InitShapeTypes(db *gorm.DB) error {
 	return nil
 }
 
+// InitShapeKinds adds any missing shape kinds
 func InitShapeKinds(db *gorm.DB) error {
-	// delete all existing shapes
-	err := db.Exec("DELETE FROM shape_kinds")
-	if err.Error != nil {
-		log.Fatal("failed to delete shape_kinds:", err.Error)
-	}
 	shapes := []ShapeKind{
 		{
 			ID:   1,
@@ -108,13 +140,17 @@ func GetShape(db *gorm.DB, shapeId uint) Shape {
 	var shape Shape
 	err := db.First(&shape, shapeId)
 	if err.Error != nil {
-		log.Fatal("failed to get shape:", err.Error)
+		// shapes in other workspaces aren't found either, so this can't be fatal
+		log.Printf("failed to get shape: %v", err.Error)
 	}
 	return shape
 }
 
 func DeleteShape(db *gorm.DB, shapeId uint) Shape {
 	shape := GetShape(db, shapeId)
+	if shape.ID == 0 {
+		return shape
+	}
 	err := db.Delete(&shape)
 	if err.Error != nil {
 		log.Fatal("failed to delete shape:", err.Error)
@@ -182,8 +218,9 @@ func GetActiveTheme(db *gorm.DB, themeIdOverride uint) Theme {
 		var theme Theme
 		err := db.First(&theme, themeIdOverride)
 		if err.Error != nil {
+			// the themeId cookie can be for a theme in another workspace
 			log.Printf("failed to get active theme: %v", err.Error)
-			return Theme{}
+			return GetActiveTheme(db, 0)
 		}
 		return theme
 	}
@@ -261,17 +298,31 @@ func DeleteImgOverlay(db *gorm.DB, id int) *ImageOverlay {
 }
 
 func CreateChatType(db *gorm.DB, chatType ChatType) (*ChatType, error) {
-	err := db.Create(&chatType)
-	if err.Error != nil {
-		return nil, err.Error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&chatType).Error; err != nil {
+			return err
+		}
+		if err := saveChatTypeVersion(tx, &chatType); err != nil {
+			return err
+		}
+		return tx.Model(&chatType).Update("version_id", chatType.VersionID).Error
+	})
+	if err != nil {
+		return nil, err
 	}
 	return &chatType, nil
 }
 
+// UpdateChatType saves a new ChatTypeVersion when the prompt fields change, older chats keep pointing at theirs
 func UpdateChatType(db *gorm.DB, chatType ChatType) (*ChatType, error) {
-	err := db.Save(&chatType)
-	if err.Error != nil {
-		return nil, err.Error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := saveChatTypeVersion(tx, &chatType); err != nil {
+			return err
+		}
+		return tx.Save(&chatType).Error
+	})
+	if err != nil {
+		return nil, err
 	}
 	return &chatType, nil
 }
@@ -285,18 +336,21 @@ func GetChatType(db *gorm.DB, id uint) (*ChatType, error) {
 	return &chatType, nil
 }
 
+// DeleteChat deletes a chat with its results, citations and related questions
 func DeleteChat(db *gorm.DB, id uint) (*Chat, error) {
 	chat := Chat{ID: id}
-	err := db.Delete(&chat)
-	if err.Error != nil {
-		return nil, err.Error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return deleteChats(tx, []uint{id})
+	})
+	if err != nil {
+		return nil, err
 	}
 	return &chat, nil
 }
 
 func GetChatTypes(db *gorm.DB, themeId uint) ([]ChatType, error) {
 	var chatTypes []ChatType
-	err := db.Find(&chatTypes).Where("theme_id = ?", themeId)
+	err := db.Where("theme_id = ?", themeId).Find(&chatTypes)
 	if err.Error != nil {
 		return nil, err.Error
 	}
@@ -319,12 +373,12 @@ func GetChats(db *gorm.DB, themeId uint, homeId uint, chatTypeId uint) ([]Chat,
 	var chats []Chat
 	log.Printf("themeId: %v, homeId: %v chatTypeID: %v", themeId, homeId, chatTypeId)
 	if chatTypeId == 0 {
-		err := db.Preload("Results").Where("theme_id = ? AND home_id = ?", themeId, homeId).Find(&chats).Error
+		err := db.Preload("Results").Preload("Citations").Preload("RelatedQuestions").Preload("Usages").Where("theme_id = ? AND home_id = ?", themeId, homeId).Find(&chats).Error
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		err := db.Preload("Results").Where("theme_id = ? AND home_id = ? AND chat_type = ?", themeId, homeId, chatTypeId).Find(&chats).Error
+		err := db.Preload("Results").Preload("Citations").Preload("RelatedQuestions").Preload("Usages").Where("theme_id = ? AND home_id = ? AND chat_type = ?", themeId, homeId, chatTypeId).Find(&chats).Error
 		if err != nil {
 			return nil, err
 		}
@@ -334,7 +388,7 @@ func GetChats(db *gorm.DB, themeId uint, homeId uint, chatTypeId uint) ([]Chat,
 
 func GetChat(db *gorm.DB, id uint) (*Chat, error) {
 	var chat Chat
-	err := db.Preload("Results").First(&chat, id)
+	err := db.Preload("Results").Preload("Citations").Preload("RelatedQuestions").Preload("Usages").First(&chat, id)
 	if err.Error != nil {
 		return nil, err.Error
 	}
@@ -357,52 +411,14 @@ func UpdateShape(db *gorm.DB, shape Shape) Shape {
 	return shape
 }
 
-type HomeFactorAndRating struct {
-	*HomeFactorRating
-	Factor
-}
-
-func GetHomeRatings(db *gorm.DB, homeId uint) []HomeFactorAndRating {
-
-	factors := GetFactors(db)
-
-	var ratings []HomeFactorRating
-	err := db.Where("home_id = ?", homeId).Find(&ratings)
-	if err.Error != nil {
-		log.Fatal("failed to get ratings:", err.Error)
-	}
-
-	ratingMap := make(map[uint]HomeFactorRating)
-	for _, rating := range ratings {
-		ratingMap[rating.FactorID] = rating
-	}
-
-	var ratingsWithFactors []HomeFactorAndRating
-	for _, factor := range factors {
-		if rating, exists := ratingMap[factor.ID]; exists {
-			// Factor has a rating
-			ratingsWithFactors = append(ratingsWithFactors, HomeFactorAndRating{
-				HomeFactorRating: &rating,
-				Factor:           factor,
-			})
-		} else {
-			// Factor does not have a rating
-			ratingsWithFactors = append(ratingsWithFactors, HomeFactorAndRating{
-				HomeFactorRating: nil,
-				Factor:           factor,
-			})
+// DeleteAll moves the workspace's shapes, homes and factors to the trash. Ratings stay with them for a restore,
+// and shape types and kinds are shared so they stay too.
+func DeleteAll(db *gorm.DB) {
+	for _, model := range []interface{}{&Shape{}, &Home{}, &Factor{}} {
+		if err := db.Where("1 = 1").Delete(model).Error; err != nil {
+			log.Printf("failed to delete all: %v", err)
 		}
 	}
-	return ratingsWithFactors
-}
-
-func DeleteAll(db *gorm.DB) {
-	db.Exec("DELETE FROM shapes")
-	db.Exec("DELETE FROM shape_types")
-	db.Exec("DELETE FROM shape_kinds")
-	db.Exec("DELETE FROM homes")
-	db.Exec("DELETE FROM factors")
-	db.Exec("DELETE FROM home_factor_ratings")
 }
 
 func CreateFractalSearch(db *gorm.DB, search FractalSearch) (*FractalSearch, error) {
@@ -443,6 +459,19 @@ func GetFractalSearchFull(db *gorm.DB, id uint) (*FractalSearchFull, error) {
 	}
 	search.Messages = messages
 
+	citations, questions, err := GetFractalSearchSources(db, id)
+	if err != nil {
+		return nil, err
+	}
+	search.Citations = citations
+	search.RelatedQuestions = questions
+
+	usages, err := GetFractalSearchUsages(db, id)
+	if err != nil {
+		return nil, err
+	}
+	search.Usages = usages
+
 	return &search, nil
 }
 
@@ -506,7 +535,7 @@ func GetMessages(db *gorm.DB, fsId uint) ([]Message, error) {
 }
 
 func DeletePoints(db *gorm.DB, id uint) error {
-	err := db.Exec("DELETE FROM points WHERE fractal_search_id = ?", id)
+	err := db.Where("fractal_search_id = ?", id).Delete(&Point{})
 	if err.Error != nil {
 		return err.Error
 	}
@@ -514,13 +543,52 @@ func DeletePoints(db *gorm.DB, id uint) error {
 }
 
 func DeleteMessages(db *gorm.DB, id uint) error {
-	err := db.Exec("DELETE FROM messages WHERE fractal_search_id = ?", id)
+	err := db.Where("fractal_search_id = ?", id).Delete(&Message{})
+	if err.Error != nil {
+		return err.Error
+	}
+
+	// citations and related questions hang off the messages
+	err = db.Where("fractal_search_id = ?", id).Delete(&Citation{})
+	if err.Error != nil {
+		return err.Error
+	}
+	err = db.Where("fractal_search_id = ?", id).Delete(&RelatedQuestion{})
 	if err.Error != nil {
 		return err.Error
 	}
 	return nil
 }
 
+func CreateResponseSources(db *gorm.DB, citations []Citation, questions []RelatedQuestion) error {
+	if len(citations) > 0 {
+		if err := db.Create(&citations).Error; err != nil {
+			return err
+		}
+	}
+	if len(questions) > 0 {
+		if err := db.Create(&questions).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetFractalSearchSources(db *gorm.DB, fsId uint) ([]Citation, []RelatedQuestion, error) {
+	var citations []Citation
+	err := db.Where("fractal_search_id = ?", fsId).Order("message_index, number").Find(&citations).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var questions []RelatedQuestion
+	err = db.Where("fractal_search_id = ?", fsId).Order("message_index, id").Find(&questions).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	return citations, questions, nil
+}
+
 func UpdatePoint(db *gorm.DB, point Point) (*Point, error) {
 	err := db.Save(&point)
 	if err.Error != nil {
@@ -538,22 +606,58 @@ func GetPoint(db *gorm.DB, id uint) (*Point, error) {
 	return &point, nil
 }
 
+// DeleteFractalSearch moves the search to the trash, its points and messages are kept for a restore
 func DeleteFractalSearch(db *gorm.DB, id uint) (*FractalSearch, error) {
 	search := FractalSearch{ID: id}
 	sdRes := db.Delete(&search)
 	if sdRes.Error != nil {
 		return nil, sdRes.Error
 	}
+	return &search, nil
+}
 
-	err := DeletePoints(db, id)
-	if err != nil {
-		return nil, err
+func CreateJobs(db *gorm.DB, jobs []Job) ([]Job, error) {
+	if len(jobs) == 0 {
+		return jobs, nil
+	}
+	err := db.Create(&jobs)
+	if err.Error != nil {
+		return nil, err.Error
+	}
+	return jobs, nil
+}
+
+func GetJob(db *gorm.DB, id uint) (*Job, error) {
+	var job Job
+	err := db.First(&job, id)
+	if err.Error != nil {
+		return nil, err.Error
 	}
+	return &job, nil
+}
 
-	err = DeleteMessages(db, id)
+// GetJobs returns the jobs in a batch, or the latest jobs when batchID is empty
+func GetJobs(db *gorm.DB, batchID string, limit int) ([]Job, error) {
+	var jobs []Job
+	query := db.Order("id desc")
+	if len(batchID) > 0 {
+		query = db.Where("batch_id = ?", batchID).Order("id")
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err := query.Find(&jobs)
+	if err.Error != nil {
+		return nil, err.Error
+	}
+	return jobs, nil
+}
+
+func GetFractalSearchUsages(db *gorm.DB, fsId uint) ([]LLMUsage, error) {
+	var usages []LLMUsage
+	err := db.Where("fractal_search_id = ?", fsId).Order("message_index").Find(&usages).Error
 	if err != nil {
 		return nil, err
 	}
-
-	return &search, nil
+	return usages, nil
 }
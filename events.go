@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+
+	eventBuffer    = 64
+	eventKeepAlive = 25 * time.Second
+)
+
+// eventKinds are the tables whose changes are broadcast, and the event name the browser listens for
+var eventKinds = map[string]string{
+	"homes":          "home",
+	"shapes":         "shape",
+	"image_overlays": "overlay",
+	"points":         "point",
+	"chats":          "chat",
+}
+
+// Event is a created, updated or deleted row. ID is 0 when a change matched rows by something other
+// than their IDs, the browser then reloads that kind of row instead.
+type Event struct {
+	Kind   string          `json:"kind"`
+	Action string          `json:"action"`
+	ID     uint            `json:"id"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// EventHub sends every change in a workspace to the browsers open on it
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]uint
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subscribers: make(map[chan Event]uint)}
+}
+
+// Subscribe returns the workspace's events, call unsubscribe once done with them
+func (h *EventHub) Subscribe(workspaceID uint) (<-chan Event, func()) {
+	events := make(chan Event, eventBuffer)
+	h.mu.Lock()
+	h.subscribers[events] = workspaceID
+	h.mu.Unlock()
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[events]; ok {
+			delete(h.subscribers, events)
+			close(events)
+		}
+	}
+	return events, unsubscribe
+}
+
+// Publish never blocks, a subscriber too slow to keep up misses events
+func (h *EventHub) Publish(workspaceID uint, event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for events, subscribed := range h.subscribers {
+		if subscribed != workspaceID {
+			continue
+		}
+		select {
+		case events <- event:
+		default:
+			log.Printf("event subscriber is full, dropping %s %s %d", event.Kind, event.Action, event.ID)
+		}
+	}
+}
+
+// Close ends every subscription so open event streams finish, as on shutdown
+func (h *EventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for events := range h.subscribers {
+		delete(h.subscribers, events)
+		close(events)
+	}
+}
+
+// Register publishes an event after every create, update and delete of the broadcast tables.
+// Changes made in a transaction are held until it commits, and dropped if it rolls back.
+func (h *EventHub) Register(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Create().After("gorm:create").Register("events:create", h.publishChanges(EventCreate)); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("gorm:update").Register("events:update", h.publishChanges(EventUpdate)); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().After("gorm:delete").Register("events:delete", h.publishChanges(EventDelete)); err != nil {
+		return err
+	}
+	pool := &eventConnPool{ConnPool: db.ConnPool}
+	db.ConnPool = pool
+	db.Statement.ConnPool = pool
+	return nil
+}
+
+// send publishes the event, or holds it until the statement's transaction commits
+func (h *EventHub) send(db *gorm.DB, workspaceID uint, event Event) {
+	if tx, ok := db.Statement.ConnPool.(*eventTx); ok {
+		tx.pending = append(tx.pending, pendingEvent{hub: h, workspaceID: workspaceID, event: event})
+		return
+	}
+	h.Publish(workspaceID, event)
+}
+
+type pendingEvent struct {
+	hub         *EventHub
+	workspaceID uint
+	event       Event
+}
+
+// eventConnPool is the database's connection pool, with transactions that hold their events until they commit.
+// gorm runs each create, update and delete in one of these too unless it's already in a transaction.
+type eventConnPool struct {
+	gorm.ConnPool
+}
+
+func (p *eventConnPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	beginner, ok := p.ConnPool.(gorm.TxBeginner)
+	if !ok {
+		return nil, gorm.ErrInvalidTransaction
+	}
+	tx, err := beginner.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &eventTx{Tx: tx, savepoints: make(map[string]int)}, nil
+}
+
+// GetDBConn lets db.DB() find the *sql.DB underneath
+func (p *eventConnPool) GetDBConn() (*sql.DB, error) {
+	if sqlDB, ok := p.ConnPool.(*sql.DB); ok {
+		return sqlDB, nil
+	}
+	return nil, gorm.ErrInvalidDB
+}
+
+type eventTx struct {
+	*sql.Tx
+	pending    []pendingEvent
+	savepoints map[string]int // how many events were pending at each savepoint of a nested transaction
+}
+
+// ExecContext follows nested transactions' savepoints, dropping the events of one that rolls back
+func (tx *eventTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	result, err := tx.Tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return result, err
+	}
+	if name, ok := strings.CutPrefix(query, "ROLLBACK TO SAVEPOINT "); ok {
+		if n, ok := tx.savepoints[name]; ok && n <= len(tx.pending) {
+			tx.pending = tx.pending[:n]
+		}
+	} else if name, ok := strings.CutPrefix(query, "SAVEPOINT "); ok {
+		tx.savepoints[name] = len(tx.pending)
+	}
+	return result, nil
+}
+
+func (tx *eventTx) Commit() error {
+	if err := tx.Tx.Commit(); err != nil {
+		tx.pending = nil
+		return err
+	}
+	for _, pending := range tx.pending {
+		pending.hub.Publish(pending.workspaceID, pending.event)
+	}
+	tx.pending = nil
+	return nil
+}
+
+func (tx *eventTx) Rollback() error {
+	tx.pending = nil
+	return tx.Tx.Rollback()
+}
+
+func (h *EventHub) publishChanges(action string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		stmt := db.Statement
+		if db.Error != nil || db.RowsAffected == 0 || stmt.Schema == nil {
+			return
+		}
+		kind, ok := eventKinds[stmt.Schema.Table]
+		if !ok {
+			return
+		}
+
+		contextWorkspace, scoped := workspaceFromContext(stmt.Context)
+		rows := changedRows(db)
+		if len(rows) == 0 {
+			ids := deletedIDs(stmt)
+			if action != EventDelete || len(ids) == 0 {
+				ids = []uint{0}
+			}
+			for _, id := range ids {
+				h.send(db, contextWorkspace, Event{Kind: kind, Action: action, ID: id})
+			}
+			return
+		}
+
+		for _, row := range rows {
+			workspaceID := contextWorkspace
+			if !scoped {
+				workspaceID = rowUint(db, row, "WorkspaceID")
+			}
+			event := Event{Kind: kind, Action: action, ID: rowUint(db, row, "ID")}
+			if action != EventDelete {
+				data, err := json.Marshal(withoutImageFile(row.Interface()))
+				if err != nil {
+					log.Printf("failed to encode %s event: %v", kind, err)
+					continue
+				}
+				event.Data = data
+			}
+			h.send(db, workspaceID, event)
+		}
+	}
+}
+
+// changedRows are the structs the statement saved or deleted, skipping ones without an ID
+func changedRows(db *gorm.DB) []reflect.Value {
+	value := reflect.Indirect(db.Statement.ReflectValue)
+	rows := make([]reflect.Value, 0)
+	switch value.Kind() {
+	case reflect.Struct:
+		rows = append(rows, value)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			rows = append(rows, reflect.Indirect(value.Index(i)))
+		}
+	}
+
+	withID := rows[:0]
+	for _, row := range rows {
+		if row.Kind() == reflect.Struct && rowUint(db, row, "ID") != 0 {
+			withID = append(withID, row)
+		}
+	}
+	return withID
+}
+
+func rowUint(db *gorm.DB, row reflect.Value, name string) uint {
+	field := db.Statement.Schema.LookUpField(name)
+	if field == nil {
+		return 0
+	}
+	value, zero := field.ValueOf(db.Statement.Context, row)
+	if zero {
+		return 0
+	}
+	id, _ := value.(uint)
+	return id
+}
+
+// deletedIDs are the IDs from db.Delete(&Home{}, id) style deletes, which don't set them on the struct
+func deletedIDs(stmt *gorm.Statement) []uint {
+	where, ok := stmt.Clauses["WHERE"].Expression.(clause.Where)
+	if !ok {
+		return nil
+	}
+	ids := make([]uint, 0)
+	for _, expr := range where.Exprs {
+		in, ok := expr.(clause.IN)
+		if !ok || in.Column != clause.PrimaryColumn {
+			continue
+		}
+		for _, value := range in.Values {
+			switch v := reflect.ValueOf(value); v.Kind() {
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				ids = append(ids, uint(v.Uint()))
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				if v.Int() > 0 {
+					ids = append(ids, uint(v.Int()))
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// withoutImageFile leaves out image overlay files, they are large and browsers load them from /images like the map does
+func withoutImageFile(row interface{}) interface{} {
+	if overlay, ok := row.(ImageOverlay); ok {
+		overlay.File = ""
+		return overlay
+	}
+	return row
+}
+
+// eventsHandler streams the workspace's changes as server sent events named by kind
+func eventsHandler(hub *EventHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workspaceID, ok := workspaceFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Choose a workspace first", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		events, unsubscribe := hub.Subscribe(workspaceID)
+		defer unsubscribe()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				// a comment line keeps proxies from closing an idle stream
+				w.Write([]byte(": keep-alive\n\n"))
+				if flusher, ok := w.(http.Flusher); ok {
+					flusher.Flush()
+				}
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					log.Printf("failed to encode event: %v", err)
+					continue
+				}
+				writeSSEEvent(w, event.Kind, string(data))
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestEventHub(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBInit(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	hub := NewEventHub()
+	if err := hub.Register(db); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	events, unsubscribe := hub.Subscribe(defaultWorkspaceID)
+	defer unsubscribe()
+	otherEvents, unsubscribeOther := hub.Subscribe(defaultWorkspaceID + 1)
+	defer unsubscribeOther()
+
+	scoped := db.WithContext(withWorkspace(context.Background(), defaultWorkspaceID))
+	home := Home{Title: "Shortlisted", Lat: -43.53, Lng: 172.58}
+	area := "[[-43.5,172.5],[-43.6,172.5],[-43.6,172.6]]"
+
+	tests := []struct {
+		name   string
+		change func() error
+		want   []Event
+	}{
+		{name: "Create", change: func() error { return scoped.Create(&home).Error }, want: []Event{{Kind: "home", Action: EventCreate, ID: 1}}},
+		{name: "Update", change: func() error { return scoped.Model(&home).Update("title", "Favourite").Error }, want: []Event{{Kind: "home", Action: EventUpdate, ID: 1}}},
+		{name: "Delete by ID", change: func() error { return scoped.Delete(&Home{}, home.ID).Error }, want: []Event{{Kind: "home", Action: EventDelete, ID: 1}}},
+		{name: "Unscoped changes go to the row's workspace", change: func() error {
+			return db.Create(&Shape{ShapeTitle: "Park", ShapeType: "area", ShapeKind: ShapeKindGood, ShapeData: area, WorkspaceID: defaultWorkspaceID}).Error
+		}, want: []Event{{Kind: "shape", Action: EventCreate, ID: 1}}},
+		{name: "Bulk deletes have no ID", change: func() error { return scoped.Where("shape_kind = ?", ShapeKindGood).Delete(&Shape{}).Error }, want: []Event{{Kind: "shape", Action: EventDelete}}},
+		{name: "Factors aren't broadcast", change: func() error { return scoped.Create(&Factor{Title: "Sun"}).Error }},
+		{name: "Nothing changed", change: func() error { return scoped.Delete(&Home{}, 99).Error }},
+	}
+	for _, tt := range tests {
+		if err := tt.change(); err != nil {
+			t.Fatalf("%s: change error = %v", tt.name, err)
+		}
+
+		got := make([]Event, 0)
+		for len(events) > 0 {
+			event := <-events
+			event.Data = nil
+			got = append(got, event)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: events = %+v, want %+v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].Kind != tt.want[i].Kind || got[i].Action != tt.want[i].Action || got[i].ID != tt.want[i].ID {
+				t.Errorf("%s: event = %+v, want %+v", tt.name, got[i], tt.want[i])
+			}
+		}
+	}
+
+	if len(otherEvents) != 0 {
+		t.Errorf("other workspace got %d events, want none", len(otherEvents))
+	}
+}
+
+func TestEventHubTransactions(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBInit(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	hub := NewEventHub()
+	if err := hub.Register(db); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	events, unsubscribe := hub.Subscribe(defaultWorkspaceID)
+	defer unsubscribe()
+	scoped := db.WithContext(withWorkspace(context.Background(), defaultWorkspaceID))
+
+	rolledBack := errors.New("rolled back")
+	err = scoped.Transaction(func(tx *gorm.DB) error {
+		tx.Create(&Home{Title: "Never saved"})
+		return rolledBack
+	})
+	if err != rolledBack || len(events) != 0 {
+		t.Errorf("rolled back transaction = %v with %d events, want none sent", err, len(events))
+	}
+
+	err = scoped.Transaction(func(tx *gorm.DB) error {
+		tx.Create(&Home{Title: "Saved"})
+		// a nested transaction that rolls back takes its events with it
+		tx.Transaction(func(nested *gorm.DB) error {
+			nested.Create(&Shape{ShapeTitle: "Never saved", ShapeType: ShapeTypeArea, ShapeKind: ShapeKindGood, ShapeData: "[[1,1],[1,2],[2,2]]"})
+			return rolledBack
+		})
+		if len(events) != 0 {
+			t.Errorf("%d events sent before the transaction committed", len(events))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Transaction() error = %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("%d events after the commit, want the saved home's", len(events))
+	}
+	if event := <-events; event.Kind != "home" || event.Action != EventCreate {
+		t.Errorf("event = %+v, want the home created", event)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	t.Parallel()
+
+	hub := NewEventHub()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		eventsHandler(hub)(w, r.WithContext(withWorkspace(r.Context(), defaultWorkspaceID)))
+	}))
+	t.Cleanup(server.Close)
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET /events error = %v", err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", res.Header.Get("Content-Type"))
+	}
+
+	// the handler subscribes after sending headers, wait for it before publishing
+	deadline := time.Now().Add(time.Second)
+	for {
+		hub.mu.Lock()
+		subscribers := len(hub.subscribers)
+		hub.mu.Unlock()
+		if subscribers > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	hub.Publish(defaultWorkspaceID+1, Event{Kind: "home", Action: EventCreate, ID: 7})
+	hub.Publish(defaultWorkspaceID, Event{Kind: "shape", Action: EventDelete, ID: 3})
+
+	reader := bufio.NewReader(res.Body)
+	var eventName, data string
+	for len(data) == 0 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %v", err)
+		}
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			eventName = strings.TrimSpace(name)
+		}
+		if value, ok := strings.CutPrefix(line, "data: "); ok {
+			data = strings.TrimSpace(value)
+		}
+	}
+
+	var event Event
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		t.Fatalf("failed to decode event %q: %v", data, err)
+	}
+	if eventName != "shape" || event.Action != EventDelete || event.ID != 3 {
+		t.Errorf("first event = %s %+v, want only this workspace's shape delete", eventName, event)
+	}
+
+	hub.Close()
+}
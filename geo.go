@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+const earthRadiusMeters = 6371000
+
+const (
+	ShapeKindWarning = "warning"
+	ShapeKindNoGo    = "noGo"
+	ShapeKindGood    = "good"
+)
+
+type LatLng struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// parseShapeRings reads Shape.ShapeData, which is whatever Leaflet gave us: a list of [lat, lng] pairs,
+// a list of {"lat", "lng"} objects, or either of those nested as rings where the first is the outline and the rest are holes
+func parseShapeRings(shapeData string) ([][]LatLng, error) {
+	var raw interface{}
+	if err := json.Unmarshal([]byte(shapeData), &raw); err != nil {
+		return nil, fmt.Errorf("invalid shape data: %w", err)
+	}
+
+	var rings [][]LatLng
+	if err := collectRings(raw, &rings); err != nil {
+		return nil, err
+	}
+	if len(rings) == 0 {
+		return nil, errors.New("invalid shape data: no points")
+	}
+	return rings, nil
+}
+
+func collectRings(raw interface{}, rings *[][]LatLng) error {
+	list, ok := raw.([]interface{})
+	if !ok || len(list) == 0 {
+		return fmt.Errorf("invalid shape data: expected a list, got %v", raw)
+	}
+
+	// a ring is a list of points, otherwise this is a list of rings (or of polygons, which are flattened)
+	if _, isPoint := parseLatLng(list[0]); !isPoint {
+		for _, item := range list {
+			if err := collectRings(item, rings); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ring := make([]LatLng, 0, len(list))
+	for _, item := range list {
+		p, ok := parseLatLng(item)
+		if !ok {
+			return fmt.Errorf("invalid shape point %v", item)
+		}
+		ring = append(ring, p)
+	}
+	*rings = append(*rings, ring)
+	return nil
+}
+
+// parseLatLng accepts [lat, lng] or {"lat": .., "lng": ..}
+func parseLatLng(raw interface{}) (LatLng, bool) {
+	switch v := raw.(type) {
+	case []interface{}:
+		if len(v) < 2 {
+			return LatLng{}, false
+		}
+		lat, latOK := v[0].(float64)
+		lng, lngOK := v[1].(float64)
+		return LatLng{Lat: lat, Lng: lng}, latOK && lngOK
+	case map[string]interface{}:
+		lat, latOK := v["lat"].(float64)
+		lng, lngOK := v["lng"].(float64)
+		return LatLng{Lat: lat, Lng: lng}, latOK && lngOK
+	}
+	return LatLng{}, false
+}
+
+// parseShapeLatLngs is the outline of a shape, ignoring any holes
+func parseShapeLatLngs(shapeData string) ([]LatLng, error) {
+	rings, err := parseShapeRings(shapeData)
+	if err != nil {
+		return nil, err
+	}
+	return rings[0], nil
+}
+
+func haversineMeters(a LatLng, b LatLng) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := (b.Lat - a.Lat) * math.Pi / 180
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(h))
+}
+
+// distanceToShapeMeters is how far p is from the nearest edge of the shape.
+// Edges are measured on a flat projection around p, which is plenty accurate at city scale.
+func distanceToShapeMeters(p LatLng, shape []LatLng) float64 {
+	if len(shape) == 0 {
+		return math.Inf(1)
+	}
+	if len(shape) == 1 {
+		return haversineMeters(p, shape[0])
+	}
+
+	// project to meters relative to p
+	mPerLat := earthRadiusMeters * math.Pi / 180
+	mPerLng := mPerLat * math.Cos(p.Lat*math.Pi/180)
+	project := func(v LatLng) (float64, float64) {
+		return (v.Lng - p.Lng) * mPerLng, (v.Lat - p.Lat) * mPerLat
+	}
+
+	best := math.Inf(1)
+	for i := range shape {
+		ax, ay := project(shape[i])
+		bx, by := project(shape[(i+1)%len(shape)])
+
+		dx, dy := bx-ax, by-ay
+		t := 0.0
+		if lengthSq := dx*dx + dy*dy; lengthSq > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lengthSq))
+		}
+		cx, cy := ax+t*dx, ay+t*dy
+		best = math.Min(best, math.Hypot(cx, cy))
+	}
+	return best
+}
+
+// pointInShape is true when p is inside the polygon, using the even-odd rule on lat/lng as if they were flat
+func pointInShape(p LatLng, shape []LatLng) bool {
+	if len(shape) < 3 {
+		return false
+	}
+
+	inside := false
+	for i, j := 0, len(shape)-1; i < len(shape); j, i = i, i+1 {
+		a, b := shape[i], shape[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) && p.Lng < (b.Lng-a.Lng)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// ringsContain applies the even-odd rule across every ring, so a point in a hole is outside
+func ringsContain(rings [][]LatLng, p LatLng) bool {
+	inside := false
+	for _, ring := range rings {
+		if pointInShape(p, ring) {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// ShapeGeometry is a Shape with its ShapeData parsed
+type ShapeGeometry struct {
+	Shape
+	Rings [][]LatLng
+}
+
+func (sg ShapeGeometry) Contains(p LatLng) bool {
+	return ringsContain(sg.Rings, p)
+}
+
+// GetShapeGeometries parses every area, shapes with bad ShapeData are logged and left out.
+// Routes are lines so nothing is inside them.
+func GetShapeGeometries(db *gorm.DB) []ShapeGeometry {
+	shapes := GetShapes(db)
+	geometries := make([]ShapeGeometry, 0, len(shapes))
+	for _, shape := range shapes {
+		if shape.ShapeType == ShapeTypeRoute {
+			continue
+		}
+		rings, err := parseShapeRings(shape.ShapeData)
+		if err != nil {
+			log.Printf("skipping shape %d: %v", shape.ID, err)
+			continue
+		}
+		geometries = append(geometries, ShapeGeometry{Shape: shape, Rings: rings})
+	}
+	return geometries
+}
+
+// containingShapes is every shape p is inside
+func containingShapes(geometries []ShapeGeometry, p LatLng) []Shape {
+	shapes := make([]Shape, 0)
+	for _, geometry := range geometries {
+		if geometry.Contains(p) {
+			shapes = append(shapes, geometry.Shape)
+		}
+	}
+	return shapes
+}
+
+// GetContainingShapes is every shape containing p
+func GetContainingShapes(db *gorm.DB, p LatLng) []Shape {
+	return containingShapes(GetShapeGeometries(db), p)
+}
+
+// GetHomeAreas is the shapes containing each home, keyed by home ID
+func GetHomeAreas(db *gorm.DB, homes []Home) map[uint][]Shape {
+	geometries := GetShapeGeometries(db)
+	areas := make(map[uint][]Shape, len(homes))
+	for _, home := range homes {
+		areas[home.ID] = containingShapes(geometries, LatLng{Lat: home.Lat, Lng: home.Lng})
+	}
+	return areas
+}
+
+// parseLatLngQuery reads lat and lng from the query string
+func parseLatLngQuery(r *http.Request) (LatLng, error) {
+	lat, err := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return LatLng{}, fmt.Errorf("lat must be a number from -90 to 90")
+	}
+	lng, err := strconv.ParseFloat(r.URL.Query().Get("lng"), 64)
+	if err != nil || lng < -180 || lng > 180 {
+		return LatLng{}, fmt.Errorf("lng must be a number from -180 to 180")
+	}
+	return LatLng{Lat: lat, Lng: lng}, nil
+}
+
+// containingShapesHandler returns the shapes containing ?lat=&lng= as JSON
+func containingShapesHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		p, err := parseLatLngQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GetContainingShapes(db, p))
+	}
+}
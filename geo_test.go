@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDistanceToShapeMeters(t *testing.T) {
+	t.Parallel()
+
+	// roughly 111m per 0.001 degree of latitude
+	square := []LatLng{{-43.530, 172.580}, {-43.530, 172.590}, {-43.540, 172.590}, {-43.540, 172.580}}
+
+	tests := []struct {
+		name  string
+		point LatLng
+		shape []LatLng
+		want  float64
+	}{
+		{
+			name:  "Point on an edge",
+			point: LatLng{-43.530, 172.585},
+			shape: square,
+			want:  0,
+		},
+		{
+			name:  "Point north of the top edge",
+			point: LatLng{-43.529, 172.585},
+			shape: square,
+			want:  111,
+		},
+		{
+			name:  "Single point shape",
+			point: LatLng{-43.529, 172.580},
+			shape: []LatLng{{-43.530, 172.580}},
+			want:  111,
+		},
+		{
+			name:  "Empty shape",
+			point: LatLng{-43.529, 172.580},
+			shape: nil,
+			want:  math.Inf(1),
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got := distanceToShapeMeters(tt.point, tt.shape)
+			if math.IsInf(tt.want, 1) {
+				if !math.IsInf(got, 1) {
+					t.Errorf("distanceToShapeMeters() = %v, want +Inf", got)
+				}
+				return
+			}
+			if math.Abs(got-tt.want) > 2 {
+				t.Errorf("distanceToShapeMeters() = %v, want about %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPointInShape(t *testing.T) {
+	t.Parallel()
+
+	// an L shape, the notch at the top right is outside
+	shape := []LatLng{{0, 0}, {0, 2}, {1, 2}, {1, 1}, {2, 1}, {2, 0}}
+
+	tests := []struct {
+		name  string
+		point LatLng
+		want  bool
+	}{
+		{name: "Inside the foot", point: LatLng{0.5, 1.5}, want: true},
+		{name: "Inside the stem", point: LatLng{1.5, 0.5}, want: true},
+		{name: "In the notch", point: LatLng{1.5, 1.5}, want: false},
+		{name: "Outside", point: LatLng{3, 3}, want: false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := pointInShape(tt.point, shape); got != tt.want {
+				t.Errorf("pointInShape(%v) = %v, want %v", tt.point, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseShapeRings(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		shapeData string
+		want      [][]LatLng
+		wantErr   bool
+	}{
+		{
+			name:      "Pairs",
+			shapeData: "[[0,0],[0,1],[1,1]]",
+			want:      [][]LatLng{{{0, 0}, {0, 1}, {1, 1}}},
+		},
+		{
+			name:      "Leaflet latlng objects",
+			shapeData: `[{"lat":0,"lng":0},{"lat":0,"lng":1},{"lat":1,"lng":1}]`,
+			want:      [][]LatLng{{{0, 0}, {0, 1}, {1, 1}}},
+		},
+		{
+			name:      "Outline with a hole",
+			shapeData: `[[{"lat":0,"lng":0},{"lat":0,"lng":4},{"lat":4,"lng":4}],[[1,1],[1,2],[2,2]]]`,
+			want:      [][]LatLng{{{0, 0}, {0, 4}, {4, 4}}, {{1, 1}, {1, 2}, {2, 2}}},
+		},
+		{
+			name:      "Not JSON",
+			shapeData: "circle",
+			wantErr:   true,
+		},
+		{
+			name:      "Empty",
+			shapeData: "[]",
+			wantErr:   true,
+		},
+		{
+			name:      "Bad point",
+			shapeData: `[[0,0],["a","b"]]`,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseShapeRings(tt.shapeData)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseShapeRings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("parseShapeRings() = %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestContainingShapesHandler(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBInit(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	db.Create(&[]Shape{
+		{ShapeTitle: "Suburb", ShapeKind: ShapeKindGood, ShapeData: "[[0,0],[0,4],[4,4],[4,0]]"},
+		{ShapeTitle: "Swamp", ShapeKind: ShapeKindNoGo, ShapeData: "[[[1,1],[1,2],[2,2],[2,1]],[[1.4,1.4],[1.4,1.6],[1.6,1.6],[1.6,1.4]]]"},
+		{ShapeTitle: "Broken", ShapeKind: ShapeKindWarning, ShapeData: "not a shape"},
+	})
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		want       []string
+	}{
+		{name: "Inside both", query: "lat=1.2&lng=1.2", wantStatus: 200, want: []string{"Suburb", "Swamp"}},
+		{name: "In the hole of the swamp", query: "lat=1.5&lng=1.5", wantStatus: 200, want: []string{"Suburb"}},
+		{name: "Outside everything", query: "lat=10&lng=10", wantStatus: 200, want: []string{}},
+		{name: "Missing lng", query: "lat=1", wantStatus: 400},
+		{name: "Lat out of range", query: "lat=91&lng=1", wantStatus: 400},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			containingShapesHandler(db).ServeHTTP(rec, httptest.NewRequest("GET", "/shapes/containing?"+tt.query, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("GET /shapes/containing?%s status = %d, want %d", tt.query, rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != 200 {
+				return
+			}
+
+			var shapes []Shape
+			if err := json.NewDecoder(rec.Body).Decode(&shapes); err != nil {
+				t.Fatalf("GET /shapes/containing?%s invalid JSON: %v", tt.query, err)
+			}
+			got := make([]string, 0, len(shapes))
+			for _, shape := range shapes {
+				got = append(got, shape.ShapeTitle)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("GET /shapes/containing?%s = %v, want %v", tt.query, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("GET /shapes/containing?%s = %v, want %v", tt.query, got, tt.want)
+				}
+			}
+		})
+	}
+
+	homes := []Home{{Lat: 1.2, Lng: 1.2, Title: "Swampy"}, {Lat: 3, Lng: 3, Title: "Dry"}}
+	db.Create(&homes)
+	areas := GetHomeAreas(db, homes)
+	if len(areas[homes[0].ID]) != 2 || len(areas[homes[1].ID]) != 1 {
+		t.Errorf("GetHomeAreas() = %+v, want Swampy in both areas and Dry in the suburb", areas)
+	}
+
+	rec := httptest.NewRecorder()
+	pointListTable(homes, nil, areas, HomeSortDefault, "").Render(GetContext(httptest.NewRequest("GET", "/", nil)), rec)
+	if !contains(rec.Body.String(), "Inside no-go area: Swamp") || !contains(rec.Body.String(), "Suburb") {
+		t.Errorf("pointListTable() = %q, want the no-go flag", rec.Body.String())
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	GeoJSONKindHome  = "home"
+	GeoJSONKindPoint = "point"
+	GeoJSONKindShape = "shape"
+)
+
+// GeoJSONFeatureCollection is RFC 7946 GeoJSON, coordinates are [lng, lat] in WGS 84
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+	CRS      json.RawMessage  `json:"crs,omitempty"` // only read, older QGIS versions still write it
+}
+
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *GeoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// ExportGeoJSON is every home, fractal search point and shape in the workspace as one FeatureCollection.
+// Each feature's kind property says which it is, shapes with data that can't be read are left out.
+func ExportGeoJSON(db *gorm.DB) (*GeoJSONFeatureCollection, error) {
+	collection := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]GeoJSONFeature, 0)}
+
+	var homes []Home
+	if err := db.Order("id").Find(&homes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get homes: %w", err)
+	}
+	stars, err := GetAverageStars(db)
+	if err != nil {
+		return nil, err
+	}
+	factorTitles := make(map[uint]string)
+	for _, factor := range GetFactors(db) {
+		factorTitles[factor.ID] = factor.Title
+	}
+	for _, home := range homes {
+		ratings := make(map[string]float64)
+		for factorID, average := range stars[home.ID] {
+			if title, ok := factorTitles[factorID]; ok {
+				ratings[title] = average
+			}
+		}
+		collection.Features = append(collection.Features, pointFeature(LatLng{Lat: home.Lat, Lng: home.Lng}, map[string]interface{}{
+			"kind":       GeoJSONKindHome,
+			"id":         home.ID,
+			"title":      home.Title,
+			"notes":      home.Notes,
+			"url":        home.Url,
+			"address":    home.CleanAddress,
+			"point_type": home.PointType,
+			"ratings":    ratings,
+		}))
+	}
+
+	var points []Point
+	if err := db.Order("id").Find(&points).Error; err != nil {
+		return nil, fmt.Errorf("failed to get points: %w", err)
+	}
+	for _, point := range points {
+		collection.Features = append(collection.Features, pointFeature(LatLng{Lat: point.Lat, Lng: point.Lng}, map[string]interface{}{
+			"kind":              GeoJSONKindPoint,
+			"id":                point.ID,
+			"title":             point.Title,
+			"notes":             point.Description,
+			"url":               point.Url,
+			"address":           point.CleanAddress,
+			"point_type":        point.PointType,
+			"fractal_search_id": point.FractalSearchID,
+		}))
+	}
+
+	var shapes []Shape
+	if err := db.Order("id").Find(&shapes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get shapes: %w", err)
+	}
+	for _, shape := range shapes {
+		geometry, err := shapeGeoJSON(shape.ShapeData)
+		if shape.ShapeType == ShapeTypeRoute {
+			geometry, err = routeGeoJSON(shape.ShapeData)
+		}
+		if err != nil {
+			continue
+		}
+		collection.Features = append(collection.Features, GeoJSONFeature{
+			Type:     "Feature",
+			Geometry: geometry,
+			Properties: map[string]interface{}{
+				"kind":       GeoJSONKindShape,
+				"id":         shape.ID,
+				"title":      shape.ShapeTitle,
+				"shape_type": shape.ShapeType,
+				"shape_kind": shape.ShapeKind,
+			},
+		})
+	}
+	return &collection, nil
+}
+
+func pointFeature(p LatLng, properties map[string]interface{}) GeoJSONFeature {
+	coordinates, _ := json.Marshal([]float64{p.Lng, p.Lat})
+	return GeoJSONFeature{
+		Type:       "Feature",
+		Geometry:   &GeoJSONGeometry{Type: "Point", Coordinates: coordinates},
+		Properties: properties,
+	}
+}
+
+// shapeGeoJSON turns ShapeData into a Polygon, or a MultiPolygon when Leaflet nested several polygons.
+// GeoJSON rings are closed, Leaflet's aren't.
+func shapeGeoJSON(shapeData string) (*GeoJSONGeometry, error) {
+	if _, err := parseShapeRings(shapeData); err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	if err := json.Unmarshal([]byte(shapeData), &raw); err != nil {
+		return nil, err
+	}
+
+	// a list of points is one ring, a list of rings is a polygon and deeper is a list of polygons
+	polygons := make([][][][]float64, 0)
+	var collect func(list []interface{})
+	collect = func(list []interface{}) {
+		if _, isPoint := parseLatLng(list[0]); isPoint {
+			polygons = append(polygons, [][][]float64{geoJSONRing(list)})
+			return
+		}
+		if ring, ok := list[0].([]interface{}); ok {
+			if _, isPoint := parseLatLng(ring[0]); isPoint {
+				polygon := make([][][]float64, 0, len(list))
+				for _, ring := range list {
+					polygon = append(polygon, geoJSONRing(ring.([]interface{})))
+				}
+				polygons = append(polygons, polygon)
+				return
+			}
+		}
+		for _, item := range list {
+			collect(item.([]interface{}))
+		}
+	}
+	collect(raw.([]interface{}))
+
+	geometry := GeoJSONGeometry{Type: "Polygon"}
+	var coordinates []byte
+	if len(polygons) == 1 {
+		coordinates, _ = json.Marshal(polygons[0])
+	} else {
+		geometry.Type = "MultiPolygon"
+		coordinates, _ = json.Marshal(polygons)
+	}
+	geometry.Coordinates = coordinates
+	return &geometry, nil
+}
+
+// routeGeoJSON turns a route's ShapeData into a LineString, or a MultiLineString for a track with several segments
+func routeGeoJSON(shapeData string) (*GeoJSONGeometry, error) {
+	lines, err := parseShapeRings(shapeData)
+	if err != nil {
+		return nil, err
+	}
+	positions := make([][][]float64, 0, len(lines))
+	for _, line := range lines {
+		positions = append(positions, lngLatPositions(line))
+	}
+
+	geometry := GeoJSONGeometry{Type: "LineString"}
+	var coordinates []byte
+	if len(positions) == 1 {
+		coordinates, _ = json.Marshal(positions[0])
+	} else {
+		geometry.Type = "MultiLineString"
+		coordinates, _ = json.Marshal(positions)
+	}
+	geometry.Coordinates = coordinates
+	return &geometry, nil
+}
+
+func lngLatPositions(points []LatLng) [][]float64 {
+	positions := make([][]float64, 0, len(points))
+	for _, p := range points {
+		positions = append(positions, []float64{p.Lng, p.Lat})
+	}
+	return positions
+}
+
+// geoJSONRing is a ring of ShapeData points as closed [lng, lat] positions
+func geoJSONRing(points []interface{}) [][]float64 {
+	ring := make([][]float64, 0, len(points)+1)
+	for _, point := range points {
+		p, _ := parseLatLng(point)
+		ring = append(ring, []float64{p.Lng, p.Lat})
+	}
+	if first, last := ring[0], ring[len(ring)-1]; first[0] != last[0] || first[1] != last[1] {
+		ring = append(ring, first)
+	}
+	return ring
+}
+
+// ParseGeoJSONImport reads an uploaded FeatureCollection, or a single Feature. Points become homes, polygons
+// become areas and lines become routes. Features that can't be imported are listed in Skipped, e.g. search points from an export.
+func ParseGeoJSONImport(data []byte, kinds ShapeKinds) (*MapImport, error) {
+	var collection GeoJSONFeatureCollection
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, fmt.Errorf("Not GeoJSON - %s", err)
+	}
+	switch collection.Type {
+	case "FeatureCollection":
+	case "Feature":
+		var feature GeoJSONFeature
+		if err := json.Unmarshal(data, &feature); err != nil {
+			return nil, fmt.Errorf("Not GeoJSON - %s", err)
+		}
+		collection.Features = []GeoJSONFeature{feature}
+	default:
+		return nil, fmt.Errorf("Expected a FeatureCollection or Feature, got %q", collection.Type)
+	}
+	if len(collection.CRS) > 0 && !strings.Contains(string(collection.CRS), "CRS84") && !strings.Contains(string(collection.CRS), "4326") {
+		return nil, errors.New("Coordinates must be WGS 84 longitude and latitude (EPSG:4326), reproject the layer before exporting it")
+	}
+
+	imported := newMapImport()
+	for i, feature := range collection.Features {
+		title := geoJSONString(feature.Properties, "title", "name", "Name", "NAME")
+		label := fmt.Sprintf("Feature %d", i+1)
+		if len(title) > 0 {
+			label = fmt.Sprintf("Feature %d (%s)", i+1, title)
+		}
+		if feature.Geometry == nil {
+			imported.skip(label, "no geometry")
+			continue
+		}
+
+		layer := geoJSONString(feature.Properties, "layer")
+		switch feature.Geometry.Type {
+		case "Point":
+			if geoJSONString(feature.Properties, "kind") == GeoJSONKindPoint {
+				imported.skip(label, "search points aren't imported, run the search again instead")
+				continue
+			}
+			var position []float64
+			if err := json.Unmarshal(feature.Geometry.Coordinates, &position); err != nil || len(position) < 2 {
+				imported.skip(label, "a Point needs [longitude, latitude]")
+				continue
+			}
+			imported.addHome(label, LatLng{Lat: position[1], Lng: position[0]}, Home{
+				PointType:    geoJSONString(feature.Properties, "point_type"),
+				Title:        title,
+				Notes:        geoJSONString(feature.Properties, "notes", "description"),
+				Url:          geoJSONString(feature.Properties, "url"),
+				CleanAddress: geoJSONString(feature.Properties, "address"),
+			})
+		case "Polygon", "MultiPolygon":
+			shapeData, err := geoJSONShapeData(*feature.Geometry)
+			if err != nil {
+				imported.skip(label, err.Error())
+				continue
+			}
+			imported.addShape(label, layer, kinds, geoJSONString(feature.Properties, "shape_kind"), Shape{
+				ShapeData:  shapeData,
+				ShapeTitle: title,
+				ShapeType:  ShapeTypeArea,
+			})
+		case "LineString", "MultiLineString":
+			shapeData, err := geoJSONRouteData(*feature.Geometry)
+			if err != nil {
+				imported.skip(label, err.Error())
+				continue
+			}
+			imported.addShape(label, layer, kinds, geoJSONString(feature.Properties, "shape_kind"), Shape{
+				ShapeData:  shapeData,
+				ShapeTitle: title,
+				ShapeType:  ShapeTypeRoute,
+			})
+		default:
+			imported.skip(label, fmt.Sprintf("%s geometries aren't supported, only points, lines and polygons", feature.Geometry.Type))
+		}
+	}
+	return imported, nil
+}
+
+// geoJSONString is the first of the properties that is set, as a string
+func geoJSONString(properties map[string]interface{}, names ...string) string {
+	for _, name := range names {
+		switch v := properties[name].(type) {
+		case string:
+			if len(strings.TrimSpace(v)) > 0 {
+				return strings.TrimSpace(v)
+			}
+		case float64:
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+// geoJSONShapeData turns a Polygon or MultiPolygon into an area's ShapeData
+func geoJSONShapeData(geometry GeoJSONGeometry) (string, error) {
+	var polygons [][][][]float64
+	if geometry.Type == "Polygon" {
+		var polygon [][][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &polygon); err != nil {
+			return "", errors.New("a Polygon needs a list of rings of [longitude, latitude]")
+		}
+		polygons = [][][][]float64{polygon}
+	} else if err := json.Unmarshal(geometry.Coordinates, &polygons); err != nil {
+		return "", errors.New("a MultiPolygon needs a list of polygons of [longitude, latitude] rings")
+	}
+
+	converted := make([][][]LatLng, 0, len(polygons))
+	for _, polygon := range polygons {
+		rings := make([][]LatLng, 0, len(polygon))
+		for _, ring := range polygon {
+			points := make([]LatLng, 0, len(ring))
+			for _, position := range ring {
+				if len(position) < 2 {
+					return "", errors.New("positions need a longitude and latitude")
+				}
+				points = append(points, LatLng{Lat: position[1], Lng: position[0]})
+			}
+			rings = append(rings, points)
+		}
+		converted = append(converted, rings)
+	}
+	return areaShapeData(converted)
+}
+
+// geoJSONRouteData turns a LineString or MultiLineString into a route's ShapeData, a list of [lat, lng]
+// or a list of those for each line
+func geoJSONRouteData(geometry GeoJSONGeometry) (string, error) {
+	var lines [][][]float64
+	if geometry.Type == "LineString" {
+		var line [][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &line); err != nil {
+			return "", errors.New("a LineString needs a list of [longitude, latitude]")
+		}
+		lines = [][][]float64{line}
+	} else if err := json.Unmarshal(geometry.Coordinates, &lines); err != nil {
+		return "", errors.New("a MultiLineString needs a list of lines of [longitude, latitude]")
+	}
+
+	converted := make([][]LatLng, 0, len(lines))
+	for _, line := range lines {
+		points := make([]LatLng, 0, len(line))
+		for _, position := range line {
+			if len(position) < 2 {
+				return "", errors.New("positions need a longitude and latitude")
+			}
+			points = append(points, LatLng{Lat: position[1], Lng: position[0]})
+		}
+		converted = append(converted, points)
+	}
+	return routeShapeData(converted)
+}
+
+// geoJSONExportHandler downloads the workspace's homes, points and shapes for QGIS or another map
+func geoJSONExportHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		collection, err := ExportGeoJSON(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/geo+json")
+		w.Header().Set("Content-Disposition", `attachment; filename="honing-inn.geojson"`)
+		json.NewEncoder(w).Encode(collection)
+	}
+}
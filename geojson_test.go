@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestShapeGeoJSONRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		shapeData string
+		wantType  string
+		wantCoord string
+	}{
+		{name: "Ring", shapeData: "[[1,2],[1,3],[2,3]]", wantType: "Polygon", wantCoord: "[[[2,1],[3,1],[3,2],[2,1]]]"},
+		{name: "Lat lng objects", shapeData: `[{"lat":1,"lng":2},{"lat":1,"lng":3},{"lat":2,"lng":3}]`, wantType: "Polygon", wantCoord: "[[[2,1],[3,1],[3,2],[2,1]]]"},
+		{name: "Hole", shapeData: "[[[0,0],[0,10],[10,10],[10,0]],[[1,1],[1,2],[2,2]]]", wantType: "Polygon", wantCoord: "[[[0,0],[10,0],[10,10],[0,10],[0,0]],[[1,1],[2,1],[2,2],[1,1]]]"},
+		{name: "Two polygons", shapeData: "[[[[1,1],[1,2],[2,2]]],[[[5,5],[5,6],[6,6]]]]", wantType: "MultiPolygon", wantCoord: "[[[[1,1],[2,1],[2,2],[1,1]]],[[[5,5],[6,5],[6,6],[5,5]]]]"},
+	}
+	for _, tt := range tests {
+		geometry, err := shapeGeoJSON(tt.shapeData)
+		if err != nil {
+			t.Errorf("%s: shapeGeoJSON() error = %v", tt.name, err)
+			continue
+		}
+		if geometry.Type != tt.wantType || string(geometry.Coordinates) != tt.wantCoord {
+			t.Errorf("%s: shapeGeoJSON() = %s %s, want %s %s", tt.name, geometry.Type, geometry.Coordinates, tt.wantType, tt.wantCoord)
+		}
+
+		shapeData, err := geoJSONShapeData(*geometry)
+		if err != nil {
+			t.Errorf("%s: geoJSONShapeData() error = %v", tt.name, err)
+			continue
+		}
+		again, _ := shapeGeoJSON(shapeData)
+		if again == nil || string(again.Coordinates) != tt.wantCoord {
+			t.Errorf("%s: round trip gave %s, want %s", tt.name, shapeData, tt.wantCoord)
+		}
+	}
+
+	if _, err := shapeGeoJSON("nope"); err == nil {
+		t.Errorf("shapeGeoJSON(nope) error = nil, want an error")
+	}
+}
+
+func TestParseGeoJSONImport(t *testing.T) {
+	t.Parallel()
+
+	square := `{"type":"Polygon","coordinates":[[[172,-43],[173,-43],[173,-44],[172,-43]]]}`
+	tests := []struct {
+		name        string
+		data        string
+		shapeKind   string
+		wantErr     string
+		wantHomes   int
+		wantShapes  int
+		wantKind    string
+		wantType    string
+		wantTitle   string
+		wantSkipped string
+	}{
+		{name: "Not JSON", data: "nope", shapeKind: ShapeKindNoGo, wantErr: "Not GeoJSON"},
+		{name: "Geometry on its own", data: square, shapeKind: ShapeKindNoGo, wantErr: "Expected a FeatureCollection or Feature"},
+		{name: "Projected", data: `{"type":"FeatureCollection","crs":{"type":"name","properties":{"name":"urn:ogc:def:crs:EPSG::2193"}},"features":[]}`, shapeKind: ShapeKindNoGo, wantErr: "EPSG:4326"},
+		{name: "Single feature", data: `{"type":"Feature","geometry":` + square + `,"properties":{"name":"Flood zone"}}`, shapeKind: ShapeKindNoGo, wantShapes: 1, wantKind: ShapeKindNoGo, wantType: ShapeTypeArea, wantTitle: "Flood zone"},
+		{name: "Kind from properties", data: `{"type":"FeatureCollection","crs":{"type":"name","properties":{"name":"urn:ogc:def:crs:OGC:1.3:CRS84"}},"features":[{"type":"Feature","geometry":` + square + `,"properties":{"shape_kind":"good"}}]}`, shapeKind: ShapeKindNoGo, wantShapes: 1, wantKind: ShapeKindGood, wantType: ShapeTypeArea},
+		{name: "Kind from a QGIS merged layer", data: `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":` + square + `,"properties":{"layer":"No Go"}}]}`, shapeKind: ShapeKindWarning, wantShapes: 1, wantKind: ShapeKindNoGo, wantType: ShapeTypeArea},
+		{name: "Point is a home", data: `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[172.5,-43.5]},"properties":{"title":"Villa"}}]}`, shapeKind: ShapeKindNoGo, wantHomes: 1, wantTitle: "Villa"},
+		{name: "Off the map", data: `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[-43.5,172.5]},"properties":{}}]}`, shapeKind: ShapeKindNoGo, wantSkipped: "isn't a longitude and latitude"},
+		{name: "Search points are skipped", data: `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[172.5,-43.5]},"properties":{"kind":"point"}}]}`, shapeKind: ShapeKindNoGo, wantSkipped: "search points"},
+		{name: "Lines are routes", data: `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"LineString","coordinates":[[172,-43],[173,-43]]},"properties":{}}]}`, shapeKind: ShapeKindGood, wantShapes: 1, wantKind: ShapeKindGood, wantType: ShapeTypeRoute},
+		{name: "A line needs two points", data: `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"LineString","coordinates":[[172,-43]]},"properties":{}}]}`, shapeKind: ShapeKindNoGo, wantSkipped: "at least 2 points"},
+		{name: "Collections are skipped", data: `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"GeometryCollection","geometries":[]},"properties":{}}]}`, shapeKind: ShapeKindNoGo, wantSkipped: "GeometryCollection"},
+		{name: "Open ring", data: `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[172,-43],[173,-43]]]},"properties":{}}]}`, shapeKind: ShapeKindNoGo, wantSkipped: "at least 3 points"},
+	}
+	for _, tt := range tests {
+		imported, err := ParseGeoJSONImport([]byte(tt.data), ShapeKinds{Default: tt.shapeKind})
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: ParseGeoJSONImport() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ParseGeoJSONImport() error = %v", tt.name, err)
+			continue
+		}
+		if len(imported.Homes) != tt.wantHomes || len(imported.Shapes) != tt.wantShapes {
+			t.Errorf("%s: got %d homes and %d shapes, want %d and %d", tt.name, len(imported.Homes), len(imported.Shapes), tt.wantHomes, tt.wantShapes)
+			continue
+		}
+		if tt.wantShapes > 0 && (imported.Shapes[0].ShapeKind != tt.wantKind || imported.Shapes[0].ShapeType != tt.wantType) {
+			t.Errorf("%s: shape = %+v, want a %s %s", tt.name, imported.Shapes[0], tt.wantKind, tt.wantType)
+		}
+		if len(tt.wantTitle) > 0 {
+			var title string
+			if tt.wantHomes > 0 {
+				title = imported.Homes[0].Title
+			} else {
+				title = imported.Shapes[0].ShapeTitle
+			}
+			if title != tt.wantTitle {
+				t.Errorf("%s: title = %q, want %q", tt.name, title, tt.wantTitle)
+			}
+		}
+		if tt.wantHomes > 0 && (imported.Homes[0].Lat != -43.5 || imported.Homes[0].Lng != 172.5 || imported.Homes[0].PointType != "Home") {
+			t.Errorf("%s: home = %+v, want a Home at -43.5, 172.5", tt.name, imported.Homes[0])
+		}
+		if len(tt.wantSkipped) > 0 && (len(imported.Skipped) != 1 || !strings.Contains(imported.Skipped[0], tt.wantSkipped)) {
+			t.Errorf("%s: Skipped = %q, want %q", tt.name, imported.Skipped, tt.wantSkipped)
+		}
+	}
+}
+
+func TestGeoJSONHandlers(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBInit(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	scoped := db.WithContext(withWorkspace(context.Background(), defaultWorkspaceID))
+	home := Home{Title: "Villa", Lat: -43.5, Lng: 172.5, PointType: "Home"}
+	scoped.Create(&home)
+	factor := Factor{Title: "Sun"}
+	scoped.Create(&factor)
+	scoped.Create(&HomeFactorRating{HomeID: home.ID, FactorID: factor.ID, Stars: 4, Rater: "sam"})
+	scoped.Create(&Shape{ShapeTitle: "Flood zone", ShapeType: ShapeTypeArea, ShapeKind: ShapeKindNoGo, ShapeData: "[[-43,172],[-43,173],[-44,173]]"})
+	scoped.Create(&Shape{ShapeTitle: "School walk", ShapeType: ShapeTypeRoute, ShapeKind: ShapeKindGood, ShapeData: "[[-43.5,172.5],[-43.51,172.52]]"})
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(withWorkspace(r.Context(), defaultWorkspaceID)))
+		})
+	})
+	r.Get("/export.geojson", geoJSONExportHandler(db))
+	r.Post("/import", mapImportHandler(db))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/export.geojson", nil))
+	if rec.Header().Get("Content-Type") != "application/geo+json" {
+		t.Errorf("export Content-Type = %q, want application/geo+json", rec.Header().Get("Content-Type"))
+	}
+	exported := rec.Body.Bytes()
+	var collection GeoJSONFeatureCollection
+	if err := json.Unmarshal(exported, &collection); err != nil || len(collection.Features) != 3 {
+		t.Fatalf("export = %s, want a home, an area and a route", exported)
+	}
+	if ratings, _ := collection.Features[0].Properties["ratings"].(map[string]interface{}); ratings["Sun"] != 4.0 {
+		t.Errorf("home ratings = %v, want Sun: 4", collection.Features[0].Properties["ratings"])
+	}
+	if route := collection.Features[2].Geometry; route.Type != "LineString" || string(route.Coordinates) != "[[172.5,-43.5],[172.52,-43.51]]" {
+		t.Errorf("route = %s %s, want a LineString", route.Type, route.Coordinates)
+	}
+
+	importFile := func(dryRun bool) string {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "honing-inn.geojson")
+		part.Write(exported)
+		form.WriteField("shapeKind", ShapeKindWarning)
+		if dryRun {
+			form.WriteField("dryRun", "on")
+		}
+		form.Close()
+		req := httptest.NewRequest("POST", "/import", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	tests := []struct {
+		name       string
+		dryRun     bool
+		want       string
+		wantHomes  int64
+		wantShapes int64
+	}{
+		{name: "Preview", dryRun: true, want: "Would create 1 homes, 0 points and 2 shapes", wantHomes: 1, wantShapes: 2},
+		{name: "Import", want: "Imported 1 homes, 0 points and 2 shapes", wantHomes: 2, wantShapes: 4},
+	}
+	for _, tt := range tests {
+		if body := importFile(tt.dryRun); !strings.Contains(body, tt.want) {
+			t.Errorf("%s: body missing %q", tt.name, tt.want)
+		}
+		var homes, shapes int64
+		scoped.Model(&Home{}).Count(&homes)
+		scoped.Model(&Shape{}).Count(&shapes)
+		if homes != tt.wantHomes || shapes != tt.wantShapes {
+			t.Errorf("%s: %d homes and %d shapes, want %d and %d", tt.name, homes, shapes, tt.wantHomes, tt.wantShapes)
+		}
+	}
+
+	var shapes []Shape
+	scoped.Order("id").Offset(2).Find(&shapes)
+	if len(shapes) != 2 || shapes[0].ShapeKind != ShapeKindNoGo || shapes[0].ShapeTitle != "Flood zone" || shapes[0].ShapeData != "[[-43,172],[-43,173],[-44,173]]" {
+		t.Errorf("imported shapes = %+v, want the exported area back", shapes)
+	} else if shapes[1].ShapeType != ShapeTypeRoute || shapes[1].ShapeKind != ShapeKindGood || shapes[1].ShapeData != "[[-43.5,172.5],[-43.51,172.52]]" {
+		t.Errorf("imported route = %+v, want the exported route back", shapes[1])
+	}
+}
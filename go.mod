@@ -3,20 +3,24 @@ module honing-inn
 go 1.21.13
 
 require (
-	github.com/a-h/templ v0.2.747 // indirect
+	github.com/a-h/templ v0.2.747
+	github.com/dustin/go-humanize v1.0.1
+	github.com/go-chi/chi/v5 v5.1.0
+	github.com/google/uuid v1.6.0
+	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	github.com/serjvanilla/go-overpass v0.0.0-20220918094045-58606372f808
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0
+	gorm.io/driver/sqlite v1.5.6
+	gorm.io/gorm v1.25.11
+)
+
+require (
 	github.com/ajg/form v1.5.1 // indirect
-	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/go-chi/chi v1.5.5 // indirect
-	github.com/go-chi/chi/v5 v5.1.0 // indirect
 	github.com/go-chi/render v1.0.3 // indirect
-	github.com/google/uuid v1.6.0 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/mattn/go-sqlite3 v1.14.22 // indirect
-	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
-	github.com/serjvanilla/go-overpass v0.0.0-20220918094045-58606372f808 // indirect
-	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/text v0.17.0 // indirect
-	gorm.io/driver/sqlite v1.5.6 // indirect
-	gorm.io/gorm v1.25.11 // indirect
 )
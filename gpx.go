@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// gpxFile is GPX 1.0 or 1.1 from a phone, watch or route planner
+type gpxFile struct {
+	XMLName   xml.Name   `xml:"gpx"`
+	Name      string     `xml:"name"` // GPX 1.0
+	Metadata  string     `xml:"metadata>name"`
+	Waypoints []gpxPoint `xml:"wpt"`
+	Routes    []gpxRoute `xml:"rte"`
+	Tracks    []gpxTrack `xml:"trk"`
+}
+
+type gpxPoint struct {
+	Lat   float64   `xml:"lat,attr"`
+	Lon   float64   `xml:"lon,attr"`
+	Name  string    `xml:"name"`
+	Desc  string    `xml:"desc"`
+	Links []gpxLink `xml:"link"`
+	URL   string    `xml:"url"` // GPX 1.0
+}
+
+type gpxLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type gpxRoute struct {
+	Name   string     `xml:"name"`
+	Points []gpxPoint `xml:"rtept"`
+}
+
+type gpxTrack struct {
+	Name     string       `xml:"name"`
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+// ParseGPXImport reads waypoints as homes, and recorded tracks and planned routes as routes, e.g. walks
+// between candidate homes. A track's segments stay separate lines of the one route.
+func ParseGPXImport(data []byte, kinds ShapeKinds) (*MapImport, error) {
+	var file gpxFile
+	if err := xml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("Not GPX - %s", err)
+	}
+	if len(file.Waypoints) == 0 && len(file.Routes) == 0 && len(file.Tracks) == 0 {
+		return nil, errors.New("The GPX has no waypoints, routes or tracks")
+	}
+
+	imported := newMapImport()
+	imported.Name = strings.TrimSpace(file.Metadata)
+	if len(imported.Name) == 0 {
+		imported.Name = strings.TrimSpace(file.Name)
+	}
+	for i, waypoint := range file.Waypoints {
+		title := strings.TrimSpace(waypoint.Name)
+		url := strings.TrimSpace(waypoint.URL)
+		if len(waypoint.Links) > 0 {
+			url = strings.TrimSpace(waypoint.Links[0].Href)
+		}
+		imported.addHome(gpxLabel("Waypoint", i, title), LatLng{Lat: waypoint.Lat, Lng: waypoint.Lon}, Home{
+			Title: title,
+			Notes: strings.TrimSpace(waypoint.Desc),
+			Url:   url,
+		})
+	}
+	for i, route := range file.Routes {
+		imported.addGPXRoute(gpxLabel("Route", i, route.Name), route.Name, [][]gpxPoint{route.Points}, kinds)
+	}
+	for i, track := range file.Tracks {
+		segments := make([][]gpxPoint, 0, len(track.Segments))
+		for _, segment := range track.Segments {
+			// a lone point is where the recording stopped and started again, not a line
+			if len(segment.Points) > 1 {
+				segments = append(segments, segment.Points)
+			}
+		}
+		imported.addGPXRoute(gpxLabel("Track", i, track.Name), track.Name, segments, kinds)
+	}
+	return imported, nil
+}
+
+func gpxLabel(kind string, i int, name string) string {
+	if len(strings.TrimSpace(name)) > 0 {
+		return fmt.Sprintf("%s %d (%s)", kind, i+1, strings.TrimSpace(name))
+	}
+	return fmt.Sprintf("%s %d", kind, i+1)
+}
+
+func (imported *MapImport) addGPXRoute(label string, name string, segments [][]gpxPoint, kinds ShapeKinds) {
+	lines := make([][]LatLng, 0, len(segments))
+	for _, segment := range segments {
+		line := make([]LatLng, 0, len(segment))
+		for _, point := range segment {
+			line = append(line, LatLng{Lat: point.Lat, Lng: point.Lon})
+		}
+		lines = append(lines, line)
+	}
+	shapeData, err := routeShapeData(lines)
+	if err != nil {
+		imported.skip(label, err.Error())
+		return
+	}
+	imported.addShape(label, "", kinds, "", Shape{ShapeData: shapeData, ShapeTitle: strings.TrimSpace(name), ShapeType: ShapeTypeRoute})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseGPXImport(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		data        string
+		wantErr     string
+		wantName    string
+		wantHomes   []Home
+		wantShapes  []Shape
+		wantSkipped string
+	}{
+		{name: "Not XML", data: "nope", wantErr: "Not GPX"},
+		{name: "Nothing in it", data: `<gpx version="1.1"><metadata><name>Empty</name></metadata></gpx>`, wantErr: "no waypoints, routes or tracks"},
+		{
+			name: "Recorded walk",
+			data: `<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1">
+				<metadata><name>Sunday viewings</name></metadata>
+				<wpt lat="-43.5" lon="172.6"><name>5 Elm Street</name><desc>Big garden</desc><link href="https://example.com/elm"/></wpt>
+				<trk><name>Elm to Oak</name>
+					<trkseg><trkpt lat="-43.5" lon="172.6"><ele>10</ele></trkpt><trkpt lat="-43.51" lon="172.61"/></trkseg>
+					<trkseg><trkpt lat="-43.52" lon="172.62"/></trkseg>
+					<trkseg><trkpt lat="-43.52" lon="172.62"/><trkpt lat="-43.53" lon="172.63"/></trkseg>
+				</trk>
+			</gpx>`,
+			wantName:   "Sunday viewings",
+			wantHomes:  []Home{{Title: "5 Elm Street", Notes: "Big garden", Url: "https://example.com/elm", CleanAddress: "5 Elm Street", PointType: "Home", Lat: -43.5, Lng: 172.6}},
+			wantShapes: []Shape{{ShapeTitle: "Elm to Oak", ShapeType: ShapeTypeRoute, ShapeKind: ShapeKindGood, ShapeData: "[[[-43.5,172.6],[-43.51,172.61]],[[-43.52,172.62],[-43.53,172.63]]]"}},
+		},
+		{
+			name: "GPX 1.0 route",
+			data: `<gpx version="1.0"><name>Planned</name>
+				<rte><name>Bus stop</name><rtept lat="-43.5" lon="172.6"/><rtept lat="-43.6" lon="172.7"/></rte>
+				<rte><name>Too short</name><rtept lat="-43.5" lon="172.6"/></rte>
+			</gpx>`,
+			wantName:    "Planned",
+			wantShapes:  []Shape{{ShapeTitle: "Bus stop", ShapeType: ShapeTypeRoute, ShapeKind: ShapeKindGood, ShapeData: "[[-43.5,172.6],[-43.6,172.7]]"}},
+			wantSkipped: "Route 2 (Too short): lines need at least 2 points",
+		},
+	}
+	for _, tt := range tests {
+		imported, err := ParseGPXImport([]byte(tt.data), ShapeKinds{Default: ShapeKindGood})
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: ParseGPXImport() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ParseGPXImport() error = %v", tt.name, err)
+			continue
+		}
+		if imported.Name != tt.wantName {
+			t.Errorf("%s: Name = %q, want %q", tt.name, imported.Name, tt.wantName)
+		}
+		if len(imported.Homes) != len(tt.wantHomes) || (len(tt.wantHomes) > 0 && !reflect.DeepEqual(imported.Homes[0], tt.wantHomes[0])) {
+			t.Errorf("%s: Homes = %+v, want %+v", tt.name, imported.Homes, tt.wantHomes)
+		}
+		if len(imported.Shapes) != len(tt.wantShapes) || (len(tt.wantShapes) > 0 && imported.Shapes[0] != tt.wantShapes[0]) {
+			t.Errorf("%s: Shapes = %+v, want %+v", tt.name, imported.Shapes, tt.wantShapes)
+		}
+		if len(tt.wantSkipped) > 0 && (len(imported.Skipped) != 1 || imported.Skipped[0] != tt.wantSkipped) {
+			t.Errorf("%s: Skipped = %q, want %q", tt.name, imported.Skipped, tt.wantSkipped)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// map files are usually small, this leaves plenty of room for detailed zones
+	maxImportBytes = 20 << 20
+	// after a preview the file is posted back base64 encoded, a third bigger, with the form's other fields
+	maxImportFormBytes = (maxImportBytes+2)/3*4 + 1<<20
+
+	ShapeTypeArea  = "area"
+	ShapeTypeRoute = "route"
+
+	ImportPointsAsHomes  = "homes"
+	ImportPointsAsPoints = "points"
+
+	// status of a search made by an import, its points came with the file so there is nothing to run
+	FractalSearchImported = "imported"
+)
+
+// importPointTypes are the home point types the map has a marker for
+var importPointTypes = []string{"Home", "RedFlag", "Office", "LocationOfInterest"}
+
+// MapImport is what an uploaded GeoJSON, KML, KMZ or GPX file creates, Skipped explains each feature that was left out
+type MapImport struct {
+	Name    string // the document's name, points imported as points are added to a search with this query
+	Homes   []Home
+	Points  []Point
+	Shapes  []Shape
+	Layers  []string // folders the shapes were in, each can be given its own kind
+	Skipped []string
+}
+
+func newMapImport() *MapImport {
+	return &MapImport{Homes: make([]Home, 0), Points: make([]Point, 0), Shapes: make([]Shape, 0), Layers: make([]string, 0), Skipped: make([]string, 0)}
+}
+
+// ShapeKinds picks each imported shape's kind: the kind chosen for its layer, else the shape_kind in the file,
+// else the layer's name when it is a kind (e.g. a "No Go" folder), else Default
+type ShapeKinds struct {
+	Default string
+	Layers  map[string]string
+}
+
+func (k ShapeKinds) kind(layer string, property string) (string, error) {
+	if kind, ok := k.Layers[layer]; ok && validShapeKind(kind) {
+		return kind, nil
+	}
+	if len(property) > 0 {
+		if !validShapeKind(property) {
+			return "", fmt.Errorf("unknown shape_kind %q", property)
+		}
+		return property, nil
+	}
+	name := strings.NewReplacer(" ", "", "-", "", "_", "").Replace(layer)
+	for _, kind := range []string{ShapeKindWarning, ShapeKindNoGo, ShapeKindGood} {
+		if strings.EqualFold(name, kind) {
+			return kind, nil
+		}
+	}
+	return k.Default, nil
+}
+
+func validShapeKind(kind string) bool {
+	return kind == ShapeKindWarning || kind == ShapeKindNoGo || kind == ShapeKindGood
+}
+
+func validLatLng(p LatLng) error {
+	if p.Lat < -90 || p.Lat > 90 || p.Lng < -180 || p.Lng > 180 {
+		return fmt.Errorf("[%v, %v] isn't a longitude and latitude", p.Lng, p.Lat)
+	}
+	return nil
+}
+
+func (imported *MapImport) skip(label string, reason string) {
+	imported.Skipped = append(imported.Skipped, fmt.Sprintf("%s: %s", label, reason))
+}
+
+// addHome adds home at p. Like the home form the address defaults to the title, unknown point types are homes.
+func (imported *MapImport) addHome(label string, p LatLng, home Home) {
+	if err := validLatLng(p); err != nil {
+		imported.skip(label, err.Error())
+		return
+	}
+	home.Lat = p.Lat
+	home.Lng = p.Lng
+	if !slices.Contains(importPointTypes, home.PointType) {
+		home.PointType = "Home"
+	}
+	if len(home.CleanAddress) == 0 && len(home.Title) > 0 {
+		home.CleanAddress = cleanAddress(home.Title)
+	}
+	imported.Homes = append(imported.Homes, home)
+}
+
+// addShape adds a shape from layer, with the shape form's checks: ShapeData that parses, a type and a kind
+func (imported *MapImport) addShape(label string, layer string, kinds ShapeKinds, kindProperty string, shape Shape) {
+	if _, err := parseShapeRings(shape.ShapeData); err != nil {
+		imported.skip(label, err.Error())
+		return
+	}
+	if shape.ShapeType != ShapeTypeArea && shape.ShapeType != ShapeTypeRoute {
+		imported.skip(label, fmt.Sprintf("unknown shape type %q", shape.ShapeType))
+		return
+	}
+	kind, err := kinds.kind(layer, kindProperty)
+	if err != nil {
+		imported.skip(label, err.Error())
+		return
+	}
+	shape.ShapeKind = kind
+	if len(layer) > 0 && !slices.Contains(imported.Layers, layer) {
+		imported.Layers = append(imported.Layers, layer)
+	}
+	imported.Shapes = append(imported.Shapes, shape)
+}
+
+// homesToPoints imports the homes as points of a search instead, e.g. the schools on a friend's My Maps
+func (imported *MapImport) homesToPoints() {
+	for _, home := range imported.Homes {
+		imported.Points = append(imported.Points, Point{
+			Title:        home.Title,
+			Description:  home.Notes,
+			Lat:          home.Lat,
+			Lng:          home.Lng,
+			PointType:    home.PointType,
+			Url:          home.Url,
+			CleanAddress: home.CleanAddress,
+		})
+	}
+	imported.Homes = make([]Home, 0)
+}
+
+// ParseMapImport reads a GeoJSON, KML, KMZ or GPX file, going by its extension
+func ParseMapImport(fileName string, data []byte, kinds ShapeKinds) (*MapImport, error) {
+	if !validShapeKind(kinds.Default) {
+		return nil, fmt.Errorf("Unknown shape kind %q", kinds.Default)
+	}
+	var imported *MapImport
+	var err error
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".geojson", ".json":
+		imported, err = ParseGeoJSONImport(data, kinds)
+	case ".kml":
+		imported, err = ParseKMLImport(data, kinds)
+	case ".kmz":
+		imported, err = ParseKMZImport(data, kinds)
+	case ".gpx":
+		imported, err = ParseGPXImport(data, kinds)
+	default:
+		return nil, fmt.Errorf("Can't import %q, choose a .geojson, .kml, .kmz or .gpx file", fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(imported.Name) == 0 {
+		imported.Name = strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	}
+	return imported, nil
+}
+
+// ImportMap creates the homes, points and shapes, all of them or none. Points go in a new search for themeID.
+func ImportMap(db *gorm.DB, imported *MapImport, themeID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if len(imported.Homes) > 0 {
+			if err := tx.Create(&imported.Homes).Error; err != nil {
+				return fmt.Errorf("failed to create homes: %w", err)
+			}
+		}
+		if len(imported.Points) > 0 {
+			search := FractalSearch{ThemeID: themeID, Query: imported.Name, DisplayName: imported.Name, Status: FractalSearchImported}
+			if err := tx.Create(&search).Error; err != nil {
+				return fmt.Errorf("failed to create search: %w", err)
+			}
+			for i := range imported.Points {
+				imported.Points[i].FractalSearchID = search.ID
+				imported.Points[i].ThemeID = themeID
+			}
+			if err := tx.Create(&imported.Points).Error; err != nil {
+				return fmt.Errorf("failed to create points: %w", err)
+			}
+		}
+		if len(imported.Shapes) > 0 {
+			if err := tx.Create(&imported.Shapes).Error; err != nil {
+				return fmt.Errorf("failed to create shapes: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// areaShapeData is ShapeData for polygons: [lat, lng] rings without the closing point, a polygon with holes
+// as a list of rings and several polygons as a list of those, the simplest form Leaflet and parseShapeRings both read
+func areaShapeData(polygons [][][]LatLng) (string, error) {
+	converted := make([][][][]float64, 0, len(polygons))
+	for _, polygon := range polygons {
+		rings := make([][][]float64, 0, len(polygon))
+		for _, ring := range polygon {
+			if len(ring) > 1 && ring[0] == ring[len(ring)-1] {
+				ring = ring[:len(ring)-1]
+			}
+			if len(ring) < 3 {
+				return "", errors.New("rings need at least 3 points")
+			}
+			latLngs, err := latLngPairs(ring)
+			if err != nil {
+				return "", err
+			}
+			rings = append(rings, latLngs)
+		}
+		if len(rings) == 0 {
+			return "", errors.New("polygons need at least one ring")
+		}
+		converted = append(converted, rings)
+	}
+
+	var data []byte
+	switch {
+	case len(converted) == 0:
+		return "", errors.New("no polygons")
+	case len(converted) == 1 && len(converted[0]) == 1:
+		data, _ = json.Marshal(converted[0][0])
+	case len(converted) == 1:
+		data, _ = json.Marshal(converted[0])
+	default:
+		data, _ = json.Marshal(converted)
+	}
+	return string(data), nil
+}
+
+// routeShapeData is ShapeData for lines: a list of [lat, lng], or a list of those when there are several lines
+func routeShapeData(lines [][]LatLng) (string, error) {
+	converted := make([][][]float64, 0, len(lines))
+	for _, line := range lines {
+		if len(line) < 2 {
+			return "", errors.New("lines need at least 2 points")
+		}
+		latLngs, err := latLngPairs(line)
+		if err != nil {
+			return "", err
+		}
+		converted = append(converted, latLngs)
+	}
+
+	var data []byte
+	switch len(converted) {
+	case 0:
+		return "", errors.New("no lines")
+	case 1:
+		data, _ = json.Marshal(converted[0])
+	default:
+		data, _ = json.Marshal(converted)
+	}
+	return string(data), nil
+}
+
+func latLngPairs(points []LatLng) ([][]float64, error) {
+	pairs := make([][]float64, 0, len(points))
+	for _, p := range points {
+		if err := validLatLng(p); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, []float64{p.Lat, p.Lng})
+	}
+	return pairs, nil
+}
+
+// mapImportForm is what the import page sends. After a preview the file comes back in FileData so it
+// doesn't have to be chosen again to change the layer kinds or import it.
+type mapImportForm struct {
+	FileName string
+	FileData string // base64
+	Kinds    ShapeKinds
+	PointsAs string
+}
+
+// readMapImportForm reads the uploaded file, or the one kept from the preview, and the import options
+func readMapImportForm(r *http.Request) (mapImportForm, []byte, error) {
+	form := mapImportForm{
+		Kinds:    ShapeKinds{Default: r.FormValue("shapeKind"), Layers: make(map[string]string)},
+		PointsAs: r.FormValue("pointsAs"),
+	}
+	layers, layerKinds := r.Form["layer"], r.Form["layerKind"]
+	for i := 0; i < len(layers) && i < len(layerKinds); i++ {
+		if len(layerKinds[i]) > 0 {
+			form.Kinds.Layers[layers[i]] = layerKinds[i]
+		}
+	}
+
+	var data []byte
+	file, header, err := r.FormFile("file")
+	switch {
+	case err == nil:
+		defer file.Close()
+		if data, err = io.ReadAll(file); err != nil {
+			return form, nil, fmt.Errorf("Failed to read the file - %s", err)
+		}
+		form.FileName = header.Filename
+	case len(r.FormValue("fileData")) > 0:
+		if data, err = base64.StdEncoding.DecodeString(r.FormValue("fileData")); err != nil {
+			return form, nil, fmt.Errorf("Failed to read the previewed file - %s", err)
+		}
+		form.FileName = r.FormValue("fileName")
+	default:
+		return form, nil, errors.New("Choose a GeoJSON, KML, KMZ or GPX file to import")
+	}
+	if len(data) > maxImportBytes {
+		return form, nil, fmt.Errorf("The file is over %d MB", maxImportBytes>>20)
+	}
+	form.FileData = base64.StdEncoding.EncodeToString(data)
+	return form, data, nil
+}
+
+// mapImportHandler shows the upload form, a dry run previews what the file would create without saving it
+func mapImportHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		switch r.Method {
+		case http.MethodGet:
+			importPage := mapImportPage(mapImportForm{Kinds: ShapeKinds{Default: ShapeKindWarning}, PointsAs: ImportPointsAsHomes}, nil, false, "", "")
+			importPage.Render(GetContext(r), w)
+		case http.MethodPost:
+			r.Body = http.MaxBytesReader(w, r.Body, maxImportFormBytes)
+			if err := r.ParseMultipartForm(maxImportFormBytes); err != nil {
+				warning := warning(fmt.Sprintf("Unable to read the upload - %s", err))
+				warning.Render(GetContext(r), w)
+				return
+			}
+			form, data, err := readMapImportForm(r)
+			if err != nil {
+				importPage := mapImportPage(form, nil, false, "", err.Error())
+				importPage.Render(GetContext(r), w)
+				return
+			}
+
+			imported, err := ParseMapImport(form.FileName, data, form.Kinds)
+			if err != nil {
+				importPage := mapImportPage(form, nil, false, "", err.Error())
+				importPage.Render(GetContext(r), w)
+				return
+			}
+			if form.PointsAs == ImportPointsAsPoints {
+				imported.homesToPoints()
+			}
+			if r.FormValue("dryRun") == "on" {
+				importPage := mapImportPage(form, imported, false, "", "")
+				importPage.Render(GetContext(r), w)
+				return
+			}
+
+			// without a theme cookie the points go in a search without a theme, like a quick search
+			themeID, _ := getThemeID(r)
+			if err := ImportMap(db, imported, themeID); err != nil {
+				importPage := mapImportPage(form, imported, false, "", err.Error())
+				importPage.Render(GetContext(r), w)
+				return
+			}
+			form.FileData = ""
+			msg := fmt.Sprintf("Imported %d homes, %d points and %d shapes from %s", len(imported.Homes), len(imported.Points), len(imported.Shapes), form.FileName)
+			importPage := mapImportPage(form, imported, true, msg, "")
+			importPage.Render(GetContext(r), w)
+		default:
+			warning := warning("Method not allowed")
+			warning.Render(GetContext(r), w)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestShapeKinds(t *testing.T) {
+	t.Parallel()
+
+	kinds := ShapeKinds{Default: ShapeKindWarning, Layers: map[string]string{"Flooding": ShapeKindNoGo, "Unset": ""}}
+	tests := []struct {
+		name     string
+		layer    string
+		property string
+		want     string
+		wantErr  bool
+	}{
+		{name: "Default", want: ShapeKindWarning},
+		{name: "Chosen for the layer", layer: "Flooding", property: ShapeKindGood, want: ShapeKindNoGo},
+		{name: "From the file", layer: "Unset", property: ShapeKindGood, want: ShapeKindGood},
+		{name: "Unknown in the file", property: "purple", wantErr: true},
+		{name: "Layer named after a kind", layer: "no-go", want: ShapeKindNoGo},
+		{name: "Layer named Good", layer: "Good", want: ShapeKindGood},
+		{name: "Other layer", layer: "Schools", want: ShapeKindWarning},
+	}
+	for _, tt := range tests {
+		got, err := kinds.kind(tt.layer, tt.property)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: kind(%q, %q) = %q, %v, want %q", tt.name, tt.layer, tt.property, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseMapImport(t *testing.T) {
+	t.Parallel()
+
+	geoJSON := `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[172.5,-43.5]},"properties":{}}]}`
+	tests := []struct {
+		name     string
+		fileName string
+		data     string
+		kind     string
+		wantErr  string
+		wantName string
+	}{
+		{name: "GeoJSON", fileName: "Open homes.GeoJSON", data: geoJSON, kind: ShapeKindNoGo, wantName: "Open homes"},
+		{name: "KML", fileName: "suburbs.kml", data: myMapsKML, kind: ShapeKindNoGo, wantName: "Christchurch suburbs"},
+		{name: "Unknown kind", fileName: "a.geojson", data: geoJSON, kind: "bad", wantErr: "Unknown shape kind"},
+		{name: "Shapefile", fileName: "zones.shp", data: "", kind: ShapeKindNoGo, wantErr: "choose a .geojson, .kml, .kmz or .gpx file"},
+		{name: "Wrong extension", fileName: "a.gpx", data: geoJSON, kind: ShapeKindNoGo, wantErr: "Not GPX"},
+	}
+	for _, tt := range tests {
+		imported, err := ParseMapImport(tt.fileName, []byte(tt.data), ShapeKinds{Default: tt.kind})
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: ParseMapImport() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || imported.Name != tt.wantName {
+			t.Errorf("%s: ParseMapImport() = %+v, %v, want %q", tt.name, imported, err, tt.wantName)
+		}
+	}
+}
+
+func TestMapImportHandler(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBInit(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+	scoped := db.WithContext(withWorkspace(context.Background(), defaultWorkspaceID))
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(withWorkspace(r.Context(), defaultWorkspaceID)))
+		})
+	})
+	r.Post("/import", mapImportHandler(db))
+
+	post := func(file []byte, fields ...string) string {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		if file != nil {
+			part, _ := form.CreateFormFile("file", "suburbs.kml")
+			part.Write(file)
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			form.WriteField(fields[i], fields[i+1])
+		}
+		form.Close()
+		req := httptest.NewRequest("POST", "/import", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.AddCookie(&http.Cookie{Name: "themeId", Value: "1"})
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	kept := base64.StdEncoding.EncodeToString([]byte(myMapsKML))
+	// posted back base64 encoded this is over the upload limit, the file itself isn't
+	big := strings.Replace(myMapsKML, "<Document>", "<Document><!--"+strings.Repeat("x", 16<<20)+"-->", 1)
+
+	tests := []struct {
+		name       string
+		file       []byte
+		fields     []string
+		want       []string
+		wantShapes int64
+		wantPoints int64
+	}{
+		{name: "No file", fields: []string{"shapeKind", ShapeKindWarning}, want: []string{"Choose a GeoJSON, KML, KMZ or GPX file"}},
+		{name: "Preview", file: []byte(myMapsKML), fields: []string{"shapeKind", ShapeKindWarning, "pointsAs", ImportPointsAsHomes, "dryRun", "on"}, want: []string{
+			"Would create 1 homes, 0 points and 3 shapes",
+			`name="fileData" value="` + kept + `"`,
+			`name="layer" value="Nice streets"`,
+			"Skipped 2 features",
+		}},
+		{name: "Preview the kept file with the layer mapped", fields: []string{"fileName", "suburbs.kml", "fileData", kept, "shapeKind", ShapeKindWarning, "pointsAs", ImportPointsAsPoints, "layer", "No Go", "layerKind", "", "layer", "Nice streets", "layerKind", ShapeKindNoGo, "dryRun", "on"}, want: []string{
+			"Would create 0 homes, 1 points and 3 shapes",
+			"noGo route",
+			`<option value="noGo" selected="selected">noGo</option>`,
+		}},
+		{name: "Preview a big kept file", fields: []string{"fileName", "big.kml", "fileData", base64.StdEncoding.EncodeToString([]byte(big)), "shapeKind", ShapeKindWarning, "pointsAs", ImportPointsAsHomes, "dryRun", "on"}, want: []string{
+			"Would create 1 homes, 0 points and 3 shapes",
+		}},
+		{name: "Too big", file: []byte(big + strings.Repeat(" ", 5<<20)), fields: []string{"shapeKind", ShapeKindWarning, "dryRun", "on"}, want: []string{"The file is over 20 MB"}},
+		{name: "Import", fields: []string{"fileName", "suburbs.kml", "fileData", kept, "shapeKind", ShapeKindWarning, "pointsAs", ImportPointsAsPoints, "layer", "Nice streets", "layerKind", ShapeKindNoGo}, want: []string{
+			"Imported 0 homes, 1 points and 3 shapes from suburbs.kml",
+		}, wantShapes: 3, wantPoints: 1},
+	}
+	for _, tt := range tests {
+		body := post(tt.file, tt.fields...)
+		for _, want := range tt.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: body missing %s", tt.name, want)
+			}
+		}
+		var shapes, points int64
+		scoped.Model(&Shape{}).Count(&shapes)
+		scoped.Model(&Point{}).Count(&points)
+		if shapes != tt.wantShapes || points != tt.wantPoints {
+			t.Errorf("%s: %d shapes and %d points, want %d and %d", tt.name, shapes, points, tt.wantShapes, tt.wantPoints)
+		}
+	}
+
+	var search FractalSearch
+	scoped.First(&search)
+	if search.Query != "Christchurch suburbs" || search.Status != FractalSearchImported || search.ThemeID != 1 {
+		t.Errorf("search = %+v, want one named after the document for the theme", search)
+	}
+	if points, _ := GetPoints(scoped, search.ID); len(points) != 1 || points[0].Title != "12 Office Road" || points[0].ThemeID != 1 {
+		t.Errorf("points = %+v, want the placemark in the search", points)
+	}
+	var routes int64
+	scoped.Model(&Shape{}).Where("shape_type = ? AND shape_kind = ?", ShapeTypeRoute, ShapeKindNoGo).Count(&routes)
+	if routes != 1 {
+		t.Errorf("%d noGo routes, want the track with its layer's kind", routes)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobComplete = "complete"
+	JobFailed   = "failed"
+
+	JobKindChat = "chat"
+
+	defaultJobWorkers     = 2
+	defaultJobMaxAttempts = 3
+)
+
+// JobQueue runs queued jobs from the jobs table on a small pool of workers.
+// Jobs live in the database so a restart picks up where it left off.
+type JobQueue struct {
+	db           *gorm.DB
+	envConfig    EnvConfig
+	workers      int
+	pollInterval time.Duration
+	backoff      time.Duration
+	maxBackoff   time.Duration
+	wg           sync.WaitGroup
+}
+
+func NewJobQueue(db *gorm.DB, envConfig EnvConfig, workers int) *JobQueue {
+	if workers < 1 {
+		workers = defaultJobWorkers
+	}
+	return &JobQueue{
+		db:           db,
+		envConfig:    envConfig,
+		workers:      workers,
+		pollInterval: time.Second,
+		backoff:      5 * time.Second,
+		maxBackoff:   2 * time.Minute,
+	}
+}
+
+// EnqueueChatJobs queues one chat job per chat type for the home, all in a single batch
+func EnqueueChatJobs(db *gorm.DB, home Home, themeID uint, chatTypes []ChatType) (string, []Job, error) {
+	batchID := uuid.New().String()
+	now := time.Now()
+
+	jobs := make([]Job, 0, len(chatTypes))
+	for _, chatType := range chatTypes {
+		jobs = append(jobs, Job{
+			BatchID:     batchID,
+			Kind:        JobKindChat,
+			Status:      JobQueued,
+			ThemeID:     themeID,
+			HomeID:      home.ID,
+			ChatTypeID:  chatType.ID,
+			MaxAttempts: defaultJobMaxAttempts,
+			RunAt:       now,
+		})
+	}
+
+	jobs, err := CreateJobs(db, jobs)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to queue jobs: %w", err)
+	}
+	return batchID, jobs, nil
+}
+
+// Start launches the workers, they stop once ctx is cancelled
+func (q *JobQueue) Start(ctx context.Context) {
+	// anything left running was interrupted by a restart, give it another go
+	res := q.db.Model(&Job{}).Where("status = ?", JobRunning).Update("status", JobQueued)
+	if res.Error != nil {
+		log.Printf("job queue failed to requeue running jobs: %v", res.Error)
+	} else if res.RowsAffected > 0 {
+		log.Printf("job queue requeued %d interrupted jobs", res.RowsAffected)
+	}
+
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work(ctx)
+	}
+	log.Printf("job queue started with %d workers", q.workers)
+}
+
+// Wait blocks until every worker has stopped
+func (q *JobQueue) Wait() {
+	q.wg.Wait()
+}
+
+func (q *JobQueue) work(ctx context.Context) {
+	defer q.wg.Done()
+	for {
+		ran, err := q.runNext()
+		if err != nil {
+			log.Printf("job queue error: %v", err)
+		}
+		if ran {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(q.pollInterval):
+		}
+	}
+}
+
+// runNext claims the next due job and runs it, returning false when there was nothing to do
+func (q *JobQueue) runNext() (bool, error) {
+	var job Job
+	err := q.db.Where("status = ?", JobQueued).Order("run_at, id").First(&job).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if job.RunAt.After(time.Now()) {
+		return false, nil
+	}
+
+	// only one worker wins the claim, the others move on to the next job
+	claim := q.db.Model(&Job{}).Where("id = ? AND status = ?", job.ID, JobQueued).Updates(map[string]interface{}{
+		"status":   JobRunning,
+		"attempts": job.Attempts + 1,
+	})
+	if claim.Error != nil {
+		return false, claim.Error
+	}
+	if claim.RowsAffected == 0 {
+		return true, nil
+	}
+	job.Attempts++
+
+	chatID, runErr := q.run(job)
+
+	updates := map[string]interface{}{}
+	switch {
+	case runErr == nil:
+		updates["status"] = JobComplete
+		updates["chat_id"] = chatID
+		updates["last_error"] = ""
+	case job.Attempts >= job.MaxAttempts:
+		log.Printf("job %d failed after %d attempts: %v", job.ID, job.Attempts, runErr)
+		updates["status"] = JobFailed
+		updates["last_error"] = runErr.Error()
+	default:
+		delay := q.backoffFor(job.Attempts)
+		log.Printf("job %d attempt %d failed, retrying in %s: %v", job.ID, job.Attempts, delay, runErr)
+		updates["status"] = JobQueued
+		updates["last_error"] = runErr.Error()
+		updates["run_at"] = time.Now().Add(delay)
+	}
+
+	if err := q.db.Model(&job).Updates(updates).Error; err != nil {
+		return true, fmt.Errorf("failed to save job %d: %w", job.ID, err)
+	}
+	return true, nil
+}
+
+// backoffFor doubles the wait after each failed attempt, up to maxBackoff
+func (q *JobQueue) backoffFor(attempts int) time.Duration {
+	delay := q.backoff
+	for i := 1; i < attempts && delay < q.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.maxBackoff {
+		delay = q.maxBackoff
+	}
+	return delay
+}
+
+func (q *JobQueue) run(job Job) (uint, error) {
+	switch job.Kind {
+	case JobKindChat:
+		// the job runs in the workspace it was queued from
+		db := q.db
+		if job.WorkspaceID != 0 {
+			db = q.db.WithContext(withWorkspace(context.Background(), job.WorkspaceID))
+		}
+		home, err := GetHome(db, job.HomeID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get home %d: %w", job.HomeID, err)
+		}
+		chatType, err := GetChatTypeForChat(db, Chat{ChatType: job.ChatTypeID, ChatTypeVersionID: job.ChatTypeVersionID})
+		if err != nil {
+			return 0, fmt.Errorf("failed to get chat type %d: %w", job.ChatTypeID, err)
+		}
+		theme := GetActiveTheme(db, job.ThemeID)
+
+		newChat, err := callAndSaveChat(db, q.envConfig, *home, *chatType, theme)
+		if err != nil {
+			return 0, err
+		}
+		return newChat.ID, nil
+	default:
+		return 0, fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+}
+
+// JobProgress is a batch of jobs along with the chats the finished ones produced
+type JobProgress struct {
+	BatchID  string
+	Jobs     []Job
+	Chats    []Chat
+	Names    map[uint]string
+	Done     int
+	Failed   int
+	Finished bool
+}
+
+func GetJobProgress(db *gorm.DB, batchID string) (*JobProgress, error) {
+	jobs, err := GetJobs(db, batchID, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	progress := JobProgress{
+		BatchID:  batchID,
+		Jobs:     jobs,
+		Chats:    make([]Chat, 0),
+		Names:    make(map[uint]string),
+		Finished: true,
+	}
+	for _, job := range jobs {
+		if chatType, err := GetChatType(db, job.ChatTypeID); err == nil {
+			progress.Names[job.ChatTypeID] = chatType.Name
+		}
+
+		switch job.Status {
+		case JobComplete:
+			progress.Done++
+			if c, err := GetChat(db, job.ChatID); err == nil {
+				progress.Chats = append(progress.Chats, *c)
+			}
+		case JobFailed:
+			progress.Failed++
+		default:
+			progress.Finished = false
+		}
+	}
+	return &progress, nil
+}
+
+func jobsHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		switch r.Method {
+		case http.MethodGet:
+			batchID := r.URL.Query().Get("batch")
+			if len(batchID) == 0 {
+				jobs, err := GetJobs(db, "", 50)
+				if err != nil {
+					warning := warning(fmt.Sprintf("Failed to get jobs - %v", err))
+					warning.Render(GetContext(r), w)
+					return
+				}
+
+				jobList := jobList(jobs)
+				jobList.Render(GetContext(r), w)
+				return
+			}
+
+			progress, err := GetJobProgress(db, batchID)
+			if err != nil {
+				warning := warning(fmt.Sprintf("Failed to get job progress - %v", err))
+				warning.Render(GetContext(r), w)
+				return
+			}
+
+			jobProgress := jobProgress(*progress)
+			jobProgress.Render(GetContext(r), w)
+			return
+		}
+	}
+}
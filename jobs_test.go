@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobQueue(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewLLMFixtureServer("testdata/llm", LLMFixtureReplay, nil)
+	if err != nil {
+		t.Fatalf("failed to start llm fixture server: %v", err)
+	}
+	t.Cleanup(server.Close)
+
+	config := EnvConfig{
+		DBUrl:              ":memory:",
+		PerplexityAPIURL:   server.URL + "/" + ProviderPerplexity,
+		PerplexityAPIToken: "test-token",
+	}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	db.Model(&Theme{}).Where("id = ?", 1).Update("start_system_prompt", "You are a home research assistant researching {topic}. Finish with a line like Rating: 2")
+
+	home := Home{Lat: -43.53, Lng: 172.58, CleanAddress: "7 Middleton Road, Riccarton", CleanSuburb: "Riccarton"}
+	db.Create(&home)
+
+	recorded := ChatType{Name: "Traffic", Prompt: "How much traffic noise is there around {address} in {suburb}?", ThemeID: 1}
+	db.Create(&recorded)
+
+	unrecorded := ChatType{Name: "Schools", Prompt: "Which schools are zoned for {address}?", ThemeID: 1}
+	db.Create(&unrecorded)
+
+	r := httptest.NewRequest("POST", "/chat", strings.NewReader(url.Values{
+		"HomeID":  {"1"},
+		"ThemeID": {"1"},
+		"All":     {"true"},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	chatHandler(db, config).ServeHTTP(rec, r)
+
+	if !contains(rec.Body.String(), "every 2s") {
+		t.Errorf("POST /chat All=true body = %q, want a polling progress fragment", rec.Body.String())
+	}
+
+	jobs, err := GetJobs(db, "", 0)
+	if err != nil || len(jobs) != 2 {
+		t.Fatalf("GetJobs() = %d jobs, err %v, want 2 queued jobs", len(jobs), err)
+	}
+	if chats, _ := GetChats(db, 1, home.ID, 0); len(chats) != 0 {
+		t.Errorf("GetChats() = %d chats before the queue ran, want 0", len(chats))
+	}
+
+	queue := NewJobQueue(db, config, 1)
+	queue.backoff = 0
+	queue.maxBackoff = 0
+
+	for i := 0; i < 10; i++ {
+		ran, err := queue.runNext()
+		if err != nil {
+			t.Fatalf("runNext() error = %v", err)
+		}
+		if !ran {
+			break
+		}
+	}
+
+	progress, err := GetJobProgress(db, jobs[0].BatchID)
+	if err != nil {
+		t.Fatalf("GetJobProgress() error = %v", err)
+	}
+	if !progress.Finished || progress.Done != 1 || progress.Failed != 1 || len(progress.Chats) != 1 {
+		t.Fatalf("GetJobProgress() = %+v, want finished with 1 done and 1 failed", progress)
+	}
+
+	for _, job := range progress.Jobs {
+		switch job.ChatTypeID {
+		case recorded.ID:
+			if job.Status != JobComplete || job.Attempts != 1 || job.ChatID != progress.Chats[0].ID {
+				t.Errorf("recorded job = %+v, want complete on the first attempt", job)
+			}
+		case unrecorded.ID:
+			if job.Status != JobFailed || job.Attempts != defaultJobMaxAttempts || !contains(job.LastError, "no recorded response") {
+				t.Errorf("unrecorded job = %+v, want failed after %d attempts", job, defaultJobMaxAttempts)
+			}
+		}
+	}
+
+	r = httptest.NewRequest("GET", "/jobs?batch="+jobs[0].BatchID, nil)
+	rec = httptest.NewRecorder()
+	jobsHandler(db).ServeHTTP(rec, r)
+
+	body := rec.Body.String()
+	if contains(body, "every 2s") || !contains(body, "Blenheim Road") || !contains(body, "Failed to research Schools") {
+		t.Errorf("GET /jobs body = %q, want the finished chat and the failure", body)
+	}
+}
+
+func TestJobQueueBackoff(t *testing.T) {
+	t.Parallel()
+
+	queue := &JobQueue{backoff: 5 * time.Second, maxBackoff: time.Minute}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: 5 * time.Second},
+		{attempts: 2, want: 10 * time.Second},
+		{attempts: 3, want: 20 * time.Second},
+		{attempts: 6, want: time.Minute},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.want.String(), func(t *testing.T) {
+			t.Parallel()
+			if got := queue.backoffFor(tt.attempts); got != tt.want {
+				t.Errorf("backoffFor(%d) = %s, want %s", tt.attempts, got, tt.want)
+			}
+		})
+	}
+}
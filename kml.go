@@ -0,0 +1,512 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const kmlNamespace = "http://www.opengis.net/kml/2.2"
+
+// KML colours are aabbggrr, these match the map's shape colours with the fill see-through
+var kmlShapeColors = map[string]string{
+	ShapeKindWarning: "0000ff",
+	ShapeKindNoGo:    "000000",
+	ShapeKindGood:    "169016",
+}
+
+// kmlFile is the part of KML (and Google My Maps exports) we read and write
+type kmlFile struct {
+	XMLName xml.Name `xml:"kml"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	kmlContainer
+}
+
+// kmlContainer is a Document or Folder, or the kml element itself
+type kmlContainer struct {
+	Name       string         `xml:"name,omitempty"`
+	Styles     []kmlStyle     `xml:"Style,omitempty"`
+	Documents  []kmlContainer `xml:"Document,omitempty"`
+	Folders    []kmlContainer `xml:"Folder,omitempty"`
+	Placemarks []kmlPlacemark `xml:"Placemark,omitempty"`
+}
+
+type kmlPlacemark struct {
+	Name        string    `xml:"name,omitempty"`
+	Address     string    `xml:"address,omitempty"`
+	Description string    `xml:"description,omitempty"`
+	StyleURL    string    `xml:"styleUrl,omitempty"`
+	Data        []kmlData `xml:"ExtendedData>Data,omitempty"`
+	SchemaData  []kmlData `xml:"ExtendedData>SchemaData>SimpleData,omitempty"`
+	kmlGeometry
+}
+
+// kmlData is a Data element with its value, or a SimpleData with the value as text
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,omitempty"`
+	Text  string `xml:",chardata"`
+}
+
+type kmlGeometry struct {
+	Points          []kmlCoordinates `xml:"Point,omitempty"`
+	LineStrings     []kmlCoordinates `xml:"LineString,omitempty"`
+	LinearRings     []kmlCoordinates `xml:"LinearRing,omitempty"`
+	Polygons        []kmlPolygon     `xml:"Polygon,omitempty"`
+	Tracks          []kmlTrack       `xml:"Track,omitempty"` // gx:Track from a phone or Google Earth recording
+	MultiGeometries []kmlGeometry    `xml:"MultiGeometry,omitempty"`
+}
+
+type kmlCoordinates struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlPolygon struct {
+	Outer kmlBoundary   `xml:"outerBoundaryIs"`
+	Inner []kmlBoundary `xml:"innerBoundaryIs,omitempty"`
+}
+
+type kmlBoundary struct {
+	Rings []kmlCoordinates `xml:"LinearRing"`
+}
+
+type kmlTrack struct {
+	Coords []string `xml:"coord"` // "lng lat alt"
+}
+
+type kmlStyle struct {
+	ID        string        `xml:"id,attr"`
+	IconStyle *kmlIconStyle `xml:"IconStyle,omitempty"`
+	LineStyle *kmlLineStyle `xml:"LineStyle,omitempty"`
+	PolyStyle *kmlPolyStyle `xml:"PolyStyle,omitempty"`
+}
+
+type kmlIconStyle struct {
+	Href string `xml:"Icon>href"`
+}
+
+type kmlLineStyle struct {
+	Color string `xml:"color"`
+	Width int    `xml:"width"`
+}
+
+type kmlPolyStyle struct {
+	Color string `xml:"color"`
+}
+
+// ParseKMLImport reads Placemarks: points become homes, polygons areas and lines routes. The innermost
+// Folder a shape is in is its layer, so each My Maps layer can be mapped to a shape kind.
+func ParseKMLImport(data []byte, kinds ShapeKinds) (*MapImport, error) {
+	var file kmlFile
+	if err := xml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("Not KML - %s", err)
+	}
+
+	imported := newMapImport()
+	count := 0
+	var walk func(container kmlContainer, layer string)
+	walk = func(container kmlContainer, layer string) {
+		for _, placemark := range container.Placemarks {
+			count++
+			imported.addPlacemark(count, layer, placemark, kinds)
+		}
+		for _, folder := range container.Folders {
+			name := strings.TrimSpace(folder.Name)
+			if len(name) == 0 {
+				name = layer
+			}
+			walk(folder, name)
+		}
+		for _, document := range container.Documents {
+			if len(imported.Name) == 0 {
+				imported.Name = strings.TrimSpace(document.Name)
+			}
+			walk(document, layer)
+		}
+	}
+	walk(file.kmlContainer, "")
+	if count == 0 {
+		return nil, errors.New("The KML has no placemarks")
+	}
+	return imported, nil
+}
+
+// ParseKMZImport reads the KML in a KMZ, the first .kml at the top of the zip like Google Earth does
+func ParseKMZImport(data []byte, kinds ShapeKinds) (*MapImport, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Not KMZ - %s", err)
+	}
+	for _, file := range archive.File {
+		if strings.Contains(file.Name, "/") || !strings.EqualFold(filepath.Ext(file.Name), ".kml") {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open %s in the KMZ - %s", file.Name, err)
+		}
+		defer reader.Close()
+		kml, err := io.ReadAll(io.LimitReader(reader, maxImportBytes+1))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s in the KMZ - %s", file.Name, err)
+		}
+		if len(kml) > maxImportBytes {
+			return nil, fmt.Errorf("%s in the KMZ is too big to import", file.Name)
+		}
+		return ParseKMLImport(kml, kinds)
+	}
+	return nil, errors.New("The KMZ has no .kml file in it")
+}
+
+func (imported *MapImport) addPlacemark(n int, layer string, placemark kmlPlacemark, kinds ShapeKinds) {
+	title := strings.TrimSpace(placemark.Name)
+	label := fmt.Sprintf("Placemark %d", n)
+	if len(title) > 0 {
+		label = fmt.Sprintf("Placemark %d (%s)", n, title)
+	}
+	data := placemark.data()
+
+	var points []LatLng
+	var lines [][]LatLng
+	var polygons [][][]LatLng
+	if err := placemark.kmlGeometry.collect(&points, &lines, &polygons); err != nil {
+		imported.skip(label, err.Error())
+		return
+	}
+	if len(points) == 0 && len(lines) == 0 && len(polygons) == 0 {
+		imported.skip(label, "no Point, LineString or Polygon")
+		return
+	}
+
+	if len(points) > 0 {
+		if data["kind"] == GeoJSONKindPoint {
+			imported.skip(label, "search points aren't imported, run the search again instead")
+		} else {
+			address := data["address"]
+			if len(address) == 0 {
+				address = strings.TrimSpace(placemark.Address)
+			}
+			for _, p := range points {
+				imported.addHome(label, p, Home{
+					PointType:    data["point_type"],
+					Title:        title,
+					Notes:        kmlText(placemark.Description),
+					Url:          data["url"],
+					CleanAddress: address,
+				})
+			}
+		}
+	}
+	if len(polygons) > 0 {
+		shapeData, err := areaShapeData(polygons)
+		if err != nil {
+			imported.skip(label, err.Error())
+		} else {
+			imported.addShape(label, layer, kinds, data["shape_kind"], Shape{ShapeData: shapeData, ShapeTitle: title, ShapeType: ShapeTypeArea})
+		}
+	}
+	if len(lines) > 0 {
+		shapeData, err := routeShapeData(lines)
+		if err != nil {
+			imported.skip(label, err.Error())
+		} else {
+			imported.addShape(label, layer, kinds, data["shape_kind"], Shape{ShapeData: shapeData, ShapeTitle: title, ShapeType: ShapeTypeRoute})
+		}
+	}
+}
+
+// data is the placemark's ExtendedData by name
+func (placemark kmlPlacemark) data() map[string]string {
+	data := make(map[string]string)
+	for _, d := range append(placemark.Data, placemark.SchemaData...) {
+		value := strings.TrimSpace(d.Value)
+		if len(value) == 0 {
+			value = strings.TrimSpace(d.Text)
+		}
+		data[d.Name] = value
+	}
+	return data
+}
+
+// collect flattens MultiGeometry into points, lines and polygons (outline then holes)
+func (geometry kmlGeometry) collect(points *[]LatLng, lines *[][]LatLng, polygons *[][][]LatLng) error {
+	for _, point := range geometry.Points {
+		coordinates, err := parseKMLCoordinates(point.Coordinates)
+		if err != nil {
+			return err
+		}
+		if len(coordinates) != 1 {
+			return errors.New("a Point needs one longitude,latitude")
+		}
+		*points = append(*points, coordinates[0])
+	}
+	for _, line := range geometry.LineStrings {
+		coordinates, err := parseKMLCoordinates(line.Coordinates)
+		if err != nil {
+			return err
+		}
+		*lines = append(*lines, coordinates)
+	}
+	for _, track := range geometry.Tracks {
+		line := make([]LatLng, 0, len(track.Coords))
+		for _, coord := range track.Coords {
+			p, err := parseKMLPosition(strings.Fields(coord))
+			if err != nil {
+				return err
+			}
+			line = append(line, p)
+		}
+		*lines = append(*lines, line)
+	}
+	for _, ring := range geometry.LinearRings {
+		coordinates, err := parseKMLCoordinates(ring.Coordinates)
+		if err != nil {
+			return err
+		}
+		*polygons = append(*polygons, [][]LatLng{coordinates})
+	}
+	for _, polygon := range geometry.Polygons {
+		if len(polygon.Outer.Rings) != 1 {
+			return errors.New("a Polygon needs one outerBoundaryIs LinearRing")
+		}
+		rings := make([][]LatLng, 0, len(polygon.Inner)+1)
+		for _, boundary := range append([]kmlBoundary{polygon.Outer}, polygon.Inner...) {
+			for _, ring := range boundary.Rings {
+				coordinates, err := parseKMLCoordinates(ring.Coordinates)
+				if err != nil {
+					return err
+				}
+				rings = append(rings, coordinates)
+			}
+		}
+		*polygons = append(*polygons, rings)
+	}
+	for _, multi := range geometry.MultiGeometries {
+		if err := multi.collect(points, lines, polygons); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseKMLCoordinates reads "lng,lat[,alt] lng,lat[,alt] ..."
+func parseKMLCoordinates(text string) ([]LatLng, error) {
+	coordinates := make([]LatLng, 0)
+	for _, tuple := range strings.Fields(text) {
+		p, err := parseKMLPosition(strings.Split(tuple, ","))
+		if err != nil {
+			return nil, err
+		}
+		coordinates = append(coordinates, p)
+	}
+	return coordinates, nil
+}
+
+func parseKMLPosition(values []string) (LatLng, error) {
+	if len(values) < 2 {
+		return LatLng{}, fmt.Errorf("coordinates %q need a longitude and latitude", strings.Join(values, ","))
+	}
+	lng, lngErr := strconv.ParseFloat(values[0], 64)
+	lat, latErr := strconv.ParseFloat(values[1], 64)
+	if lngErr != nil || latErr != nil {
+		return LatLng{}, fmt.Errorf("coordinates %q aren't numbers", strings.Join(values, ","))
+	}
+	return LatLng{Lat: lat, Lng: lng}, nil
+}
+
+var kmlTags = regexp.MustCompile(`<[^>]*>`)
+
+// kmlText is a description without the HTML My Maps puts in it
+func kmlText(description string) string {
+	description = strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n").Replace(description)
+	return strings.TrimSpace(kmlTags.ReplaceAllString(description, ""))
+}
+
+func kmlPosition(p LatLng) string {
+	return strconv.FormatFloat(p.Lng, 'f', -1, 64) + "," + strconv.FormatFloat(p.Lat, 'f', -1, 64)
+}
+
+func kmlLine(points []LatLng) kmlCoordinates {
+	positions := make([]string, 0, len(points))
+	for _, p := range points {
+		positions = append(positions, kmlPosition(p))
+	}
+	return kmlCoordinates{Coordinates: strings.Join(positions, " ")}
+}
+
+// ExportKML is the theme for Google Earth: homes with their score for the theme, the theme's searches with
+// their points, and every area and route in a folder for its kind
+func ExportKML(db *gorm.DB, theme Theme) (*kmlFile, error) {
+	name := theme.Name
+	if len(name) == 0 {
+		name = "Honing Inn"
+	}
+	document := kmlContainer{Name: name, Styles: []kmlStyle{
+		{ID: GeoJSONKindHome, IconStyle: &kmlIconStyle{Href: "https://maps.google.com/mapfiles/kml/paddle/red-circle.png"}},
+		{ID: GeoJSONKindPoint, IconStyle: &kmlIconStyle{Href: "https://maps.google.com/mapfiles/kml/paddle/blu-circle.png"}},
+	}}
+	for _, kind := range []string{ShapeKindWarning, ShapeKindNoGo, ShapeKindGood} {
+		document.Styles = append(document.Styles, kmlStyle{
+			ID:        kind,
+			LineStyle: &kmlLineStyle{Color: "ff" + kmlShapeColors[kind], Width: 3},
+			PolyStyle: &kmlPolyStyle{Color: "66" + kmlShapeColors[kind]},
+		})
+	}
+
+	homes, scores, err := GetScoredHomes(db, theme.ID, HomeSortScore)
+	if err != nil {
+		return nil, err
+	}
+	homeFolder := kmlContainer{Name: "Homes"}
+	for _, home := range homes {
+		description := make([]string, 0)
+		data := []kmlData{{Name: "kind", Value: GeoJSONKindHome}, {Name: "point_type", Value: home.PointType}}
+		if score, ok := scores[home.ID]; ok && score.Scored {
+			description = append(description, fmt.Sprintf("Score: %.0f (%.0f%% rated)", score.Score, score.Coverage*100))
+			data = append(data, kmlData{Name: "score", Value: fmt.Sprintf("%.1f", score.Score)})
+		}
+		if len(home.Notes) > 0 {
+			description = append(description, home.Notes)
+		}
+		if len(home.Url) > 0 {
+			description = append(description, home.Url)
+			data = append(data, kmlData{Name: "url", Value: home.Url})
+		}
+		homeFolder.Placemarks = append(homeFolder.Placemarks, kmlPlacemark{
+			Name:        home.Title,
+			Address:     home.CleanAddress,
+			Description: strings.Join(description, "\n"),
+			StyleURL:    "#" + GeoJSONKindHome,
+			Data:        data,
+			kmlGeometry: kmlGeometry{Points: []kmlCoordinates{kmlLine([]LatLng{{Lat: home.Lat, Lng: home.Lng}})}},
+		})
+	}
+	document.Folders = append(document.Folders, homeFolder)
+
+	shapeFolders := make(map[string]*kmlContainer)
+	for _, kind := range []string{ShapeKindWarning, ShapeKindNoGo, ShapeKindGood} {
+		shapeFolders[kind] = &kmlContainer{Name: kind}
+	}
+	for _, shape := range GetShapes(db) {
+		folder, ok := shapeFolders[shape.ShapeKind]
+		if !ok {
+			continue
+		}
+		geometry, err := kmlShapeGeometry(shape)
+		if err != nil {
+			continue
+		}
+		folder.Placemarks = append(folder.Placemarks, kmlPlacemark{
+			Name:        shape.ShapeTitle,
+			StyleURL:    "#" + shape.ShapeKind,
+			Data:        []kmlData{{Name: "kind", Value: GeoJSONKindShape}, {Name: "shape_type", Value: shape.ShapeType}, {Name: "shape_kind", Value: shape.ShapeKind}},
+			kmlGeometry: geometry,
+		})
+	}
+	for _, kind := range []string{ShapeKindWarning, ShapeKindNoGo, ShapeKindGood} {
+		if len(shapeFolders[kind].Placemarks) > 0 {
+			document.Folders = append(document.Folders, *shapeFolders[kind])
+		}
+	}
+
+	var searches []FractalSearch
+	if err := db.Where("theme_id = ?", theme.ID).Order("id").Find(&searches).Error; err != nil {
+		return nil, fmt.Errorf("failed to get searches: %w", err)
+	}
+	for _, search := range searches {
+		points, err := GetPoints(db, search.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get points: %w", err)
+		}
+		folder := kmlContainer{Name: search.Query}
+		for _, point := range points {
+			folder.Placemarks = append(folder.Placemarks, kmlPlacemark{
+				Name:        point.Title,
+				Address:     point.CleanAddress,
+				Description: point.Description,
+				StyleURL:    "#" + GeoJSONKindPoint,
+				Data:        []kmlData{{Name: "kind", Value: GeoJSONKindPoint}, {Name: "fractal_search_id", Value: fmt.Sprint(search.ID)}},
+				kmlGeometry: kmlGeometry{Points: []kmlCoordinates{kmlLine([]LatLng{{Lat: point.Lat, Lng: point.Lng}})}},
+			})
+		}
+		if len(folder.Placemarks) > 0 {
+			document.Folders = append(document.Folders, folder)
+		}
+	}
+
+	return &kmlFile{Xmlns: kmlNamespace, kmlContainer: kmlContainer{Documents: []kmlContainer{document}}}, nil
+}
+
+// kmlShapeGeometry is an area's polygons or a route's lines, in a MultiGeometry when there are several
+func kmlShapeGeometry(shape Shape) (kmlGeometry, error) {
+	var geometry kmlGeometry
+	if shape.ShapeType == ShapeTypeRoute {
+		lines, err := parseShapeRings(shape.ShapeData)
+		if err != nil {
+			return geometry, err
+		}
+		for _, line := range lines {
+			geometry.LineStrings = append(geometry.LineStrings, kmlLine(line))
+		}
+	} else {
+		// shapeGeoJSON already sorts the ShapeData into closed rings of polygons
+		polygonGeometry, err := shapeGeoJSON(shape.ShapeData)
+		if err != nil {
+			return geometry, err
+		}
+		polygons := make([][][][]float64, 0)
+		if polygonGeometry.Type == "Polygon" {
+			var polygon [][][]float64
+			json.Unmarshal(polygonGeometry.Coordinates, &polygon)
+			polygons = append(polygons, polygon)
+		} else {
+			json.Unmarshal(polygonGeometry.Coordinates, &polygons)
+		}
+		for _, polygon := range polygons {
+			var kmlRings []kmlBoundary
+			for _, ring := range polygon {
+				points := make([]LatLng, 0, len(ring))
+				for _, position := range ring {
+					points = append(points, LatLng{Lat: position[1], Lng: position[0]})
+				}
+				kmlRings = append(kmlRings, kmlBoundary{Rings: []kmlCoordinates{kmlLine(points)}})
+			}
+			geometry.Polygons = append(geometry.Polygons, kmlPolygon{Outer: kmlRings[0], Inner: kmlRings[1:]})
+		}
+	}
+	if len(geometry.LineStrings)+len(geometry.Polygons) > 1 {
+		return kmlGeometry{MultiGeometries: []kmlGeometry{geometry}}, nil
+	}
+	return geometry, nil
+}
+
+// kmlExportHandler downloads the current theme as KML for Google Earth
+func kmlExportHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		// without a theme cookie this is the first theme, like the rest of the map
+		themeId, _ := getThemeID(r)
+		file, err := ExportKML(db, GetActiveTheme(db, themeId))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.google-earth.kml+xml")
+		w.Header().Set("Content-Disposition", `attachment; filename="honing-inn.kml"`)
+		w.Write([]byte(xml.Header))
+		encoder := xml.NewEncoder(w)
+		encoder.Indent("", "  ")
+		encoder.Encode(file)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+// myMapsKML is trimmed down from a Google My Maps export with two layers
+const myMapsKML = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2" xmlns:gx="http://www.google.com/kml/ext/2.2">
+  <Document>
+    <name>Christchurch suburbs</name>
+    <Folder>
+      <name>No Go</name>
+      <Placemark>
+        <name>Flood plain</name>
+        <styleUrl>#poly-000000-1200-77</styleUrl>
+        <Polygon>
+          <outerBoundaryIs><LinearRing><coordinates>
+            172.6,-43.5,0
+            172.7,-43.5,0
+            172.7,-43.6,0
+            172.6,-43.5,0
+          </coordinates></LinearRing></outerBoundaryIs>
+          <innerBoundaryIs><LinearRing><coordinates>172.65,-43.52 172.66,-43.52 172.66,-43.53 172.65,-43.52</coordinates></LinearRing></innerBoundaryIs>
+        </Polygon>
+      </Placemark>
+    </Folder>
+    <Folder>
+      <name>Nice streets</name>
+      <Placemark>
+        <name>Merivale</name>
+        <ExtendedData><Data name="shape_kind"><value>good</value></Data></ExtendedData>
+        <MultiGeometry>
+          <Polygon><outerBoundaryIs><LinearRing><coordinates>172.61,-43.51 172.62,-43.51 172.62,-43.52</coordinates></LinearRing></outerBoundaryIs></Polygon>
+          <Polygon><outerBoundaryIs><LinearRing><coordinates>172.63,-43.51 172.64,-43.51 172.64,-43.52</coordinates></LinearRing></outerBoundaryIs></Polygon>
+        </MultiGeometry>
+      </Placemark>
+      <Placemark>
+        <name>Walk to the park</name>
+        <gx:Track><gx:coord>172.61 -43.51 5</gx:coord><gx:coord>172.62 -43.52 6</gx:coord></gx:Track>
+      </Placemark>
+      <Placemark>
+        <name>12 Office Road</name>
+        <description><![CDATA[Open home Sunday<br>3 bedrooms]]></description>
+        <Point><coordinates>172.63,-43.53,0</coordinates></Point>
+      </Placemark>
+      <Placemark>
+        <name>Nowhere</name>
+        <Point><coordinates>-43.53,172.63</coordinates></Point>
+      </Placemark>
+      <Placemark>
+        <name>Just a name</name>
+      </Placemark>
+    </Folder>
+  </Document>
+</kml>`
+
+func TestParseKMLImport(t *testing.T) {
+	t.Parallel()
+
+	imported, err := ParseKMLImport([]byte(myMapsKML), ShapeKinds{Default: ShapeKindWarning})
+	if err != nil {
+		t.Fatalf("ParseKMLImport() error = %v", err)
+	}
+	if imported.Name != "Christchurch suburbs" {
+		t.Errorf("Name = %q, want the document's name", imported.Name)
+	}
+	if strings.Join(imported.Layers, ",") != "No Go,Nice streets" {
+		t.Errorf("Layers = %q, want the folders with shapes", imported.Layers)
+	}
+
+	tests := []struct {
+		title     string
+		shapeType string
+		shapeKind string
+		shapeData string
+	}{
+		{title: "Flood plain", shapeType: ShapeTypeArea, shapeKind: ShapeKindNoGo, shapeData: "[[[-43.5,172.6],[-43.5,172.7],[-43.6,172.7]],[[-43.52,172.65],[-43.52,172.66],[-43.53,172.66]]]"},
+		{title: "Merivale", shapeType: ShapeTypeArea, shapeKind: ShapeKindGood, shapeData: "[[[[-43.51,172.61],[-43.51,172.62],[-43.52,172.62]]],[[[-43.51,172.63],[-43.51,172.64],[-43.52,172.64]]]]"},
+		{title: "Walk to the park", shapeType: ShapeTypeRoute, shapeKind: ShapeKindWarning, shapeData: "[[-43.51,172.61],[-43.52,172.62]]"},
+	}
+	if len(imported.Shapes) != len(tests) {
+		t.Fatalf("Shapes = %+v, want %d", imported.Shapes, len(tests))
+	}
+	for i, tt := range tests {
+		shape := imported.Shapes[i]
+		if shape.ShapeTitle != tt.title || shape.ShapeType != tt.shapeType || shape.ShapeKind != tt.shapeKind || shape.ShapeData != tt.shapeData {
+			t.Errorf("shape %d = %+v, want %s a %s %s of %s", i, shape, tt.title, tt.shapeKind, tt.shapeType, tt.shapeData)
+		}
+	}
+
+	if len(imported.Homes) != 1 || imported.Homes[0].Title != "12 Office Road" || imported.Homes[0].Notes != "Open home Sunday\n3 bedrooms" || imported.Homes[0].Lat != -43.53 {
+		t.Errorf("Homes = %+v, want 12 Office Road with its description", imported.Homes)
+	} else if imported.Homes[0].CleanAddress != "12 Office Road" || imported.Homes[0].PointType != "Home" {
+		t.Errorf("home = %+v, want the title as the address like the home form", imported.Homes[0])
+	}
+	if len(imported.Skipped) != 2 || !strings.Contains(imported.Skipped[0], "Nowhere") || !strings.Contains(imported.Skipped[1], "no Point, LineString or Polygon") {
+		t.Errorf("Skipped = %q, want the point off the map and the placemark without geometry", imported.Skipped)
+	}
+
+	mapped, _ := ParseKMLImport([]byte(myMapsKML), ShapeKinds{Default: ShapeKindWarning, Layers: map[string]string{"Nice streets": ShapeKindNoGo}})
+	for _, shape := range mapped.Shapes {
+		if shape.ShapeKind != ShapeKindNoGo {
+			t.Errorf("%s kind = %s, want noGo from the layer mapping", shape.ShapeTitle, shape.ShapeKind)
+		}
+	}
+}
+
+func TestParseKMLImportErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "Not XML", data: "nope", wantErr: "Not KML"},
+		{name: "GPX", data: `<gpx></gpx>`, wantErr: "Not KML"},
+		{name: "Empty", data: `<kml><Document><name>Empty</name></Document></kml>`, wantErr: "no placemarks"},
+	}
+	for _, tt := range tests {
+		if _, err := ParseKMLImport([]byte(tt.data), ShapeKinds{Default: ShapeKindWarning}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: ParseKMLImport() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if imported, err := ParseKMLImport([]byte(`<kml><Placemark><Point><coordinates>a,b</coordinates></Point></Placemark></kml>`), ShapeKinds{Default: ShapeKindWarning}); err != nil || len(imported.Skipped) != 1 || !strings.Contains(imported.Skipped[0], "aren't numbers") {
+		t.Errorf("bad coordinates = %+v, %v, want the placemark skipped", imported, err)
+	}
+}
+
+func TestParseKMZImport(t *testing.T) {
+	t.Parallel()
+
+	kmz := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		for name, content := range files {
+			file, _ := archive.Create(name)
+			file.Write([]byte(content))
+		}
+		archive.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantErr   string
+		wantHomes int
+	}{
+		{name: "doc.kml", data: kmz(map[string]string{"doc.kml": myMapsKML, "images/icon.png": "png"}), wantHomes: 1},
+		{name: "Only nested KML", data: kmz(map[string]string{"files/doc.kml": myMapsKML}), wantErr: "no .kml file"},
+		{name: "Not a zip", data: []byte(myMapsKML), wantErr: "Not KMZ"},
+	}
+	for _, tt := range tests {
+		imported, err := ParseKMZImport(tt.data, ShapeKinds{Default: ShapeKindWarning})
+		if len(tt.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: ParseKMZImport() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || len(imported.Homes) != tt.wantHomes {
+			t.Errorf("%s: ParseKMZImport() = %+v, %v, want %d homes", tt.name, imported, err, tt.wantHomes)
+		}
+	}
+}
+
+func TestExportKML(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBInit(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	scoped := db.WithContext(withWorkspace(context.Background(), defaultWorkspaceID))
+	theme := GetActiveTheme(scoped, 0)
+	scoped.Create(&Home{Title: "Villa", Lat: -43.5, Lng: 172.5, PointType: "Home", Url: "https://example.com/villa"})
+	scoped.Create(&Shape{ShapeTitle: "Flood zone", ShapeType: ShapeTypeArea, ShapeKind: ShapeKindNoGo, ShapeData: "[[-43,172],[-43,173],[-44,173]]"})
+	scoped.Create(&Shape{ShapeTitle: "School walk", ShapeType: ShapeTypeRoute, ShapeKind: ShapeKindGood, ShapeData: "[[[-43.5,172.5],[-43.51,172.52]],[[-43.6,172.6],[-43.61,172.62]]]"})
+	search := FractalSearch{ThemeID: theme.ID, Query: "Parks", Status: FractalSearchImported}
+	scoped.Create(&search)
+	scoped.Create(&Point{Title: "Hagley Park", Lat: -43.53, Lng: 172.62, FractalSearchID: search.ID, ThemeID: theme.ID})
+	other := FractalSearch{ThemeID: theme.ID + 1, Query: "Another theme's search", Status: FractalSearchImported}
+	scoped.Create(&other)
+	scoped.Create(&Point{Title: "Elsewhere", Lat: -43.53, Lng: 172.62, FractalSearchID: other.ID, ThemeID: other.ThemeID})
+
+	file, err := ExportKML(scoped, theme)
+	if err != nil {
+		t.Fatalf("ExportKML() error = %v", err)
+	}
+	exported, err := xml.Marshal(file)
+	if err != nil {
+		t.Fatalf("xml.Marshal() error = %v", err)
+	}
+
+	for _, want := range []string{
+		`<kml xmlns="http://www.opengis.net/kml/2.2"><Document><name>` + theme.Name + `</name>`,
+		`<Folder><name>Homes</name><Placemark><name>Villa</name>`,
+		`<coordinates>172.5,-43.5</coordinates>`,
+		`<Folder><name>noGo</name>`,
+		`<outerBoundaryIs><LinearRing><coordinates>172,-43 173,-43 173,-44 172,-43</coordinates></LinearRing></outerBoundaryIs>`,
+		`<MultiGeometry><LineString><coordinates>172.5,-43.5 172.52,-43.51</coordinates></LineString><LineString>`,
+		`<Folder><name>Parks</name><Placemark><name>Hagley Park</name>`,
+	} {
+		if !strings.Contains(string(exported), want) {
+			t.Errorf("export is missing %s", want)
+		}
+	}
+	if strings.Contains(string(exported), "Elsewhere") {
+		t.Errorf("export has another theme's search points")
+	}
+
+	// importing the export gives the same shapes back, the search points are left out
+	imported, err := ParseKMLImport(exported, ShapeKinds{Default: ShapeKindWarning})
+	if err != nil {
+		t.Fatalf("ParseKMLImport() of the export error = %v", err)
+	}
+	if len(imported.Homes) != 1 || imported.Homes[0].Url != "https://example.com/villa" {
+		t.Errorf("Homes = %+v, want the villa with its url", imported.Homes)
+	}
+	shapes := GetShapes(scoped)
+	if len(imported.Shapes) != 2 {
+		t.Fatalf("Shapes = %+v, want the area and the route", imported.Shapes)
+	}
+	for i, shape := range imported.Shapes {
+		if shape.ShapeData != shapes[i].ShapeData || shape.ShapeKind != shapes[i].ShapeKind || shape.ShapeType != shapes[i].ShapeType {
+			t.Errorf("shape %d = %+v, want %+v", i, shape, shapes[i])
+		}
+	}
+	if len(imported.Skipped) != 1 || !strings.Contains(imported.Skipped[0], "search points") {
+		t.Errorf("Skipped = %q, want the search point", imported.Skipped)
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	ProviderPerplexity = "perplexity"
+	ProviderOpenAI     = "openai"
+	ProviderFake       = "fake"
+)
+
+const (
+	defaultPerplexityURL   = "https://api.perplexity.ai/chat/completions"
+	defaultPerplexityModel = "llama-3.1-sonar-large-128k-online"
+	defaultOpenAIURL       = "http://localhost:11434/v1/chat/completions"
+	defaultOpenAIModel     = "llama3.1"
+	defaultFakeModel       = "fake-deterministic"
+)
+
+// llmProviderNames is the list offered in the theme and chat type editors, "" means inherit/default
+var llmProviderNames = []string{ProviderPerplexity, ProviderOpenAI, ProviderFake}
+
+// LLMProvider sends a prompt to a chat completions backend
+type LLMProvider interface {
+	Name() string
+	DefaultModel() string
+	Complete(config PromptConfig) (PerplexityResult, error)
+	// Stream calls onDelta with each chunk of the answer as it arrives, the result holds the full message
+	Stream(config PromptConfig, onDelta func(delta string) error) (PerplexityResult, error)
+}
+
+// NewLLMProvider returns the provider registered under name (defaults to perplexity)
+func NewLLMProvider(name string, envConfig EnvConfig) (LLMProvider, error) {
+	switch name {
+	case "", ProviderPerplexity:
+		url := envConfig.PerplexityAPIURL
+		if len(url) == 0 {
+			url = defaultPerplexityURL
+		}
+		return &perplexityProvider{
+			url:   url,
+			token: envConfig.PerplexityAPIToken,
+		}, nil
+	case ProviderOpenAI:
+		url := envConfig.OpenAIAPIURL
+		if len(url) == 0 {
+			url = defaultOpenAIURL
+		}
+		model := envConfig.OpenAIModel
+		if len(model) == 0 {
+			model = defaultOpenAIModel
+		}
+		return &openAIProvider{
+			url:   url,
+			token: envConfig.OpenAIAPIToken,
+			model: model,
+		}, nil
+	case ProviderFake:
+		return &fakeProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown llm provider %q", name)
+	}
+}
+
+// resolveLLMSettings picks the provider and model for a chat, the ChatType overrides the Theme
+func resolveLLMSettings(theme Theme, chatType ChatType) (string, string) {
+	provider := theme.LLMProvider
+	model := theme.LLMModel
+	if len(chatType.LLMProvider) > 0 {
+		provider = chatType.LLMProvider
+		model = chatType.LLMModel
+	} else if len(chatType.LLMModel) > 0 {
+		model = chatType.LLMModel
+	}
+	if len(provider) == 0 {
+		provider = ProviderPerplexity
+	}
+	return provider, model
+}
+
+// callLLM sends the prompt to the provider selected in the config
+func callLLM(envConfig EnvConfig, config PromptConfig) (PerplexityResult, error) {
+	provider, err := NewLLMProvider(config.Provider, envConfig)
+	if err != nil {
+		return PerplexityResult{ErrorMessage: err.Error(), config: config}, err
+	}
+
+	if len(config.Model) == 0 {
+		config.Model = provider.DefaultModel()
+	}
+
+	log.Printf("callLLM provider:%s model:%s messages:%d", provider.Name(), config.Model, len(config.Messages))
+	return provider.Complete(config)
+}
+
+// streamLLM is callLLM but hands each chunk of the answer to onDelta as it arrives
+func streamLLM(envConfig EnvConfig, config PromptConfig, onDelta func(delta string) error) (PerplexityResult, error) {
+	provider, err := NewLLMProvider(config.Provider, envConfig)
+	if err != nil {
+		return PerplexityResult{ErrorMessage: err.Error(), config: config}, err
+	}
+
+	if len(config.Model) == 0 {
+		config.Model = provider.DefaultModel()
+	}
+
+	log.Printf("streamLLM provider:%s model:%s messages:%d", provider.Name(), config.Model, len(config.Messages))
+	return provider.Stream(config, onDelta)
+}
+
+type perplexityProvider struct {
+	url   string
+	token string
+}
+
+func (p *perplexityProvider) Name() string {
+	return ProviderPerplexity
+}
+
+func (p *perplexityProvider) DefaultModel() string {
+	return defaultPerplexityModel
+}
+
+func (p *perplexityProvider) request(config PromptConfig, stream bool) PerplexityRequest {
+	runSettings := RunSettings{
+		MaxTokens: 512,
+	}
+
+	// Construct the Perplexity API request body
+	/*
+		llama-3.1-sonar-small-128k-online (8B parameters)
+		llama-3.1-sonar-large-128k-online (70B parameters)
+		llama-3.1-sonar-huge-128k-online (405B parameters)
+	*/
+	return PerplexityRequest{
+		Model:                  config.Model,
+		Messages:               config.Messages,
+		MaxTokens:              runSettings.MaxTokens,
+		Temperature:            0.2,
+		TopP:                   0.9,
+		ReturnCitations:        true,
+		SearchDomainFilter:     []string{}, // []string{"perplexity.ai"},
+		ReturnImages:           false,
+		ReturnRelatedQuestions: true,
+		TopK:                   0,
+		Stream:                 stream,
+		PresencePenalty:        0,
+		FrequencyPenalty:       1,
+		ResponseFormat:         config.ResponseFormat,
+	}
+}
+
+func (p *perplexityProvider) Complete(config PromptConfig) (PerplexityResult, error) {
+	if p.token == "" {
+		return PerplexityResult{ErrorMessage: "API token not set"}, errors.New("API token not set")
+	}
+
+	return postChatCompletion(p.url, p.token, p.request(config, false), config)
+}
+
+func (p *perplexityProvider) Stream(config PromptConfig, onDelta func(delta string) error) (PerplexityResult, error) {
+	if p.token == "" {
+		return PerplexityResult{ErrorMessage: "API token not set"}, errors.New("API token not set")
+	}
+
+	return streamChatCompletion(p.url, p.token, p.request(config, true), config, onDelta)
+}
+
+// OpenAIChatRequest is the subset of the OpenAI chat completions body that local servers (ollama, llama.cpp) accept
+type OpenAIChatRequest struct {
+	Model          string          `json:"model"`
+	Messages       []Message       `json:"messages"`
+	MaxTokens      int             `json:"max_tokens,omitempty"`
+	Temperature    float64         `json:"temperature"`
+	TopP           float64         `json:"top_p"`
+	Stream         bool            `json:"stream"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+type openAIProvider struct {
+	url   string
+	token string
+	model string
+}
+
+func (p *openAIProvider) Name() string {
+	return ProviderOpenAI
+}
+
+func (p *openAIProvider) DefaultModel() string {
+	return p.model
+}
+
+func (p *openAIProvider) request(config PromptConfig, stream bool) OpenAIChatRequest {
+	return OpenAIChatRequest{
+		Model:          config.Model,
+		Messages:       config.Messages,
+		MaxTokens:      512,
+		Temperature:    0.2,
+		TopP:           0.9,
+		Stream:         stream,
+		ResponseFormat: config.ResponseFormat,
+	}
+}
+
+func (p *openAIProvider) Complete(config PromptConfig) (PerplexityResult, error) {
+	return postChatCompletion(p.url, p.token, p.request(config, false), config)
+}
+
+func (p *openAIProvider) Stream(config PromptConfig, onDelta func(delta string) error) (PerplexityResult, error) {
+	return streamChatCompletion(p.url, p.token, p.request(config, true), config, onDelta)
+}
+
+func newChatCompletionRequest(url string, token string, reqBody interface{}) (*http.Request, error) {
+	// Convert the struct to JSON
+	reqBodyBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a new POST request
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers for the API call (local servers don't need a token)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// chatCompletionError turns a non 200 response body into an error result
+func chatCompletionError(statusCode int, body []byte, config PromptConfig) (PerplexityResult, error) {
+	// Try to unmarshal into ErrorResponse
+	var errResp ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil {
+		return PerplexityResult{ErrorMessage: "Failed to unmarshal error response", config: config}, err
+	}
+
+	log.Printf("\n\n====Response: %+v\n\n", errResp)
+
+	if len(errResp.Detail) == 0 {
+		msg := fmt.Sprintf("API error %d - %v", statusCode, errResp)
+		return PerplexityResult{ErrorMessage: msg, config: config}, errors.New(msg)
+	}
+
+	// Extract error details and return them
+	return PerplexityResult{ErrorMessage: errResp.Detail[0].Msg, config: config}, fmt.Errorf("API error: %s", errResp.Detail[0].Msg)
+}
+
+// postChatCompletion sends a chat completions request and decodes the (OpenAI shaped) response
+func postChatCompletion(url string, token string, reqBody interface{}, config PromptConfig) (PerplexityResult, error) {
+	req, err := newChatCompletionRequest(url, token, reqBody)
+	if err != nil {
+		return PerplexityResult{ErrorMessage: "Failed to create request", config: config}, err
+	}
+
+	if config.DryRun {
+		return PerplexityResult{
+			config:         config,
+			SuccessResults: PerplexitySuccessResponse{},
+		}, nil
+	}
+
+	// Send the request
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return PerplexityResult{ErrorMessage: "Failed to call API", config: config}, err
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return PerplexityResult{ErrorMessage: "Failed to read response body", config: config}, err
+	}
+
+	// Check for HTTP errors
+	if resp.StatusCode != http.StatusOK {
+		return chatCompletionError(resp.StatusCode, body, config)
+	}
+
+	// Try to unmarshal into SuccessResponse
+	var successResp SuccessResponse
+	if err := json.Unmarshal(body, &successResp); err != nil {
+		return PerplexityResult{ErrorMessage: "Failed to unmarshal success response", config: config}, err
+	}
+
+	model := successResp.Model
+	if len(model) == 0 {
+		model = config.Model
+	}
+
+	// Return the content of the assistant's message
+	if len(successResp.Choices) > 0 {
+		return PerplexityResult{
+			SuccessResults: PerplexitySuccessResponse{
+				Choices:          successResp.Choices,
+				Model:            model,
+				Usage:            successResp.Usage,
+				Citations:        successResp.Citations,
+				RelatedQuestions: successResp.RelatedQuestions,
+				config:           config,
+			},
+		}, nil
+	}
+
+	return PerplexityResult{ErrorMessage: "No choices returned in the response"}, fmt.Errorf("no choices returned")
+}
+
+// streamChatCompletion sends a stream:true request and reads the "data: {...}" server sent events
+// until [DONE], passing each delta to onDelta. The returned result holds the assembled message.
+func streamChatCompletion(url string, token string, reqBody interface{}, config PromptConfig, onDelta func(delta string) error) (PerplexityResult, error) {
+	req, err := newChatCompletionRequest(url, token, reqBody)
+	if err != nil {
+		return PerplexityResult{ErrorMessage: "Failed to create request", config: config}, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	if config.DryRun {
+		return PerplexityResult{
+			config:         config,
+			SuccessResults: PerplexitySuccessResponse{},
+		}, nil
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return PerplexityResult{ErrorMessage: "Failed to call API", config: config}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return PerplexityResult{ErrorMessage: "Failed to read response body", config: config}, err
+		}
+		return chatCompletionError(resp.StatusCode, body, config)
+	}
+
+	var content strings.Builder
+	role := "assistant"
+	finishReason := ""
+	var citations, relatedQuestions []string
+	var usage Usage
+	model := config.Model
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk SuccessResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return PerplexityResult{ErrorMessage: "Failed to unmarshal stream chunk", config: config}, err
+		}
+		if len(chunk.Model) > 0 {
+			model = chunk.Model
+		}
+		// usage is cumulative when sent, it may only come on the last chunk
+		if chunk.Usage.TotalTokens > 0 {
+			usage = chunk.Usage
+		}
+		// perplexity repeats the sources on every chunk, keep the latest
+		if len(chunk.Citations) > 0 {
+			citations = chunk.Citations
+		}
+		if len(chunk.RelatedQuestions) > 0 {
+			relatedQuestions = chunk.RelatedQuestions
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		choice := chunk.Choices[0]
+		if len(choice.Delta.Role) > 0 {
+			role = choice.Delta.Role
+		}
+		if len(choice.FinishReason) > 0 {
+			finishReason = choice.FinishReason
+		}
+		if len(choice.Delta.Content) == 0 {
+			continue
+		}
+
+		content.WriteString(choice.Delta.Content)
+		if err := onDelta(choice.Delta.Content); err != nil {
+			return PerplexityResult{ErrorMessage: "Stream cancelled", config: config}, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return PerplexityResult{ErrorMessage: "Failed to read stream", config: config}, err
+	}
+
+	if content.Len() == 0 {
+		return PerplexityResult{ErrorMessage: "No content returned in the stream"}, fmt.Errorf("no content returned")
+	}
+
+	return PerplexityResult{
+		SuccessResults: PerplexitySuccessResponse{
+			Choices: []Choice{
+				{
+					FinishReason: finishReason,
+					Message: Message{
+						Role:    role,
+						Content: content.String(),
+					},
+				},
+			},
+			Model:            model,
+			Usage:            usage,
+			Citations:        citations,
+			RelatedQuestions: relatedQuestions,
+			config:           config,
+		},
+	}, nil
+}
+
+// splitStreamChunks breaks a full answer into word sized deltas, used to fake a stream from a complete response
+func splitStreamChunks(content string) []string {
+	return strings.SplitAfter(content, " ")
+}
+
+// fakeProvider answers without any network calls, the same prompt always gives the same answer.
+// The content is shaped so both extractRating and parseFractalSearchResult can read it.
+type fakeProvider struct{}
+
+func (p *fakeProvider) Name() string {
+	return ProviderFake
+}
+
+func (p *fakeProvider) DefaultModel() string {
+	return defaultFakeModel
+}
+
+func (p *fakeProvider) Complete(config PromptConfig) (PerplexityResult, error) {
+	if config.DryRun {
+		return PerplexityResult{
+			config:         config,
+			SuccessResults: PerplexitySuccessResponse{},
+		}, nil
+	}
+
+	var lastUser string
+	h := fnv.New32a()
+	for _, msg := range config.Messages {
+		h.Write([]byte(msg.Role))
+		h.Write([]byte(msg.Content))
+		if msg.Role == "user" {
+			lastUser = msg.Content
+		}
+	}
+	sum := h.Sum32()
+	topic := strings.TrimSpace(lastUser)
+
+	content := fmt.Sprintf(`# Fake results
+- Fake place %d - %s
+- Fake place %d - %s
+
+Fake answer (%s) for: %s
+
+Rating: %d`, sum%100, topic, (sum/100)%100, topic, config.Model, topic, int(sum%3)+1)
+
+	if config.ResponseFormat != nil {
+		answer, _ := json.Marshal(StructuredAnswer{
+			Rating:     int(sum%3) + 1,
+			Summary:    fmt.Sprintf("Fake answer (%s) for: %s", config.Model, topic),
+			Pros:       []string{fmt.Sprintf("Fake place %d", sum%100)},
+			Cons:       []string{fmt.Sprintf("Fake place %d", (sum/100)%100)},
+			Confidence: float64(sum%10) / 10,
+		})
+		content = string(answer)
+	}
+
+	// roughly a token per word, enough to exercise usage accounting
+	promptTokens := 0
+	for _, msg := range config.Messages {
+		promptTokens += len(strings.Fields(msg.Content))
+	}
+	completionTokens := len(strings.Fields(content))
+
+	return PerplexityResult{
+		SuccessResults: PerplexitySuccessResponse{
+			Choices: []Choice{
+				{
+					Index:        0,
+					FinishReason: "stop",
+					Message: Message{
+						Role:    "assistant",
+						Content: content,
+					},
+				},
+			},
+			Model: config.Model,
+			Usage: Usage{
+				PromptTokens:     promptTokens,
+				CompletionTokens: completionTokens,
+				TotalTokens:      promptTokens + completionTokens,
+			},
+			config: config,
+		},
+	}, nil
+}
+
+func (p *fakeProvider) Stream(config PromptConfig, onDelta func(delta string) error) (PerplexityResult, error) {
+	result, err := p.Complete(config)
+	if err != nil || config.DryRun {
+		return result, err
+	}
+
+	for _, chunk := range splitStreamChunks(result.SuccessResults.Choices[0].Message.Content) {
+		if err := onDelta(chunk); err != nil {
+			return PerplexityResult{ErrorMessage: "Stream cancelled", config: config}, err
+		}
+	}
+	return result, nil
+}
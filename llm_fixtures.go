@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	LLMFixtureReplay = "replay"
+	LLMFixtureRecord = "record"
+)
+
+// LLMFixture is one recorded chat completions exchange, stored as <dir>/<key>.json
+type LLMFixture struct {
+	Key      string          `json:"key"`
+	Model    string          `json:"model"`
+	Messages []Message       `json:"messages"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response"`
+}
+
+// llmPromptKey hashes the role and content of each message, so fixtures survive model changes
+func llmPromptKey(messages []Message) string {
+	h := sha256.New()
+	for _, msg := range messages {
+		fmt.Fprintf(h, "%s\x00%s\x00", msg.Role, msg.Content)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// llmFixtureServer stands in for a chat completions endpoint.
+// In replay mode it answers from the fixture dir, in record mode it forwards to the real
+// endpoint (picked by the first path segment, e.g. /perplexity) and saves what comes back.
+type llmFixtureServer struct {
+	dir       string
+	mode      string
+	upstreams map[string]string
+}
+
+// NewLLMFixtureServer starts the stand-in, upstreams maps a path prefix ("perplexity") to the real URL
+func NewLLMFixtureServer(dir string, mode string, upstreams map[string]string) (*httptest.Server, error) {
+	if len(mode) == 0 {
+		mode = LLMFixtureReplay
+	}
+	if mode != LLMFixtureReplay && mode != LLMFixtureRecord {
+		return nil, fmt.Errorf("unknown llm fixture mode %q (replay, record)", mode)
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("unable to create fixture directory: %w", err)
+	}
+
+	return httptest.NewServer(&llmFixtureServer{
+		dir:       dir,
+		mode:      mode,
+		upstreams: upstreams,
+	}), nil
+}
+
+func (s *llmFixtureServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeLLMFixtureError(w, http.StatusBadRequest, fmt.Sprintf("failed to read request - %v", err))
+		return
+	}
+
+	var req struct {
+		Model    string    `json:"model"`
+		Messages []Message `json:"messages"`
+		Stream   bool      `json:"stream"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeLLMFixtureError(w, http.StatusBadRequest, fmt.Sprintf("failed to decode request - %v", err))
+		return
+	}
+
+	// fixtures are always recorded as complete responses, streams are replayed from them
+	if req.Stream {
+		body, err = setRequestStream(body, false)
+		if err != nil {
+			writeLLMFixtureError(w, http.StatusBadRequest, fmt.Sprintf("failed to decode request - %v", err))
+			return
+		}
+	}
+
+	key := llmPromptKey(req.Messages)
+
+	switch s.mode {
+	case LLMFixtureRecord:
+		prefix := strings.Split(strings.Trim(r.URL.Path, "/"), "/")[0]
+		upstream, ok := s.upstreams[prefix]
+		if !ok {
+			writeLLMFixtureError(w, http.StatusNotFound, fmt.Sprintf("no upstream for path %s", r.URL.Path))
+			return
+		}
+
+		fixture, err := s.record(r, upstream, body)
+		if err != nil {
+			writeLLMFixtureError(w, http.StatusBadGateway, fmt.Sprintf("failed to record - %v", err))
+			return
+		}
+		fixture.Key = key
+		fixture.Model = req.Model
+		fixture.Messages = req.Messages
+
+		if err := SaveLLMFixture(s.dir, *fixture); err != nil {
+			writeLLMFixtureError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		log.Printf("llm fixture recorded %s (%d)", key, fixture.Status)
+		writeLLMFixture(w, *fixture, req.Stream)
+	default:
+		fixture, err := LoadLLMFixture(s.dir, key)
+		if err != nil {
+			log.Printf("llm fixture missing %s - %v", key, err)
+			writeLLMFixtureError(w, http.StatusNotFound, fmt.Sprintf("no recorded response for prompt %s", key))
+			return
+		}
+
+		writeLLMFixture(w, *fixture, req.Stream)
+	}
+}
+
+func setRequestStream(body []byte, stream bool) ([]byte, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	fields["stream"] = stream
+	return json.Marshal(fields)
+}
+
+// writeLLMFixture writes the recorded response, as chat completion chunks when the caller asked for a stream
+func writeLLMFixture(w http.ResponseWriter, fixture LLMFixture, stream bool) {
+	if !stream || fixture.Status != http.StatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(fixture.Status)
+		w.Write(fixture.Response)
+		return
+	}
+
+	var resp SuccessResponse
+	if err := json.Unmarshal(fixture.Response, &resp); err != nil || len(resp.Choices) == 0 {
+		writeLLMFixtureError(w, http.StatusInternalServerError, fmt.Sprintf("fixture %s has no choices to stream", fixture.Key))
+		return
+	}
+	msg := resp.Choices[len(resp.Choices)-1].Message
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	chunks := splitStreamChunks(msg.Content)
+	for i, chunk := range chunks {
+		streamed := SuccessResponse{
+			ID:    resp.ID,
+			Model: resp.Model,
+			Choices: []Choice{
+				{Delta: Message{Role: msg.Role, Content: chunk}},
+			},
+			Citations:        resp.Citations,
+			RelatedQuestions: resp.RelatedQuestions,
+		}
+		// like the openai include_usage option, the totals come with the last chunk
+		if i == len(chunks)-1 {
+			streamed.Usage = resp.Usage
+		}
+		data, _ := json.Marshal(streamed)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func (s *llmFixtureServer) record(r *http.Request, upstream string, body []byte) (*LLMFixture, error) {
+	req, err := http.NewRequest("POST", upstream, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if auth := r.Header.Get("Authorization"); len(auth) > 0 {
+		req.Header.Set("Authorization", auth)
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if !json.Valid(respBody) {
+		return nil, fmt.Errorf("upstream returned non json response (%d)", resp.StatusCode)
+	}
+
+	return &LLMFixture{
+		Status:   resp.StatusCode,
+		Response: respBody,
+	}, nil
+}
+
+func writeLLMFixtureError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Detail: []ErrorDetail{{Msg: msg, Type: "llm_fixture"}},
+	})
+}
+
+func SaveLLMFixture(dir string, fixture LLMFixture) error {
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode fixture: %w", err)
+	}
+
+	filePath := filepath.Join(dir, fmt.Sprintf("%s.json", fixture.Key))
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return fmt.Errorf("unable to save fixture: %w", err)
+	}
+	return nil
+}
+
+func LoadLLMFixture(dir string, key string) (*LLMFixture, error) {
+	data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%s.json", key)))
+	if err != nil {
+		return nil, err
+	}
+
+	var fixture LLMFixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("unable to decode fixture %s: %w", key, err)
+	}
+	if fixture.Status == 0 {
+		fixture.Status = http.StatusOK
+	}
+	return &fixture, nil
+}
+
+// startLLMFixtureServer points the provider URLs at a fixture server when LLM_FIXTURE_DIR is set
+func startLLMFixtureServer(envConfig *EnvConfig) (*httptest.Server, error) {
+	perplexityURL := envConfig.PerplexityAPIURL
+	if len(perplexityURL) == 0 {
+		perplexityURL = defaultPerplexityURL
+	}
+	openAIURL := envConfig.OpenAIAPIURL
+	if len(openAIURL) == 0 {
+		openAIURL = defaultOpenAIURL
+	}
+
+	server, err := NewLLMFixtureServer(envConfig.LLMFixtureDir, envConfig.LLMFixtureMode, map[string]string{
+		ProviderPerplexity: perplexityURL,
+		ProviderOpenAI:     openAIURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// replaying never reaches the real api, so a token isn't required
+	if envConfig.LLMFixtureMode != LLMFixtureRecord && len(envConfig.PerplexityAPIToken) == 0 {
+		envConfig.PerplexityAPIToken = LLMFixtureReplay
+	}
+
+	envConfig.PerplexityAPIURL = server.URL + "/" + ProviderPerplexity
+	envConfig.OpenAIAPIURL = server.URL + "/" + ProviderOpenAI
+	log.Printf("LLM fixture server (%s) on %s using %s", envConfig.LLMFixtureMode, server.URL, envConfig.LLMFixtureDir)
+	return server, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLLMFixtureServerRecordReplay(t *testing.T) {
+	t.Parallel()
+
+	upstreamCalls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		if r.Header.Get("Authorization") != "Bearer real-token" {
+			t.Errorf("upstream Authorization = %q, want token forwarded", r.Header.Get("Authorization"))
+		}
+		json.NewEncoder(w).Encode(SuccessResponse{
+			Choices: []Choice{{Message: Message{Role: "assistant", Content: "Quiet street.\n\nRating: 3"}}},
+		})
+	}))
+	t.Cleanup(upstream.Close)
+
+	dir := t.TempDir()
+	config := PromptConfig{
+		Provider: ProviderPerplexity,
+		Messages: []Message{{Role: "user", Content: "Is 1 Test Street quiet?"}},
+	}
+
+	recorder, err := NewLLMFixtureServer(dir, LLMFixtureRecord, map[string]string{ProviderPerplexity: upstream.URL})
+	if err != nil {
+		t.Fatalf("NewLLMFixtureServer() error = %v", err)
+	}
+	recorded, err := callLLM(EnvConfig{PerplexityAPIURL: recorder.URL + "/" + ProviderPerplexity, PerplexityAPIToken: "real-token"}, config)
+	recorder.Close()
+	if err != nil {
+		t.Fatalf("callLLM() record error = %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, llmPromptKey(config.Messages)+".json")); err != nil {
+		t.Fatalf("fixture not written: %v", err)
+	}
+
+	replayer, err := NewLLMFixtureServer(dir, LLMFixtureReplay, nil)
+	if err != nil {
+		t.Fatalf("NewLLMFixtureServer() error = %v", err)
+	}
+	t.Cleanup(replayer.Close)
+	replayConfig := EnvConfig{PerplexityAPIURL: replayer.URL + "/" + ProviderPerplexity, PerplexityAPIToken: "test-token"}
+
+	replayed, err := callLLM(replayConfig, config)
+	if err != nil {
+		t.Fatalf("callLLM() replay error = %v", err)
+	}
+
+	if upstreamCalls != 1 {
+		t.Errorf("upstream called %d times, want 1", upstreamCalls)
+	}
+	if replayed.SuccessResults.Choices[0].Message.Content != recorded.SuccessResults.Choices[0].Message.Content {
+		t.Errorf("replayed %q, recorded %q", replayed.SuccessResults.Choices[0].Message.Content, recorded.SuccessResults.Choices[0].Message.Content)
+	}
+
+	config.Messages = []Message{{Role: "user", Content: "Something never recorded"}}
+	_, err = callLLM(replayConfig, config)
+	if err == nil || !contains(err.Error(), "no recorded response") {
+		t.Errorf("callLLM() unrecorded prompt error = %v, want no recorded response", err)
+	}
+}
+
+func TestLLMFixtureServerStream(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewLLMFixtureServer("testdata/llm", LLMFixtureReplay, nil)
+	if err != nil {
+		t.Fatalf("NewLLMFixtureServer() error = %v", err)
+	}
+	t.Cleanup(server.Close)
+
+	envConfig := EnvConfig{PerplexityAPIURL: server.URL + "/" + ProviderPerplexity, PerplexityAPIToken: "test-token"}
+	config := PromptConfig{
+		Provider: ProviderPerplexity,
+		Messages: []Message{
+			{Role: "system", Content: "Group places under # headers and list them as - [name] - [location]"},
+			{Role: "user", Content: "Parks in Christchurch"},
+		},
+	}
+
+	complete, err := callLLM(envConfig, config)
+	if err != nil {
+		t.Fatalf("callLLM() error = %v", err)
+	}
+
+	deltas := 0
+	streamed, err := streamLLM(envConfig, config, func(delta string) error {
+		deltas++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("streamLLM() error = %v", err)
+	}
+
+	if deltas < 2 {
+		t.Errorf("streamLLM() sent %d deltas, want several", deltas)
+	}
+	if streamed.SuccessResults.Choices[0].Message.Content != complete.SuccessResults.Choices[0].Message.Content {
+		t.Errorf("streamed %q, want %q", streamed.SuccessResults.Choices[0].Message.Content, complete.SuccessResults.Choices[0].Message.Content)
+	}
+}
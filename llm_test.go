@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveLLMSettings(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		theme        Theme
+		chatType     ChatType
+		wantProvider string
+		wantModel    string
+	}{
+		{
+			name:         "Defaults to perplexity",
+			theme:        Theme{},
+			chatType:     ChatType{},
+			wantProvider: ProviderPerplexity,
+			wantModel:    "",
+		},
+		{
+			name:         "Theme provider and model",
+			theme:        Theme{LLMProvider: ProviderOpenAI, LLMModel: "llama3.1"},
+			chatType:     ChatType{},
+			wantProvider: ProviderOpenAI,
+			wantModel:    "llama3.1",
+		},
+		{
+			name:         "ChatType provider overrides theme",
+			theme:        Theme{LLMProvider: ProviderOpenAI, LLMModel: "llama3.1"},
+			chatType:     ChatType{LLMProvider: ProviderFake},
+			wantProvider: ProviderFake,
+			wantModel:    "",
+		},
+		{
+			name:         "ChatType model only keeps theme provider",
+			theme:        Theme{LLMProvider: ProviderOpenAI, LLMModel: "llama3.1"},
+			chatType:     ChatType{LLMModel: "qwen2.5"},
+			wantProvider: ProviderOpenAI,
+			wantModel:    "qwen2.5",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			provider, model := resolveLLMSettings(tt.theme, tt.chatType)
+			if provider != tt.wantProvider || model != tt.wantModel {
+				t.Errorf("resolveLLMSettings() = (%q, %q), want (%q, %q)", provider, model, tt.wantProvider, tt.wantModel)
+			}
+		})
+	}
+}
+
+func TestNewLLMProviderUnknown(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewLLMProvider("not-a-provider", EnvConfig{})
+	if err == nil {
+		t.Errorf("NewLLMProvider() expected error for unknown provider")
+	}
+}
+
+func TestFakeProvider(t *testing.T) {
+	t.Parallel()
+
+	home := Home{ID: 1, CleanAddress: "7 Middleton Road", CleanSuburb: "Riccarton"}
+	chatType := ChatType{ID: 2, Name: "Traffic", Prompt: "How busy is {address}?", ThemeID: 1, LLMProvider: ProviderFake}
+	config, err := buildPromptConfig(newPromptData(home, chatType, Theme{ID: 1}))
+	if err != nil {
+		t.Fatalf("buildPromptConfig() error = %v", err)
+	}
+
+	first, err := callLLM(EnvConfig{}, config)
+	if err != nil {
+		t.Fatalf("callLLM() error = %v", err)
+	}
+	second, err := callLLM(EnvConfig{}, config)
+	if err != nil {
+		t.Fatalf("callLLM() error = %v", err)
+	}
+
+	firstContent := first.SuccessResults.Choices[0].Message.Content
+	if firstContent != second.SuccessResults.Choices[0].Message.Content {
+		t.Errorf("fake provider not deterministic: %q vs %q", firstContent, second.SuccessResults.Choices[0].Message.Content)
+	}
+
+	if !contains(firstContent, "7 Middleton Road") {
+		t.Errorf("fake response does not include the rendered prompt: %q", firstContent)
+	}
+
+	newChat := buildChat(first, home, chatType)
+	if newChat.Rating < 1 || newChat.Rating > 3 {
+		t.Errorf("buildChat() rating = %d, want 1-3", newChat.Rating)
+	}
+
+	results, err := parseFractalSearchResult(first, FractalSearch{ID: 3, ThemeID: 1})
+	if err != nil {
+		t.Fatalf("parseFractalSearchResult() error = %v", err)
+	}
+	if len(results) != 1 || len(results[0].Points) != 2 {
+		t.Errorf("parseFractalSearchResult() = %+v, want 1 group with 2 points", results)
+	}
+}
+
+func TestFakeProviderStream(t *testing.T) {
+	t.Parallel()
+
+	config := PromptConfig{
+		Provider: ProviderFake,
+		Messages: []Message{{Role: "user", Content: "Is 1 Test Street quiet?"}},
+	}
+
+	complete, err := callLLM(EnvConfig{}, config)
+	if err != nil {
+		t.Fatalf("callLLM() error = %v", err)
+	}
+
+	var deltas []string
+	streamed, err := streamLLM(EnvConfig{}, config, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("streamLLM() error = %v", err)
+	}
+
+	if len(deltas) < 2 {
+		t.Errorf("streamLLM() sent %d deltas, want several", len(deltas))
+	}
+
+	want := complete.SuccessResults.Choices[0].Message.Content
+	if strings.Join(deltas, "") != want || streamed.SuccessResults.Choices[0].Message.Content != want {
+		t.Errorf("streamed content %q does not match complete content %q", strings.Join(deltas, ""), want)
+	}
+}
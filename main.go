@@ -29,11 +29,15 @@ import (
 // startServer starts the HTTP server with graceful shutdown.
 
 // startServer starts the HTTP server with graceful shutdown.
-func startServer(r *chi.Mux, portStr string) {
+func startServer(r *chi.Mux, portStr string, onShutdown ...func()) {
 	server := &http.Server{
 		Addr:    portStr,
 		Handler: r,
 	}
+	// long lived streams like /events have to be told to finish or shutdown waits for them
+	for _, f := range onShutdown {
+		server.RegisterOnShutdown(f)
+	}
 
 	// Channel to listen for interrupt signals
 	stop := make(chan os.Signal, 1)
@@ -68,6 +72,18 @@ type EnvConfig struct {
 	DBUrl               string
 	HuggingFaceAPIToken string
 	ImageDir            string
+	PerplexityAPIURL    string
+	PerplexityAPIToken  string
+	OpenAIAPIURL        string
+	OpenAIAPIToken      string
+	OpenAIModel         string
+	LLMFixtureDir       string
+	LLMFixtureMode      string
+	JobWorkers          int
+	LLMPrices           map[string]LLMPrice
+	LLMMonthlyBudget    float64
+	AdminUsername       string
+	AdminPassword       string
 }
 
 func GetEnvConfig() EnvConfig {
@@ -77,6 +93,16 @@ func GetEnvConfig() EnvConfig {
 		DBUrl:               os.Getenv("DATABASE_URL"),
 		HuggingFaceAPIToken: os.Getenv("HUGGINGFACE_API_TOKEN"),
 		ImageDir:            os.Getenv("IMAGE_DIR"),
+		PerplexityAPIURL:    os.Getenv("PERPLEXITY_API_URL"),
+		PerplexityAPIToken:  os.Getenv("PERPLEXITY_API_TOKEN"),
+		OpenAIAPIURL:        os.Getenv("OPENAI_API_URL"),
+		OpenAIAPIToken:      os.Getenv("OPENAI_API_TOKEN"),
+		OpenAIModel:         os.Getenv("OPENAI_MODEL"),
+		LLMFixtureDir:       os.Getenv("LLM_FIXTURE_DIR"),
+		LLMFixtureMode:      os.Getenv("LLM_FIXTURE_MODE"),
+		JobWorkers:          parseQueryInt(os.Getenv("JOB_WORKERS")),
+		AdminUsername:       os.Getenv("AUTH_ADMIN_USERNAME"),
+		AdminPassword:       os.Getenv("AUTH_ADMIN_PASSWORD"),
 	}
 
 	if len(config.DBUrl) == 0 {
@@ -90,17 +116,45 @@ func GetEnvConfig() EnvConfig {
 	if len(config.HuggingFaceAPIToken) == 0 {
 		log.Printf("HUGGINGFACE_API_TOKEN not set")
 	}
+
+	prices, err := loadLLMPrices(os.Getenv("LLM_PRICE_FILE"))
+	if err != nil {
+		log.Fatalf("LLM_PRICE_FILE invalid: %v", err)
+	}
+	config.LLMPrices = prices
+
+	if budget := os.Getenv("LLM_MONTHLY_BUDGET"); len(budget) > 0 {
+		config.LLMMonthlyBudget, err = strconv.ParseFloat(budget, 64)
+		if err != nil {
+			log.Fatalf("LLM_MONTHLY_BUDGET invalid: %v", err)
+		}
+	}
 	return config
 }
 
 const themeId uint = 1
 
+// deleteAllConfirmation has to be typed to delete everything
+const deleteAllConfirmation = "delete everything"
+
 func main() {
 
 	envConfig := GetEnvConfig()
 
-	// Initialize the database connection
-	db, err := DBInit(envConfig)
+	if len(envConfig.LLMFixtureDir) > 0 {
+		fixtureServer, err := startLLMFixtureServer(&envConfig)
+		if err != nil {
+			log.Fatal("ERROR: failed to start llm fixture server:", err)
+		}
+		defer fixtureServer.Close()
+	}
+
+	// Initialize the database connection, migrate only opens it so it can show and roll back migrations first
+	openDB := DBInit
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		openDB = DBOpen
+	}
+	db, err := openDB(envConfig)
 	if err != nil {
 		log.Fatal("ERROR: failed to connect to database:", err)
 	}
@@ -115,10 +169,49 @@ func main() {
 		log.Println("Database connection closed")
 	}()
 
+	if len(os.Args) > 1 {
+		if err := runCommand(db, envConfig, os.Args[1:], os.Stdout); err != nil {
+			log.Fatal("ERROR: ", err)
+		}
+		return
+	}
+
+	if err := InitAdminUser(db, envConfig); err != nil {
+		log.Fatal("ERROR: failed to create admin user:", err)
+	}
+
+	jobCtx, stopJobs := context.WithCancel(context.Background())
+	jobQueue := NewJobQueue(db, envConfig, envConfig.JobWorkers)
+	jobQueue.Start(jobCtx)
+	defer func() {
+		stopJobs()
+		jobQueue.Wait()
+	}()
+
+	// open maps get every change made in their workspace from /events
+	eventHub := NewEventHub()
+	if err := eventHub.Register(db); err != nil {
+		log.Fatal("ERROR: failed to register event callbacks:", err)
+	}
+
 	osmClient := NewOSMClient()
 
-	// Create a new router
+	// Create a new router, everything but logging in and invites is scoped to a workspace the user is a member of
 	r := chi.NewRouter()
+	r.Use(loadUser(db))
+	r.Use(requireUserToChange)
+	r.Use(loadWorkspace(db))
+	r.Use(requireWorkspace)
+
+	r.Get("/login", loginHandler(db, envConfig))
+	r.Post("/login", loginHandler(db, envConfig))
+	r.Post("/logout", logoutHandler(db, envConfig))
+	r.With(requireRole(RoleAdmin)).Get("/users", usersHandler(db))
+	r.With(requireRole(RoleAdmin)).Post("/users", usersHandler(db))
+	r.Get("/workspaces", workspacesHandler(db, envConfig))
+	r.Post("/workspaces", workspacesHandler(db, envConfig))
+	r.Get("/invite/{token}", inviteHandler(db, envConfig))
+	r.Post("/invite/{token}", inviteHandler(db, envConfig))
 
 	r.Get("/mapmanager", mapManagerHandler(db))
 	r.Get("/set-theme", setThemeHandler(db))
@@ -130,6 +223,7 @@ func main() {
 	// Define routes with method-specific handlers
 	r.Get("/shapes", shapeHandler(db))
 	r.Get("/shapes/{shapeId:[0-9]+}", specificShapeHandler(db))
+	r.Get("/shapes/containing", containingShapesHandler(db))
 	r.Delete("/shapes/{shapeId:[0-9]+}", specificShapeHandler(db))
 	r.Post("/image-overlay/{imageOverlayId:[0-9]+}/key", imageOverlayKeyHandler(db))
 
@@ -140,6 +234,18 @@ func main() {
 	r.Get("/images/{imageID}", imageHandler(envConfig.ImageDir))
 
 	r.Get("/health", healthHandler())
+	r.Mount(apiPrefix, apiRouter(db, envConfig))
+	r.Get("/events", eventsHandler(eventHub))
+	r.Get("/trash", trashHandler(db, envConfig))
+	r.Post("/trash/{kind:[a-z]+}/{id:[0-9]+}/restore", trashHandler(db, envConfig))
+	r.With(requireRole(RoleAdmin)).Post("/trash/{kind:[a-z]+}/{id:[0-9]+}/purge", trashHandler(db, envConfig))
+	r.Get("/audit", auditHandler(db))
+	r.Get("/export.geojson", geoJSONExportHandler(db))
+	r.Get("/export.kml", kmlExportHandler(db))
+	r.Get("/import", mapImportHandler(db))
+	r.Post("/import", mapImportHandler(db))
+	r.Get("/import/csv", csvImportHandler(db, osmClient))
+	r.Post("/import/csv", csvImportHandler(db, osmClient))
 
 	r.Post("/shapes", shapeHandler(db))
 
@@ -148,20 +254,25 @@ func main() {
 
 	r.Post("/factors", createFactor(db))
 
+	r.Get("/score-weights", scoreWeightsHandler(db))
+	r.Post("/score-weights", scoreWeightsHandler(db))
+
 	r.Get("/chatlist", chatListHandler(db))
 
 	r.Get("/homes/{homeId:[0-9]+}", singleHomeHandler(db))
 	r.Delete("/homes/{homeId:[0-9]+}", singleHomeHandler(db))
 
+	r.Get("/compare", compareHandler(db))
+
 	r.Get("/homes", homeHandler(db))
 	r.Post("/homes", homeHandler(db))
 	r.Post("/homes/url", homeUrlHandler(db))
 
-	r.Get("/fractal", fractalSearchHandler(db))
-	r.Post("/fractal", fractalSearchHandler(db))
-	r.Get("/fractal/{fractalSearchId:[0-9]+}", fractalSearchHandler(db))
-	r.Put("/fractal/{fractalSearchId:[0-9]+}", fractalSearchHandler(db))
-	r.Delete("/fractal/{fractalSearchId:[0-9]+}", fractalSearchHandler(db))
+	r.Get("/fractal", fractalSearchHandler(db, envConfig))
+	r.Post("/fractal", fractalSearchHandler(db, envConfig))
+	r.Get("/fractal/{fractalSearchId:[0-9]+}", fractalSearchHandler(db, envConfig))
+	r.Put("/fractal/{fractalSearchId:[0-9]+}", fractalSearchHandler(db, envConfig))
+	r.Delete("/fractal/{fractalSearchId:[0-9]+}", fractalSearchHandler(db, envConfig))
 	r.Delete("/fractal/{fractalSearchId:[0-9]+}/results", fractalSearchResultsHandler(db))
 
 	r.Put("/fractal/{fractalSearchId:[0-9]+}/locations", fractalSearchLocatonHandler(db, osmClient))
@@ -174,20 +285,30 @@ func main() {
 	r.Get("/process", mapProcessView(db, envConfig))
 	r.Post("/process", mapProcessHandler(db, envConfig))
 
-	r.Get("/delete-all", deleteHandler(db))
-	r.Delete("/delete-all", deleteHandler(db))
+	r.With(requireRole(RoleAdmin)).Get("/delete-all", deleteHandler(db))
+	r.With(requireRole(RoleAdmin)).Post("/delete-all", deleteHandler(db))
+	r.With(requireRole(RoleAdmin)).Get("/backup", backupHandler(db, envConfig))
+	r.With(requireRole(RoleAdmin)).Post("/backup", backupHandler(db, envConfig))
+	r.With(requireRole(RoleAdmin)).Get("/backup.zip", backupDownloadHandler(db, envConfig))
 
 	r.Get("/factors", factorHandler(db))
 	r.Post("/factors", factorHandler(db))
 	r.Delete("/factors/{factorId:[0-9]+}", factorHandler(db))
 
-	r.Get("/chat", chatHandler(db))
-	r.Post("/chat", chatHandler(db))
-	r.Delete("/chat/{chatId:[0-9]+}", chatHandler(db))
+	r.With(requireUser).Get("/chat", chatHandler(db, envConfig))
+	r.Post("/chat", chatHandler(db, envConfig))
+	r.Delete("/chat/{chatId:[0-9]+}", chatHandler(db, envConfig))
+	r.With(requireUser).Get("/chat/{chatId:[0-9]+}/stream", chatStreamHandler(db, envConfig))
+
+	r.Get("/jobs", jobsHandler(db))
+	r.Get("/usage", usageHandler(db, envConfig))
 
 	r.Get("/chattype", chatTypeHandler(db))
 	r.Post("/chattype", chatTypeHandler(db))
 	r.Delete("/chattype/{chatTypeId:[0-9]+}", chatTypeHandler(db))
+	r.Post("/chattype/preview", chatTypePreviewHandler(db))
+	r.Get("/chattype/{chatTypeId:[0-9]+}/compare", chatTypeCompareHandler(db))
+	r.Post("/chattype/{chatTypeId:[0-9]+}/compare", chatTypeCompareHandler(db))
 
 	port := os.Getenv("PORT")
 	if len(port) == 0 {
@@ -199,7 +320,7 @@ func main() {
 	log.Printf("Using port (%s)", portStr)
 
 	// Start the HTTP server
-	startServer(r, port)
+	startServer(r, port, eventHub.Close)
 
 }
 
@@ -264,6 +385,7 @@ func getThemeID(r *http.Request) (uint, error) {
 
 func mapControlsHandler(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case "GET":
 			themeId, err := getThemeID(r)
@@ -286,6 +408,7 @@ func mapControlsHandler(db *gorm.DB) http.HandlerFunc {
 
 func mapManagerHandler(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		themeId, err := getThemeID(r)
 		if err != nil {
 			w.Header().Add("HX-Redirect", "/set-theme")
@@ -301,6 +424,7 @@ func mapManagerHandler(db *gorm.DB) http.HandlerFunc {
 
 func setThemeHandler(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case "GET":
 			{
@@ -352,6 +476,7 @@ func setThemeHandler(db *gorm.DB) http.HandlerFunc {
 
 func themeEditHandler(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case "POST":
 			if err := r.ParseForm(); err != nil {
@@ -363,7 +488,9 @@ func themeEditHandler(db *gorm.DB) http.HandlerFunc {
 			name := r.FormValue("themeName")
 
 			themeToSave := Theme{
-				Name: name,
+				Name:        name,
+				LLMProvider: r.FormValue("llmProvider"),
+				LLMModel:    r.FormValue("llmModel"),
 			}
 
 			if len(id) > 0 {
@@ -452,6 +579,7 @@ func imageHandler(imageDir string) http.HandlerFunc {
 
 func imageOverlayKeyHandler(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case "POST":
 			if err := r.ParseForm(); err != nil {
@@ -508,6 +636,7 @@ func imageOverlayKeyHandler(db *gorm.DB) http.HandlerFunc {
 
 func chatTypeHandler(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case "GET":
 
@@ -523,7 +652,7 @@ func chatTypeHandler(db *gorm.DB) http.HandlerFunc {
 				return
 			}
 
-			chatTypeList := chatTypeList(chatTypes, ChatMeta{
+			chatTypeList := chatTypeList(chatTypes, GetHomes(db), ChatMeta{
 				SelectedChatID: 0,
 				ThemeID:        themeId,
 				HomeID:         0,
@@ -538,9 +667,18 @@ func chatTypeHandler(db *gorm.DB) http.HandlerFunc {
 			}
 
 			chatType := ChatType{
-				Name:    r.FormValue("name"),
-				Prompt:  r.FormValue("prompt"),
-				ThemeID: themeId,
+				Name:        r.FormValue("name"),
+				Prompt:      r.FormValue("prompt"),
+				ThemeID:     themeId,
+				LLMProvider: r.FormValue("llmProvider"),
+				LLMModel:    r.FormValue("llmModel"),
+				OutputMode:  r.FormValue("outputMode"),
+			}
+
+			if chatType.OutputMode != OutputModeText && chatType.OutputMode != OutputModeJSON {
+				warning := warning(fmt.Sprintf("Unknown output mode %q", chatType.OutputMode))
+				warning.Render(GetContext(r), w)
+				return
 			}
 
 			chatTypeIDStr := r.FormValue("chatTypeID")
@@ -612,8 +750,80 @@ func chatTypeHandler(db *gorm.DB) http.HandlerFunc {
 	}
 }
 
+// chatTypePreviewHandler renders the prompt being edited against a home without calling the LLM
+func chatTypePreviewHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		if err := r.ParseForm(); err != nil {
+			warning := warning("chatTypePreviewHandler - Unable to parse form data")
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		homeID, err := strconv.Atoi(r.FormValue("homeId"))
+		if err != nil {
+			warning := warning("Choose a home to preview the prompt with")
+			warning.Render(GetContext(r), w)
+			return
+		}
+		home, err := GetHome(db, uint(homeID))
+		if err != nil {
+			warning := warning(fmt.Sprintf("Home %d not found - %s", homeID, err))
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		themeId, err := getThemeIDOrRedirect(w, r)
+		if err != nil {
+			return
+		}
+
+		// start from the saved chat type so fields the form doesn't edit are kept
+		chatType := ChatType{ThemeID: themeId}
+		if chatTypeIDStr := r.FormValue("chatTypeID"); len(chatTypeIDStr) > 0 {
+			chatTypeID, err := strconv.Atoi(chatTypeIDStr)
+			if err != nil {
+				warning := warning("Invalid chatTypeID")
+				warning.Render(GetContext(r), w)
+				return
+			}
+			saved, err := GetChatType(db, uint(chatTypeID))
+			if err != nil {
+				warning := warning(fmt.Sprintf("Chat type %d not found - %s", chatTypeID, err))
+				warning.Render(GetContext(r), w)
+				return
+			}
+			chatType = *saved
+		}
+		chatType.Name = r.FormValue("name")
+		chatType.Prompt = r.FormValue("prompt")
+		chatType.LLMProvider = r.FormValue("llmProvider")
+		chatType.LLMModel = r.FormValue("llmModel")
+		chatType.OutputMode = r.FormValue("outputMode")
+
+		theme := GetActiveTheme(db, chatType.ThemeID)
+		data, err := GetPromptData(db, *home, chatType, theme)
+		if err != nil {
+			warning := warning(fmt.Sprintf("Failed to load prompt data - %s", err))
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		config, err := buildPromptConfig(data)
+		if err != nil {
+			warning := warning(err.Error())
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		preview := promptPreview(config)
+		preview.Render(GetContext(r), w)
+	}
+}
+
 func chatListHandler(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		log.Print("chatListHandler START \n\n")
 		switch r.Method {
 		case "POST":
@@ -731,6 +941,7 @@ func chatListHandler(db *gorm.DB) http.HandlerFunc {
 
 func imageOverlayHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case "GET":
 			viewMode := r.URL.Query().Get("viewMode")
@@ -881,6 +1092,7 @@ func imageOverlayHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
 				return
 			}
 
+			// the image file is kept so the overlay can be restored from the trash
 			imgOverlay := DeleteImgOverlay(db, int(imageOverlayIdInt))
 			if imgOverlay == nil {
 				warning := warning(fmt.Sprintf("Failed to delete image overlay - %s", imageOverlayId))
@@ -888,15 +1100,7 @@ func imageOverlayHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
 				return
 			}
 
-			imageDelete := DeleteImage(envConfig.ImageDir, imgOverlay.FileName)
-			if imageDelete != nil {
-				warning := warning(fmt.Sprintf("Failed to delete image overlay file - %s", imgOverlay.FileName))
-				warning.Render(GetContext(r), w)
-				return
-			}
-
-			w.Header().Add("HX-Refresh", "true")
-			success := success(fmt.Sprintf("Deleted image overlay - %s", imgOverlay.Name))
+			success := success(fmt.Sprintf("Moved image overlay %s to the trash", imgOverlay.Name))
 			success.Render(GetContext(r), w)
 			return
 
@@ -1060,6 +1264,7 @@ func classifyImageWithHuggingFace(request MapRequest, envConfig EnvConfig) ([]by
 
 func deleteHandler(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case "GET":
 			shapes := GetShapes(db)
@@ -1069,10 +1274,15 @@ func deleteHandler(db *gorm.DB) http.HandlerFunc {
 			deleteForm := deleteAllForm(shapes, homes)
 			deleteForm.Render(GetContext(r), w)
 			return
-		case "DELETE":
+		case "POST":
+			if r.PostFormValue("confirm") != deleteAllConfirmation {
+				warning := warning(fmt.Sprintf("Type \"%s\" to confirm deleting everything", deleteAllConfirmation))
+				warning.Render(GetContext(r), w)
+				return
+			}
 			DeleteAll(db)
 
-			success := success("Deleted all shapes and homes")
+			success := success("Moved all shapes, homes and factors to the trash")
 			success.Render(GetContext(r), w)
 			return
 		}
@@ -1081,6 +1291,7 @@ func deleteHandler(db *gorm.DB) http.HandlerFunc {
 
 func specificShapeHandler(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case "GET":
 			shapeIdStr := chi.URLParam(r, "shapeId")
@@ -1112,7 +1323,7 @@ func specificShapeHandler(db *gorm.DB) http.HandlerFunc {
 
 			shape := DeleteShape(db, uint(shapeId))
 
-			warning := refreshButton("Refresh", fmt.Sprintf("Deleted shape %d (%s)", shape.ID, shape.ShapeTitle))
+			warning := refreshButton("Refresh", fmt.Sprintf("Moved shape %d (%s) to the trash", shape.ID, shape.ShapeTitle))
 			warning.Render(GetContext(r), w)
 
 		}
@@ -1123,6 +1334,7 @@ func shapeHandler(db *gorm.DB) http.HandlerFunc {
 	log.Printf("shapeHandler")
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		log.Printf("shapeHandler")
 
 		switch r.Method {
@@ -1284,6 +1496,7 @@ func shapeHandler(db *gorm.DB) http.HandlerFunc {
 // createFactor handler with db dependency injection
 func createFactor(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		var factor Factor
 		if err := json.NewDecoder(r.Body).Decode(&factor); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -1297,6 +1510,7 @@ func createFactor(db *gorm.DB) http.HandlerFunc {
 
 func singleHomeHandler(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case "GET":
 			log.Printf("GET  singleHomeHandler request received")
@@ -1330,12 +1544,13 @@ func singleHomeHandler(db *gorm.DB) http.HandlerFunc {
 			case "view":
 				log.Printf("===============home - view")
 
-				ratings := GetHomeRatings(db, home.ID)
+				ratings := GetHomeRatings(db, home.ID, getRater(r))
 				for _, rating := range ratings {
 					log.Printf("rating %+v", rating)
 				}
 
-				homeForm := homeView(*home, "", pointMeta, ratings)
+				areas := GetContainingShapes(db, LatLng{Lat: home.Lat, Lng: home.Lng})
+				homeForm := homeView(*home, "", pointMeta, ratings, areas)
 				homeForm.Render(GetContext(r), w)
 
 				chats, err := GetChats(db, 1, home.ID, 0)
@@ -1386,9 +1601,9 @@ func singleHomeHandler(db *gorm.DB) http.HandlerFunc {
 			case "edit":
 				log.Printf("=============home - edit")
 
-				ratings := GetHomeRatings(db, home.ID)
+				ratings := GetHomeRatings(db, home.ID, getRater(r))
 
-				homeForm := homeEditForm(*home, "", pointMeta, ratings)
+				homeForm := homeEditForm(*home, "", pointMeta, ratings, getRater(r), GetRaters(db))
 				homeForm.Render(GetContext(r), w)
 				return
 			default:
@@ -1406,16 +1621,14 @@ func singleHomeHandler(db *gorm.DB) http.HandlerFunc {
 				return
 			}
 
-			var home = Home{ID: uint(id)}
-
-			result := db.Delete(&home)
-			if result.Error != nil {
-				warning := warning(fmt.Sprintf("Failed to delete home - %s", result.Error.Error()))
+			_, err = DeleteHome(db, uint(id))
+			if err != nil {
+				warning := warning(fmt.Sprintf("Failed to delete home - %s", err.Error()))
 				warning.Render(GetContext(r), w)
 				return
 			}
 
-			success := success("Home deleted")
+			success := success("Home moved to the trash")
 			success.Render(GetContext(r), w)
 			return
 		}
@@ -1424,6 +1637,7 @@ func singleHomeHandler(db *gorm.DB) http.HandlerFunc {
 
 func getHomeFactorRating(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case "GET":
 			homeId := r.URL.Query().Get("homeId")
@@ -1435,7 +1649,20 @@ func getHomeFactorRating(db *gorm.DB) http.HandlerFunc {
 				return
 			}
 
-			homeFactorVoteList := GetHomeRatings(db, uint(homeIdInt))
+			// ?rater= switches who is rating
+			if err := r.ParseForm(); err != nil {
+				warning := warning("getHomeFactorRating - Unable to parse form data")
+				warning.Render(GetContext(r), w)
+				return
+			}
+			rater, err := parseRater(w, r)
+			if err != nil {
+				warning := warning(err.Error())
+				warning.Render(GetContext(r), w)
+				return
+			}
+
+			homeFactorVoteList := GetHomeRatings(db, uint(homeIdInt), rater)
 
 			home, err := GetHome(db, uint(homeIdInt))
 			if err != nil {
@@ -1444,7 +1671,7 @@ func getHomeFactorRating(db *gorm.DB) http.HandlerFunc {
 				return
 			}
 
-			homeFactorVoteListComp := factorVoteList(homeFactorVoteList, *home, "")
+			homeFactorVoteListComp := factorVoteList(homeFactorVoteList, *home, rater, GetRaters(db), "")
 			homeFactorVoteListComp.Render(GetContext(r), w)
 			return
 		}
@@ -1453,6 +1680,7 @@ func getHomeFactorRating(db *gorm.DB) http.HandlerFunc {
 
 func homeHandler(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		log.Print("==== Home Handler ==== " + r.Method)
 		switch r.Method {
 		case "GET":
@@ -1462,8 +1690,16 @@ func homeHandler(db *gorm.DB) http.HandlerFunc {
 			log.Printf("homeHandler - viewMode:%s addressType:%s", viewMode, addressType)
 			switch viewMode {
 			case "list":
-				homes := GetHomes(db)
-				pointList := pointListTable(homes, "")
+				// without a theme cookie homes are scored with the default weights
+				themeId, _ := getThemeID(r)
+				sortKey := r.URL.Query().Get("sort")
+				homes, scores, err := GetScoredHomes(db, themeId, sortKey)
+				if err != nil {
+					warning := warning(fmt.Sprintf("Failed to score homes - %v", err))
+					warning.Render(GetContext(r), w)
+					return
+				}
+				pointList := pointListTable(homes, scores, GetHomeAreas(db, homes), sortKey, "")
 				pointList.Render(GetContext(r), w)
 				return
 			case "view":
@@ -1581,15 +1817,13 @@ func homeHandler(db *gorm.DB) http.HandlerFunc {
 				return
 			}
 
-			var home = Home{ID: uint(id)}
-
-			result := db.Delete(&home)
-			if result.Error != nil {
+			_, err = DeleteHome(db, uint(id))
+			if err != nil {
 				http.Error(w, "Failed to delete home", http.StatusInternalServerError)
 				return
 			}
 
-			success := success("Home deleted")
+			success := success("Home moved to the trash")
 			success.Render(GetContext(r), w)
 			return
 
@@ -1699,25 +1933,31 @@ func homeHandler(db *gorm.DB) http.HandlerFunc {
 			switch viewMode {
 			case "view":
 				if len(idStr) == 0 {
-					homes := GetHomes(db)
-					pointList := pointListTable(homes, "")
+					homes, scores, err := GetScoredHomes(db, themeId, HomeSortDefault)
+					if err != nil {
+						warning := warning(fmt.Sprintf("Failed to score homes - %v", err))
+						warning.Render(GetContext(r), w)
+						return
+					}
+					pointList := pointListTable(homes, scores, GetHomeAreas(db, homes), HomeSortDefault, "")
 
 					pointList.Render(GetContext(r), w)
 					return
 				}
 
-				ratings := GetHomeRatings(db, uint(home.ID))
+				ratings := GetHomeRatings(db, uint(home.ID), getRater(r))
 
 				log.Printf("===============home - view")
-				homeForm := homeView(home, msg, pointMeta, ratings)
+				areas := GetContainingShapes(db, LatLng{Lat: home.Lat, Lng: home.Lng})
+				homeForm := homeView(home, msg, pointMeta, ratings, areas)
 				homeForm.Render(GetContext(r), w)
 				return
 			case "edit":
 
 				log.Printf("=============home - edit")
-				ratings := GetHomeRatings(db, home.ID)
+				ratings := GetHomeRatings(db, home.ID, getRater(r))
 
-				homeForm := homeEditForm(home, msg, pointMeta, ratings)
+				homeForm := homeEditForm(home, msg, pointMeta, ratings, getRater(r), GetRaters(db))
 				homeForm.Render(GetContext(r), w)
 				return
 			default:
@@ -1740,8 +1980,9 @@ type FractalSearchRequest struct {
 	dryRun bool
 }
 
-func fractalSearchHandler(db *gorm.DB) http.HandlerFunc {
+func fractalSearchHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case "PUT":
 			idStr := chi.URLParam(r, "fractalSearchId")
@@ -1777,9 +2018,9 @@ func fractalSearchHandler(db *gorm.DB) http.HandlerFunc {
 			}
 
 			theme := GetActiveTheme(db, 0)
-			search, config, err := progressFractalGeoSearch(db, *fractalSearch, messages, theme, fsr)
+			search, config, err := progressFractalGeoSearch(db, envConfig, *fractalSearch, messages, theme, fsr)
 			if err != nil {
-				log.Printf("SEARCH ERROR - %s \n\nMessages: %+v", messages, err)
+				log.Printf("SEARCH ERROR - %s \n\nMessages: %+v", err, messages)
 				warning := warning(fmt.Sprintf("Failed to progress fractal search - %s", err))
 				warning.Render(GetContext(r), w)
 				return
@@ -1937,6 +2178,7 @@ func renderFractalSearchFull(id int, w http.ResponseWriter, r *http.Request, db
 
 func fractalSearchLocatonHandler(db *gorm.DB, client *osmClient) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 
 		switch r.Method {
 		case "PUT":
@@ -2020,6 +2262,7 @@ func fractalSearchLocatonHandler(db *gorm.DB, client *osmClient) http.HandlerFun
 
 func fractalSearchResultsHandler(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case "DELETE":
 			{
@@ -2111,6 +2354,7 @@ func homeUrlHandler(db *gorm.DB) http.HandlerFunc {
 // createHomeFactorRatingForm handler with db dependency injection
 func createHomeFactorRating(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		// Parse form data
 		if err := r.ParseForm(); err != nil {
 			warn := warning("Failed to parse form data")
@@ -2140,22 +2384,29 @@ func createHomeFactorRating(db *gorm.DB) http.HandlerFunc {
 			return
 		}
 
-		// Create the HomeFactorRating instance
+		rater, err := parseRater(w, r)
+		if err != nil {
+			warn := warning(err.Error())
+			warn.Render(GetContext(r), w)
+			return
+		}
+
+		// Create the HomeFactorRating instance, replacing the rater's earlier rating
 		rating := HomeFactorRating{
 			Stars:    stars,
 			FactorID: uint(factorID),
 			HomeID:   uint(homeID),
+			Rater:    rater,
 		}
 
 		// Save to the database
-		result := db.Create(&rating)
-		if result.Error != nil {
-			warn := warning("Failed to create home factor rating")
+		if err := SaveHomeFactorRating(db, rating); err != nil {
+			warn := warning("Failed to save home factor rating")
 			warn.Render(GetContext(r), w)
 			return
 		}
 
-		homeFactorVoteList := GetHomeRatings(db, uint(homeID))
+		homeFactorVoteList := GetHomeRatings(db, uint(homeID), rater)
 
 		home, err := GetHome(db, uint(homeID))
 		if err != nil {
@@ -2164,7 +2415,7 @@ func createHomeFactorRating(db *gorm.DB) http.HandlerFunc {
 			return
 		}
 
-		homeFactorVoteListComp := factorVoteList(homeFactorVoteList, *home, fmt.Sprintf("Home factor rating created - %d * for %d", stars, factorID))
+		homeFactorVoteListComp := factorVoteList(homeFactorVoteList, *home, rater, GetRaters(db), fmt.Sprintf("Home factor rating saved - %d * for %d by %s", stars, factorID, raterName(rater)))
 		homeFactorVoteListComp.Render(GetContext(r), w)
 		return
 		// Render success message
@@ -2210,6 +2461,7 @@ func processMap(startPoint [2]float64, zoom, width, height int) image.Image {
 
 func factorHandler(db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
 		switch r.Method {
 		case "GET":
 			factors := GetFactors(db)
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestFractalSearchHandler(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewLLMFixtureServer("testdata/llm", LLMFixtureReplay, nil)
+	if err != nil {
+		t.Fatalf("failed to start llm fixture server: %v", err)
+	}
+	t.Cleanup(server.Close)
+
+	config := EnvConfig{
+		DBUrl:              ":memory:",
+		PerplexityAPIURL:   server.URL + "/" + ProviderPerplexity,
+		PerplexityAPIToken: "test-token",
+	}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	db.Model(&Theme{}).Where("id = ?", 1).Update("start_geo_system_prompt", "Group places under # headers and list them as - [name] - [location]")
+
+	r := chi.NewRouter()
+	r.Put("/fractal/{fractalSearchId:[0-9]+}", fractalSearchHandler(db, config))
+
+	tests := []struct {
+		name         string
+		dryRun       bool
+		wantPoints   int
+		wantMessages int
+	}{
+		{
+			name:         "Dry run saves nothing",
+			dryRun:       true,
+			wantPoints:   0,
+			wantMessages: 0,
+		},
+		{
+			name:         "Recorded response is parsed into points",
+			dryRun:       false,
+			wantPoints:   3,
+			wantMessages: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fs, err := CreateFractalSearch(db, FractalSearch{ThemeID: 1, Query: "Parks in Christchurch", Status: "pending"})
+			if err != nil {
+				t.Fatalf("CreateFractalSearch() error = %v", err)
+			}
+
+			form := url.Values{}
+			if tt.dryRun {
+				form.Set("dryRun", "on")
+			}
+			req := httptest.NewRequest("PUT", fmt.Sprintf("/fractal/%d", fs.ID), strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+
+			r.ServeHTTP(rec, req)
+
+			if contains(rec.Body.String(), "Failed") {
+				t.Fatalf("fractalSearchHandler() body = %q", rec.Body.String())
+			}
+
+			fsf, err := GetFractalSearchFull(db, fs.ID)
+			if err != nil {
+				t.Fatalf("GetFractalSearchFull() error = %v", err)
+			}
+			if len(fsf.Points) != tt.wantPoints {
+				t.Errorf("got %d points, want %d", len(fsf.Points), tt.wantPoints)
+			}
+			if len(fsf.Messages) != tt.wantMessages {
+				t.Errorf("got %d messages, want %d", len(fsf.Messages), tt.wantMessages)
+			}
+			if len(fsf.Citations) != tt.wantMessages || len(fsf.RelatedQuestions) != tt.wantMessages {
+				t.Errorf("got %d citations %d related questions, want %d of each", len(fsf.Citations), len(fsf.RelatedQuestions), tt.wantMessages)
+			}
+			for _, point := range fsf.Points {
+				if point.FractalSearchID != fs.ID || point.FractalSearchResultGroupID == 0 {
+					t.Errorf("point not linked to search/group: %+v", point)
+				}
+			}
+		})
+	}
+}
@@ -36,8 +36,8 @@ func span() templ.Component {
 
 func mapActor() templ.ComponentScript {
 	return templ.ComponentScript{
-		Name: `__templ_mapActor_a8bd`,
-		Function: `function __templ_mapActor_a8bd(){/**
+		Name: `__templ_mapActor_01de`,
+		Function: `function __templ_mapActor_01de(){/**
  * @typedef {import('https://cdn.jsdelivr.net/npm/@types/leaflet/index.d.ts').Map} L 
  * @typedef {import('https://cdn.jsdelivr.net/npm/@types/leaflet/index.d.ts').Marker} L.Marker
  * @typedef {import('https://cdn.jsdelivr.net/npm/@types/leaflet/index.d.ts').LatLng} L.LatLng
@@ -59,6 +59,8 @@ class mapActor {
       this.map = null;
       this.markers = [];
       this.polygons = [];
+      this.pointMarkers = {};
+      this.overlayNames = {};
       this.mode = initialMode;
       this.pointMode = initalPointMode;
       this.mapContainerId = mapContainerId;
@@ -164,6 +166,8 @@ getMap(){
         const marker = L.marker([lat, lng])
             .bindPopup(popupHTML, {minWidth: 500});
 
+        this.removePoint(id)
+        this.pointMarkers[id] = { marker, markerLayer, fractalSearchId: fSearch.ID };
             
         markerLayer.addLayer(marker);
       });
@@ -171,6 +175,14 @@ getMap(){
       markerLayer.addTo(this.map);
     }
 
+    removePoint(id){
+      const shown = this.pointMarkers[id]
+      if(shown){
+        shown.markerLayer.removeLayer(shown.marker)
+        delete this.pointMarkers[id]
+      }
+    }
+
     /**
      * 
      * @param southWest {L.LatLng}
@@ -861,7 +873,10 @@ handleMapMoveEnd(e){
      */
     addMarker(lat, lng, options = {}) {
 
-     
+      // a home is only ever shown once, adding it again moves it
+      if(options.homeId){
+        this.removeMarker(options.homeId)
+      }
       
       switch(options.pointKind){
         
@@ -993,7 +1008,7 @@ handleMapMoveEnd(e){
     }
   
     /**
-     * Adds a polygon to the map.
+     * Adds a polygon to the map, or a line when areaOptions.shapeType is 'route'.
      * @param {Array<Array<number>>} latlngs - An array of latitude and longitude pairs defining the polygon's vertices.
      * @param {L.PolylineOptions} [options={}] - Optional settings for the polygon.
      */
@@ -1007,6 +1022,10 @@ handleMapMoveEnd(e){
           }
       }
 
+      if(areaOptions.shapeId){
+        this.removePolygon(areaOptions.shapeId)
+      }
+
       const shapeLayerMapping = {
         "warning": overlayMaps.warning,
         "noGo": overlayMaps.noGo,
@@ -1036,7 +1055,8 @@ handleMapMoveEnd(e){
 
       const layerGroup = shapeLayerMapping[areaOptions.shapeKind] || L.layerGroup({})
 
-      const polygon = L.polygon(latlngs, areaOptions).bindPopup(` + "`" + `<div hx-get="/shapes/${areaOptions.shapeId}" hx-trigger="revealed">loading...</div>` + "`" + `, bindOptions).openPopup().addTo(this.map)          .addTo(layerGroup);
+      const draw = areaOptions.shapeType === 'route' ? L.polyline : L.polygon
+      const polygon = draw(latlngs, areaOptions).bindPopup(` + "`" + `<div hx-get="/shapes/${areaOptions.shapeId}" hx-trigger="revealed">loading...</div>` + "`" + `, bindOptions).openPopup().addTo(this.map)          .addTo(layerGroup);
 
       layerGroup.addTo(this.map)
       
@@ -1044,6 +1064,127 @@ handleMapMoveEnd(e){
       this.polygons.push(polygon);
     }
   
+    removeMarker(homeId){
+      this.markers = this.markers.filter((marker) => {
+        if(marker.options.homeId != homeId) return true
+        Object.values(overlayMaps).forEach((group) => group.removeLayer(marker))
+        this.map.removeLayer(marker)
+        return false
+      })
+    }
+
+    removePolygon(shapeId){
+      this.polygons = this.polygons.filter((polygon) => {
+        if(polygon.options.shapeId != shapeId) return true
+        Object.values(overlayMaps).forEach((group) => group.removeLayer(polygon))
+        this.map.removeLayer(polygon)
+        return false
+      })
+    }
+
+    addImageOverlayFromData(imgElem, imageUrl){
+      let imgBounds = imgElem.imgBounds
+      if(imgBounds.length == 0){
+        imgBounds = window.mapActor.map.getBounds()
+      }else{
+        imgBounds = JSON.parse(imgBounds);
+      }
+
+      const bounds = L.latLngBounds(
+          L.latLng(imgBounds._southWest.lat, imgBounds._southWest.lng),
+          L.latLng(imgBounds._northEast.lat, imgBounds._northEast.lng)
+      );
+
+      this.removeImageOverlay(imgElem.ID)
+      this.overlayNames[imgElem.ID] = imgElem.name
+
+      const overlay = L.imageOverlay(imageUrl, bounds, {opacity: imgElem.opacity ? imgElem.opacity : 1})
+      window.mapActor.addImageOverLay(overlay, imgElem.name)
+    }
+
+    removeImageOverlay(id){
+      const name = this.overlayNames[id]
+      const layerGroup = name && window.mapActor.layerGroups[name]
+      if(layerGroup){
+        this.map.removeLayer(layerGroup)
+        delete window.mapActor.layerGroups[name]
+        this.setLayers(window.mapActor.layerGroups)
+      }
+      delete this.overlayNames[id]
+    }
+
+    /**
+     * Listens to /events so homes, shapes, overlays and search points other people change show up without a reload.
+     * Every event is also dispatched on document.body as e.g. "chat-changed" for htmx triggers.
+     */
+    listenForChanges(){
+      if(!window.EventSource){
+        return
+      }
+      const source = new EventSource('/events')
+      const kinds = ['home', 'shape', 'overlay', 'point', 'chat']
+      kinds.forEach((kind) => {
+        source.addEventListener(kind, (e) => {
+          const change = JSON.parse(e.data)
+          try {
+            this.applyChange(change)
+          }catch(err){
+            console.error('Failed to apply change', { change, err })
+          }
+          document.body.dispatchEvent(new CustomEvent(` + "`" + `${kind}-changed` + "`" + `, { detail: change }))
+        })
+      })
+    }
+
+    /**
+     * @param {{kind: string, action: 'create'|'update'|'delete', id: number, data?: object}} change
+     */
+    applyChange(change){
+      const deleted = change.action === 'delete'
+
+      // several rows changed at once, only a reload shows which
+      if(change.id === 0 && ['home', 'shape', 'overlay'].includes(change.kind)){
+        window.location.reload()
+        return
+      }
+
+      switch(change.kind){
+        case 'home':
+          if(deleted){
+            this.removeMarker(change.id)
+          }else{
+            this.addMarker(change.data.Lat, change.data.Lng, { homeId: change.id, pointKind: change.data.PointType || "Home" })
+          }
+          break
+        case 'shape':
+          if(deleted || !['area', 'route'].includes(change.data.shape_type)){
+            this.removePolygon(change.id)
+          }else{
+            this.addPolygon(change.data.shape_data, { shapeKind: change.data.shape_kind, shapeType: change.data.shape_type, shapeId: change.id }, this.editAreaPopupOptions)
+          }
+          break
+        case 'overlay':
+          if(deleted){
+            this.removeImageOverlay(change.id)
+          }else{
+            this.addImageOverlayFromData(change.data, ` + "`" + `/images/${change.data.fileName}` + "`" + `)
+          }
+          break
+        case 'point': {
+          if(deleted){
+            this.removePoint(change.id)
+            break
+          }
+          // only searches already on the map get their new points
+          const shown = Object.values(this.pointMarkers).find((p) => p.fractalSearchId === change.data.FractalSearchID)
+          if(shown && change.data.Lat && change.data.Lng){
+            this.addPoints({ ID: change.data.FractalSearchID }, [{ lat: change.data.Lat, lng: change.data.Lng, id: change.id }])
+          }
+          break
+        }
+      }
+    }
+
     /**
      * Removes all markers from the map.
      */
@@ -1117,11 +1258,12 @@ handleMapMoveEnd(e){
                   const shapeData = JSON.parse(element.getAttribute('data-shape-data'));
                   const shapeId = element.getAttribute('data-shape-id');
                   const shapeKind = element.getAttribute('data-shape-kind');
+                  const shapeType = element.getAttribute('data-shape-type');
 
                   // Get the corresponding layer group for the shape kind
             
                   // Add the polygon to the layer group
-                  window.mapActor.addPolygon(shapeData, { shapeKind: shapeKind, shapeId: shapeId }, window.mapActor.editAreaPopupOptions)
+                  window.mapActor.addPolygon(shapeData, { shapeKind: shapeKind, shapeType: shapeType, shapeId: shapeId }, window.mapActor.editAreaPopupOptions)
                      
 
                   element.setAttribute('rendered', 'true');
@@ -1155,25 +1297,12 @@ handleMapMoveEnd(e){
                       return
                   }
 
-                  let imgBounds = imgElem.imgBounds
-                  if(imgBounds.length == 0){
-                    imgBounds = window.mapActor.map.getBounds()
-                  }else{
-                    imgBounds = JSON.parse(imgBounds);
-                  }
-                
-                const bounds = L.latLngBounds(
-                    L.latLng(imgBounds._southWest.lat, imgBounds._southWest.lng),
-                    L.latLng(imgBounds._northEast.lat, imgBounds._northEast.lng)
-                );
-                  
 
               /* if (!imgData.startsWith('data:image/png;base64,')) {
                   console.error('The base64 string does not start with the correct prefix.');
                   return
               }*/
-                  const overlay = L.imageOverlay(imageUrl, bounds, {opacity: imgElem.opacity ? imgElem.opacity : 1})
-                  window.mapActor.addImageOverLay(overlay, imgElem.name)
+                  window.mapActor.addImageOverlayFromData(imgElem, imageUrl)
 
                   element.setAttribute('rendered', 'true');
 
@@ -1301,6 +1430,7 @@ handleMapMoveEnd(e){
 
   const mapController = new mapActor('map');
   mapController.initMap();
+  mapController.listenForChanges();
 
     function startArea(lat, lng){
         setMode('area')
@@ -1354,7 +1484,7 @@ handleMapMoveEnd(e){
   
       
 }`,
-		Call:       templ.SafeScript(`__templ_mapActor_a8bd`),
-		CallInline: templ.SafeScriptInline(`__templ_mapActor_a8bd`),
+		Call:       templ.SafeScript(`__templ_mapActor_01de`),
+		CallInline: templ.SafeScriptInline(`__templ_mapActor_01de`),
 	}
 }
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration is one numbered change to the schema or data. Up and Down each run in a transaction with the
+// schema_migrations row that records them. A fresh database runs every migration from the baseline, so each is
+// plain SQL against the tables as they were when it was written rather than the models, which keep changing.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error // nil when it can't be rolled back
+}
+
+// MigrationStatus is a migration and when it was applied, AppliedAt is zero while it is pending
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+	Unknown   bool // applied by a newer build that this one doesn't know
+}
+
+// schemaModels are every table, the migrations must leave them as AutoMigrate would create them from the models
+var schemaModels = []interface{}{
+	&Factor{}, &Home{}, &HomeFactorRating{}, &Shape{}, &ShapeType{}, &ShapeKind{}, &ImageOverlay{}, &ChatType{}, &Chat{},
+	&ChatResult{}, &Theme{}, &FractalSearch{}, &Point{}, &Message{}, &FractalSearchResultGroup{}, &Job{}, &Citation{},
+	&RelatedQuestion{}, &LLMUsage{}, &ChatTypeVersion{}, &ScoreWeight{}, &User{}, &Session{}, &Workspace{},
+	&WorkspaceMember{}, &WorkspaceInvite{}, &AuditLog{},
+}
+
+// migrations are applied in order, add new ones to the end with the next version
+var migrations = []Migration{
+	{Version: 1, Name: "baseline", Up: execSQL(baselineTables...)},
+	{Version: 2, Name: "llm_provider", Up: execSQL(
+		"ALTER TABLE `themes` ADD `llm_provider` text",
+		"ALTER TABLE `themes` ADD `llm_model` text",
+		"ALTER TABLE `chat_types` ADD `llm_provider` text",
+		"ALTER TABLE `chat_types` ADD `llm_model` text",
+	), Down: execSQL(
+		"ALTER TABLE `chat_types` DROP COLUMN `llm_model`",
+		"ALTER TABLE `chat_types` DROP COLUMN `llm_provider`",
+		"ALTER TABLE `themes` DROP COLUMN `llm_model`",
+		"ALTER TABLE `themes` DROP COLUMN `llm_provider`",
+	)},
+	{Version: 3, Name: "chat_status", Up: execSQL(
+		"ALTER TABLE `chats` ADD `status` text",
+	), Down: execSQL(
+		"ALTER TABLE `chats` DROP COLUMN `status`",
+	)},
+	{Version: 4, Name: "jobs", Up: execSQL(
+		"CREATE TABLE `jobs` (`id` integer PRIMARY KEY AUTOINCREMENT,`batch_id` text,`kind` text,`status` text,`theme_id` integer,`home_id` integer,`chat_type_id` integer,`chat_id` integer,`attempts` integer,`max_attempts` integer,`last_error` text,`run_at` datetime,`created_at` datetime,`updated_at` datetime)",
+		"CREATE INDEX `idx_jobs_status` ON `jobs`(`status`)",
+		"CREATE INDEX `idx_jobs_batch_id` ON `jobs`(`batch_id`)",
+	), Down: execSQL(
+		"DROP TABLE `jobs`",
+	)},
+	{Version: 5, Name: "citations", Up: execSQL(
+		"CREATE TABLE `citations` (`id` integer PRIMARY KEY AUTOINCREMENT,`chat_id` integer,`chat_result_id` integer,`fractal_search_id` integer,`message_index` integer,`number` integer,`url` text,CONSTRAINT `fk_chats_citations` FOREIGN KEY (`chat_id`) REFERENCES `chats`(`id`))",
+		"CREATE INDEX `idx_citations_fractal_search_id` ON `citations`(`fractal_search_id`)",
+		"CREATE INDEX `idx_citations_chat_id` ON `citations`(`chat_id`)",
+		"CREATE TABLE `related_questions` (`id` integer PRIMARY KEY AUTOINCREMENT,`chat_id` integer,`chat_result_id` integer,`fractal_search_id` integer,`message_index` integer,`question` text,CONSTRAINT `fk_chats_related_questions` FOREIGN KEY (`chat_id`) REFERENCES `chats`(`id`))",
+		"CREATE INDEX `idx_related_questions_fractal_search_id` ON `related_questions`(`fractal_search_id`)",
+		"CREATE INDEX `idx_related_questions_chat_id` ON `related_questions`(`chat_id`)",
+	), Down: execSQL(
+		"DROP TABLE `related_questions`",
+		"DROP TABLE `citations`",
+	)},
+	{Version: 6, Name: "llm_usages", Up: execSQL(
+		"CREATE TABLE `llm_usages` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`theme_id` integer,`home_id` integer,`chat_type_id` integer,`chat_id` integer,`chat_result_id` integer,`fractal_search_id` integer,`message_index` integer,`provider` text,`model` text,`prompt_tokens` integer,`completion_tokens` integer,`total_tokens` integer,`cost` real,CONSTRAINT `fk_chats_usages` FOREIGN KEY (`chat_id`) REFERENCES `chats`(`id`))",
+		"CREATE INDEX `idx_llm_usages_fractal_search_id` ON `llm_usages`(`fractal_search_id`)",
+		"CREATE INDEX `idx_llm_usages_chat_id` ON `llm_usages`(`chat_id`)",
+	), Down: execSQL(
+		"DROP TABLE `llm_usages`",
+	)},
+	{Version: 7, Name: "chat_output_mode", Up: execSQL(
+		"ALTER TABLE `chat_types` ADD `output_mode` text",
+		"ALTER TABLE `chats` ADD `summary` text",
+		"ALTER TABLE `chats` ADD `pros` text",
+		"ALTER TABLE `chats` ADD `cons` text",
+		"ALTER TABLE `chats` ADD `confidence` real",
+	), Down: execSQL(
+		"ALTER TABLE `chats` DROP COLUMN `confidence`",
+		"ALTER TABLE `chats` DROP COLUMN `cons`",
+		"ALTER TABLE `chats` DROP COLUMN `pros`",
+		"ALTER TABLE `chats` DROP COLUMN `summary`",
+		"ALTER TABLE `chat_types` DROP COLUMN `output_mode`",
+	)},
+	{Version: 8, Name: "chat_type_versions", Up: execSQL(
+		"CREATE TABLE `chat_type_versions` (`id` integer PRIMARY KEY AUTOINCREMENT,`chat_type_id` integer,`version` integer,`name` text,`prompt` text,`theme_id` integer,`address_type` text,`start_system_prompt_override` text,`llm_provider` text,`llm_model` text,`output_mode` text,`created_at` datetime)",
+		"CREATE INDEX `idx_chat_type_versions_chat_type_id` ON `chat_type_versions`(`chat_type_id`)",
+		"ALTER TABLE `chat_types` ADD `version_id` integer",
+		"ALTER TABLE `chats` ADD `chat_type_version_id` integer",
+		"ALTER TABLE `chats` ADD `system_prompt` text",
+		"CREATE INDEX `idx_chats_chat_type_version_id` ON `chats`(`chat_type_version_id`)",
+		"ALTER TABLE `jobs` ADD `chat_type_version_id` integer",
+	), Down: execSQL(
+		"ALTER TABLE `jobs` DROP COLUMN `chat_type_version_id`",
+		"DROP INDEX `idx_chats_chat_type_version_id`",
+		"ALTER TABLE `chats` DROP COLUMN `system_prompt`",
+		"ALTER TABLE `chats` DROP COLUMN `chat_type_version_id`",
+		"ALTER TABLE `chat_types` DROP COLUMN `version_id`",
+		"DROP TABLE `chat_type_versions`",
+	)},
+	{Version: 9, Name: "score_weights", Up: execSQL(
+		"CREATE TABLE `score_weights` (`id` integer PRIMARY KEY AUTOINCREMENT,`theme_id` integer,`factor_id` integer,`chat_type_id` integer,`weight` real)",
+		"CREATE UNIQUE INDEX `idx_score_weight` ON `score_weights`(`theme_id`,`factor_id`,`chat_type_id`)",
+	), Down: execSQL(
+		"DROP TABLE `score_weights`",
+	)},
+	{Version: 10, Name: "rating_raters", Up: addRaters},
+	{Version: 11, Name: "users", Up: execSQL(
+		"CREATE TABLE `users` (`id` integer PRIMARY KEY AUTOINCREMENT,`username` text,`password_hash` text,`role` text,`created_at` datetime)",
+		"CREATE UNIQUE INDEX `idx_users_username` ON `users`(`username`)",
+		"CREATE TABLE `sessions` (`id` integer PRIMARY KEY AUTOINCREMENT,`token_hash` text,`user_id` integer,`expires_at` datetime,`created_at` datetime)",
+		"CREATE INDEX `idx_sessions_user_id` ON `sessions`(`user_id`)",
+		"CREATE UNIQUE INDEX `idx_sessions_token_hash` ON `sessions`(`token_hash`)",
+	), Down: execSQL(
+		"DROP TABLE `sessions`",
+		"DROP TABLE `users`",
+	)},
+	{Version: 12, Name: "workspaces", Up: addWorkspaces, Down: dropWorkspaces},
+	{Version: 13, Name: "trash", Up: execSQL(
+		"ALTER TABLE `factors` ADD `deleted_at` datetime",
+		"CREATE INDEX `idx_factors_deleted_at` ON `factors`(`deleted_at`)",
+		"ALTER TABLE `homes` ADD `deleted_at` datetime",
+		"CREATE INDEX `idx_homes_deleted_at` ON `homes`(`deleted_at`)",
+		"ALTER TABLE `shapes` ADD `deleted_at` datetime",
+		"CREATE INDEX `idx_shapes_deleted_at` ON `shapes`(`deleted_at`)",
+		"ALTER TABLE `image_overlays` ADD `deleted_at` datetime",
+		"CREATE INDEX `idx_image_overlays_deleted_at` ON `image_overlays`(`deleted_at`)",
+		"ALTER TABLE `fractal_searches` ADD `deleted_at` datetime",
+		"CREATE INDEX `idx_fractal_searches_deleted_at` ON `fractal_searches`(`deleted_at`)",
+		"CREATE TABLE `audit_logs` (`id` integer PRIMARY KEY AUTOINCREMENT,`workspace_id` integer,`user_id` integer,`username` text,`action` text,`kind` text,`record_id` integer,`before` text,`after` text,`created_at` datetime)",
+		"CREATE INDEX `idx_audit_logs_created_at` ON `audit_logs`(`created_at`)",
+		"CREATE INDEX `idx_audit_record` ON `audit_logs`(`kind`,`record_id`)",
+		"CREATE INDEX `idx_audit_logs_workspace_id` ON `audit_logs`(`workspace_id`)",
+	), Down: execSQL(
+		"DROP TABLE `audit_logs`",
+		"DROP INDEX `idx_fractal_searches_deleted_at`",
+		"ALTER TABLE `fractal_searches` DROP COLUMN `deleted_at`",
+		"DROP INDEX `idx_image_overlays_deleted_at`",
+		"ALTER TABLE `image_overlays` DROP COLUMN `deleted_at`",
+		"DROP INDEX `idx_shapes_deleted_at`",
+		"ALTER TABLE `shapes` DROP COLUMN `deleted_at`",
+		"DROP INDEX `idx_homes_deleted_at`",
+		"ALTER TABLE `homes` DROP COLUMN `deleted_at`",
+		"DROP INDEX `idx_factors_deleted_at`",
+		"ALTER TABLE `factors` DROP COLUMN `deleted_at`",
+	)},
+	// SQLite can't add a constraint to a table, so these are copied into new ones that have them
+	{Version: 14, Name: "foreign_keys", Up: execSQL(
+		"CREATE TABLE `home_factor_ratings__temp` (`id` integer PRIMARY KEY AUTOINCREMENT,`workspace_id` integer,`stars` integer,`factor_id` integer,`home_id` integer,`rater` text NOT NULL DEFAULT \"\",CONSTRAINT `fk_factors_ratings` FOREIGN KEY (`factor_id`) REFERENCES `factors`(`id`) ON DELETE CASCADE,CONSTRAINT `fk_homes_ratings` FOREIGN KEY (`home_id`) REFERENCES `homes`(`id`) ON DELETE CASCADE)",
+		"INSERT INTO `home_factor_ratings__temp` (`id`,`workspace_id`,`stars`,`factor_id`,`home_id`,`rater`) SELECT `id`,`workspace_id`,`stars`,`factor_id`,`home_id`,`rater` FROM `home_factor_ratings`",
+		"DROP TABLE `home_factor_ratings`",
+		"ALTER TABLE `home_factor_ratings__temp` RENAME TO `home_factor_ratings`",
+		"CREATE UNIQUE INDEX `idx_home_factor_rater` ON `home_factor_ratings`(`factor_id`,`home_id`,`rater`)",
+		"CREATE INDEX `idx_home_factor_ratings_workspace_id` ON `home_factor_ratings`(`workspace_id`)",
+		"CREATE TABLE `chats__temp` (`id` integer PRIMARY KEY AUTOINCREMENT,`workspace_id` integer,`theme_id` integer,`home_id` integer,`rating` integer,`chat_type` integer,`chat_type_title` text,`chat_type_version_id` integer,`prompt` text,`system_prompt` text,`status` text,`summary` text,`pros` text,`cons` text,`confidence` real,CONSTRAINT `fk_homes_chats` FOREIGN KEY (`home_id`) REFERENCES `homes`(`id`) ON DELETE CASCADE)",
+		"INSERT INTO `chats__temp` (`id`,`workspace_id`,`theme_id`,`home_id`,`rating`,`chat_type`,`chat_type_title`,`chat_type_version_id`,`prompt`,`system_prompt`,`status`,`summary`,`pros`,`cons`,`confidence`) SELECT `id`,`workspace_id`,`theme_id`,`home_id`,`rating`,`chat_type`,`chat_type_title`,`chat_type_version_id`,`prompt`,`system_prompt`,`status`,`summary`,`pros`,`cons`,`confidence` FROM `chats`",
+		"DROP TABLE `chats`",
+		"ALTER TABLE `chats__temp` RENAME TO `chats`",
+		"CREATE INDEX `idx_chats_chat_type_version_id` ON `chats`(`chat_type_version_id`)",
+		"CREATE INDEX `idx_chats_workspace_id` ON `chats`(`workspace_id`)",
+		"CREATE TABLE `chat_results__temp` (`id` integer PRIMARY KEY AUTOINCREMENT,`workspace_id` integer,`chat_id` integer,`result` text,`role` text,CONSTRAINT `fk_chats_results` FOREIGN KEY (`chat_id`) REFERENCES `chats`(`id`) ON DELETE CASCADE)",
+		"INSERT INTO `chat_results__temp` (`id`,`workspace_id`,`chat_id`,`result`,`role`) SELECT `id`,`workspace_id`,`chat_id`,`result`,`role` FROM `chat_results`",
+		"DROP TABLE `chat_results`",
+		"ALTER TABLE `chat_results__temp` RENAME TO `chat_results`",
+		"CREATE INDEX `idx_chat_results_workspace_id` ON `chat_results`(`workspace_id`)",
+	)},
+	{Version: 15, Name: "home_price", Up: execSQL(
+		"ALTER TABLE `homes` ADD `price` text DEFAULT null",
+	), Down: execSQL(
+		"ALTER TABLE `homes` DROP COLUMN `price`",
+	)},
+}
+
+// baselineTables are the tables as they were before numbered migrations. Databases from then already have them,
+// which is why they are only created when missing.
+var baselineTables = []string{
+	"CREATE TABLE IF NOT EXISTS `factors` (`id` integer PRIMARY KEY AUTOINCREMENT,`title` text,`display_order` integer)",
+	"CREATE TABLE IF NOT EXISTS `homes` (`id` integer PRIMARY KEY AUTOINCREMENT,`lat` real NOT NULL,`lng` real NOT NULL,`point_type` text DEFAULT null,`title` text DEFAULT null,`url` text DEFAULT null,`clean_address` text DEFAULT null,`clean_suburb` text DEFAULT null,`image_url` text DEFAULT null,`notes` text DEFAULT null,`remove_request_at` datetime DEFAULT null,`postcode` text,`state` text,`country` text,`road` text,`house_number` text,`display_name` text)",
+	"CREATE TABLE IF NOT EXISTS `home_factor_ratings` (`id` integer PRIMARY KEY AUTOINCREMENT,`stars` integer,`factor_id` integer,`home_id` integer)",
+	"CREATE TABLE IF NOT EXISTS `shapes` (`id` integer PRIMARY KEY AUTOINCREMENT,`shape_data` text,`shape_title` text,`shape_type` text,`shape_kind` text)",
+	"CREATE TABLE IF NOT EXISTS `shape_types` (`id` integer PRIMARY KEY AUTOINCREMENT,`name` text)",
+	"CREATE TABLE IF NOT EXISTS `shape_kinds` (`id` integer PRIMARY KEY AUTOINCREMENT,`name` text)",
+	"CREATE TABLE IF NOT EXISTS `image_overlays` (`id` integer PRIMARY KEY AUTOINCREMENT,`name` text,`file_name` text,`bounds` text,`file` text,`key_image` text,`opacity` real,`source_url` text)",
+	"CREATE TABLE IF NOT EXISTS `chat_types` (`id` integer PRIMARY KEY AUTOINCREMENT,`name` text,`prompt` text,`theme_id` integer,`address_type` text,`start_system_prompt_override` text)",
+	"CREATE TABLE IF NOT EXISTS `chats` (`id` integer PRIMARY KEY AUTOINCREMENT,`theme_id` integer,`home_id` integer,`rating` integer,`chat_type` integer,`chat_type_title` text,`prompt` text)",
+	"CREATE TABLE IF NOT EXISTS `chat_results` (`id` integer PRIMARY KEY AUTOINCREMENT,`chat_id` integer,`result` text,`role` text,CONSTRAINT `fk_chats_results` FOREIGN KEY (`chat_id`) REFERENCES `chats`(`id`))",
+	"CREATE TABLE IF NOT EXISTS `themes` (`id` integer PRIMARY KEY AUTOINCREMENT,`name` text,`description` text,`start_system_prompt` text,`start_geo_system_prompt` text)",
+	"CREATE TABLE IF NOT EXISTS `fractal_searches` (`id` integer PRIMARY KEY AUTOINCREMENT,`theme_id` integer,`display_name` text,`country` text,`place_id` text,`query` text,`status` text)",
+	"CREATE TABLE IF NOT EXISTS `points` (`id` integer PRIMARY KEY AUTOINCREMENT,`title` text NOT NULL,`description` text DEFAULT null,`lat` real DEFAULT null,`lng` real DEFAULT null,`theme_id` integer DEFAULT null,`fractal_search_id` integer DEFAULT null,`fractal_search_result_group_id` integer DEFAULT null,`point_type` text DEFAULT null,`url` text DEFAULT null,`clean_address` text DEFAULT null,`warning_message` text DEFAULT null)",
+	"CREATE TABLE IF NOT EXISTS `messages` (`fractal_search_id` integer,`role` text,`content` text)",
+	"CREATE TABLE IF NOT EXISTS `fractal_search_result_groups` (`id` integer PRIMARY KEY AUTOINCREMENT,`fractal_search_id` integer,`display_name` text,`point_type_name` text)",
+}
+
+// execSQL runs the statements in order
+func execSQL(statements ...string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addRaters lets each member of the household rate a home, the ratings from before are kept as described in
+// keepDuplicateRatings so the unique index can be added
+func addRaters(tx *gorm.DB) error {
+	if err := tx.Exec("ALTER TABLE `home_factor_ratings` ADD `rater` text NOT NULL DEFAULT \"\"").Error; err != nil {
+		return err
+	}
+	if err := keepDuplicateRatings(tx); err != nil {
+		return fmt.Errorf("failed to keep duplicate ratings: %w", err)
+	}
+	return tx.Exec("CREATE UNIQUE INDEX `idx_home_factor_rater` ON `home_factor_ratings`(`factor_id`,`home_id`,`rater`)").Error
+}
+
+// workspaceTables are the tables that had their rows moved into workspaces, as they were then
+var workspaceTables = []string{
+	"factors", "themes", "homes", "score_weights", "home_factor_ratings", "shapes", "image_overlays", "chat_types",
+	"chat_type_versions", "chats", "chat_results", "citations", "related_questions", "fractal_searches", "points",
+	"messages", "fractal_search_result_groups", "jobs", "llm_usages",
+}
+
+// addWorkspaces adds the workspace tables and puts every existing row in the default workspace, which SeedDB creates
+func addWorkspaces(tx *gorm.DB) error {
+	err := execSQL(
+		"CREATE TABLE `workspaces` (`id` integer PRIMARY KEY AUTOINCREMENT,`name` text,`created_at` datetime)",
+		"CREATE TABLE `workspace_members` (`id` integer PRIMARY KEY AUTOINCREMENT,`workspace_id` integer,`user_id` integer,`created_at` datetime)",
+		"CREATE UNIQUE INDEX `idx_workspace_member` ON `workspace_members`(`workspace_id`,`user_id`)",
+		"CREATE TABLE `workspace_invites` (`id` integer PRIMARY KEY AUTOINCREMENT,`workspace_id` integer,`token_hash` text,`created_by_id` integer,`expires_at` datetime,`created_at` datetime)",
+		"CREATE UNIQUE INDEX `idx_workspace_invites_token_hash` ON `workspace_invites`(`token_hash`)",
+		"CREATE INDEX `idx_workspace_invites_workspace_id` ON `workspace_invites`(`workspace_id`)",
+	)(tx)
+	if err != nil {
+		return err
+	}
+	for _, table := range workspaceTables {
+		err := execSQL(
+			fmt.Sprintf("ALTER TABLE `%s` ADD `workspace_id` integer", table),
+			fmt.Sprintf("UPDATE `%s` SET `workspace_id` = %d", table, defaultWorkspaceID),
+			fmt.Sprintf("CREATE INDEX `idx_%s_workspace_id` ON `%s`(`workspace_id`)", table, table),
+		)(tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropWorkspaces(tx *gorm.DB) error {
+	for _, table := range workspaceTables {
+		err := execSQL(
+			fmt.Sprintf("DROP INDEX `idx_%s_workspace_id`", table),
+			fmt.Sprintf("ALTER TABLE `%s` DROP COLUMN `workspace_id`", table),
+		)(tx)
+		if err != nil {
+			return err
+		}
+	}
+	return execSQL(
+		"DROP TABLE `workspace_invites`",
+		"DROP TABLE `workspace_members`",
+		"DROP TABLE `workspaces`",
+	)(tx)
+}
+
+func appliedMigrations(db *gorm.DB) (map[int]SchemaMigration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	var rows []SchemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	applied := make(map[int]SchemaMigration)
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// GetMigrationStatus is every known migration, and any applied by a newer build, in version order
+func GetMigrationStatus(db *gorm.DB) ([]MigrationStatus, error) {
+	return migrationStatus(db, migrations)
+}
+
+func migrationStatus(db *gorm.DB, list []Migration) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(list))
+	for _, m := range list {
+		statuses = append(statuses, MigrationStatus{Version: m.Version, Name: m.Name, AppliedAt: applied[m.Version].AppliedAt})
+		delete(applied, m.Version)
+	}
+	for _, row := range applied {
+		statuses = append(statuses, MigrationStatus{Version: row.Version, Name: row.Name, AppliedAt: row.AppliedAt, Unknown: true})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// MigrateUp applies the pending migrations up to and including target, 0 applies them all
+func MigrateUp(db *gorm.DB, target int) ([]Migration, error) {
+	return migrateUp(db, migrations, target)
+}
+
+func migrateUp(db *gorm.DB, list []Migration, target int) ([]Migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	latest := 0
+	if len(list) > 0 {
+		latest = list[len(list)-1].Version
+	}
+	for version := range applied {
+		if version > latest {
+			return nil, fmt.Errorf("database is at migration %d but this build only knows up to %d, roll it back with the build that applied it", version, latest)
+		}
+	}
+
+	pending := make([]Migration, 0)
+	for _, m := range list {
+		if _, ok := applied[m.Version]; !ok && (target == 0 || m.Version <= target) {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return pending, nil
+	}
+	if _, err := backupDB(db, fmt.Sprintf("before-%d", pending[0].Version)); err != nil {
+		return nil, err
+	}
+
+	for i, m := range pending {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return pending[:i], fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+	}
+	return pending, nil
+}
+
+// MigrateDown rolls back the latest steps applied migrations, newest first
+func MigrateDown(db *gorm.DB, steps int) ([]Migration, error) {
+	return migrateDown(db, migrations, steps)
+}
+
+func migrateDown(db *gorm.DB, list []Migration, steps int) ([]Migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[int]Migration)
+	for _, m := range list {
+		known[m.Version] = m
+	}
+	versions := make([]int, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+	if steps < len(versions) {
+		versions = versions[:steps]
+	}
+
+	rollback := make([]Migration, 0, len(versions))
+	for _, version := range versions {
+		m, ok := known[version]
+		if !ok {
+			return nil, fmt.Errorf("migration %d was applied by a newer build, roll it back with that build", version)
+		}
+		if m.Down == nil {
+			return nil, fmt.Errorf("migration %d (%s) can't be rolled back", m.Version, m.Name)
+		}
+		rollback = append(rollback, m)
+	}
+	if len(rollback) == 0 {
+		return rollback, nil
+	}
+	if _, err := backupDB(db, fmt.Sprintf("before-rollback-%d", rollback[0].Version)); err != nil {
+		return nil, err
+	}
+
+	for i, m := range rollback {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{Version: m.Version}).Error
+		})
+		if err != nil {
+			return rollback[:i], fmt.Errorf("rolling back migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+	}
+	return rollback, nil
+}
+
+// backupDB copies the database file next to itself before it is migrated, e.g. data.db.before-2-20240905181458.bak.
+// VACUUM INTO makes a consistent copy while the database is open. In-memory databases have no file to copy.
+func backupDB(db *gorm.DB, label string) (string, error) {
+	var databases []struct {
+		Name string
+		File string
+	}
+	if err := db.Raw("PRAGMA database_list").Scan(&databases).Error; err != nil {
+		return "", fmt.Errorf("failed to find the database file: %w", err)
+	}
+	for _, database := range databases {
+		if database.Name != "main" || len(database.File) == 0 {
+			continue
+		}
+		path := fmt.Sprintf("%s.%s-%s.bak", database.File, label, time.Now().Format("20060102150405"))
+		if err := db.Exec("VACUUM INTO ?", path).Error; err != nil {
+			return "", fmt.Errorf("failed to back up the database to %s: %w", path, err)
+		}
+		return path, nil
+	}
+	return "", nil
+}
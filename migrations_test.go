@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBOpen(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	list := []Migration{
+		{
+			Version: 1,
+			Name:    "create notes",
+			Up: func(tx *gorm.DB) error {
+				return tx.Exec("CREATE TABLE notes (id integer PRIMARY KEY, body text)").Error
+			},
+			Down: func(tx *gorm.DB) error { return tx.Exec("DROP TABLE notes").Error },
+		},
+		{
+			Version: 2,
+			Name:    "rename body to text",
+			Up: func(tx *gorm.DB) error {
+				if !tx.Migrator().HasColumn("notes", "body") {
+					return nil
+				}
+				return tx.Migrator().RenameColumn("notes", "body", "text")
+			},
+			Down: func(tx *gorm.DB) error { return tx.Migrator().RenameColumn("notes", "text", "body") },
+		},
+		{
+			Version: 3,
+			Name:    "seed a note",
+			Up:      func(tx *gorm.DB) error { return tx.Exec("INSERT INTO notes (text) VALUES ('hello')").Error },
+			Down:    func(tx *gorm.DB) error { return tx.Exec("DELETE FROM notes").Error },
+		},
+	}
+	broken := append(list[:3:3], Migration{Version: 4, Name: "half done",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Exec("CREATE TABLE half (id integer)").Error; err != nil {
+				return err
+			}
+			return errors.New("failed part way")
+		}})
+	irreversible := append(list[:3:3], Migration{Version: 4, Name: "irreversible",
+		Up: func(tx *gorm.DB) error { return nil }})
+
+	tests := []struct {
+		name    string
+		run     func() ([]Migration, error)
+		want    []int
+		wantErr string
+	}{
+		{name: "Up to a version", run: func() ([]Migration, error) { return migrateUp(db, list, 2) }, want: []int{1, 2}},
+		{name: "Up the rest", run: func() ([]Migration, error) { return migrateUp(db, list, 0) }, want: []int{3}},
+		{name: "Nothing pending", run: func() ([]Migration, error) { return migrateUp(db, list, 0) }},
+		{name: "Failed migration is rolled back", run: func() ([]Migration, error) { return migrateUp(db, broken, 0) }, wantErr: "failed part way"},
+		{name: "Down two", run: func() ([]Migration, error) { return migrateDown(db, list, 2) }, want: []int{3, 2}},
+		{name: "Up again", run: func() ([]Migration, error) { return migrateUp(db, irreversible, 0) }, want: []int{2, 3, 4}},
+		{name: "Irreversible", run: func() ([]Migration, error) { return migrateDown(db, irreversible, 1) }, wantErr: "can't be rolled back"},
+		{name: "Newer database", run: func() ([]Migration, error) { return migrateUp(db, list, 0) }, wantErr: "only knows up to 3"},
+		{name: "Newer migration can't be rolled back", run: func() ([]Migration, error) { return migrateDown(db, list, 1) }, wantErr: "newer build"},
+	}
+	for _, tt := range tests {
+		got, err := tt.run()
+		if len(tt.wantErr) > 0 {
+			if err == nil || !contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		versions := make([]int, 0, len(got))
+		for _, m := range got {
+			versions = append(versions, m.Version)
+		}
+		if len(versions) != len(tt.want) {
+			t.Errorf("%s: migrated %v, want %v", tt.name, versions, tt.want)
+			continue
+		}
+		for i := range versions {
+			if versions[i] != tt.want[i] {
+				t.Errorf("%s: migrated %v, want %v", tt.name, versions, tt.want)
+				break
+			}
+		}
+	}
+
+	if db.Migrator().HasTable("half") {
+		t.Errorf("the failed migration's table was kept")
+	}
+	var text string
+	db.Raw("SELECT text FROM notes").Scan(&text)
+	if text != "hello" {
+		t.Errorf("note = %q, want the renamed column and seeded row", text)
+	}
+	statuses, err := migrationStatus(db, list)
+	if err != nil {
+		t.Fatalf("migrationStatus() error = %v", err)
+	}
+	if len(statuses) != 4 || statuses[3].Version != 4 || !statuses[3].Unknown || statuses[0].AppliedAt.IsZero() {
+		t.Errorf("migrationStatus() = %+v, want 1-3 applied and 4 unknown", statuses)
+	}
+}
+
+func TestMigrationsAndSeeds(t *testing.T) {
+	t.Parallel()
+
+	for i, m := range migrations {
+		if m.Version != i+1 || m.Up == nil {
+			t.Errorf("migration %d is version %d, versions must count up from 1 and have an Up", i, m.Version)
+		}
+	}
+
+	dir := t.TempDir()
+	config := EnvConfig{DBUrl: filepath.Join(dir, "data.db")}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	backups, _ := filepath.Glob(filepath.Join(dir, "data.db.before-1-*.bak"))
+	if len(backups) != 1 {
+		t.Errorf("backups = %v, want one from before the baseline", backups)
+	}
+
+	// shape types someone added stay, and seeding again adds nothing
+	db.Create(&ShapeType{ID: 9, Name: "boundary"})
+	if err := SeedDB(db); err != nil {
+		t.Fatalf("SeedDB() error = %v", err)
+	}
+	var shapeTypes, shapeKinds, themes int64
+	db.Model(&ShapeType{}).Count(&shapeTypes)
+	db.Model(&ShapeKind{}).Count(&shapeKinds)
+	db.Model(&Theme{}).Count(&themes)
+	if shapeTypes != 3 || shapeKinds != 3 || themes != 1 {
+		t.Errorf("after seeding twice %d shape types, %d shape kinds and %d themes, want 3, 3 and 1", shapeTypes, shapeKinds, themes)
+	}
+
+	var out bytes.Buffer
+	if err := runCommand(db, EnvConfig{}, []string{"migrate", "status"}, &out); err != nil {
+		t.Fatalf("migrate status error = %v", err)
+	}
+	if !contains(out.String(), "1 baseline: applied") {
+		t.Errorf("migrate status = %q, want the baseline applied", out.String())
+	}
+	out.Reset()
+	if err := runCommand(db, EnvConfig{}, []string{"migrate"}, &out); err != nil || !contains(out.String(), "no pending migrations") {
+		t.Errorf("migrate = %q, %v, want nothing to do", out.String(), err)
+	}
+	out.Reset()
+	if err := runCommand(db, EnvConfig{}, []string{"migrate", "down"}, &out); err != nil || !contains(out.String(), "rolled back 15 home_price") || db.Migrator().HasColumn(&Home{}, "Price") {
+		t.Errorf("migrate down = %q, %v, want the price column dropped", out.String(), err)
+	}
+	if err := runCommand(db, EnvConfig{}, []string{"migrate", "up"}, &out); err != nil || !db.Migrator().HasColumn(&Home{}, "Price") {
+		t.Errorf("migrate up error = %v, want the price column added back", err)
+	}
+	if err := runCommand(db, EnvConfig{}, []string{"migrate", "down", "2"}, &out); err == nil || !contains(err.Error(), "14 (foreign_keys) can't be rolled back") {
+		t.Errorf("migrate down of the foreign keys error = %v, want it can't be rolled back", err)
+	}
+}
+
+func TestMigrationsMatchModels(t *testing.T) {
+	t.Parallel()
+
+	migrated, err := DBOpen(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	models, err := DBOpen(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		for _, db := range []*gorm.DB{migrated, models} {
+			sqlDB, _ := db.DB()
+			sqlDB.Close()
+		}
+	})
+
+	// a home from before migrations ends up in the default workspace
+	if _, err := migrateUp(migrated, migrations, 1); err != nil {
+		t.Fatalf("migrateUp() to the baseline error = %v", err)
+	}
+	migrated.Exec("INSERT INTO homes (lat, lng, title) VALUES (-36.85, 174.76, 'Old home')")
+	if _, err := migrateUp(migrated, migrations, 0); err != nil {
+		t.Fatalf("migrateUp() error = %v", err)
+	}
+	var workspaceID uint
+	migrated.Raw("SELECT workspace_id FROM homes WHERE title = 'Old home'").Scan(&workspaceID)
+	if workspaceID != defaultWorkspaceID {
+		t.Errorf("home from before workspaces is in workspace %d, want %d", workspaceID, defaultWorkspaceID)
+	}
+
+	if err := models.AutoMigrate(schemaModels...); err != nil {
+		t.Fatalf("AutoMigrate() error = %v", err)
+	}
+	want, got := describeSchema(models), describeSchema(migrated)
+	for table, description := range want {
+		if !reflect.DeepEqual(got[table], description) {
+			t.Errorf("migrated %s = %v, want %v as in the models", table, got[table], description)
+		}
+	}
+	for table := range got {
+		if _, ok := want[table]; !ok {
+			t.Errorf("migrated table %s has no model", table)
+		}
+	}
+}
+
+// describeSchema lists each table's columns, indexes and foreign keys, ignoring the order of the columns
+func describeSchema(db *gorm.DB) map[string][]string {
+	var tables []string
+	db.Raw("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT IN ('sqlite_sequence', 'schema_migrations')").Scan(&tables)
+	schema := make(map[string][]string)
+	for _, table := range tables {
+		var columns, indexes, foreignKeys []string
+		db.Raw(`SELECT name || ' ' || type || ' ' || "notnull" || ' ' || IFNULL(dflt_value, '') || ' ' || pk FROM pragma_table_info(?) ORDER BY name`, table).Scan(&columns)
+		db.Raw("SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL ORDER BY name", table).Scan(&indexes)
+		db.Raw(`SELECT "from" || ' ' || "table" || '.' || "to" || ' ' || on_delete FROM pragma_foreign_key_list(?) ORDER BY "from"`, table).Scan(&foreignKeys)
+		schema[table] = append(append(columns, indexes...), foreignKeys...)
+	}
+	return schema
+}
@@ -9,22 +9,29 @@ import (
 
 // Factor represents something like "Near bus lines", "Has backyard", etc.
 type Factor struct {
-	ID           uint   `gorm:"primaryKey"`
-	Title        string `json:"title"`
-	DisplayOrder int    `json:"display_order"`
+	ID           uint               `gorm:"primaryKey"`
+	WorkspaceID  uint               `json:"workspace_id" gorm:"index"`
+	Title        string             `json:"title"`
+	DisplayOrder int                `json:"display_order"`
+	DeletedAt    gorm.DeletedAt     `json:"deleted_at" gorm:"index"` // set while in the trash
+	Ratings      []HomeFactorRating `json:"-" gorm:"foreignKey:FactorID;constraint:OnDelete:CASCADE"`
 }
 
 type Theme struct {
 	ID                   uint   `gorm:"primaryKey"`
+	WorkspaceID          uint   `json:"workspace_id" gorm:"index"`
 	Name                 string `json:"name"`
 	Description          string `json:"description"`
 	StartSystemPrompt    string `json:"start_system_prompt"`
 	StartGeoSystemPrompt string `json:"start_geo_system_prompt"`
+	LLMProvider          string `json:"llm_provider"`
+	LLMModel             string `json:"llm_model"`
 }
 
 // Home represents a home with specific attributes.
 type Home struct {
 	ID              uint      `gorm:"primaryKey"`
+	WorkspaceID     uint      `json:"workspace_id" gorm:"index"`
 	Lat             float64   `gorm:"not null"`
 	Lng             float64   `gorm:"not null"`
 	PointType       string    `gorm:"default:null"`
@@ -34,6 +41,7 @@ type Home struct {
 	CleanSuburb     string    `gorm:"default:null"`
 	ImageUrl        string    `gorm:"default:null"`
 	Notes           string    `gorm:"default:null" form:"notes"`
+	Price           string    `gorm:"default:null"` // as the listing gives it, e.g. "$650,000" or "By negotiation"
 	RemoveRequestAt time.Time `gorm:"default:null"`
 	Postcode        string
 	State           string
@@ -41,23 +49,41 @@ type Home struct {
 	Road            string
 	HouseNumber     string
 	DisplayName     string
+	DeletedAt       gorm.DeletedAt     `gorm:"index"`                                                  // set while in the trash
+	Ratings         []HomeFactorRating `json:"-" gorm:"foreignKey:HomeID;constraint:OnDelete:CASCADE"` // purged with the home, see cascade.go
+	Chats           []Chat             `json:"-" gorm:"foreignKey:HomeID;constraint:OnDelete:CASCADE"`
 }
 
-// HomeFactorRating represents a rating for a specific factor of a home.
+// ScoreWeight is how much a factor, or a chat type's AI rating, counts towards a home's score in a theme.
+// Exactly one of FactorID and ChatTypeID is set.
+type ScoreWeight struct {
+	ID          uint    `gorm:"primaryKey"`
+	WorkspaceID uint    `json:"workspace_id" gorm:"index"`
+	ThemeID     uint    `json:"theme_id" gorm:"uniqueIndex:idx_score_weight"`
+	FactorID    uint    `json:"factor_id" gorm:"uniqueIndex:idx_score_weight"`
+	ChatTypeID  uint    `json:"chat_type_id" gorm:"uniqueIndex:idx_score_weight"`
+	Weight      float64 `json:"weight"`
+}
+
+// HomeFactorRating represents a rater's rating for a specific factor of a home.
 type HomeFactorRating struct {
-	ID       uint `gorm:"primaryKey"`
-	Stars    int  `json:"stars" validate:"min=1,max=5"`
-	FactorID uint `json:"factor_id"`
-	HomeID   uint `json:"home_id"`
+	ID          uint   `gorm:"primaryKey"`
+	WorkspaceID uint   `json:"workspace_id" gorm:"index"`
+	Stars       int    `json:"stars" validate:"min=1,max=5"`
+	FactorID    uint   `json:"factor_id" gorm:"uniqueIndex:idx_home_factor_rater"`
+	HomeID      uint   `json:"home_id" gorm:"uniqueIndex:idx_home_factor_rater"`
+	Rater       string `json:"rater" gorm:"uniqueIndex:idx_home_factor_rater;not null;default:''"`
 }
 
 // Shape represents a custom area that can be added to the map.
 type Shape struct {
-	ID         uint   `gorm:"primaryKey"`
-	ShapeData  string `json:"shape_data"`
-	ShapeTitle string `json:"shape_title"`
-	ShapeType  string `json:"shape_type"`
-	ShapeKind  string `json:"shape_kind"`
+	ID          uint           `gorm:"primaryKey"`
+	WorkspaceID uint           `json:"workspace_id" gorm:"index"`
+	ShapeData   string         `json:"shape_data"`
+	ShapeTitle  string         `json:"shape_title"`
+	ShapeType   string         `json:"shape_type"`
+	ShapeKind   string         `json:"shape_kind"`
+	DeletedAt   gorm.DeletedAt `json:"deleted_at" gorm:"index"` // set while in the trash
 }
 
 type ShapeType struct {
@@ -118,23 +144,29 @@ type FractalAISearchInitInfo struct {
 }
 
 type FractalSearch struct {
-	ID          uint   `gorm:"primaryKey"`
-	ThemeID     uint   `json:"theme_id"`
-	DisplayName string `json:"display_name"`
-	Country     string `json:"country"`
-	PlaceId     string `json:"place_id"`
-	Query       string `json:"query"`
-	Status      string `json:"status"`
+	ID          uint           `gorm:"primaryKey"`
+	WorkspaceID uint           `json:"workspace_id" gorm:"index"`
+	ThemeID     uint           `json:"theme_id"`
+	DisplayName string         `json:"display_name"`
+	Country     string         `json:"country"`
+	PlaceId     string         `json:"place_id"`
+	Query       string         `json:"query"`
+	Status      string         `json:"status"`
+	DeletedAt   gorm.DeletedAt `json:"deleted_at" gorm:"index"` // set while in the trash
 }
 
 type FractalSearchFull struct {
 	FractalSearch
-	Points   []Point
-	Messages []Message
+	Points           []Point
+	Messages         []Message
+	Citations        []Citation
+	RelatedQuestions []RelatedQuestion
+	Usages           []LLMUsage
 }
 
 type Point struct {
 	ID                         uint    `gorm:"primaryKey"`
+	WorkspaceID                uint    `json:"workspace_id" gorm:"index"`
 	Title                      string  `gorm:"not null"`
 	Description                string  `gorm:"default:null"`
 	Lat                        float64 `gorm:"default:null"`
@@ -150,12 +182,14 @@ type Point struct {
 
 type FractalSearchResultGroup struct {
 	ID              uint   `gorm:"primaryKey"`
+	WorkspaceID     uint   `json:"workspace_id" gorm:"index"`
 	FractalSearchID uint   `json:"fractal_search_id"`
 	DisplayName     string `json:"display_name"`
 	PointTypeName   string `json:"point_type_name"`
 }
 
 type Message struct {
+	WorkspaceID     uint   `json:"workspace_id" gorm:"index"`
 	FractalSearchID uint   `json:"fractal_search_id"`
 	Role            string `json:"role"`
 	Content         string `json:"content"`
@@ -180,41 +214,101 @@ type PointIcons struct {
 }
 
 type ImageOverlay struct {
-	ID        uint    `gorm:"primaryKey"`
-	Name      string  `json:"name"`
-	FileName  string  `json:"fileName"`
-	Bounds    string  `json:"imgBounds"`
-	File      string  `json:"fileInput"`
-	KeyImage  string  `json:"keyImage"`
-	Opacity   float64 `json:"opacity"`
-	SourceUrl string  `json:"sourceUrl"`
+	ID          uint           `gorm:"primaryKey"`
+	WorkspaceID uint           `json:"workspace_id" gorm:"index"`
+	Name        string         `json:"name"`
+	FileName    string         `json:"fileName"`
+	Bounds      string         `json:"imgBounds"`
+	File        string         `json:"fileInput"`
+	KeyImage    string         `json:"keyImage"`
+	Opacity     float64        `json:"opacity"`
+	SourceUrl   string         `json:"sourceUrl"`
+	DeletedAt   gorm.DeletedAt `json:"deletedAt" gorm:"index"` // set while in the trash, the image file is kept for a restore
 }
 
 type ChatType struct {
 	ID                        uint   `gorm:"primaryKey"`
+	WorkspaceID               uint   `json:"workspace_id" gorm:"index"`
 	Name                      string `json:"name"`
 	Prompt                    string `json:"prompt"`
 	ThemeID                   uint   `json:"theme_id"`
 	AddressType               string `json:"address_type"`
 	StartSystemPromptOverride string `json:"start_system_prompt_override"`
+	LLMProvider               string `json:"llm_provider"`
+	LLMModel                  string `json:"llm_model"`
+	OutputMode                string `json:"output_mode"`
+	VersionID                 uint   `json:"version_id"` // the ChatTypeVersion matching the fields above
+}
+
+// ChatTypeVersion is an immutable snapshot of a ChatType's prompt fields, a new one is saved whenever they change
+type ChatTypeVersion struct {
+	ID                        uint      `gorm:"primaryKey"`
+	WorkspaceID               uint      `json:"workspace_id" gorm:"index"`
+	ChatTypeID                uint      `json:"chat_type_id" gorm:"index"`
+	Version                   int       `json:"version"`
+	Name                      string    `json:"name"`
+	Prompt                    string    `json:"prompt"`
+	ThemeID                   uint      `json:"theme_id"`
+	AddressType               string    `json:"address_type"`
+	StartSystemPromptOverride string    `json:"start_system_prompt_override"`
+	LLMProvider               string    `json:"llm_provider"`
+	LLMModel                  string    `json:"llm_model"`
+	OutputMode                string    `json:"output_mode"`
+	CreatedAt                 time.Time `json:"created_at"`
 }
 
 type Chat struct {
-	ID            uint         `gorm:"primaryKey"`
-	ThemeID       uint         `json:"theme_id"`
-	HomeID        uint         `json:"home_id"`
-	Rating        int          `json:"rating"`
-	ChatType      uint         `json:"chat_type"`
-	ChatTypeTitle string       `json:"chat_type_title"`
-	Prompt        string       `json:"prompt"`
-	Results       []ChatResult `gorm:"foreignKey:ChatID"`
+	ID                uint              `gorm:"primaryKey"`
+	WorkspaceID       uint              `json:"workspace_id" gorm:"index"`
+	ThemeID           uint              `json:"theme_id"`
+	HomeID            uint              `json:"home_id"`
+	Rating            int               `json:"rating"`
+	ChatType          uint              `json:"chat_type"`
+	ChatTypeTitle     string            `json:"chat_type_title"`
+	ChatTypeVersionID uint              `json:"chat_type_version_id" gorm:"index"`
+	Prompt            string            `json:"prompt"`
+	SystemPrompt      string            `json:"system_prompt"`
+	Status            string            `json:"status"`
+	Summary           string            `json:"summary"`
+	Pros              []string          `json:"pros" gorm:"serializer:json"`
+	Cons              []string          `json:"cons" gorm:"serializer:json"`
+	Confidence        float64           `json:"confidence"`
+	Results           []ChatResult      `gorm:"foreignKey:ChatID;constraint:OnDelete:CASCADE"`
+	Citations         []Citation        `gorm:"foreignKey:ChatID"`
+	RelatedQuestions  []RelatedQuestion `gorm:"foreignKey:ChatID"`
+	Usages            []LLMUsage        `gorm:"foreignKey:ChatID"`
 }
 
 type ChatResult struct {
-	ID     uint   `gorm:"primaryKey"`
-	ChatID uint   `json:"chat_id"` // Foreign key to the Chat
-	Result string `json:"result"`  // Actual result string
-	Role   string `json:"role"`
+	ID          uint   `gorm:"primaryKey"`
+	WorkspaceID uint   `json:"workspace_id" gorm:"index"`
+	ChatID      uint   `json:"chat_id"` // Foreign key to the Chat
+	Result      string `json:"result"`  // Actual result string
+	Role        string `json:"role"`
+}
+
+// Citation is a source returned with an answer, Number matches the [n] markers in the answer text.
+// It belongs to a ChatResult, or to the MessageIndex'th message of a FractalSearch.
+type Citation struct {
+	ID              uint   `gorm:"primaryKey"`
+	WorkspaceID     uint   `json:"workspace_id" gorm:"index"`
+	ChatID          uint   `json:"chat_id" gorm:"index"`
+	ChatResultID    uint   `json:"chat_result_id"`
+	FractalSearchID uint   `json:"fractal_search_id" gorm:"index"`
+	MessageIndex    int    `json:"message_index"`
+	Number          int    `json:"number"`
+	URL             string `json:"url"`
+}
+
+// RelatedQuestion is a follow up the research api suggested, linked the same way as Citation
+type RelatedQuestion struct {
+	ID              uint   `gorm:"primaryKey"`
+	WorkspaceID     uint   `json:"workspace_id" gorm:"index"`
+	ChatID          uint   `json:"chat_id" gorm:"index"`
+	ChatResultID    uint   `json:"chat_result_id"`
+	FractalSearchID uint   `json:"fractal_search_id" gorm:"index"`
+	MessageIndex    int    `json:"message_index"`
+	Question        string `json:"question"`
 }
 
 type ChatMeta struct {
@@ -258,3 +352,109 @@ func GetPointMeta(db *gorm.DB, themeIDOverride uint) PointMeta {
 		theme: activeTheme,
 	}
 }
+
+// Job is one queued unit of background work, currently a chat type researched for a home.
+// Jobs started together share a BatchID so their progress can be shown as one.
+type Job struct {
+	ID                uint      `gorm:"primaryKey"`
+	WorkspaceID       uint      `json:"workspace_id" gorm:"index"`
+	BatchID           string    `json:"batch_id" gorm:"index"`
+	Kind              string    `json:"kind"`
+	Status            string    `json:"status" gorm:"index"`
+	ThemeID           uint      `json:"theme_id"`
+	HomeID            uint      `json:"home_id"`
+	ChatTypeID        uint      `json:"chat_type_id"`
+	ChatTypeVersionID uint      `json:"chat_type_version_id"` // 0 runs the chat type as it is now
+	ChatID            uint      `json:"chat_id"`
+	Attempts          int       `json:"attempts"`
+	MaxAttempts       int       `json:"max_attempts"`
+	LastError         string    `json:"last_error"`
+	RunAt             time.Time `json:"run_at"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// LLMUsage is the tokens and cost of one LLM call. Chat calls set ChatID and ChatResultID,
+// fractal search calls set FractalSearchID and the MessageIndex of the message they produced.
+type LLMUsage struct {
+	ID               uint      `gorm:"primaryKey"`
+	WorkspaceID      uint      `json:"workspace_id" gorm:"index"`
+	CreatedAt        time.Time `json:"created_at"`
+	ThemeID          uint      `json:"theme_id"`
+	HomeID           uint      `json:"home_id"`
+	ChatTypeID       uint      `json:"chat_type_id"`
+	ChatID           uint      `json:"chat_id" gorm:"index"`
+	ChatResultID     uint      `json:"chat_result_id"`
+	FractalSearchID  uint      `json:"fractal_search_id" gorm:"index"`
+	MessageIndex     int       `json:"message_index"`
+	Provider         string    `json:"provider"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	Cost             float64   `json:"cost"`
+}
+
+// User can log in to change things, Role is RoleMember or RoleAdmin
+type User struct {
+	ID           uint      `gorm:"primaryKey"`
+	Username     string    `json:"username" gorm:"uniqueIndex"`
+	PasswordHash string    `json:"-"`
+	Role         string    `json:"role"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Session is a logged in browser, TokenHash is the sha256 of the session cookie so a leaked database can't log in
+type Session struct {
+	ID        uint      `gorm:"primaryKey"`
+	TokenHash string    `gorm:"uniqueIndex"`
+	UserID    uint      `gorm:"index"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Workspace is one household's map, homes and research, members only see their own workspaces
+type Workspace struct {
+	ID        uint      `gorm:"primaryKey"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WorkspaceMember struct {
+	ID          uint      `gorm:"primaryKey"`
+	WorkspaceID uint      `json:"workspace_id" gorm:"uniqueIndex:idx_workspace_member"`
+	UserID      uint      `json:"user_id" gorm:"uniqueIndex:idx_workspace_member"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// WorkspaceInvite is an invite link, TokenHash is the sha256 of the token in the link
+type WorkspaceInvite struct {
+	ID          uint      `gorm:"primaryKey"`
+	WorkspaceID uint      `json:"workspace_id" gorm:"index"`
+	TokenHash   string    `gorm:"uniqueIndex"`
+	CreatedByID uint      `json:"created_by_id"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// AuditLog is a change to a home, shape, image overlay, search or factor. Before and After are the row as JSON,
+// Before is empty for creates and After for deletes.
+type AuditLog struct {
+	ID          uint      `gorm:"primaryKey"`
+	WorkspaceID uint      `json:"workspace_id" gorm:"index"`
+	UserID      uint      `json:"user_id"`  // 0 for changes made by the job queue or at startup
+	Username    string    `json:"username"` // as it was when the change was made
+	Action      string    `json:"action"`
+	Kind        string    `json:"kind" gorm:"index:idx_audit_record"`
+	RecordID    uint      `json:"record_id" gorm:"index:idx_audit_record"`
+	Before      string    `json:"before"`
+	After       string    `json:"after"`
+	CreatedAt   time.Time `json:"created_at" gorm:"index"`
+}
+
+// SchemaMigration is a Migration that has been applied to this database
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `json:"name"`
+	AppliedAt time.Time `json:"applied_at"`
+}
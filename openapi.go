@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// openAPIDocument is the OpenAPI 3 description of /api/v1 served at /api/v1/openapi.json.
+// Schemas are generated from the Go types so they can't drift from what the API sends.
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       map[string]string                       `json:"info"`
+	Servers    []map[string]string                     `json:"servers"`
+	Security   []map[string][]string                   `json:"security"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema    `json:"schemas"`
+	SecuritySchemes map[string]map[string]string `json:"securitySchemes"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	ReadOnly             bool                      `json:"readOnly,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+}
+
+type openAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	OperationID string                     `json:"operationId"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Security    []map[string][]string      `json:"security,omitempty"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Headers     map[string]openAPIParameter `json:"headers,omitempty"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	deletedAtType = reflect.TypeOf(gorm.DeletedAt{})
+)
+
+func queryParameter(name string, schemaType string, description string) openAPIParameter {
+	return openAPIParameter{Name: name, In: "query", Description: description, Schema: &openAPISchema{Type: schemaType}}
+}
+
+// schemaRef adds the type of v to the document's schemas and refers to it
+func (doc *openAPIDocument) schemaRef(v interface{}) *openAPISchema {
+	return doc.schemaFor(reflect.TypeOf(v))
+}
+
+func (doc *openAPIDocument) schemaFor(t reflect.Type) *openAPISchema {
+	switch t {
+	case timeType:
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	case deletedAtType:
+		return &openAPISchema{Type: "string", Format: "date-time", Nullable: true, ReadOnly: true, Description: "set while in the trash"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := doc.schemaFor(t.Elem())
+		schema.Nullable = true
+		return schema
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &openAPISchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &openAPISchema{Type: "number"}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &openAPISchema{Type: "array", Items: doc.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: doc.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if _, ok := doc.Components.Schemas[t.Name()]; !ok {
+			// added before its fields so types that refer to themselves stop
+			schema := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+			doc.Components.Schemas[t.Name()] = schema
+			doc.addProperties(schema, t)
+		}
+		return &openAPISchema{Ref: "#/components/schemas/" + t.Name()}
+	default:
+		return &openAPISchema{}
+	}
+}
+
+// addProperties adds t's fields as encoding/json names them, embedded structs' fields are flattened into it
+func (doc *openAPIDocument) addProperties(schema *openAPISchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			doc.addProperties(schema, field.Type)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+
+		property := doc.schemaFor(field.Type)
+		for _, protected := range apiProtectedFields {
+			if field.Name == protected && len(property.Ref) == 0 {
+				property.ReadOnly = true
+			}
+		}
+		schema.Properties[name] = property
+	}
+}
+
+func jsonContent(schema *openAPISchema) map[string]openAPIMediaType {
+	return map[string]openAPIMediaType{"application/json": {Schema: schema}}
+}
+
+func (doc *openAPIDocument) jsonResponse(description string, v interface{}) openAPIResponse {
+	return openAPIResponse{Description: description, Content: jsonContent(doc.schemaRef(v))}
+}
+
+func (doc *openAPIDocument) jsonBody(v interface{}) *openAPIRequestBody {
+	return &openAPIRequestBody{Required: true, Content: jsonContent(doc.schemaRef(v))}
+}
+
+// addOperation adds an operation with the error responses every operation can have
+func (doc *openAPIDocument) addOperation(path string, method string, op *openAPIOperation) {
+	if _, ok := doc.Paths[path]; !ok {
+		doc.Paths[path] = make(map[string]*openAPIOperation)
+	}
+	errorResponse := doc.jsonResponse("Error", APIError{})
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound} {
+		if _, ok := op.Responses[fmt.Sprint(status)]; !ok {
+			op.Responses[fmt.Sprint(status)] = errorResponse
+		}
+	}
+	op.Parameters = append(op.Parameters, openAPIParameter{
+		Name:        "X-Workspace-ID",
+		In:          "header",
+		Description: "the workspace to use, the user's first workspace when not set",
+		Schema:      &openAPISchema{Type: "integer"},
+	})
+	doc.Paths[path][strings.ToLower(method)] = op
+}
+
+func operationID(verb string, name string) string {
+	words := strings.Fields(name)
+	for i := range words {
+		words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+	}
+	return verb + strings.Join(words, "")
+}
+
+// describe adds the resource's paths to the document
+func (res apiResource[T]) describe(doc *openAPIDocument) {
+	var model T
+	tag := []string{strings.TrimPrefix(res.path, "/")}
+	idParam := openAPIParameter{Name: "id", In: "path", Required: true, Schema: &openAPISchema{Type: "integer"}}
+	item := res.path + "/{id}"
+
+	if res.list != nil {
+		doc.addOperation(res.path, http.MethodGet, &openAPIOperation{
+			Summary:     fmt.Sprintf("List %ss", res.name),
+			OperationID: operationID("list", res.name+"s"),
+			Tags:        tag,
+			Parameters:  append([]openAPIParameter{}, res.listParams...),
+			Responses:   map[string]openAPIResponse{"200": doc.jsonResponse("OK", []T{})},
+		})
+	}
+	if res.create != nil {
+		created := doc.jsonResponse("Created", model)
+		created.Headers = map[string]openAPIParameter{"Location": {Name: "Location", In: "header", Schema: &openAPISchema{Type: "string"}}}
+		doc.addOperation(res.path, http.MethodPost, &openAPIOperation{
+			Summary:     fmt.Sprintf("Create a %s", res.name),
+			OperationID: operationID("create", res.name),
+			Tags:        tag,
+			RequestBody: doc.jsonBody(model),
+			Responses:   map[string]openAPIResponse{"201": created},
+		})
+	}
+
+	var detail interface{} = model
+	if res.detailOf != nil {
+		detail = res.detailOf
+	}
+	doc.addOperation(item, http.MethodGet, &openAPIOperation{
+		Summary:     fmt.Sprintf("Get a %s", res.name),
+		OperationID: operationID("get", res.name),
+		Tags:        tag,
+		Parameters:  []openAPIParameter{idParam},
+		Responses:   map[string]openAPIResponse{"200": doc.jsonResponse("OK", detail)},
+	})
+	if res.update != nil {
+		for _, method := range []string{http.MethodPut, http.MethodPatch} {
+			doc.addOperation(item, method, &openAPIOperation{
+				Summary:     fmt.Sprintf("Update a %s, fields left out keep their value", res.name),
+				OperationID: operationID(strings.ToLower(method), res.name),
+				Tags:        tag,
+				Parameters:  []openAPIParameter{idParam},
+				RequestBody: doc.jsonBody(model),
+				Responses:   map[string]openAPIResponse{"200": doc.jsonResponse("OK", model)},
+			})
+		}
+	}
+	if res.remove != nil {
+		doc.addOperation(item, http.MethodDelete, &openAPIOperation{
+			Summary:     fmt.Sprintf("Delete a %s", res.name),
+			OperationID: operationID("delete", res.name),
+			Tags:        tag,
+			Parameters:  []openAPIParameter{idParam},
+			Responses:   map[string]openAPIResponse{"204": {Description: "Deleted"}},
+		})
+	}
+}
+
+// buildOpenAPI describes the resources and the endpoints that aren't CRUD
+func buildOpenAPI(resources []apiMountable) *openAPIDocument {
+	doc := &openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: map[string]string{
+			"title":       "Honing-Inn API",
+			"version":     "1",
+			"description": "JSON versions of the map's homes, factors, ratings, shapes, overlays, themes, chat types, chats and fractal searches. Log in with POST /login and send the token as a bearer token.",
+		},
+		Servers:  []map[string]string{{"url": apiPrefix}},
+		Security: []map[string][]string{{"bearerAuth": {}}, {"cookieAuth": {}}},
+		Paths:    make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{
+			Schemas: make(map[string]*openAPISchema),
+			SecuritySchemes: map[string]map[string]string{
+				"bearerAuth": {"type": "http", "scheme": "bearer"},
+				"cookieAuth": {"type": "apiKey", "in": "cookie", "name": sessionCookie},
+			},
+		},
+	}
+
+	for _, res := range resources {
+		res.describe(doc)
+	}
+
+	doc.addOperation("/chats", http.MethodPost, &openAPIOperation{
+		Summary:     "Queue research of a home, the chats are saved as the jobs finish",
+		OperationID: "queueChats",
+		Tags:        []string{"chats"},
+		RequestBody: doc.jsonBody(APIChatRequest{}),
+		Responses:   map[string]openAPIResponse{"202": doc.jsonResponse("Queued", APIChatBatch{})},
+	})
+	noAuth := []map[string][]string{{}}
+	doc.addOperation("/login", http.MethodPost, &openAPIOperation{
+		Summary:     "Log in for a bearer token",
+		OperationID: "login",
+		Tags:        []string{"auth"},
+		Security:    noAuth,
+		RequestBody: doc.jsonBody(APILoginRequest{}),
+		Responses:   map[string]openAPIResponse{"200": doc.jsonResponse("Logged in", APILoginResponse{})},
+	})
+	doc.addOperation("/logout", http.MethodPost, &openAPIOperation{
+		Summary:     "End the session of the bearer token",
+		OperationID: "logout",
+		Tags:        []string{"auth"},
+		Responses:   map[string]openAPIResponse{"204": {Description: "Logged out"}},
+	})
+	doc.addOperation("/openapi.json", http.MethodGet, &openAPIOperation{
+		Summary:     "This document",
+		OperationID: "openAPI",
+		Tags:        []string{"meta"},
+		Security:    noAuth,
+		Responses:   map[string]openAPIResponse{"200": {Description: "OK"}},
+	})
+	return doc
+}
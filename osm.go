@@ -1,18 +1,61 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/serjvanilla/go-overpass"
 )
 
+const (
+	nominatimEndpoint = "https://nominatim.openstreetmap.org/search"
+	// Nominatim's usage policy allows one request a second from the whole app
+	nominatimInterval = time.Second
+)
+
 // osmClient is a wrapper around the Overpass API client
 type osmClient struct {
-	client overpass.Client
+	client   overpass.Client
+	endpoint string
+	limiter  *rateLimiter
+}
+
+// rateLimiter spaces calls at least interval apart, callers wait their turn in the order they arrived
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	return &rateLimiter{interval: interval}
+}
+
+// Wait blocks until it's the caller's turn, or returns ctx's error if it's done first
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	turn := l.next
+	if turn.Before(now) {
+		turn = now
+	}
+	l.next = turn.Add(l.interval)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(turn.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 type GeocodeResult struct {
@@ -35,7 +78,9 @@ type GeocodeResult struct {
 // NewOSMClient creates a new instance of osmClient
 func NewOSMClient() *osmClient {
 	return &osmClient{
-		client: overpass.New(),
+		client:   overpass.New(),
+		endpoint: nominatimEndpoint,
+		limiter:  newRateLimiter(nominatimInterval),
 	}
 }
 
@@ -52,15 +97,27 @@ func (o *osmClient) FetchDrinkingWaterData() (*overpass.Result, error) {
 
 // GeocodeAddress performs an address lookup using the Nominatim API and returns latitude and longitude
 func (o *osmClient) GeocodeAddress(address string) ([]GeocodeResult, error) {
+	return o.GeocodeAddressContext(context.Background(), address)
+}
+
+// GeocodeAddressContext is GeocodeAddress that gives up waiting for its turn, or for Nominatim, once ctx is done
+func (o *osmClient) GeocodeAddressContext(ctx context.Context, address string) ([]GeocodeResult, error) {
+	if err := o.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
 	// Construct the Nominatim query URL
-	endpoint := "https://nominatim.openstreetmap.org/search"
 	query := url.Values{}
 	query.Set("q", address)
 	query.Set("format", "json")
 	query.Set("limit", "10")
 
 	// Make the request to Nominatim
-	resp, err := http.Get(fmt.Sprintf("%s?%s", endpoint, query.Encode()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s?%s", o.endpoint, query.Encode()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error querying Nominatim: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error querying Nominatim: %w", err)
 	}
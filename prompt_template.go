@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// shapes within this distance of a home are listed in .Shapes
+	nearbyShapeMeters = 2000
+	// free text answers are cut down to this many characters in .PreviousChats
+	previousChatSummaryLength = 500
+)
+
+// PromptData is what ChatType.Prompt and Theme.StartSystemPrompt templates are rendered with,
+// e.g. {{.Home.Road}}, {{range .Ratings}}{{.Factor}}: {{.Stars}}{{end}} or {{if .Home.Notes}}...{{end}}.
+// The legacy {address}, {suburb}, {addressType} and {topic} placeholders still work.
+type PromptData struct {
+	Home          Home
+	Theme         Theme
+	ChatType      ChatType
+	Address       string
+	Suburb        string
+	AddressType   string
+	Topic         string
+	Ratings       []PromptRating
+	Shapes        []PromptShape
+	PreviousChats []PromptChat
+}
+
+type PromptRating struct {
+	Factor string
+	Stars  float64 // averaged over every rater
+}
+
+type PromptShape struct {
+	Title          string
+	Type           string
+	Kind           string
+	DistanceMeters int
+}
+
+type PromptChat struct {
+	Topic   string
+	Rating  int
+	Summary string
+}
+
+var promptTemplateFuncs = template.FuncMap{
+	"join": strings.Join,
+	"default": func(fallback string, value string) string {
+		if len(strings.TrimSpace(value)) == 0 {
+			return fallback
+		}
+		return value
+	},
+}
+
+// newPromptData holds what is known without the database, GetPromptData adds the rest
+func newPromptData(home Home, chatType ChatType, theme Theme) PromptData {
+	return PromptData{
+		Home:          home,
+		Theme:         theme,
+		ChatType:      chatType,
+		Address:       home.CleanAddress,
+		Suburb:        home.CleanSuburb,
+		AddressType:   chatType.AddressType,
+		Topic:         chatType.Name,
+		Ratings:       []PromptRating{},
+		Shapes:        []PromptShape{},
+		PreviousChats: []PromptChat{},
+	}
+}
+
+// GetPromptData loads the home's factor ratings, nearby shapes and earlier chats for the prompt templates
+func GetPromptData(db *gorm.DB, home Home, chatType ChatType, theme Theme) (PromptData, error) {
+	data := newPromptData(home, chatType, theme)
+
+	for _, rating := range GetHomeRatings(db, home.ID, "") {
+		average, ok := rating.Average()
+		if !ok {
+			continue
+		}
+		data.Ratings = append(data.Ratings, PromptRating{
+			Factor: rating.Factor.Title,
+			Stars:  average,
+		})
+	}
+
+	homeLatLng := LatLng{Lat: home.Lat, Lng: home.Lng}
+	for _, shape := range GetShapes(db) {
+		// distances are to an area's edge, a route's ends aren't joined up
+		if shape.ShapeType == ShapeTypeRoute {
+			continue
+		}
+		latLngs, err := parseShapeLatLngs(shape.ShapeData)
+		if err != nil {
+			continue
+		}
+		distance := distanceToShapeMeters(homeLatLng, latLngs)
+		if distance > nearbyShapeMeters {
+			continue
+		}
+		data.Shapes = append(data.Shapes, PromptShape{
+			Title:          shape.ShapeTitle,
+			Type:           shape.ShapeType,
+			Kind:           shape.ShapeKind,
+			DistanceMeters: int(math.Round(distance)),
+		})
+	}
+	sort.SliceStable(data.Shapes, func(i, j int) bool { return data.Shapes[i].DistanceMeters < data.Shapes[j].DistanceMeters })
+
+	chats, err := GetChats(db, theme.ID, home.ID, 0)
+	if err != nil {
+		return data, fmt.Errorf("failed to get previous chats: %w", err)
+	}
+	for _, c := range chats {
+		if c.ChatType == chatType.ID || c.Status == "pending" || c.Status == "streaming" || c.Status == "failed" {
+			continue
+		}
+		data.PreviousChats = append(data.PreviousChats, PromptChat{
+			Topic:   c.ChatTypeTitle,
+			Rating:  c.Rating,
+			Summary: chatSummary(c),
+		})
+	}
+
+	return data, nil
+}
+
+// chatSummary is the structured summary when there is one, otherwise the start of the latest answer
+func chatSummary(c Chat) string {
+	if len(c.Summary) > 0 {
+		return c.Summary
+	}
+
+	var latest ChatResult
+	for _, res := range c.Results {
+		if res.Role == "assistant" && res.ID >= latest.ID {
+			latest = res
+		}
+	}
+
+	summary := strings.TrimSpace(latest.Result)
+	if runes := []rune(summary); len(runes) > previousChatSummaryLength {
+		summary = strings.TrimSpace(string(runes[:previousChatSummaryLength])) + "..."
+	}
+	return summary
+}
+
+// renderPrompt runs the prompt as a text/template then swaps the legacy {placeholders}. The placeholders go in
+// last so a {{ in an address or notes is left as text instead of being run.
+func renderPrompt(name string, prompt string, replacements map[string]string, data PromptData) (string, error) {
+	if !strings.Contains(prompt, "{{") {
+		return applyReplacements(prompt, replacements), nil
+	}
+
+	tmpl, err := template.New(name).Funcs(promptTemplateFuncs).Option("missingkey=error").Parse(prompt)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s template: %w", name, err)
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("failed to render %s template: %w", name, err)
+	}
+	return applyReplacements(rendered.String(), replacements), nil
+}
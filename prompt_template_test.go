@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderPrompt(t *testing.T) {
+	t.Parallel()
+
+	data := newPromptData(
+		Home{CleanAddress: "7 Middleton Road, Riccarton", Road: "Middleton Road", HouseNumber: "7", Postcode: "8041"},
+		ChatType{Name: "Flooding", AddressType: "house"},
+		Theme{ID: 1},
+	)
+	data.Ratings = []PromptRating{{Factor: "Sun", Stars: 4}}
+	data.Shapes = []PromptShape{{Title: "Hagley Park", Type: "park", DistanceMeters: 850}}
+	data.PreviousChats = []PromptChat{{Topic: "Traffic", Rating: 2, Summary: "Busy at peak times"}}
+	replacements := getReplacements(data.Home, "house", data.ChatType)
+
+	tests := []struct {
+		name    string
+		prompt  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "Legacy placeholders",
+			prompt: "Does {address} flood?",
+			want:   "Does 7 Middleton Road, Riccarton flood?",
+		},
+		{
+			name:   "Home fields",
+			prompt: "{{.Home.HouseNumber}} {{.Home.Road}} {{.Home.Postcode}}",
+			want:   "7 Middleton Road 8041",
+		},
+		{
+			name:   "Conditional on empty notes",
+			prompt: "{{if .Home.Notes}}Notes: {{.Home.Notes}}{{else}}No notes{{end}}",
+			want:   "No notes",
+		},
+		{
+			name:   "Default for empty field",
+			prompt: `{{default "no listing" .Home.Url}}`,
+			want:   "no listing",
+		},
+		{
+			name:   "Ratings, shapes and previous chats",
+			prompt: "{{range .Ratings}}{{.Factor}}={{.Stars}} {{end}}{{range .Shapes}}{{.Title}} {{.DistanceMeters}}m {{end}}{{range .PreviousChats}}{{.Topic}}: {{.Summary}}{{end}}",
+			want:   "Sun=4 Hagley Park 850m Traffic: Busy at peak times",
+		},
+		{
+			name:    "Unknown field",
+			prompt:  "{{.Home.Garage}}",
+			wantErr: true,
+		},
+		{
+			name:    "Invalid template",
+			prompt:  "{{if .Home.Notes}}unclosed",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := renderPrompt("prompt", tt.prompt, replacements, data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderPrompt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("renderPrompt() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderPromptUserData(t *testing.T) {
+	t.Parallel()
+
+	// addresses and notes are text, a {{ in them isn't run as part of the template
+	home := Home{CleanAddress: "{{.Theme}} Road", Notes: "Ask about {{.Home.Url}} and {{if"}
+	data := newPromptData(home, ChatType{Name: "Flooding", AddressType: "house"}, Theme{ID: 1})
+	replacements := getReplacements(home, "house", data.ChatType)
+
+	tests := []struct {
+		prompt string
+		want   string
+	}{
+		{prompt: "Does {address} flood?", want: "Does {{.Theme}} Road flood?"},
+		{prompt: "{address}: {{.Home.Notes}}", want: "{{.Theme}} Road: Ask about {{.Home.Url}} and {{if"},
+	}
+	for _, tt := range tests {
+		got, err := renderPrompt("prompt", tt.prompt, replacements, data)
+		if err != nil || got != tt.want {
+			t.Errorf("renderPrompt(%q) = %q, %v, want %q", tt.prompt, got, err, tt.want)
+		}
+	}
+}
+
+func TestGetPromptData(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	home := Home{Lat: -43.53, Lng: 172.58, CleanAddress: "7 Middleton Road, Riccarton", Road: "Middleton Road"}
+	db.Create(&home)
+
+	factor := Factor{Title: "Sun"}
+	db.Create(&factor)
+	db.Create(&HomeFactorRating{HomeID: home.ID, FactorID: factor.ID, Stars: 4})
+
+	db.Create(&Shape{ShapeTitle: "Near park", ShapeType: "park", ShapeData: "[[-43.531,172.579],[-43.531,172.581],[-43.532,172.581]]"})
+	db.Create(&Shape{ShapeTitle: "Far zone", ShapeData: "[[-43.6,172.7],[-43.6,172.71],[-43.61,172.71]]"})
+	db.Create(&Shape{ShapeTitle: "Broken", ShapeData: "not json"})
+
+	traffic := ChatType{Name: "Traffic", Prompt: "Traffic near {address}", ThemeID: 1}
+	db.Create(&traffic)
+	flooding := ChatType{Name: "Flooding", Prompt: "Does {{.Home.Road}} flood?", ThemeID: 1}
+	db.Create(&flooding)
+
+	db.Create(&Chat{ThemeID: 1, HomeID: home.ID, ChatType: traffic.ID, ChatTypeTitle: traffic.Name, Status: "complete", Rating: 2, Summary: "Busy at peak times"})
+	db.Create(&Chat{ThemeID: 1, HomeID: home.ID, ChatType: traffic.ID, ChatTypeTitle: traffic.Name, Status: "failed"})
+	db.Create(&Chat{ThemeID: 1, HomeID: home.ID, ChatType: flooding.ID, ChatTypeTitle: flooding.Name, Status: "complete", Summary: "Own topic"})
+	schools := ChatType{Name: "Schools", Prompt: "Schools near {address}", ThemeID: 1}
+	db.Create(&schools)
+	db.Create(&Chat{ThemeID: 1, HomeID: home.ID, ChatType: schools.ID, ChatTypeTitle: schools.Name, Status: "streaming",
+		Results: []ChatResult{{Role: "assistant", Result: "Half an ans"}}})
+	noise := ChatType{Name: "Noise", Prompt: "Noise near {address}", ThemeID: 1}
+	db.Create(&noise)
+	db.Create(&Chat{ThemeID: 1, HomeID: home.ID, ChatType: noise.ID, ChatTypeTitle: noise.Name, Status: "complete",
+		Results: []ChatResult{{Role: "assistant", Result: strings.Repeat("é", previousChatSummaryLength+100)}}})
+
+	data, err := GetPromptData(db, home, flooding, GetActiveTheme(db, 1))
+	if err != nil {
+		t.Fatalf("GetPromptData() error = %v", err)
+	}
+
+	if len(data.Ratings) != 1 || data.Ratings[0] != (PromptRating{Factor: "Sun", Stars: 4}) {
+		t.Errorf("GetPromptData() ratings = %+v, want Sun=4", data.Ratings)
+	}
+	if len(data.Shapes) != 1 || data.Shapes[0].Title != "Near park" || data.Shapes[0].DistanceMeters > 200 {
+		t.Errorf("GetPromptData() shapes = %+v, want only the near park", data.Shapes)
+	}
+	wantChats := []PromptChat{
+		{Topic: "Traffic", Rating: 2, Summary: "Busy at peak times"},
+		{Topic: "Noise", Summary: strings.Repeat("é", previousChatSummaryLength) + "..."},
+	}
+	if !reflect.DeepEqual(data.PreviousChats, wantChats) {
+		t.Errorf("GetPromptData() previous chats = %+v, want the complete traffic and noise chats, noise cut to whole characters", data.PreviousChats)
+	}
+
+	promptConfig, err := buildPromptConfig(data)
+	if err != nil {
+		t.Fatalf("buildPromptConfig() error = %v", err)
+	}
+	if got := promptConfig.Messages[1].Content; got != "Does Middleton Road flood?" {
+		t.Errorf("buildPromptConfig() prompt = %q, want the rendered template", got)
+	}
+}
+
+func TestChatTypePreviewHandler(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	home := Home{Lat: -43.53, Lng: 172.58, CleanAddress: "7 Middleton Road, Riccarton", Road: "Middleton Road", Postcode: "8041"}
+	db.Create(&home)
+	db.Create(&Theme{Name: "Flats", StartSystemPrompt: "You research flats"})
+	theme := Theme{Name: "Schools", StartSystemPrompt: "You research {topic} for families"}
+	db.Create(&theme)
+
+	tests := []struct {
+		name     string
+		homeID   string
+		prompt   string
+		wantBody string
+	}{
+		{
+			name:     "Renders the prompt for the home",
+			homeID:   "1",
+			prompt:   "Schools near {{.Home.Road}} {{.Home.Postcode}}",
+			wantBody: "Schools near Middleton Road 8041",
+		},
+		{
+			name:     "Uses the selected theme",
+			homeID:   "1",
+			prompt:   "Schools near {address}",
+			wantBody: "You research Schools for families",
+		},
+		{
+			name:     "Template error renders a warning",
+			homeID:   "1",
+			prompt:   "{{.Home.Garage}}",
+			wantBody: "failed to render prompt template",
+		},
+		{
+			name:     "Missing home renders a warning",
+			homeID:   "",
+			prompt:   "Schools near {address}",
+			wantBody: "Choose a home",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{
+				"name":       {"Schools"},
+				"prompt":     {tt.prompt},
+				"outputMode": {OutputModeText},
+				"homeId":     {tt.homeID},
+			}
+			req := httptest.NewRequest("POST", "/chattype/preview", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.AddCookie(&http.Cookie{Name: "themeId", Value: fmt.Sprint(theme.ID)})
+			rec := httptest.NewRecorder()
+			chatTypePreviewHandler(db).ServeHTTP(rec, req)
+
+			if !contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("POST /chattype/preview body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+
+	var chats int64
+	db.Model(&Chat{}).Count(&chats)
+	if chats != 0 {
+		t.Errorf("preview created %d chats, want none", chats)
+	}
+}
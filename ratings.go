@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	raterCookie    = "rater"
+	maxRaterLength = 40
+
+	// raters this many stars apart on a factor are flagged as disagreeing
+	raterDisagreementStars = 2
+)
+
+type HomeFactorAndRating struct {
+	*HomeFactorRating // the current rater's rating, nil when they haven't rated the factor
+	Factor
+	Ratings []HomeFactorRating // every rater's rating, sorted by rater
+}
+
+// Average is the mean of every rater's stars, ok is false when nobody has rated the factor
+func (r HomeFactorAndRating) Average() (float64, bool) {
+	if len(r.Ratings) == 0 {
+		return 0, false
+	}
+	total := 0
+	for _, rating := range r.Ratings {
+		total += rating.Stars
+	}
+	return float64(total) / float64(len(r.Ratings)), true
+}
+
+// Spread is how many stars apart the highest and lowest raters are
+func (r HomeFactorAndRating) Spread() int {
+	if len(r.Ratings) == 0 {
+		return 0
+	}
+	low, high := r.Ratings[0].Stars, r.Ratings[0].Stars
+	for _, rating := range r.Ratings[1:] {
+		low = min(low, rating.Stars)
+		high = max(high, rating.Stars)
+	}
+	return high - low
+}
+
+func (r HomeFactorAndRating) Disagree() bool {
+	return r.Spread() >= raterDisagreementStars
+}
+
+// GetHomeRatings is every factor with the home's ratings for it, HomeFactorRating is set to rater's own rating
+func GetHomeRatings(db *gorm.DB, homeId uint, rater string) []HomeFactorAndRating {
+	factors := GetFactors(db)
+
+	var ratings []HomeFactorRating
+	err := db.Where("home_id = ?", homeId).Order("rater").Find(&ratings)
+	if err.Error != nil {
+		log.Fatal("failed to get ratings:", err.Error)
+	}
+
+	ratingMap := make(map[uint][]HomeFactorRating)
+	for _, rating := range ratings {
+		ratingMap[rating.FactorID] = append(ratingMap[rating.FactorID], rating)
+	}
+
+	ratingsWithFactors := make([]HomeFactorAndRating, 0, len(factors))
+	for _, factor := range factors {
+		withFactor := HomeFactorAndRating{Factor: factor, Ratings: ratingMap[factor.ID]}
+		for i := range withFactor.Ratings {
+			if withFactor.Ratings[i].Rater == rater {
+				withFactor.HomeFactorRating = &withFactor.Ratings[i]
+			}
+		}
+		ratingsWithFactors = append(ratingsWithFactors, withFactor)
+	}
+	return ratingsWithFactors
+}
+
+// GetAverageStars is every rater's stars averaged, keyed by home then factor ID
+func GetAverageStars(db *gorm.DB) (map[uint]map[uint]float64, error) {
+	var rows []struct {
+		HomeID   uint
+		FactorID uint
+		Stars    float64
+	}
+	err := db.Model(&HomeFactorRating{}).Select("home_id, factor_id, AVG(stars) AS stars").Group("home_id, factor_id").Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ratings: %w", err)
+	}
+
+	stars := make(map[uint]map[uint]float64)
+	for _, row := range rows {
+		if stars[row.HomeID] == nil {
+			stars[row.HomeID] = make(map[uint]float64)
+		}
+		stars[row.HomeID][row.FactorID] = row.Stars
+	}
+	return stars, nil
+}
+
+// GetRaters is everyone who has rated a home, sorted by name
+func GetRaters(db *gorm.DB) []string {
+	raters := make([]string, 0)
+	err := db.Model(&HomeFactorRating{}).Where("rater <> ''").Distinct().Pluck("rater", &raters).Error
+	if err != nil {
+		log.Printf("failed to get raters: %v", err)
+	}
+	sort.Strings(raters)
+	return raters
+}
+
+// SaveHomeFactorRating sets the rater's stars for a home and factor, replacing their earlier rating
+func SaveHomeFactorRating(db *gorm.DB, rating HomeFactorRating) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "home_id"}, {Name: "factor_id"}, {Name: "rater"}},
+		DoUpdates: clause.AssignmentColumns([]string{"stars"}),
+	}).Create(&rating).Error
+}
+
+// keepDuplicateRatings makes the ratings unique per home, factor and rater so the unique index can be added.
+// Ratings from before raters existed all count as the same unnamed rater, where a home and factor was rated more
+// than once the latest rating stays theirs and each earlier one is kept under its own "Earlier rating" rater.
+func keepDuplicateRatings(db *gorm.DB) error {
+	var older []struct {
+		ID       uint
+		HomeID   uint
+		FactorID uint
+		Rater    string
+	}
+	// raw SQL as the table can be from before workspaces, and these aren't changes to audit
+	err := db.Raw("SELECT id, home_id, factor_id, rater FROM home_factor_ratings WHERE id NOT IN (SELECT MAX(id) FROM home_factor_ratings GROUP BY home_id, factor_id, rater) ORDER BY id DESC").Scan(&older).Error
+	if err != nil {
+		return err
+	}
+
+	earlier := make(map[string]int)
+	for _, rating := range older {
+		key := fmt.Sprintf("%d/%d/%s", rating.HomeID, rating.FactorID, rating.Rater)
+		earlier[key]++
+		rater := fmt.Sprintf("Earlier rating %d", earlier[key])
+		if len(rating.Rater) > 0 {
+			rater = fmt.Sprintf("%s - earlier rating %d", rating.Rater, earlier[key])
+		}
+		if err := db.Exec("UPDATE home_factor_ratings SET rater = ? WHERE id = ?", rater, rating.ID).Error; err != nil {
+			return err
+		}
+	}
+	if len(older) > 0 {
+		log.Printf("kept %d earlier ratings of the same home and factor under their own raters", len(older))
+	}
+	return nil
+}
+
+// getRater is the name ratings are saved under, from the rater cookie
+func getRater(r *http.Request) string {
+	cookie, err := r.Cookie(raterCookie)
+	if err != nil {
+		return ""
+	}
+	rater, err := url.QueryUnescape(cookie.Value)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(rater)
+}
+
+// parseRater reads the rater form value, falling back to the cookie, and remembers it for next time
+func parseRater(w http.ResponseWriter, r *http.Request) (string, error) {
+	if _, sent := r.Form["rater"]; !sent {
+		return getRater(r), nil
+	}
+
+	rater := strings.TrimSpace(r.FormValue("rater"))
+	if len(rater) > maxRaterLength {
+		return "", fmt.Errorf("Rater name must be %d characters or less", maxRaterLength)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   raterCookie,
+		Value:  url.QueryEscape(rater),
+		Path:   "/",
+		MaxAge: 60 * 60 * 24 * 365,
+	})
+	return rater, nil
+}
+
+// raterName is how a rater is shown, ratings from before raters existed have no name
+func raterName(rater string) string {
+	if len(rater) == 0 {
+		return "Unnamed"
+	}
+	return rater
+}
+
+// raterBreakdown lists each rater's stars, for a hover title
+func raterBreakdown(r HomeFactorAndRating) string {
+	parts := make([]string, 0, len(r.Ratings))
+	for _, rating := range r.Ratings {
+		parts = append(parts, fmt.Sprintf("%s %d", raterName(rating.Rater), rating.Stars))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHomeFactorRatingsPerRater(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	home := Home{Lat: -43.53, Lng: 172.58, Title: "Middleton"}
+	db.Create(&home)
+	sun := Factor{Title: "Sun"}
+	db.Create(&sun)
+
+	tests := []struct {
+		name         string
+		rater        string
+		cookie       string
+		stars        int
+		wantBody     string
+		wantRatings  int
+		wantAverage  float64
+		wantDisagree bool
+	}{
+		{
+			name:        "First rater",
+			rater:       "Sam",
+			stars:       5,
+			wantBody:    "5 * for 1 by Sam",
+			wantRatings: 1,
+			wantAverage: 5,
+		},
+		{
+			name:        "Rating again replaces the rater's rating",
+			rater:       "Sam",
+			stars:       4,
+			wantBody:    "4 * for 1 by Sam",
+			wantRatings: 1,
+			wantAverage: 4,
+		},
+		{
+			name:        "Second rater from the cookie is kept separately",
+			cookie:      "Alex",
+			stars:       3,
+			wantBody:    "3 * for 1 by Alex",
+			wantRatings: 2,
+			wantAverage: 3.5,
+		},
+		{
+			name:         "Raters far apart disagree",
+			cookie:       "Alex",
+			stars:        1,
+			wantBody:     "Raters disagree by 3 stars",
+			wantRatings:  2,
+			wantAverage:  2.5,
+			wantDisagree: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{
+				"stars":    {fmt.Sprintf("%d", tt.stars)},
+				"factorId": {fmt.Sprintf("%d", sun.ID)},
+				"homeId":   {fmt.Sprintf("%d", home.ID)},
+			}
+			if len(tt.rater) > 0 {
+				form.Set("rater", tt.rater)
+			}
+			req := httptest.NewRequest("POST", "/homes-rating", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if len(tt.cookie) > 0 {
+				req.AddCookie(&http.Cookie{Name: raterCookie, Value: tt.cookie})
+			}
+			rec := httptest.NewRecorder()
+			createHomeFactorRating(db).ServeHTTP(rec, req)
+
+			ratings := GetHomeRatings(db, home.ID, tt.rater)
+			if len(ratings) != 1 || len(ratings[0].Ratings) != tt.wantRatings {
+				t.Fatalf("GetHomeRatings() = %+v, want %d ratings for sun", ratings, tt.wantRatings)
+			}
+			if average, ok := ratings[0].Average(); !ok || average != tt.wantAverage {
+				t.Errorf("Average() = %v, want %v", average, tt.wantAverage)
+			}
+			if ratings[0].Disagree() != tt.wantDisagree {
+				t.Errorf("Disagree() = %v, want %v", ratings[0].Disagree(), tt.wantDisagree)
+			}
+
+			if len(tt.rater) > 0 {
+				if ratings[0].HomeFactorRating == nil || ratings[0].HomeFactorRating.Stars != tt.stars {
+					t.Errorf("GetHomeRatings() own rating = %+v, want %d stars", ratings[0].HomeFactorRating, tt.stars)
+				}
+				if !contains(rec.Header().Get("Set-Cookie"), "rater="+tt.rater) {
+					t.Errorf("POST /homes-rating Set-Cookie = %q, want the rater remembered", rec.Header().Get("Set-Cookie"))
+				}
+			}
+
+			view := httptest.NewRecorder()
+			ratingListView(ratings).Render(GetContext(req), view)
+			body := rec.Body.String() + view.Body.String()
+			if !contains(body, tt.wantBody) {
+				t.Errorf("rating views = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+
+	stars, err := GetAverageStars(db)
+	if err != nil {
+		t.Fatalf("GetAverageStars() error = %v", err)
+	}
+	if stars[home.ID][sun.ID] != 2.5 {
+		t.Errorf("GetAverageStars() = %v, want 2.5 for sun", stars)
+	}
+	if raters := GetRaters(db); strings.Join(raters, ",") != "Alex,Sam" {
+		t.Errorf("GetRaters() = %v, want Alex,Sam", raters)
+	}
+}
+
+func TestKeepDuplicateRatings(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBOpen(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	// ratings from before raters, where every vote was a new row
+	raters := 0
+	for _, m := range migrations {
+		if m.Name == "rating_raters" {
+			raters = m.Version
+		}
+	}
+	if _, err := migrateUp(db, migrations, raters-1); err != nil {
+		t.Fatalf("migrateUp() error = %v", err)
+	}
+	db.Exec("INSERT INTO home_factor_ratings (stars, factor_id, home_id) VALUES (2, 1, 1), (5, 1, 1), (4, 1, 1), (3, 2, 1)")
+
+	if _, err := migrateUp(db, migrations, 0); err != nil {
+		t.Fatalf("migrateUp() error = %v", err)
+	}
+
+	var ratings []HomeFactorRating
+	db.Order("factor_id, id").Find(&ratings)
+	got := make([]string, 0, len(ratings))
+	for _, rating := range ratings {
+		got = append(got, fmt.Sprintf("%d:%s=%d", rating.FactorID, rating.Rater, rating.Stars))
+	}
+	if want := "1:Earlier rating 2=2,1:Earlier rating 1=5,1:=4,2:=3"; strings.Join(got, ",") != want {
+		t.Errorf("ratings = %s, want %s, the latest unnamed with the earlier ones kept", strings.Join(got, ","), want)
+	}
+
+	if err := SaveHomeFactorRating(db, HomeFactorRating{HomeID: 1, FactorID: 1, Stars: 5}); err != nil {
+		t.Fatalf("SaveHomeFactorRating() error = %v", err)
+	}
+	var count int64
+	db.Model(&HomeFactorRating{}).Count(&count)
+	if count != 4 {
+		t.Errorf("ratings after saving for the unnamed rater = %d, want 4", count)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// factors count fully unless weighted otherwise, AI chat ratings only count once given a weight
+	defaultFactorWeight   = 1.0
+	defaultChatTypeWeight = 0.0
+
+	factorStarsMin = 1
+	factorStarsMax = 5
+
+	HomeSortDefault = ""
+	HomeSortScore   = "score"
+)
+
+// HomeScore is a home's weighted score out of 100, averaged over the factors and chat types it has ratings for
+type HomeScore struct {
+	HomeID   uint
+	Score    float64
+	Scored   bool
+	Coverage float64 // share of the total weight the home has ratings for
+	Parts    []ScorePart
+}
+
+// ScorePart is one rating's contribution, Value is the rating scaled to 0-1
+type ScorePart struct {
+	Label  string
+	Weight float64
+	Value  float64
+}
+
+// ScoreWeights are a theme's weights keyed by factor and chat type ID
+type ScoreWeights struct {
+	ThemeID   uint
+	Factors   map[uint]float64
+	ChatTypes map[uint]float64
+}
+
+func (sw ScoreWeights) factor(id uint) float64 {
+	if w, ok := sw.Factors[id]; ok {
+		return w
+	}
+	return defaultFactorWeight
+}
+
+func (sw ScoreWeights) chatType(id uint) float64 {
+	if w, ok := sw.ChatTypes[id]; ok {
+		return w
+	}
+	return defaultChatTypeWeight
+}
+
+func GetScoreWeights(db *gorm.DB, themeID uint) (ScoreWeights, error) {
+	weights := ScoreWeights{
+		ThemeID:   themeID,
+		Factors:   make(map[uint]float64),
+		ChatTypes: make(map[uint]float64),
+	}
+
+	var rows []ScoreWeight
+	if err := db.Where("theme_id = ?", themeID).Find(&rows).Error; err != nil {
+		return weights, fmt.Errorf("failed to get score weights: %w", err)
+	}
+	for _, row := range rows {
+		if row.FactorID != 0 {
+			weights.Factors[row.FactorID] = row.Weight
+		} else {
+			weights.ChatTypes[row.ChatTypeID] = row.Weight
+		}
+	}
+	return weights, nil
+}
+
+// SaveScoreWeight sets the weight of a factor or chat type for a theme
+func SaveScoreWeight(db *gorm.DB, weight ScoreWeight) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "theme_id"}, {Name: "factor_id"}, {Name: "chat_type_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"weight"}),
+	}).Create(&weight).Error
+}
+
+// scaleRating maps a rating in min-max onto 0-1, ok is false for ratings outside the range such as -1 for "no rating"
+func scaleRating(rating float64, min int, max int) (float64, bool) {
+	if rating < float64(min) || rating > float64(max) {
+		return 0, false
+	}
+	return (rating - float64(min)) / float64(max-min), true
+}
+
+func (hs *HomeScore) add(label string, weight float64, value float64) {
+	hs.Parts = append(hs.Parts, ScorePart{Label: label, Weight: weight, Value: value})
+}
+
+// finish turns the parts into the score, totalWeight is the weight of every factor and chat type in play
+func (hs *HomeScore) finish(totalWeight float64) {
+	var weighted, rated float64
+	for _, part := range hs.Parts {
+		weighted += part.Weight * part.Value
+		rated += part.Weight
+	}
+	if rated == 0 {
+		return
+	}
+	hs.Scored = true
+	hs.Score = 100 * weighted / rated
+	if totalWeight > 0 {
+		hs.Coverage = rated / totalWeight
+	}
+}
+
+// GetHomeScores scores every home for a theme from its factor stars and, where weighted, its latest AI chat ratings
+func GetHomeScores(db *gorm.DB, themeID uint) (map[uint]HomeScore, error) {
+	weights, err := GetScoreWeights(db, themeID)
+	if err != nil {
+		return nil, err
+	}
+
+	factors := GetFactors(db)
+	chatTypes, err := GetChatTypes(db, themeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chat types: %w", err)
+	}
+
+	// each factor counts the raters' average stars
+	stars, err := GetAverageStars(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the latest finished chat of each type counts
+	var chats []Chat
+	err = db.Where("theme_id = ? AND status NOT IN ?", themeID, []string{"pending", "streaming", "failed"}).Order("id").Find(&chats).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chats: %w", err)
+	}
+	chatRatings := make(map[uint]map[uint]int)
+	for _, c := range chats {
+		if chatRatings[c.HomeID] == nil {
+			chatRatings[c.HomeID] = make(map[uint]int)
+		}
+		chatRatings[c.HomeID][c.ChatType] = c.Rating
+	}
+
+	var totalWeight float64
+	for _, f := range factors {
+		totalWeight += weights.factor(f.ID)
+	}
+	for _, ct := range chatTypes {
+		totalWeight += weights.chatType(ct.ID)
+	}
+
+	scores := make(map[uint]HomeScore)
+	for _, home := range GetHomes(db) {
+		score := HomeScore{HomeID: home.ID, Parts: make([]ScorePart, 0)}
+
+		for _, f := range factors {
+			weight := weights.factor(f.ID)
+			if value, ok := scaleRating(stars[home.ID][f.ID], factorStarsMin, factorStarsMax); ok && weight > 0 {
+				score.add(f.Title, weight, value)
+			}
+		}
+		for _, ct := range chatTypes {
+			weight := weights.chatType(ct.ID)
+			if value, ok := scaleRating(float64(chatRatings[home.ID][ct.ID]), structuredRatingMin, structuredRatingMax); ok && weight > 0 {
+				score.add(ct.Name, weight, value)
+			}
+		}
+
+		score.finish(totalWeight)
+		scores[home.ID] = score
+	}
+	return scores, nil
+}
+
+// sortHomes orders homes by sortKey, HomeSortScore puts the best scores first and unscored homes last
+func sortHomes(homes []Home, scores map[uint]HomeScore, sortKey string) {
+	if sortKey != HomeSortScore {
+		return
+	}
+	sort.SliceStable(homes, func(i, j int) bool {
+		a, b := scores[homes[i].ID], scores[homes[j].ID]
+		if a.Scored != b.Scored {
+			return a.Scored
+		}
+		return a.Score > b.Score
+	})
+}
+
+// GetScoredHomes is every home with its score for the theme, sorted by sortKey
+func GetScoredHomes(db *gorm.DB, themeID uint, sortKey string) ([]Home, map[uint]HomeScore, error) {
+	scores, err := GetHomeScores(db, themeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	homes := GetHomes(db)
+	sortHomes(homes, scores, sortKey)
+	return homes, scores, nil
+}
+
+// scoreWeightsHandler lists and saves the current theme's factor and chat type weights
+func scoreWeightsHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		themeId, err := getThemeIDOrRedirect(w, r)
+		if err != nil {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				warning := warning("scoreWeightsHandler - Unable to parse form data")
+				warning.Render(GetContext(r), w)
+				return
+			}
+
+			// fields are named factor-<id> and chatType-<id>
+			for key := range r.PostForm {
+				kind, idStr, found := strings.Cut(key, "-")
+				if !found || (kind != "factor" && kind != "chatType") {
+					continue
+				}
+				id, err := strconv.ParseUint(idStr, 10, 32)
+				if err != nil {
+					warning := warning(fmt.Sprintf("Invalid weight field %q", key))
+					warning.Render(GetContext(r), w)
+					return
+				}
+				value, err := strconv.ParseFloat(strings.TrimSpace(r.PostForm.Get(key)), 64)
+				if err != nil || value < 0 {
+					warning := warning(fmt.Sprintf("Weight for %s must be a number of 0 or more", key))
+					warning.Render(GetContext(r), w)
+					return
+				}
+
+				weight := ScoreWeight{ThemeID: themeId, Weight: value}
+				if kind == "factor" {
+					weight.FactorID = uint(id)
+				} else {
+					weight.ChatTypeID = uint(id)
+				}
+				if err := SaveScoreWeight(db, weight); err != nil {
+					warning := warning(fmt.Sprintf("Failed to save weight - %v", err))
+					warning.Render(GetContext(r), w)
+					return
+				}
+			}
+		default:
+			warning := warning("Method not allowed")
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		weights, err := GetScoreWeights(db, themeId)
+		if err != nil {
+			warning := warning(err.Error())
+			warning.Render(GetContext(r), w)
+			return
+		}
+		chatTypes, err := GetChatTypes(db, themeId)
+		if err != nil {
+			warning := warning(fmt.Sprintf("Failed to get chat types - %s", err))
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		scoreWeightList := scoreWeightList(weights, GetFactors(db), chatTypes, r.Method == http.MethodPost)
+		scoreWeightList.Render(GetContext(r), w)
+	}
+}
+
+// scoreBreakdown lists each part of a score, for a hover title
+func scoreBreakdown(score HomeScore) string {
+	parts := make([]string, 0, len(score.Parts))
+	for _, part := range score.Parts {
+		parts = append(parts, fmt.Sprintf("%s %.0f%% x%g", part.Label, part.Value*100, part.Weight))
+	}
+	return strings.Join(parts, ", ")
+}
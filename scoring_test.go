@@ -0,0 +1,240 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGetHomeScores(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	homes := []Home{
+		{Lat: -43.53, Lng: 172.58, Title: "Sunny"},
+		{Lat: -43.52, Lng: 172.57, Title: "Quiet"},
+		{Lat: -43.51, Lng: 172.56, Title: "Unrated"},
+	}
+	db.Create(&homes)
+
+	sun := Factor{Title: "Sun"}
+	noise := Factor{Title: "Noise"}
+	db.Create(&sun)
+	db.Create(&noise)
+
+	// Sunny has 5 star sun and 1 star noise, Quiet the opposite
+	db.Create(&[]HomeFactorRating{
+		{HomeID: homes[0].ID, FactorID: sun.ID, Stars: 5},
+		{HomeID: homes[0].ID, FactorID: noise.ID, Stars: 1},
+		{HomeID: homes[1].ID, FactorID: sun.ID, Stars: 1},
+		{HomeID: homes[1].ID, FactorID: noise.ID, Stars: 5},
+	})
+
+	// chat types belong to a theme, each case's theme gets its own Flooding for weights with a ChatTypeID
+	const flooding = 1
+
+	tests := []struct {
+		name       string
+		weights    []ScoreWeight
+		wantScores []float64
+		wantOrder  []string
+	}{
+		{
+			name:       "Equal factor weights by default",
+			wantScores: []float64{50, 50},
+			wantOrder:  []string{"Sunny", "Quiet", "Unrated"},
+		},
+		{
+			name:       "Weighting noise ranks quiet first",
+			weights:    []ScoreWeight{{FactorID: noise.ID, Weight: 3}},
+			wantScores: []float64{25, 75},
+			wantOrder:  []string{"Quiet", "Sunny", "Unrated"},
+		},
+		{
+			name:       "Zero weight leaves a factor out",
+			weights:    []ScoreWeight{{FactorID: noise.ID, Weight: 0}},
+			wantScores: []float64{100, 0},
+			wantOrder:  []string{"Sunny", "Quiet", "Unrated"},
+		},
+		{
+			name:       "Latest finished AI rating counts once weighted",
+			weights:    []ScoreWeight{{FactorID: noise.ID, Weight: 0}, {ChatTypeID: flooding, Weight: 1}},
+			wantScores: []float64{50, 0},
+			wantOrder:  []string{"Sunny", "Quiet", "Unrated"},
+		},
+	}
+
+	// each case gets its own theme, so its own weights
+	for i, tt := range tests {
+		tt := tt
+		themeID := uint(100 + i)
+		chatType := ChatType{Name: "Flooding", ThemeID: themeID}
+		db.Create(&chatType)
+		db.Create(&[]Chat{
+			{ThemeID: themeID, HomeID: homes[0].ID, ChatType: chatType.ID, Rating: 3, Status: "complete"},
+			{ThemeID: themeID, HomeID: homes[0].ID, ChatType: chatType.ID, Rating: 1, Status: "complete"},
+			{ThemeID: themeID, HomeID: homes[0].ID, ChatType: chatType.ID, Rating: 3, Status: "failed"},
+		})
+		for _, weight := range tt.weights {
+			weight.ThemeID = themeID
+			if weight.ChatTypeID == flooding {
+				weight.ChatTypeID = chatType.ID
+			}
+			if err := SaveScoreWeight(db, weight); err != nil {
+				t.Fatalf("SaveScoreWeight() error = %v", err)
+			}
+		}
+
+		t.Run(tt.name, func(t *testing.T) {
+			sorted, scores, err := GetScoredHomes(db, themeID, HomeSortScore)
+			if err != nil {
+				t.Fatalf("GetScoredHomes() error = %v", err)
+			}
+
+			for j, want := range tt.wantScores {
+				got := scores[homes[j].ID]
+				if !got.Scored || math.Abs(got.Score-want) > 0.01 {
+					t.Errorf("GetScoredHomes() %s score = %+v, want %v", homes[j].Title, got, want)
+				}
+			}
+			if scores[homes[2].ID].Scored {
+				t.Errorf("GetScoredHomes() Unrated score = %+v, want unscored", scores[homes[2].ID])
+			}
+
+			for j, want := range tt.wantOrder {
+				if sorted[j].Title != want {
+					t.Errorf("GetScoredHomes() order[%d] = %s, want %s", j, sorted[j].Title, want)
+				}
+			}
+		})
+	}
+}
+
+func TestScoreWeightsHandler(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	sun := Factor{Title: "Sun"}
+	db.Create(&sun)
+
+	tests := []struct {
+		name       string
+		weight     string
+		wantBody   string
+		wantWeight float64
+	}{
+		{
+			name:       "Saves a weight",
+			weight:     "2.5",
+			wantBody:   "Weights saved",
+			wantWeight: 2.5,
+		},
+		{
+			name:       "Saving again updates it",
+			weight:     "0",
+			wantBody:   "Weights saved",
+			wantWeight: 0,
+		},
+		{
+			name:       "Negative weight is rejected",
+			weight:     "-1",
+			wantBody:   "must be a number of 0 or more",
+			wantWeight: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"factor-1": {tt.weight}}
+			req := httptest.NewRequest("POST", "/score-weights", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.AddCookie(&http.Cookie{Name: "themeId", Value: "1"})
+			rec := httptest.NewRecorder()
+			scoreWeightsHandler(db).ServeHTTP(rec, req)
+
+			if !contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("POST /score-weights body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+
+			weights, err := GetScoreWeights(db, 1)
+			if err != nil {
+				t.Fatalf("GetScoreWeights() error = %v", err)
+			}
+			if got := weights.factor(sun.ID); got != tt.wantWeight {
+				t.Errorf("GetScoreWeights() sun = %v, want %v", got, tt.wantWeight)
+			}
+		})
+	}
+
+	var rows int64
+	db.Model(&ScoreWeight{}).Count(&rows)
+	if rows != 1 {
+		t.Errorf("score_weights has %d rows, want 1 per theme and factor", rows)
+	}
+}
+
+func TestScoringOtherThemesChatTypes(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	home := Home{Lat: -43.53, Lng: 172.58, Title: "Sunny"}
+	db.Create(&home)
+	sun := Factor{Title: "Sun"}
+	db.Create(&sun)
+	db.Create(&HomeFactorRating{HomeID: home.ID, FactorID: sun.ID, Stars: 5})
+	other := Theme{Name: "Schools"}
+	db.Create(&other)
+	zoning := ChatType{Name: "Zoning", ThemeID: other.ID}
+	db.Create(&zoning)
+	// a weight saved under theme 1 for another theme's chat type, which can never be rated in theme 1
+	if err := SaveScoreWeight(db, ScoreWeight{ThemeID: 1, ChatTypeID: zoning.ID, Weight: 1}); err != nil {
+		t.Fatalf("SaveScoreWeight() error = %v", err)
+	}
+
+	scores, err := GetHomeScores(db, 1)
+	if err != nil {
+		t.Fatalf("GetHomeScores() error = %v", err)
+	}
+	if score := scores[home.ID]; score.Score != 100 || score.Coverage != 1 {
+		t.Errorf("GetHomeScores() = %+v, want 100 with full coverage from the sun rating alone", score)
+	}
+
+	req := httptest.NewRequest("GET", "/score-weights", nil)
+	req.AddCookie(&http.Cookie{Name: "themeId", Value: "1"})
+	rec := httptest.NewRecorder()
+	scoreWeightsHandler(db).ServeHTTP(rec, req)
+	if contains(rec.Body.String(), "Zoning") || !contains(rec.Body.String(), "Sun") {
+		t.Errorf("GET /score-weights body = %q, want the factors and only theme 1's chat types", rec.Body.String())
+	}
+}
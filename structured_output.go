@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	OutputModeText = ""
+	OutputModeJSON = "json"
+
+	structuredRatingMin = 1
+	structuredRatingMax = 3
+)
+
+// StructuredAnswer is what a json output ChatType asks the provider to reply with
+type StructuredAnswer struct {
+	Rating     int      `json:"rating"`
+	Summary    string   `json:"summary"`
+	Pros       []string `json:"pros"`
+	Cons       []string `json:"cons"`
+	Confidence float64  `json:"confidence"`
+}
+
+// ResponseFormat is the OpenAI style response_format request field, perplexity accepts the same shape
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+type JSONSchema struct {
+	Name   string                 `json:"name"`
+	Strict bool                   `json:"strict"`
+	Schema map[string]interface{} `json:"schema"`
+}
+
+func structuredResponseFormat() *ResponseFormat {
+	stringList := map[string]interface{}{
+		"type":  "array",
+		"items": map[string]interface{}{"type": "string"},
+	}
+	return &ResponseFormat{
+		Type: "json_schema",
+		JSONSchema: &JSONSchema{
+			Name:   "home_research_answer",
+			Strict: true,
+			Schema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"rating":     map[string]interface{}{"type": "integer", "minimum": structuredRatingMin, "maximum": structuredRatingMax},
+					"summary":    map[string]interface{}{"type": "string"},
+					"pros":       stringList,
+					"cons":       stringList,
+					"confidence": map[string]interface{}{"type": "number", "minimum": 0, "maximum": 1},
+				},
+				"required":             []string{"rating", "summary", "pros", "cons", "confidence"},
+				"additionalProperties": false,
+			},
+		},
+	}
+}
+
+// structuredOutputInstructions is added to the system prompt, not every provider enforces response_format
+var structuredOutputInstructions = fmt.Sprintf(`
+
+Reply with only a JSON object, no other text, in this shape:
+{"rating": %d-%d (%d is best), "summary": "one paragraph answer", "pros": ["..."], "cons": ["..."], "confidence": 0.0-1.0}`,
+	structuredRatingMin, structuredRatingMax, structuredRatingMax)
+
+// parseStructuredAnswer reads and validates a json answer, tolerating a ```json fence or text around the object
+func parseStructuredAnswer(content string) (*StructuredAnswer, error) {
+	start := strings.Index(content, "{")
+	end := strings.LastIndex(content, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("no JSON object in answer")
+	}
+
+	var answer StructuredAnswer
+	decoder := json.NewDecoder(strings.NewReader(content[start : end+1]))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&answer); err != nil {
+		return nil, fmt.Errorf("invalid JSON answer: %w", err)
+	}
+
+	if answer.Rating < structuredRatingMin || answer.Rating > structuredRatingMax {
+		return nil, fmt.Errorf("rating %d is outside %d-%d", answer.Rating, structuredRatingMin, structuredRatingMax)
+	}
+	if len(strings.TrimSpace(answer.Summary)) == 0 {
+		return nil, errors.New("summary is empty")
+	}
+	if answer.Confidence < 0 || answer.Confidence > 1 {
+		return nil, fmt.Errorf("confidence %v is outside 0-1", answer.Confidence)
+	}
+	if answer.Pros == nil {
+		answer.Pros = []string{}
+	}
+	if answer.Cons == nil {
+		answer.Cons = []string{}
+	}
+	return &answer, nil
+}
+
+// rateChatAnswer sets the Chat's rating from an answer, json chat types also fill the structured columns.
+// Text chat types keep using the "Rating: N" regex.
+func rateChatAnswer(c *Chat, chatType ChatType, content string) error {
+	if chatType.OutputMode != OutputModeJSON {
+		c.Rating = extractRating(content)
+		return nil
+	}
+
+	answer, err := parseStructuredAnswer(content)
+	if err != nil {
+		return err
+	}
+	c.Rating = answer.Rating
+	c.Summary = answer.Summary
+	c.Pros = answer.Pros
+	c.Cons = answer.Cons
+	c.Confidence = answer.Confidence
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseStructuredAnswer(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		content    string
+		wantRating int
+		wantErr    bool
+	}{
+		{
+			name:       "Valid answer",
+			content:    `{"rating": 2, "summary": "Quiet street", "pros": ["Parks"], "cons": ["Traffic"], "confidence": 0.8}`,
+			wantRating: 2,
+		},
+		{
+			name:       "Fenced answer with text around it",
+			content:    "Here you go:\n```json\n{\"rating\": 3, \"summary\": \"Great\", \"pros\": [], \"cons\": [], \"confidence\": 1}\n```",
+			wantRating: 3,
+		},
+		{
+			name:    "Rating out of range",
+			content: `{"rating": 123, "summary": "Quiet street", "pros": [], "cons": [], "confidence": 0.8}`,
+			wantErr: true,
+		},
+		{
+			name:    "Missing summary",
+			content: `{"rating": 2, "pros": [], "cons": [], "confidence": 0.8}`,
+			wantErr: true,
+		},
+		{
+			name:    "Confidence above 1",
+			content: `{"rating": 2, "summary": "Quiet street", "pros": [], "cons": [], "confidence": 80}`,
+			wantErr: true,
+		},
+		{
+			name:    "Unknown field",
+			content: `{"rating": 2, "summary": "Quiet street", "pros": [], "cons": [], "confidence": 0.8, "stars": 5}`,
+			wantErr: true,
+		},
+		{
+			name:    "Free text answer",
+			content: "A quiet street.\n\nRating: 2",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseStructuredAnswer(tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseStructuredAnswer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.Rating != tt.wantRating {
+				t.Errorf("parseStructuredAnswer() rating = %d, want %d", got.Rating, tt.wantRating)
+			}
+		})
+	}
+}
+
+func TestStructuredChat(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	home := Home{Lat: -43.53, Lng: 172.58, CleanAddress: "7 Middleton Road, Riccarton", CleanSuburb: "Riccarton"}
+	db.Create(&home)
+
+	chatType := ChatType{Name: "Schools", Prompt: "Which schools are zoned for {address}?", ThemeID: 1, LLMProvider: ProviderFake, OutputMode: OutputModeJSON}
+	db.Create(&chatType)
+
+	promptConfig, err := buildPromptConfig(newPromptData(home, chatType, GetActiveTheme(db, 1)))
+	if err != nil {
+		t.Fatalf("buildPromptConfig() error = %v", err)
+	}
+	if promptConfig.ResponseFormat == nil || !contains(promptConfig.Messages[0].Content, "Reply with only a JSON object") {
+		t.Errorf("buildPromptConfig() = %+v, want a response format and JSON instructions", promptConfig)
+	}
+
+	newChat, err := callAndSaveChat(db, config, home, chatType, GetActiveTheme(db, 1))
+	if err != nil {
+		t.Fatalf("callAndSaveChat() error = %v", err)
+	}
+
+	saved, err := GetChat(db, newChat.ID)
+	if err != nil {
+		t.Fatalf("GetChat() error = %v", err)
+	}
+	if saved.Rating < structuredRatingMin || saved.Rating > structuredRatingMax || len(saved.Summary) == 0 {
+		t.Errorf("GetChat() rating = %d summary = %q, want structured columns", saved.Rating, saved.Summary)
+	}
+	if len(saved.Pros) != 1 || len(saved.Cons) != 1 {
+		t.Errorf("GetChat() pros = %v cons = %v, want one of each", saved.Pros, saved.Cons)
+	}
+
+	continued, err := continueChat(db, config, *saved, "What about secondary schools?")
+	if err != nil {
+		t.Fatalf("continueChat() error = %v", err)
+	}
+	if len(continued.Results) != 3 || !contains(continued.Summary, "What about secondary schools?") {
+		t.Errorf("continueChat() = %d results, summary %q, want the follow up summary", len(continued.Results), continued.Summary)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// TrashItem is a soft deleted row, DeletedBy comes from the audit log
+type TrashItem struct {
+	Kind      string
+	ID        uint
+	Title     string
+	DeletedAt time.Time
+	DeletedBy string
+}
+
+// trashKind is a model that goes to the trash when deleted, Title is the SQL for the name it is listed under
+// and Dependents deletes what belongs to it when it is purged
+type trashKind struct {
+	Kind       string
+	Model      interface{}
+	Title      string
+	Dependents func(tx *gorm.DB, ids []uint) error
+}
+
+var trashKinds = []trashKind{
+	{Kind: "home", Model: &Home{}, Title: "coalesce(nullif(title, ''), nullif(clean_address, ''), display_name, '')", Dependents: deleteHomeDependents},
+	{Kind: "shape", Model: &Shape{}, Title: "shape_title"},
+	{Kind: "overlay", Model: &ImageOverlay{}, Title: "name"},
+	{Kind: "search", Model: &FractalSearch{}, Title: "query", Dependents: deleteSearchDependents},
+	{Kind: "factor", Model: &Factor{}, Title: "title", Dependents: deleteFactorDependents},
+}
+
+func getTrashKind(kind string) (trashKind, bool) {
+	for _, k := range trashKinds {
+		if k.Kind == kind {
+			return k, true
+		}
+	}
+	return trashKind{}, false
+}
+
+// GetTrash is everything deleted, most recently deleted first
+func GetTrash(db *gorm.DB) ([]TrashItem, error) {
+	trash := make([]TrashItem, 0)
+	for _, k := range trashKinds {
+		var items []TrashItem
+		err := db.Unscoped().Model(k.Model).Select(fmt.Sprintf("id, %s AS title, deleted_at", k.Title)).
+			Where("deleted_at IS NOT NULL").Scan(&items).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to get deleted %ss: %w", k.Kind, err)
+		}
+		if len(items) == 0 {
+			continue
+		}
+
+		ids := make([]uint, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+		var deletes []AuditLog
+		err = db.Where("action = ? AND kind = ? AND record_id IN ?", AuditDelete, k.Kind, ids).Order("id").Find(&deletes).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to get who deleted %ss: %w", k.Kind, err)
+		}
+		deletedBy := make(map[uint]string)
+		for _, entry := range deletes {
+			deletedBy[entry.RecordID] = entry.Username
+		}
+
+		for _, item := range items {
+			item.Kind = k.Kind
+			item.DeletedBy = deletedBy[item.ID]
+			trash = append(trash, item)
+		}
+	}
+
+	sort.SliceStable(trash, func(i, j int) bool { return trash[i].DeletedAt.After(trash[j].DeletedAt) })
+	return trash, nil
+}
+
+// trashRow loads a row that is in the trash
+func trashRow(db *gorm.DB, kind string, id uint) (trashKind, interface{}, error) {
+	k, ok := getTrashKind(kind)
+	if !ok {
+		return k, nil, fmt.Errorf("Unknown kind %q", kind)
+	}
+
+	row := reflect.New(reflect.TypeOf(k.Model).Elem()).Interface()
+	if err := db.Unscoped().Where("deleted_at IS NOT NULL").First(row, id).Error; err != nil {
+		return k, nil, fmt.Errorf("%s %d is not in the trash", kind, id)
+	}
+	return k, row, nil
+}
+
+// RestoreTrash takes a row back out of the trash, along with everything that still points at it
+func RestoreTrash(db *gorm.DB, kind string, id uint) error {
+	_, row, err := trashRow(db, kind, id)
+	if err != nil {
+		return err
+	}
+	if err := db.Unscoped().Set(auditActionKey, AuditRestore).Model(row).Update("deleted_at", nil).Error; err != nil {
+		return fmt.Errorf("failed to restore %s %d: %w", kind, id, err)
+	}
+	return nil
+}
+
+// PurgeTrash deletes a row in the trash for good, along with everything that belongs to it.
+// The row is returned so an image overlay's file can be removed once it's gone.
+func PurgeTrash(db *gorm.DB, kind string, id uint) (interface{}, error) {
+	var purged interface{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		k, row, err := trashRow(tx, kind, id)
+		if err != nil {
+			return err
+		}
+		if k.Dependents != nil {
+			if err := k.Dependents(tx, []uint{id}); err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Set(auditActionKey, AuditPurge).Delete(row).Error; err != nil {
+			return fmt.Errorf("failed to purge %s %d: %w", kind, id, err)
+		}
+		purged = row
+		return nil
+	})
+	return purged, err
+}
+
+// trashHandler lists the trash, POST /trash/{kind}/{id}/restore restores one row and .../purge deletes it for good
+func trashHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		msg, errMsg := "", ""
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			kind := chi.URLParam(r, "kind")
+			id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+			if err != nil {
+				errMsg = "Invalid ID"
+				break
+			}
+			if strings.HasSuffix(r.URL.Path, "/purge") {
+				purged, err := PurgeTrash(db, kind, uint(id))
+				if err != nil {
+					errMsg = err.Error()
+					break
+				}
+				if overlay, ok := purged.(*ImageOverlay); ok {
+					if err := DeleteImage(envConfig.ImageDir, overlay.FileName); err != nil {
+						log.Printf("failed to delete purged overlay image: %v", err)
+					}
+				}
+				msg = fmt.Sprintf("Deleted %s %d for good", kind, id)
+				break
+			}
+			if err := RestoreTrash(db, kind, uint(id)); err != nil {
+				errMsg = err.Error()
+				break
+			}
+			msg = fmt.Sprintf("Restored %s %d", kind, id)
+		default:
+			warning := warning("Method not allowed")
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		trash, err := GetTrash(db)
+		if err != nil {
+			errMsg = err.Error()
+		}
+		trashList := trashList(trash, msg, errMsg)
+		trashList.Render(GetContext(r), w)
+	}
+}
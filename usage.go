@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LLMPrice is what a model costs in USD, tokens are priced per million
+type LLMPrice struct {
+	PromptPerMillion     float64 `json:"prompt_per_million"`
+	CompletionPerMillion float64 `json:"completion_per_million"`
+	PerRequest           float64 `json:"per_request"`
+}
+
+// defaultLLMPrices covers the perplexity models, local and fake models are free.
+// LLM_PRICE_FILE can add to or override these with a JSON object keyed by model name.
+var defaultLLMPrices = map[string]LLMPrice{
+	"llama-3.1-sonar-small-128k-online": {PromptPerMillion: 0.2, CompletionPerMillion: 0.2, PerRequest: 0.005},
+	"llama-3.1-sonar-large-128k-online": {PromptPerMillion: 1, CompletionPerMillion: 1, PerRequest: 0.005},
+	"llama-3.1-sonar-huge-128k-online":  {PromptPerMillion: 5, CompletionPerMillion: 5, PerRequest: 0.005},
+	defaultFakeModel:                    {},
+}
+
+var ErrLLMBudgetExceeded = errors.New("monthly LLM budget exceeded")
+
+func loadLLMPrices(path string) (map[string]LLMPrice, error) {
+	prices := make(map[string]LLMPrice, len(defaultLLMPrices))
+	for model, price := range defaultLLMPrices {
+		prices[model] = price
+	}
+	if len(path) == 0 {
+		return prices, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read price file: %w", err)
+	}
+
+	var overrides map[string]LLMPrice
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("unable to decode price file: %w", err)
+	}
+	for model, price := range overrides {
+		prices[model] = price
+	}
+	return prices, nil
+}
+
+// llmCost prices a call, unknown models are logged and counted as free
+func llmCost(prices map[string]LLMPrice, model string, usage Usage) float64 {
+	if prices == nil {
+		prices = defaultLLMPrices
+	}
+	price, ok := prices[model]
+	if !ok {
+		log.Printf("no price for llm model %q, counting it as free", model)
+		return 0
+	}
+	return float64(usage.PromptTokens)*price.PromptPerMillion/1e6 +
+		float64(usage.CompletionTokens)*price.CompletionPerMillion/1e6 +
+		price.PerRequest
+}
+
+// recordLLMUsage saves the tokens and cost of a response, link says what the call was for
+func recordLLMUsage(db *gorm.DB, envConfig EnvConfig, response PerplexityResult, config PromptConfig, link LLMUsage) (*LLMUsage, error) {
+	usage := response.SuccessResults.Usage
+	model := response.SuccessResults.Model
+	if len(model) == 0 {
+		model = config.Model
+	}
+
+	link.Provider = config.Provider
+	link.Model = model
+	link.PromptTokens = usage.PromptTokens
+	link.CompletionTokens = usage.CompletionTokens
+	link.TotalTokens = usage.TotalTokens
+	link.Cost = llmCost(envConfig.LLMPrices, model, usage)
+
+	if err := db.Create(&link).Error; err != nil {
+		return nil, fmt.Errorf("failed to save usage: %w", err)
+	}
+	return &link, nil
+}
+
+func usageMonth(t time.Time) string {
+	return t.Format("2006-01")
+}
+
+func GetMonthlySpend(db *gorm.DB, month string) (float64, error) {
+	var spend float64
+	err := db.Model(&LLMUsage{}).Where("substr(created_at, 1, 7) = ?", month).Select("coalesce(sum(cost), 0)").Scan(&spend).Error
+	if err != nil {
+		return 0, err
+	}
+	return spend, nil
+}
+
+// checkLLMBudget refuses new calls once this month's spend reaches LLM_MONTHLY_BUDGET (0 means no budget)
+func checkLLMBudget(db *gorm.DB, envConfig EnvConfig) error {
+	if envConfig.LLMMonthlyBudget <= 0 {
+		return nil
+	}
+
+	// the budget is for the whole site, not each workspace
+	spend, err := GetMonthlySpend(db.WithContext(context.Background()), usageMonth(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to check budget: %w", err)
+	}
+	if spend >= envConfig.LLMMonthlyBudget {
+		return fmt.Errorf("%w: $%.2f spent of $%.2f", ErrLLMBudgetExceeded, spend, envConfig.LLMMonthlyBudget)
+	}
+	return nil
+}
+
+// UsageSummary is the spend for one theme, home, chat type or day
+type UsageSummary struct {
+	Key              string `gorm:"column:group_key"`
+	Name             string
+	Calls            int
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	Cost             float64
+}
+
+var usageGroupColumns = map[string]string{
+	"theme":    "theme_id",
+	"home":     "home_id",
+	"chattype": "chat_type_id",
+	"day":      "substr(created_at, 1, 10)",
+}
+
+// GetUsageSummary totals usage by one of usageGroupColumns, month ("2006-01") is optional
+func GetUsageSummary(db *gorm.DB, groupBy string, month string) ([]UsageSummary, error) {
+	column, ok := usageGroupColumns[groupBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown usage grouping %q", groupBy)
+	}
+
+	query := db.Model(&LLMUsage{}).Select(fmt.Sprintf(`cast(%s as text) as group_key, count(*) as calls,
+		sum(prompt_tokens) as prompt_tokens, sum(completion_tokens) as completion_tokens,
+		sum(total_tokens) as total_tokens, sum(cost) as cost`, column))
+	if len(month) > 0 {
+		query = query.Where("substr(created_at, 1, 7) = ?", month)
+	}
+
+	var summaries []UsageSummary
+	err := query.Group(column).Order("group_key").Scan(&summaries).Error
+	if err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+// UsageReport is every grouping of one month's usage, plus the budget when one is set
+type UsageReport struct {
+	Month     string
+	Spend     float64
+	Budget    float64
+	Groupings []UsageGrouping
+}
+
+type UsageGrouping struct {
+	Title     string
+	Summaries []UsageSummary
+}
+
+func GetUsageReport(db *gorm.DB, envConfig EnvConfig, month string) (*UsageReport, error) {
+	spend, err := GetMonthlySpend(db, month)
+	if err != nil {
+		return nil, err
+	}
+
+	report := UsageReport{
+		Month:  month,
+		Spend:  spend,
+		Budget: envConfig.LLMMonthlyBudget,
+	}
+
+	names := map[string]map[string]string{
+		"theme":    {},
+		"home":     {},
+		"chattype": {},
+	}
+	themes, err := GetThemes(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, theme := range themes {
+		names["theme"][fmt.Sprintf("%d", theme.ID)] = theme.Name
+	}
+	for _, home := range GetHomes(db) {
+		names["home"][fmt.Sprintf("%d", home.ID)] = strings.TrimSpace(home.CleanAddress + " " + home.CleanSuburb)
+	}
+	var chatTypes []ChatType
+	if err := db.Find(&chatTypes).Error; err != nil {
+		return nil, err
+	}
+	for _, chatType := range chatTypes {
+		names["chattype"][fmt.Sprintf("%d", chatType.ID)] = chatType.Name
+	}
+
+	titles := map[string]string{"theme": "Theme", "home": "Home", "chattype": "Chat Type", "day": "Day"}
+	groupings := []string{"theme", "home", "chattype", "day"}
+	for _, groupBy := range groupings {
+		summaries, err := GetUsageSummary(db, groupBy, month)
+		if err != nil {
+			return nil, err
+		}
+		for i := range summaries {
+			summaries[i].Name = names[groupBy][summaries[i].Key]
+		}
+		if groupBy != "day" {
+			sort.SliceStable(summaries, func(i, j int) bool { return summaries[i].Cost > summaries[j].Cost })
+		}
+		report.Groupings = append(report.Groupings, UsageGrouping{
+			Title:     titles[groupBy],
+			Summaries: summaries,
+		})
+	}
+	return &report, nil
+}
+
+func usageHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		switch r.Method {
+		case http.MethodGet:
+			month := r.URL.Query().Get("month")
+			if len(month) == 0 {
+				month = usageMonth(time.Now())
+			}
+			if _, err := time.Parse("2006-01", month); err != nil {
+				warning := warning("Invalid month, use YYYY-MM")
+				warning.Render(GetContext(r), w)
+				return
+			}
+
+			report, err := GetUsageReport(db, envConfig, month)
+			if err != nil {
+				warning := warning(fmt.Sprintf("Failed to get usage - %v", err))
+				warning.Render(GetContext(r), w)
+				return
+			}
+
+			usageReport := usageReport(*report)
+			usageReport.Render(GetContext(r), w)
+			return
+		}
+	}
+}
+
+// usageLabel sums the usage on a chat or fractal search for display
+func usageLabel(usages []LLMUsage) string {
+	tokens := 0
+	cost := 0.0
+	for _, usage := range usages {
+		tokens += usage.TotalTokens
+		cost += usage.Cost
+	}
+	return fmt.Sprintf("%d tokens, $%.4f", tokens, cost)
+}
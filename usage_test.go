@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLLMCost(t *testing.T) {
+	t.Parallel()
+
+	prices := map[string]LLMPrice{
+		"per-token":   {PromptPerMillion: 1, CompletionPerMillion: 2},
+		"per-request": {PerRequest: 0.005},
+	}
+
+	tests := []struct {
+		name  string
+		model string
+		usage Usage
+		want  float64
+	}{
+		{
+			name:  "Tokens are priced per million",
+			model: "per-token",
+			usage: Usage{PromptTokens: 1000, CompletionTokens: 500, TotalTokens: 1500},
+			want:  0.002,
+		},
+		{
+			name:  "Request fee without tokens",
+			model: "per-request",
+			usage: Usage{},
+			want:  0.005,
+		},
+		{
+			name:  "Unknown models are free",
+			model: "not-priced",
+			usage: Usage{PromptTokens: 1000, CompletionTokens: 1000, TotalTokens: 2000},
+			want:  0,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := llmCost(prices, tt.model, tt.usage); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("llmCost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLLMUsageBudget(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{
+		DBUrl:            ":memory:",
+		LLMPrices:        map[string]LLMPrice{defaultFakeModel: {PerRequest: 1}},
+		LLMMonthlyBudget: 1.5,
+	}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	home := Home{Lat: -43.53, Lng: 172.58, CleanAddress: "7 Middleton Road, Riccarton", CleanSuburb: "Riccarton"}
+	db.Create(&home)
+
+	chatType := ChatType{Name: "Flooding", Prompt: "Does {address} flood?", ThemeID: 1, LLMProvider: ProviderFake}
+	db.Create(&chatType)
+
+	theme := GetActiveTheme(db, 1)
+
+	first, err := callAndSaveChat(db, config, home, chatType, theme)
+	if err != nil {
+		t.Fatalf("callAndSaveChat() error = %v", err)
+	}
+	if len(first.Usages) != 1 || first.Usages[0].TotalTokens == 0 || first.Usages[0].Cost != 1 || first.Usages[0].Model != defaultFakeModel {
+		t.Errorf("callAndSaveChat() usages = %+v, want one priced usage row", first.Usages)
+	}
+
+	if _, err := continueChat(db, config, *first, "What about 2022?"); err != nil {
+		t.Fatalf("continueChat() error = %v", err)
+	}
+
+	_, err = callAndSaveChat(db, config, home, chatType, theme)
+	if !errors.Is(err, ErrLLMBudgetExceeded) {
+		t.Errorf("callAndSaveChat() over budget error = %v, want ErrLLMBudgetExceeded", err)
+	}
+
+	saved, err := GetChat(db, first.ID)
+	if err != nil {
+		t.Fatalf("GetChat() error = %v", err)
+	}
+	if len(saved.Usages) != 2 {
+		t.Errorf("GetChat() usages = %d, want 2", len(saved.Usages))
+	}
+
+	report, err := GetUsageReport(db, config, usageMonth(time.Now()))
+	if err != nil {
+		t.Fatalf("GetUsageReport() error = %v", err)
+	}
+	if report.Spend != 2 || len(report.Groupings) != 4 {
+		t.Fatalf("GetUsageReport() = %+v, want $2 spend over 4 groupings", report)
+	}
+	for _, grouping := range report.Groupings {
+		if len(grouping.Summaries) != 1 || grouping.Summaries[0].Calls != 2 || grouping.Summaries[0].Cost != 2 {
+			t.Errorf("%s grouping = %+v, want one row with 2 calls", grouping.Title, grouping.Summaries)
+		}
+	}
+	if name := report.Groupings[2].Summaries[0].Name; name != "Flooding" {
+		t.Errorf("chat type grouping name = %q, want Flooding", name)
+	}
+
+	rec := httptest.NewRecorder()
+	usageHandler(db, config).ServeHTTP(rec, httptest.NewRequest("GET", "/usage", nil))
+	if !contains(rec.Body.String(), "Monthly budget reached") {
+		t.Errorf("GET /usage body = %q, want the budget warning", rec.Body.String())
+	}
+}
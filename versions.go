@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+func newChatTypeVersion(chatType ChatType, version int) ChatTypeVersion {
+	return ChatTypeVersion{
+		WorkspaceID:               chatType.WorkspaceID,
+		ChatTypeID:                chatType.ID,
+		Version:                   version,
+		Name:                      chatType.Name,
+		Prompt:                    chatType.Prompt,
+		ThemeID:                   chatType.ThemeID,
+		AddressType:               chatType.AddressType,
+		StartSystemPromptOverride: chatType.StartSystemPromptOverride,
+		LLMProvider:               chatType.LLMProvider,
+		LLMModel:                  chatType.LLMModel,
+		OutputMode:                chatType.OutputMode,
+	}
+}
+
+// matches is true when the ChatType would still render the same prompt as this version
+func (v ChatTypeVersion) matches(chatType ChatType) bool {
+	snapshot := newChatTypeVersion(chatType, v.Version)
+	snapshot.ID, snapshot.WorkspaceID, snapshot.CreatedAt = v.ID, v.WorkspaceID, v.CreatedAt
+	return snapshot == v
+}
+
+// asChatType is the ChatType as it was at this version, ready to pass to callAndSaveChat
+func (v ChatTypeVersion) asChatType() ChatType {
+	return ChatType{
+		ID:                        v.ChatTypeID,
+		WorkspaceID:               v.WorkspaceID,
+		Name:                      v.Name,
+		Prompt:                    v.Prompt,
+		ThemeID:                   v.ThemeID,
+		AddressType:               v.AddressType,
+		StartSystemPromptOverride: v.StartSystemPromptOverride,
+		LLMProvider:               v.LLMProvider,
+		LLMModel:                  v.LLMModel,
+		OutputMode:                v.OutputMode,
+		VersionID:                 v.ID,
+	}
+}
+
+// saveChatTypeVersion points chatType.VersionID at its latest version, saving a new one if the prompt fields changed.
+// The caller saves the ChatType.
+func saveChatTypeVersion(tx *gorm.DB, chatType *ChatType) error {
+	var latest ChatTypeVersion
+	err := tx.Where("chat_type_id = ?", chatType.ID).Order("version desc").First(&latest).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("failed to get chat type version: %w", err)
+	}
+	if err == nil && latest.matches(*chatType) {
+		chatType.VersionID = latest.ID
+		return nil
+	}
+
+	version := newChatTypeVersion(*chatType, latest.Version+1)
+	if err := tx.Create(&version).Error; err != nil {
+		return fmt.Errorf("failed to save chat type version: %w", err)
+	}
+	chatType.VersionID = version.ID
+	return nil
+}
+
+// InitChatTypeVersions gives chat types created before versioning their first version
+func InitChatTypeVersions(db *gorm.DB) error {
+	var chatTypes []ChatType
+	if err := db.Where("version_id IS NULL OR version_id = 0").Find(&chatTypes).Error; err != nil {
+		log.Printf("failed to get unversioned chat types: %v", err)
+		return err
+	}
+
+	for _, chatType := range chatTypes {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := saveChatTypeVersion(tx, &chatType); err != nil {
+				return err
+			}
+			return tx.Model(&chatType).Update("version_id", chatType.VersionID).Error
+		})
+		if err != nil {
+			log.Printf("failed to version chat type %d: %v", chatType.ID, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func GetChatTypeVersion(db *gorm.DB, id uint) (*ChatTypeVersion, error) {
+	var version ChatTypeVersion
+	err := db.First(&version, id)
+	if err.Error != nil {
+		return nil, err.Error
+	}
+	return &version, nil
+}
+
+// GetChatTypeVersions returns every version of a chat type, newest first
+func GetChatTypeVersions(db *gorm.DB, chatTypeID uint) ([]ChatTypeVersion, error) {
+	var versions []ChatTypeVersion
+	err := db.Where("chat_type_id = ?", chatTypeID).Order("version desc").Find(&versions)
+	if err.Error != nil {
+		return nil, err.Error
+	}
+	return versions, nil
+}
+
+// GetChatTypeForChat is the chat type as it was when the chat was created,
+// chats from before versioning get the chat type as it is now
+func GetChatTypeForChat(db *gorm.DB, c Chat) (*ChatType, error) {
+	if c.ChatTypeVersionID == 0 {
+		return GetChatType(db, c.ChatType)
+	}
+
+	version, err := GetChatTypeVersion(db, c.ChatTypeVersionID)
+	if err != nil {
+		return nil, err
+	}
+	chatType := version.asChatType()
+	return &chatType, nil
+}
+
+// EnqueueVersionJobs queues every version against every home in a single batch
+func EnqueueVersionJobs(db *gorm.DB, themeID uint, versions []ChatTypeVersion, homes []Home) (string, []Job, error) {
+	batchID := uuid.New().String()
+	now := time.Now()
+
+	jobs := make([]Job, 0, len(versions)*len(homes))
+	for _, home := range homes {
+		for _, version := range versions {
+			jobs = append(jobs, Job{
+				BatchID:           batchID,
+				Kind:              JobKindChat,
+				Status:            JobQueued,
+				ThemeID:           themeID,
+				HomeID:            home.ID,
+				ChatTypeID:        version.ChatTypeID,
+				ChatTypeVersionID: version.ID,
+				MaxAttempts:       defaultJobMaxAttempts,
+				RunAt:             now,
+			})
+		}
+	}
+
+	jobs, err := CreateJobs(db, jobs)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to queue jobs: %w", err)
+	}
+	return batchID, jobs, nil
+}
+
+// VersionComparison lines up the latest chat from two versions of a chat type for each home
+type VersionComparison struct {
+	ChatType ChatType
+	Versions []ChatTypeVersion
+	A        ChatTypeVersion
+	B        ChatTypeVersion
+	Homes    []Home
+	Rows     []VersionComparisonRow
+	BatchID  string
+	Finished bool
+	Changed  int
+}
+
+type VersionComparisonRow struct {
+	Home Home
+	A    *Chat
+	B    *Chat
+}
+
+// GetVersionComparison compares versions a and b, on homeIDs when given or otherwise every home either has been run on
+func GetVersionComparison(db *gorm.DB, chatTypeID uint, aID uint, bID uint, homeIDs []uint) (*VersionComparison, error) {
+	chatType, err := GetChatType(db, chatTypeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chat type %d: %w", chatTypeID, err)
+	}
+	versions, err := GetChatTypeVersions(db, chatTypeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get versions: %w", err)
+	}
+
+	cmp := VersionComparison{
+		ChatType: *chatType,
+		Versions: versions,
+		Homes:    GetHomes(db),
+		Rows:     make([]VersionComparisonRow, 0),
+		Finished: true,
+	}
+
+	// default to the current version against the one before it
+	if aID == 0 && len(versions) > 1 {
+		aID = versions[1].ID
+	}
+	if bID == 0 && len(versions) > 0 {
+		bID = versions[0].ID
+	}
+	for _, v := range versions {
+		if v.ID == aID {
+			cmp.A = v
+		}
+		if v.ID == bID {
+			cmp.B = v
+		}
+	}
+	if (aID != 0 && cmp.A.ID == 0) || (bID != 0 && cmp.B.ID == 0) {
+		return nil, fmt.Errorf("versions %d and %d are not both versions of %s", aID, bID, chatType.Name)
+	}
+
+	var chats []Chat
+	err = db.Preload("Results").Where("chat_type_version_id IN ?", []uint{cmp.A.ID, cmp.B.ID}).
+		Where("status NOT IN ?", []string{"pending", "streaming", "failed"}).
+		Order("id").Find(&chats).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chats: %w", err)
+	}
+
+	latest := make(map[uint]map[uint]Chat)
+	for _, c := range chats {
+		if latest[c.HomeID] == nil {
+			latest[c.HomeID] = make(map[uint]Chat)
+		}
+		latest[c.HomeID][c.ChatTypeVersionID] = c
+	}
+
+	include := make(map[uint]bool)
+	for _, id := range homeIDs {
+		include[id] = true
+	}
+	for _, home := range cmp.Homes {
+		byVersion, ran := latest[home.ID]
+		if (len(homeIDs) > 0 && !include[home.ID]) || (len(homeIDs) == 0 && !ran) {
+			continue
+		}
+
+		row := VersionComparisonRow{Home: home}
+		if c, ok := byVersion[cmp.A.ID]; ok {
+			row.A = &c
+		}
+		if c, ok := byVersion[cmp.B.ID]; ok {
+			row.B = &c
+		}
+		if row.A != nil && row.B != nil && row.A.Rating != row.B.Rating {
+			cmp.Changed++
+		}
+		cmp.Rows = append(cmp.Rows, row)
+	}
+	return &cmp, nil
+}
+
+func parseUintParams(values []string) ([]uint, error) {
+	ids := make([]uint, 0, len(values))
+	for _, value := range values {
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", value)
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+// chatTypeCompareHandler shows two versions of a chat type side by side, POST runs both against the chosen homes
+func chatTypeCompareHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := workspaceDB(db, r)
+		chatTypeID, err := strconv.Atoi(chi.URLParam(r, "chatTypeId"))
+		if err != nil {
+			warning := warning("Invalid chatTypeId")
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			warning := warning("chatTypeCompareHandler - Unable to parse form data")
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		aID, _ := strconv.Atoi(r.Form.Get("a"))
+		bID, _ := strconv.Atoi(r.Form.Get("b"))
+		homeIDs, err := parseUintParams(r.Form["homeId"])
+		if err != nil {
+			warning := warning(err.Error())
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			cmp, err := GetVersionComparison(db, uint(chatTypeID), uint(aID), uint(bID), homeIDs)
+			if err != nil {
+				warning := warning(fmt.Sprintf("Failed to compare versions - %v", err))
+				warning.Render(GetContext(r), w)
+				return
+			}
+
+			if batchID := r.Form.Get("batch"); len(batchID) > 0 {
+				progress, err := GetJobProgress(db, batchID)
+				if err != nil {
+					warning := warning(fmt.Sprintf("Failed to get job progress - %v", err))
+					warning.Render(GetContext(r), w)
+					return
+				}
+				cmp.BatchID = batchID
+				cmp.Finished = progress.Finished
+			}
+
+			versionComparison := versionComparison(*cmp, homeIDs)
+			versionComparison.Render(GetContext(r), w)
+			return
+		case http.MethodPost:
+			if aID == bID {
+				warning := warning("Choose two different versions to compare")
+				warning.Render(GetContext(r), w)
+				return
+			}
+			if len(homeIDs) == 0 {
+				warning := warning("Choose at least one home to run the comparison on")
+				warning.Render(GetContext(r), w)
+				return
+			}
+
+			cmp, err := GetVersionComparison(db, uint(chatTypeID), uint(aID), uint(bID), homeIDs)
+			if err != nil {
+				warning := warning(fmt.Sprintf("Failed to compare versions - %v", err))
+				warning.Render(GetContext(r), w)
+				return
+			}
+
+			homes := make([]Home, 0, len(cmp.Rows))
+			for _, row := range cmp.Rows {
+				homes = append(homes, row.Home)
+			}
+			batchID, _, err := EnqueueVersionJobs(db, cmp.ChatType.ThemeID, []ChatTypeVersion{cmp.A, cmp.B}, homes)
+			if err != nil {
+				warning := warning(err.Error())
+				warning.Render(GetContext(r), w)
+				return
+			}
+
+			cmp.BatchID = batchID
+			cmp.Finished = false
+			versionComparison := versionComparison(*cmp, homeIDs)
+			versionComparison.Render(GetContext(r), w)
+			return
+		default:
+			warning := warning("Method not allowed")
+			warning.Render(GetContext(r), w)
+			return
+		}
+	}
+}
+
+func comparisonURL(cmp VersionComparison, homeIDs []uint) string {
+	query := url.Values{}
+	query.Set("a", strconv.FormatUint(uint64(cmp.A.ID), 10))
+	query.Set("b", strconv.FormatUint(uint64(cmp.B.ID), 10))
+	query.Set("batch", cmp.BatchID)
+	for _, id := range homeIDs {
+		query.Add("homeId", strconv.FormatUint(uint64(id), 10))
+	}
+	return fmt.Sprintf("/chattype/%d/compare?%s", cmp.ChatType.ID, query.Encode())
+}
+
+func containsUint(values []uint, value uint) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestChatTypeVersions(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	home := Home{Lat: -43.53, Lng: 172.58, CleanAddress: "7 Middleton Road, Riccarton", CleanSuburb: "Riccarton"}
+	db.Create(&home)
+
+	chatType, err := CreateChatType(db, ChatType{Name: "Flooding", Prompt: "Does {address} flood?", ThemeID: 1, LLMProvider: ProviderFake})
+	if err != nil {
+		t.Fatalf("CreateChatType() error = %v", err)
+	}
+	first := chatType.VersionID
+	if first == 0 {
+		t.Fatalf("CreateChatType() VersionID = 0, want a first version")
+	}
+
+	oldChat, err := callAndSaveChat(db, config, home, *chatType, GetActiveTheme(db, 1))
+	if err != nil {
+		t.Fatalf("callAndSaveChat() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		prompt      string
+		wantVersion int
+	}{
+		{
+			name:        "Saving without changes keeps the version",
+			prompt:      "Does {address} flood?",
+			wantVersion: 1,
+		},
+		{
+			name:        "Changing the prompt adds a version",
+			prompt:      "Has {address} flooded in the last 20 years?",
+			wantVersion: 2,
+		},
+		{
+			name:        "Changing it back is still a new version",
+			prompt:      "Does {address} flood?",
+			wantVersion: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			updated := *chatType
+			updated.Prompt = tt.prompt
+			saved, err := UpdateChatType(db, updated)
+			if err != nil {
+				t.Fatalf("UpdateChatType() error = %v", err)
+			}
+
+			version, err := GetChatTypeVersion(db, saved.VersionID)
+			if err != nil {
+				t.Fatalf("GetChatTypeVersion() error = %v", err)
+			}
+			if version.Version != tt.wantVersion || version.Prompt != tt.prompt {
+				t.Errorf("UpdateChatType() version = v%d %q, want v%d %q", version.Version, version.Prompt, tt.wantVersion, tt.prompt)
+			}
+		})
+	}
+
+	saved, err := GetChat(db, oldChat.ID)
+	if err != nil {
+		t.Fatalf("GetChat() error = %v", err)
+	}
+	if saved.ChatTypeVersionID != first || saved.Prompt != "Does 7 Middleton Road, Riccarton flood?" || len(saved.SystemPrompt) == 0 {
+		t.Errorf("GetChat() = version %d, prompt %q, system prompt %q, want version %d and the rendered prompts", saved.ChatTypeVersionID, saved.Prompt, saved.SystemPrompt, first)
+	}
+
+	chatTypeForChat, err := GetChatTypeForChat(db, *saved)
+	if err != nil {
+		t.Fatalf("GetChatTypeForChat() error = %v", err)
+	}
+	if chatTypeForChat.VersionID != first || chatTypeForChat.Prompt != "Does {address} flood?" {
+		t.Errorf("GetChatTypeForChat() = %+v, want the first version", chatTypeForChat)
+	}
+}
+
+func TestChatTypeCompareHandler(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	homes := []Home{
+		{Lat: -43.53, Lng: 172.58, Title: "Middleton", CleanAddress: "7 Middleton Road, Riccarton"},
+		{Lat: -43.52, Lng: 172.57, Title: "Ilam", CleanAddress: "12 Ilam Road, Ilam"},
+		{Lat: -43.51, Lng: 172.56, Title: "Fendalton", CleanAddress: "3 Fendalton Road, Fendalton"},
+	}
+	db.Create(&homes)
+
+	chatType, err := CreateChatType(db, ChatType{Name: "Flooding", Prompt: "Does {address} flood?", ThemeID: 1, LLMProvider: ProviderFake})
+	if err != nil {
+		t.Fatalf("CreateChatType() error = %v", err)
+	}
+	v1 := chatType.VersionID
+	chatType.Prompt = "Has {address} flooded in the last 20 years?"
+	chatType, err = UpdateChatType(db, *chatType)
+	if err != nil {
+		t.Fatalf("UpdateChatType() error = %v", err)
+	}
+	v2 := chatType.VersionID
+
+	r := chi.NewRouter()
+	r.Get("/chattype/{chatTypeId:[0-9]+}/compare", chatTypeCompareHandler(db))
+	r.Post("/chattype/{chatTypeId:[0-9]+}/compare", chatTypeCompareHandler(db))
+	compareURL := fmt.Sprintf("/chattype/%d/compare", chatType.ID)
+
+	form := url.Values{
+		"a":      {fmt.Sprintf("%d", v1)},
+		"b":      {fmt.Sprintf("%d", v1)},
+		"homeId": {"1", "2"},
+	}
+	req := httptest.NewRequest("POST", compareURL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if !contains(rec.Body.String(), "two different versions") {
+		t.Errorf("POST compare with the same version body = %q, want a warning", rec.Body.String())
+	}
+
+	form.Set("b", fmt.Sprintf("%d", v2))
+	req = httptest.NewRequest("POST", compareURL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if !contains(rec.Body.String(), "every 2s") {
+		t.Errorf("POST compare body = %q, want a polling comparison", rec.Body.String())
+	}
+
+	jobs, err := GetJobs(db, "", 0)
+	if err != nil || len(jobs) != 4 {
+		t.Fatalf("GetJobs() = %d jobs, err %v, want 2 versions x 2 homes", len(jobs), err)
+	}
+
+	queue := NewJobQueue(db, config, 1)
+	for i := 0; i < 10; i++ {
+		ran, err := queue.runNext()
+		if err != nil {
+			t.Fatalf("runNext() error = %v", err)
+		}
+		if !ran {
+			break
+		}
+	}
+
+	cmp, err := GetVersionComparison(db, chatType.ID, v1, v2, nil)
+	if err != nil {
+		t.Fatalf("GetVersionComparison() error = %v", err)
+	}
+	if len(cmp.Rows) != 2 {
+		t.Fatalf("GetVersionComparison() = %d rows, want the 2 homes that were run", len(cmp.Rows))
+	}
+	for _, row := range cmp.Rows {
+		if row.A == nil || row.B == nil {
+			t.Fatalf("GetVersionComparison() row %s = %+v, want chats from both versions", row.Home.Title, row)
+		}
+		if row.A.ChatTypeVersionID != v1 || !contains(row.A.Prompt, "Does") || row.B.ChatTypeVersionID != v2 || !contains(row.B.Prompt, "20 years") {
+			t.Errorf("GetVersionComparison() row %s = %q / %q, want each version's prompt", row.Home.Title, row.A.Prompt, row.B.Prompt)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprintf("%s?a=%d&b=%d&batch=%s", compareURL, v1, v2, jobs[0].BatchID), nil))
+	if contains(rec.Body.String(), "every 2s") || !contains(rec.Body.String(), "of 2 homes") {
+		t.Errorf("GET compare body = %q, want the finished comparison of the homes that were run", rec.Body.String())
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	defaultWorkspaceID = 1
+	workspaceCookie    = "workspaceId"
+	inviteDuration     = 7 * 24 * time.Hour
+	maxWorkspaceName   = 60
+
+	workspaceKey       contextKey = "Workspace"
+	workspaceRecordKey contextKey = "WorkspaceRecord"
+)
+
+// workspaceModels are the tables with a WorkspaceID. Shape types and kinds, users and sessions are shared by every workspace.
+var workspaceModels = []interface{}{
+	&Factor{}, &Theme{}, &Home{}, &ScoreWeight{}, &HomeFactorRating{}, &Shape{}, &ImageOverlay{},
+	&ChatType{}, &ChatTypeVersion{}, &Chat{}, &ChatResult{}, &Citation{}, &RelatedQuestion{},
+	&FractalSearch{}, &Point{}, &Message{}, &FractalSearchResultGroup{}, &Job{}, &LLMUsage{}, &AuditLog{},
+}
+
+// withWorkspace scopes every query made with db.WithContext(ctx) to the workspace
+func withWorkspace(ctx context.Context, workspaceID uint) context.Context {
+	return context.WithValue(ctx, workspaceKey, workspaceID)
+}
+
+// workspaceFromContext is false when there is no workspace, queries are then unscoped, as for startup and migrations
+func workspaceFromContext(ctx context.Context) (uint, bool) {
+	if ctx == nil {
+		return 0, false
+	}
+	workspaceID, ok := ctx.Value(workspaceKey).(uint)
+	return workspaceID, ok
+}
+
+// workspaceDB scopes db to the request's workspace
+func workspaceDB(db *gorm.DB, r *http.Request) *gorm.DB {
+	return db.WithContext(r.Context())
+}
+
+// registerWorkspaceScope adds callbacks that filter every query, update and delete of a workspace model by the
+// context's workspace and set it on created rows
+func registerWorkspaceScope(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Query().Before("gorm:query").Register("workspace:query", scopeWorkspaceWhere); err != nil {
+		return err
+	}
+	if err := callbacks.Row().Before("gorm:row").Register("workspace:row", scopeWorkspaceWhere); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().Before("gorm:delete").Register("workspace:delete", scopeWorkspaceWhere); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("gorm:update").Register("workspace:update", scopeWorkspaceUpdate); err != nil {
+		return err
+	}
+	return callbacks.Create().Before("gorm:create").Register("workspace:create", scopeWorkspaceCreate)
+}
+
+// workspaceField is the statement's WorkspaceID field and the workspace to scope it to, nil when it isn't scoped
+func workspaceField(db *gorm.DB) (*schema.Field, uint) {
+	stmt := db.Statement
+	if stmt.Schema == nil {
+		return nil, 0
+	}
+	workspaceID, ok := workspaceFromContext(stmt.Context)
+	if !ok {
+		return nil, 0
+	}
+	field := stmt.Schema.LookUpField("WorkspaceID")
+	if field == nil {
+		return nil, 0
+	}
+	return field, workspaceID
+}
+
+func workspaceColumn() clause.Column {
+	return clause.Column{Table: clause.CurrentTable, Name: "workspace_id"}
+}
+
+func scopeWorkspaceWhere(db *gorm.DB) {
+	if field, workspaceID := workspaceField(db); field != nil {
+		db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{clause.Eq{Column: workspaceColumn(), Value: workspaceID}}})
+	}
+}
+
+func scopeWorkspaceUpdate(db *gorm.DB) {
+	scopeWorkspaceWhere(db)
+	// Save writes every column, keep the row in its workspace
+	setWorkspaceField(db)
+}
+
+func scopeWorkspaceCreate(db *gorm.DB) {
+	field, workspaceID := workspaceField(db)
+	if field == nil {
+		return
+	}
+	setWorkspaceField(db)
+
+	// upserts, including Save of a missing row, must not take over a row from another workspace
+	if c, ok := db.Statement.Clauses["ON CONFLICT"]; ok {
+		if onConflict, ok := c.Expression.(clause.OnConflict); ok && !onConflict.DoNothing {
+			onConflict.Where.Exprs = append(onConflict.Where.Exprs, clause.Eq{Column: clause.Column{Table: db.Statement.Table, Name: "workspace_id"}, Value: workspaceID})
+			db.Statement.AddClause(onConflict)
+		}
+	}
+}
+
+// setWorkspaceField sets WorkspaceID on the struct, or every struct in the slice, being saved
+func setWorkspaceField(db *gorm.DB) {
+	field, workspaceID := workspaceField(db)
+	if field == nil {
+		return
+	}
+	stmt := db.Statement
+	value := reflect.Indirect(stmt.ReflectValue)
+	switch value.Kind() {
+	case reflect.Struct:
+		if err := field.Set(stmt.Context, value, workspaceID); err != nil {
+			db.AddError(err)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err := field.Set(stmt.Context, reflect.Indirect(value.Index(i)), workspaceID); err != nil {
+				db.AddError(err)
+			}
+		}
+	}
+}
+
+// InitWorkspaces makes sure the default workspace exists. Rows from before workspaces, or created at startup,
+// belong to it, and the first time it is created every existing user joins it.
+func InitWorkspaces(db *gorm.DB) error {
+	var workspace Workspace
+	err := db.First(&workspace, defaultWorkspaceID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		workspace = Workspace{ID: defaultWorkspaceID, Name: "Default"}
+		if err := db.Create(&workspace).Error; err != nil {
+			return fmt.Errorf("failed to create default workspace: %w", err)
+		}
+
+		var users []User
+		if err := db.Find(&users).Error; err != nil {
+			return fmt.Errorf("failed to get users: %w", err)
+		}
+		for _, user := range users {
+			if err := AddWorkspaceMember(db, defaultWorkspaceID, user.ID); err != nil {
+				return err
+			}
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to get default workspace: %w", err)
+	}
+
+	for _, model := range workspaceModels {
+		if err := db.Unscoped().Model(model).Where("workspace_id = 0").Update("workspace_id", defaultWorkspaceID).Error; err != nil {
+			return fmt.Errorf("failed to move rows to the default workspace: %w", err)
+		}
+	}
+	return nil
+}
+
+// CreateWorkspace adds a workspace with the user as its first member and a default theme
+func CreateWorkspace(db *gorm.DB, name string, userID uint) (*Workspace, error) {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 || len(name) > maxWorkspaceName {
+		return nil, fmt.Errorf("Workspace name must be 1 to %d characters", maxWorkspaceName)
+	}
+
+	workspace := Workspace{Name: name}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&workspace).Error; err != nil {
+			return err
+		}
+		if err := AddWorkspaceMember(tx, workspace.ID, userID); err != nil {
+			return err
+		}
+		inWorkspace := tx.WithContext(withWorkspace(tx.Statement.Context, workspace.ID))
+		return inWorkspace.Create(&Theme{Name: "Default"}).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace: %w", err)
+	}
+	return &workspace, nil
+}
+
+func AddWorkspaceMember(db *gorm.DB, workspaceID uint, userID uint) error {
+	member := WorkspaceMember{WorkspaceID: workspaceID, UserID: userID}
+	err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error
+	if err != nil {
+		return fmt.Errorf("failed to add user %d to workspace %d: %w", userID, workspaceID, err)
+	}
+	return nil
+}
+
+// GetUserWorkspaces is every workspace the user is a member of, oldest first
+func GetUserWorkspaces(db *gorm.DB, userID uint) ([]Workspace, error) {
+	var workspaces []Workspace
+	err := db.Where("id IN (?)", db.Model(&WorkspaceMember{}).Select("workspace_id").Where("user_id = ?", userID)).Order("id").Find(&workspaces).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspaces: %w", err)
+	}
+	return workspaces, nil
+}
+
+// CreateInvite makes an invite link token for the workspace, anyone with it can join until it expires
+func CreateInvite(db *gorm.DB, workspaceID uint, userID uint) (string, error) {
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to create invite token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+
+	invite := WorkspaceInvite{
+		WorkspaceID: workspaceID,
+		TokenHash:   hashSessionToken(token),
+		CreatedByID: userID,
+		ExpiresAt:   time.Now().Add(inviteDuration),
+	}
+	if err := db.Create(&invite).Error; err != nil {
+		return "", fmt.Errorf("failed to save invite: %w", err)
+	}
+	return token, nil
+}
+
+// GetInviteWorkspace is the workspace an unexpired invite token is for
+func GetInviteWorkspace(db *gorm.DB, token string) (*Workspace, error) {
+	var invite WorkspaceInvite
+	err := db.Where("token_hash = ? AND expires_at > ?", hashSessionToken(token), time.Now()).First(&invite).Error
+	if err != nil {
+		return nil, errors.New("This invite link is invalid or has expired")
+	}
+	var workspace Workspace
+	if err := db.First(&workspace, invite.WorkspaceID).Error; err != nil {
+		return nil, fmt.Errorf("failed to get workspace: %w", err)
+	}
+	return &workspace, nil
+}
+
+// AcceptInvite adds the user to the invite's workspace
+func AcceptInvite(db *gorm.DB, token string, userID uint) (*Workspace, error) {
+	workspace, err := GetInviteWorkspace(db, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := AddWorkspaceMember(db, workspace.ID, userID); err != nil {
+		return nil, err
+	}
+	return workspace, nil
+}
+
+func currentWorkspace(ctx context.Context) *Workspace {
+	workspace, _ := ctx.Value(workspaceRecordKey).(*Workspace)
+	return workspace
+}
+
+// loadWorkspace picks the logged in user's workspace, from the workspaceId cookie when they are a member of it.
+// API requests pick it with an X-Workspace-ID header, which must be one of theirs.
+func loadWorkspace(db *gorm.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := userFromContext(r.Context())
+			if user == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			workspaces, err := GetUserWorkspaces(db, user.ID)
+			if err != nil || len(workspaces) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			workspace := workspaces[0]
+			if cookie, err := r.Cookie(workspaceCookie); err == nil {
+				for _, ws := range workspaces {
+					if strconv.FormatUint(uint64(ws.ID), 10) == cookie.Value {
+						workspace = ws
+					}
+				}
+			}
+			if header := r.Header.Get("X-Workspace-ID"); len(header) > 0 {
+				found := false
+				for _, ws := range workspaces {
+					if strconv.FormatUint(uint64(ws.ID), 10) == header {
+						workspace, found = ws, true
+					}
+				}
+				if !found {
+					writeAPIError(w, http.StatusForbidden, fmt.Sprintf("You aren't a member of workspace %s", header))
+					return
+				}
+			}
+
+			ctx := withWorkspace(r.Context(), workspace.ID)
+			ctx = context.WithValue(ctx, workspaceRecordKey, &workspace)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// requireWorkspace keeps everything but logging in and joining or creating a workspace to workspace members
+func requireWorkspace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if path == "/login" || path == "/logout" || path == "/health" || strings.HasPrefix(path, "/invite/") ||
+			path == apiPrefix+"/login" || path == apiPrefix+"/openapi.json" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := workspaceFromContext(r.Context()); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if userFromContext(r.Context()) == nil {
+			denyLogin(w, r)
+			return
+		}
+		if path == "/workspaces" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isAPIRequest(r) {
+			writeAPIError(w, http.StatusForbidden, "Create or join a workspace at /workspaces first")
+			return
+		}
+		http.Redirect(w, r, "/workspaces", http.StatusSeeOther)
+	})
+}
+
+// switchWorkspace makes the workspace current for the browser, the theme cookie is reset to its first theme
+func switchWorkspace(db *gorm.DB, w http.ResponseWriter, workspaceID uint) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   workspaceCookie,
+		Value:  strconv.FormatUint(uint64(workspaceID), 10),
+		Path:   "/",
+		MaxAge: 60 * 60 * 24 * 365,
+	})
+
+	theme := GetActiveTheme(db.WithContext(withWorkspace(context.Background(), workspaceID)), 0)
+	http.SetCookie(w, &http.Cookie{
+		Name:   "themeId",
+		Value:  strconv.FormatUint(uint64(theme.ID), 10),
+		Path:   "/",
+		MaxAge: 60 * 60 * 24 * 365,
+	})
+}
+
+// workspacesHandler lists the user's workspaces, creates new ones, switches between them and makes invite links
+func workspacesHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			denyLogin(w, r)
+			return
+		}
+
+		msg, errMsg, inviteURL := "", "", ""
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				errMsg = "workspacesHandler - Unable to parse form data"
+				break
+			}
+
+			switch r.PostForm.Get("action") {
+			case "create":
+				workspace, err := CreateWorkspace(db, r.PostForm.Get("name"), user.ID)
+				if err != nil {
+					errMsg = err.Error()
+					break
+				}
+				switchWorkspace(db, w, workspace.ID)
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			case "switch":
+				workspaceID, err := strconv.ParseUint(r.PostForm.Get("workspaceId"), 10, 32)
+				if err != nil {
+					errMsg = "Invalid workspace"
+					break
+				}
+				workspaces, err := GetUserWorkspaces(db, user.ID)
+				if err != nil {
+					errMsg = err.Error()
+					break
+				}
+				if !workspaceListed(workspaces, uint(workspaceID)) {
+					errMsg = "You are not a member of that workspace"
+					break
+				}
+				switchWorkspace(db, w, uint(workspaceID))
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			case "invite":
+				workspace := currentWorkspace(r.Context())
+				if workspace == nil {
+					errMsg = "Choose a workspace to invite people to"
+					break
+				}
+				token, err := CreateInvite(db, workspace.ID, user.ID)
+				if err != nil {
+					errMsg = err.Error()
+					break
+				}
+				inviteURL = fmt.Sprintf("%s/invite/%s", strings.TrimRight(envConfig.BaseURL, "/"), token)
+				msg = fmt.Sprintf("Send this link to invite people to %s, it works for %d days", workspace.Name, int(inviteDuration.Hours()/24))
+			default:
+				errMsg = "Unknown workspace action"
+			}
+		default:
+			warning := warning("Method not allowed")
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		workspaces, err := GetUserWorkspaces(db, user.ID)
+		if err != nil {
+			errMsg = err.Error()
+		}
+		workspaceList := workspaceList(workspaces, currentWorkspace(r.Context()), inviteURL, msg, errMsg)
+		workspaceList.Render(GetContext(r), w)
+	}
+}
+
+func workspaceListed(workspaces []Workspace, id uint) bool {
+	for _, workspace := range workspaces {
+		if workspace.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// inviteHandler shows an invite link's workspace and joins it on a POST, people without an account can create one
+func inviteHandler(db *gorm.DB, envConfig EnvConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := chi.URLParam(r, "token")
+		user := userFromContext(r.Context())
+		workspace, err := GetInviteWorkspace(db, token)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			invitePage := invitePage(nil, user, token, err.Error())
+			invitePage.Render(GetContext(r), w)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			// only joined on a POST, so a link or image to the invite can't move someone into another workspace
+			invitePage := invitePage(workspace, user, token, "")
+			invitePage.Render(GetContext(r), w)
+			return
+		case http.MethodPost:
+			if user == nil {
+				if err := r.ParseForm(); err != nil {
+					invitePage := invitePage(workspace, user, token, "inviteHandler - Unable to parse form data")
+					invitePage.Render(GetContext(r), w)
+					return
+				}
+				user, err = CreateUser(db, r.PostForm.Get("username"), r.PostForm.Get("password"), RoleMember)
+				if err != nil {
+					invitePage := invitePage(workspace, user, token, err.Error())
+					invitePage.Render(GetContext(r), w)
+					return
+				}
+				sessionToken, err := CreateSession(db, user.ID)
+				if err != nil {
+					invitePage := invitePage(workspace, user, token, err.Error())
+					invitePage.Render(GetContext(r), w)
+					return
+				}
+				setSessionCookie(w, envConfig, sessionToken, int(sessionDuration.Seconds()))
+			}
+		default:
+			warning := warning("Method not allowed")
+			warning.Render(GetContext(r), w)
+			return
+		}
+
+		if _, err := AcceptInvite(db, token, user.ID); err != nil {
+			invitePage := invitePage(workspace, user, token, err.Error())
+			invitePage.Render(GetContext(r), w)
+			return
+		}
+		log.Printf("user %s joined workspace %d", user.Username, workspace.ID)
+		switchWorkspace(db, w, workspace.ID)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
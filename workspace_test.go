@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestWorkspaceScope(t *testing.T) {
+	t.Parallel()
+
+	db, err := DBInit(EnvConfig{DBUrl: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	user, err := CreateUser(db, "sam", "member password", RoleMember)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	other, err := CreateWorkspace(db, "Other", user.ID)
+	if err != nil {
+		t.Fatalf("CreateWorkspace() error = %v", err)
+	}
+
+	defaultDB := db.WithContext(withWorkspace(context.Background(), defaultWorkspaceID))
+	otherDB := db.WithContext(withWorkspace(context.Background(), other.ID))
+
+	mine := Home{Title: "Mine", Lat: -43.53, Lng: 172.58}
+	if err := defaultDB.Create(&mine).Error; err != nil {
+		t.Fatalf("failed to create home: %v", err)
+	}
+	theirs := Home{Title: "Theirs", Lat: -43.54, Lng: 172.59}
+	if err := otherDB.Create(&theirs).Error; err != nil {
+		t.Fatalf("failed to create home: %v", err)
+	}
+	if mine.WorkspaceID != defaultWorkspaceID || theirs.WorkspaceID != other.ID {
+		t.Fatalf("Create() workspaces = %d and %d, want %d and %d", mine.WorkspaceID, theirs.WorkspaceID, defaultWorkspaceID, other.ID)
+	}
+
+	tests := []struct {
+		name string
+		got  func() interface{}
+		want interface{}
+	}{
+		{name: "Only the workspace's homes are listed", got: func() interface{} { return len(GetHomes(otherDB)) }, want: 1},
+		{name: "Other workspace's homes aren't found", got: func() interface{} {
+			_, err := GetHome(otherDB, mine.ID)
+			return err != nil
+		}, want: true},
+		{name: "New workspaces get their own theme", got: func() interface{} { return GetActiveTheme(otherDB, 0).WorkspaceID }, want: other.ID},
+		{name: "Unscoped queries see everything", got: func() interface{} { return len(GetHomes(db)) }, want: 2},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.got(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// saving or deleting another workspace's row by ID must leave it alone
+	stolen := Home{ID: mine.ID, Title: "Stolen", Lat: 1, Lng: 1}
+	otherDB.Save(&stolen)
+	otherDB.Delete(&Home{}, mine.ID)
+	home, err := GetHome(defaultDB, mine.ID)
+	if err != nil || home.Title != "Mine" || home.WorkspaceID != defaultWorkspaceID {
+		t.Errorf("GetHome() after another workspace saved and deleted it = %+v, %v, want it unchanged", home, err)
+	}
+}
+
+func TestWorkspaceInvite(t *testing.T) {
+	t.Parallel()
+
+	config := EnvConfig{DBUrl: ":memory:", BaseURL: "http://localhost"}
+	db, err := DBInit(config)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	})
+
+	owner, err := CreateUser(db, "sam", "member password", RoleMember)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	workspace, err := CreateWorkspace(db, "Flat hunt", owner.ID)
+	if err != nil {
+		t.Fatalf("CreateWorkspace() error = %v", err)
+	}
+	token, err := CreateInvite(db, workspace.ID, owner.ID)
+	if err != nil {
+		t.Fatalf("CreateInvite() error = %v", err)
+	}
+	if _, err := CreateUser(db, "loner", "member password", RoleMember); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	loner, err := Authenticate(db, "loner", "member password")
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	lonerToken, err := CreateSession(db, loner.ID)
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(loadUser(db))
+	r.Use(requireUserToChange)
+	r.Use(loadWorkspace(db))
+	r.Use(requireWorkspace)
+	r.Get("/factors", factorHandler(db))
+	r.Get("/workspaces", workspacesHandler(db, config))
+	r.Get("/invite/{token}", inviteHandler(db, config))
+	r.Post("/invite/{token}", inviteHandler(db, config))
+
+	form := url.Values{"username": {"alex"}, "password": {"alex password"}}
+	req := httptest.NewRequest("POST", "/invite/"+token, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("POST /invite = %d, want a redirect after joining: %s", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+
+	alex, err := Authenticate(db, "alex", "alex password")
+	if err != nil {
+		t.Fatalf("Authenticate() after joining error = %v", err)
+	}
+	workspaces, err := GetUserWorkspaces(db, alex.ID)
+	if err != nil || len(workspaces) != 1 || workspaces[0].ID != workspace.ID {
+		t.Errorf("GetUserWorkspaces() = %+v, %v, want only %s", workspaces, err, workspace.Name)
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		cookies      []*http.Cookie
+		wantStatus   int
+		wantLocation string
+	}{
+		{name: "Anonymous users log in first", path: "/factors", wantStatus: http.StatusSeeOther, wantLocation: "/login?next="},
+		{name: "Users without a workspace pick one", path: "/factors", cookies: []*http.Cookie{{Name: sessionCookie, Value: lonerToken}}, wantStatus: http.StatusSeeOther, wantLocation: "/workspaces"},
+		{name: "Users without a workspace can see the workspace page", path: "/workspaces", cookies: []*http.Cookie{{Name: sessionCookie, Value: lonerToken}}, wantStatus: http.StatusOK},
+		{name: "Invited users are in the workspace", path: "/factors", cookies: cookies, wantStatus: http.StatusOK},
+		{name: "Bad invite links", path: "/invite/nope", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			for _, cookie := range tt.cookies {
+				req.AddCookie(cookie)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("GET %s status = %d, want %d", tt.path, rec.Code, tt.wantStatus)
+			}
+			if !strings.HasPrefix(rec.Header().Get("Location"), tt.wantLocation) {
+				t.Errorf("GET %s Location = %q, want %q", tt.path, rec.Header().Get("Location"), tt.wantLocation)
+			}
+		})
+	}
+
+	// logged in users only join when they press the button, opening the link doesn't move them
+	for _, method := range []string{"GET", "POST"} {
+		req := httptest.NewRequest(method, "/invite/"+token, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: lonerToken})
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+
+		workspaces, _ := GetUserWorkspaces(db, loner.ID)
+		joined := len(workspaces) == 1 && workspaces[0].ID == workspace.ID
+		switchedTo := ""
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Name == workspaceCookie {
+				switchedTo = cookie.Value
+			}
+		}
+		if method == "GET" && (rec.Code != http.StatusOK || joined || len(switchedTo) > 0) {
+			t.Errorf("GET /invite as loner = %d, joined %v, workspace cookie %q, want only the invite page", rec.Code, joined, switchedTo)
+		}
+		if method == "POST" && (rec.Code != http.StatusSeeOther || !joined || switchedTo != fmt.Sprint(workspace.ID)) {
+			t.Errorf("POST /invite as loner = %d, joined %v, workspace cookie %q, want to join and switch to %d", rec.Code, joined, switchedTo, workspace.ID)
+		}
+	}
+}